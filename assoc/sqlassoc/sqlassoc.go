@@ -0,0 +1,589 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+// Package sqlassoc implements an assoc.Assoc on top of an embedded
+// SQLite database. Together with a file-backed repository, it permits
+// Reflow's cache to be used on a single machine, without access to
+// cloud services.
+package sqlassoc
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/grailbio/base/digest"
+	"github.com/grailbio/infra"
+	"github.com/grailbio/reflow"
+	"github.com/grailbio/reflow/assoc"
+	"github.com/grailbio/reflow/errors"
+	"github.com/grailbio/reflow/liveset"
+	"github.com/grailbio/reflow/log"
+	"github.com/grailbio/reflow/pool"
+	"golang.org/x/time/rate"
+
+	// Register the sqlite3 database/sql driver.
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func init() {
+	infra.Register("sqlassoc", new(Assoc))
+}
+
+// pageSize is the number of rows read at a time by scans. Rows are
+// read a page at a time so that handlers may call back into the
+// assoc without contending for the database connection.
+const pageSize = 1000
+
+// maxBatchParams is the maximum number of keys looked up in a single
+// BatchGet query, well under SQLite's parameter limit.
+const maxBatchParams = 500
+
+var colmap = map[assoc.Kind]string{
+	assoc.Fileset:     "Value",
+	assoc.ExecInspect: "ExecInspect",
+	assoc.Logs:        "Logs",
+	assoc.Bundle:      "Bundle",
+}
+
+const schema = `
+CREATE TABLE IF NOT EXISTS assoc (
+	ID             TEXT PRIMARY KEY,
+	ID4            TEXT NOT NULL,
+	Value          TEXT,
+	ExecInspect    TEXT,
+	Logs           TEXT,
+	Bundle         TEXT,
+	Labels         TEXT,
+	LastAccessTime INTEGER NOT NULL DEFAULT 0,
+	AccessCount    INTEGER NOT NULL DEFAULT 0
+);
+CREATE INDEX IF NOT EXISTS assoc_ID4 ON assoc (ID4);
+`
+
+// Assoc implements a SQLite-backed Assoc for use in caches. Each
+// association entry is a row keyed by "ID". Fileset mappings are
+// stored in the "Value" column; ExecInspect, Logs and Bundle
+// mappings are stored as JSON lists, most recent first, just as
+// they are stored by dydbassoc.
+type Assoc struct {
+	// DB is the underlying database handle.
+	DB *sql.DB `yaml:"-"`
+	// File is the path of the SQLite database file.
+	File string `yaml:"-"`
+	// Labels to assign to cache entries.
+	Labels pool.Labels `yaml:"-"`
+}
+
+// Open opens (creating if necessary) the SQLite database at path and
+// returns an Assoc backed by it. The special path ":memory:" opens a
+// private, in-memory database.
+func Open(path string) (*Assoc, error) {
+	a := &Assoc{File: path}
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *Assoc) open() error {
+	if a.File != ":memory:" {
+		if err := os.MkdirAll(filepath.Dir(a.File), 0777); err != nil {
+			return errors.E("sqlassoc", "open", a.File, err)
+		}
+	}
+	db, err := sql.Open("sqlite3", a.File+"?_busy_timeout=10000")
+	if err != nil {
+		return errors.E("sqlassoc", "open", a.File, err)
+	}
+	// See sqltask: SQLite serializes writers, and in-memory databases
+	// are private to a connection.
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return errors.E("sqlassoc", "open", a.File, err)
+	}
+	a.DB = db
+	return nil
+}
+
+// Help implements infra.Provider
+func (a *Assoc) Help() string {
+	return "configure an assoc using a local SQLite database"
+}
+
+// Flags implements infra.Provider.
+func (a *Assoc) Flags(flags *flag.FlagSet) {
+	flags.StringVar(&a.File, "file", "$HOME/.reflow/assoc.sqlite", "path of the SQLite database file")
+}
+
+// Init implements infra.Provider.
+func (a *Assoc) Init(labels pool.Labels) error {
+	a.File = os.ExpandEnv(a.File)
+	a.Labels = labels.Copy()
+	return a.open()
+}
+
+// Close closes the underlying database.
+func (a *Assoc) Close() error {
+	return a.DB.Close()
+}
+
+// row is the in-memory representation of an assoc row.
+type row struct {
+	ID, ID4                     string
+	Value                       sql.NullString
+	ExecInspect, Logs, Bundle   []string
+	Labels                      []string
+	LastAccessTime, AccessCount int64
+}
+
+func (r *row) list(kind assoc.Kind) *[]string {
+	switch kind {
+	case assoc.ExecInspect:
+		return &r.ExecInspect
+	case assoc.Logs:
+		return &r.Logs
+	case assoc.Bundle:
+		return &r.Bundle
+	}
+	panic(kind)
+}
+
+func (r *row) empty() bool {
+	return !r.Value.Valid && len(r.ExecInspect) == 0 && len(r.Logs) == 0 && len(r.Bundle) == 0
+}
+
+// Store associates the digest v with the key digest k of the provided kind. If v is zero,
+// k's association for (kind,v) will be removed.
+func (a *Assoc) Store(ctx context.Context, kind assoc.Kind, k, v digest.Digest) error {
+	if _, ok := colmap[kind]; !ok {
+		return errors.E(errors.NotSupported, errors.Errorf("mappings of kind %v are not supported", kind))
+	}
+	tx, err := a.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	r, err := getRow(ctx, tx, k.String())
+	if err != nil {
+		return err
+	}
+	if r == nil {
+		if v.IsZero() {
+			return nil
+		}
+		k4 := k
+		k4.Truncate(4)
+		r = &row{ID: k.String(), ID4: k4.HexN(4)}
+	}
+	switch kind {
+	case assoc.Fileset:
+		if v.IsZero() {
+			r.Value = sql.NullString{}
+		} else {
+			r.Value = sql.NullString{String: v.String(), Valid: true}
+			r.LastAccessTime = time.Now().Unix()
+		}
+	default:
+		l := r.list(kind)
+		if v.IsZero() {
+			*l = nil
+		} else {
+			*l = append([]string{v.String()}, *l...)
+		}
+	}
+	if !v.IsZero() && len(a.Labels) > 0 {
+		r.Labels = addLabels(r.Labels, a.Labels)
+	}
+	if r.empty() {
+		_, err = tx.ExecContext(ctx, "DELETE FROM assoc WHERE ID = ?", r.ID)
+	} else {
+		err = putRow(ctx, tx, r)
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// addLabels adds the provided labels to the (sorted) set labels.
+func addLabels(labels []string, add pool.Labels) []string {
+	set := make(map[string]bool, len(labels)+len(add))
+	for _, l := range labels {
+		set[l] = true
+	}
+	for k, v := range add {
+		set[fmt.Sprintf("%s=%s", k, v)] = true
+	}
+	labels = labels[:0]
+	for l := range set {
+		labels = append(labels, l)
+	}
+	sort.Strings(labels)
+	return labels
+}
+
+type querier interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+const rowColumns = "ID, ID4, Value, ExecInspect, Logs, Bundle, Labels, LastAccessTime, AccessCount"
+
+type scannable interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanRow(s scannable) (*row, error) {
+	var (
+		r                                 row
+		execInspect, logs, bundle, labels sql.NullString
+	)
+	if err := s.Scan(&r.ID, &r.ID4, &r.Value, &execInspect, &logs, &bundle, &labels, &r.LastAccessTime, &r.AccessCount); err != nil {
+		return nil, err
+	}
+	for _, l := range []struct {
+		s sql.NullString
+		p *[]string
+	}{
+		{execInspect, &r.ExecInspect},
+		{logs, &r.Logs},
+		{bundle, &r.Bundle},
+		{labels, &r.Labels},
+	} {
+		if !l.s.Valid {
+			continue
+		}
+		if err := json.Unmarshal([]byte(l.s.String), l.p); err != nil {
+			return nil, errors.E("sqlassoc", "invalid entry", r.ID, err)
+		}
+	}
+	return &r, nil
+}
+
+func getRow(ctx context.Context, q querier, id string) (*row, error) {
+	r, err := scanRow(q.QueryRowContext(ctx, "SELECT "+rowColumns+" FROM assoc WHERE ID = ?", id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return r, err
+}
+
+func putRow(ctx context.Context, q querier, r *row) error {
+	list := func(l []string) interface{} {
+		if len(l) == 0 {
+			return nil
+		}
+		b, err := json.Marshal(l)
+		if err != nil {
+			panic(err)
+		}
+		return string(b)
+	}
+	_, err := q.ExecContext(ctx,
+		"INSERT OR REPLACE INTO assoc ("+rowColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		r.ID, r.ID4, r.Value, list(r.ExecInspect), list(r.Logs), list(r.Bundle), list(r.Labels), r.LastAccessTime, r.AccessCount)
+	return err
+}
+
+// value returns the (most recent) value of the provided kind, if any.
+func (r *row) value(kind assoc.Kind) (string, bool) {
+	if kind == assoc.Fileset {
+		return r.Value.String, r.Value.Valid
+	}
+	l := *r.list(kind)
+	if len(l) == 0 {
+		return "", false
+	}
+	return l[0], true
+}
+
+// Get returns the digest associated with key digest k. Lookup
+// returns an error flagged errors.NotExist when no such mapping
+// exists. Lookup also modifies the item's last-accessed time, which
+// can be used for LRU object garbage collection.
+// Get expands abbreviated keys by making use of an index on the
+// key's four-byte prefix.
+func (a *Assoc) Get(ctx context.Context, kind assoc.Kind, k digest.Digest) (digest.Digest, digest.Digest, error) {
+	var v digest.Digest
+	col, ok := colmap[kind]
+	if !ok {
+		return k, v, errors.E(errors.NotSupported, errors.Errorf("mappings of kind %v are not supported", kind))
+	}
+	var r *row
+	if k.IsAbbrev() {
+		rows, err := a.DB.QueryContext(ctx,
+			fmt.Sprintf("SELECT %s FROM assoc WHERE ID4 = ? AND %s IS NOT NULL", rowColumns, col), k.HexN(4))
+		if err != nil {
+			return k, v, err
+		}
+		var matched []*row
+		for rows.Next() {
+			rit, err := scanRow(rows)
+			if err != nil {
+				rows.Close()
+				return k, v, err
+			}
+			kit, err := reflow.Digester.Parse(rit.ID)
+			if err != nil {
+				log.Debugf("invalid sqlassoc entry %v", rit.ID)
+				continue
+			}
+			if kit.Expands(k) {
+				matched = append(matched, rit)
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return k, v, err
+		}
+		switch len(matched) {
+		case 0:
+		case 1:
+			r = matched[0]
+		default:
+			return k, v, errors.E("lookup", k, errors.Invalid, errors.New("more than one key matched"))
+		}
+		if r != nil {
+			var err error
+			if k, err = reflow.Digester.Parse(r.ID); err != nil {
+				return k, v, errors.E("lookup", k, err)
+			}
+		}
+	} else {
+		var err error
+		if r, err = getRow(ctx, a.DB, k.String()); err != nil {
+			return k, v, err
+		}
+	}
+	if r == nil {
+		return k, v, errors.E("lookup", k, errors.NotExist)
+	}
+	s, ok := r.value(kind)
+	if !ok {
+		return k, v, errors.E("lookup", k, errors.NotExist)
+	}
+	var err error
+	v, err = reflow.Digester.Parse(s)
+	if err != nil {
+		return k, v, errors.E("lookup", k, err)
+	}
+	_, err = a.DB.ExecContext(ctx,
+		"UPDATE assoc SET LastAccessTime = ?, AccessCount = AccessCount + 1 WHERE ID = ?",
+		time.Now().Unix(), r.ID)
+	if err != nil && err != ctx.Err() {
+		log.Errorf("sqlassoc: update %v: %v", k, err)
+	}
+	return k, v, nil
+}
+
+// BatchGet implements the assoc interface. BatchGet will return a result for each key in the batch.
+// Global errors, like context cancellation or database errors, are returned from BatchGet. Any
+// value parse errors are returned as part of the result for that key.
+func (a *Assoc) BatchGet(ctx context.Context, batch assoc.Batch) error {
+	unique := make(map[string][]assoc.Kind)
+	for k := range batch {
+		unique[k.Digest.String()] = append(unique[k.Digest.String()], k.Kind)
+	}
+	keys := make([]string, 0, len(unique))
+	for k := range unique {
+		keys = append(keys, k)
+	}
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > maxBatchParams {
+			n = maxBatchParams
+		}
+		var (
+			chunk = keys[:n]
+			args  = make([]interface{}, n)
+		)
+		keys = keys[n:]
+		for i := range chunk {
+			args[i] = chunk[i]
+		}
+		query := fmt.Sprintf("SELECT %s FROM assoc WHERE ID IN (?%s)", rowColumns, strings.Repeat(", ?", n-1))
+		rows, err := a.DB.QueryContext(ctx, query, args...)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			r, err := scanRow(rows)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			k, err := reflow.Digester.Parse(r.ID)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			for _, kind := range unique[r.ID] {
+				s, ok := r.value(kind)
+				if !ok {
+					continue
+				}
+				key := assoc.Key{Digest: k, Kind: kind}
+				v, err := reflow.Digester.Parse(s)
+				if err != nil {
+					batch[key] = assoc.Result{Error: err}
+					continue
+				}
+				batch[key] = assoc.Result{Digest: v}
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scan calls fn for each row which has a mapping of the provided kind,
+// in key order. Rows are read a page at a time.
+func (a *Assoc) scan(ctx context.Context, kind assoc.Kind, fn func(r *row) error) error {
+	col, ok := colmap[kind]
+	if !ok {
+		return errors.E(errors.NotSupported, errors.Errorf("mappings of kind %v are not supported", kind))
+	}
+	query := fmt.Sprintf("SELECT %s FROM assoc WHERE ID > ? AND %s IS NOT NULL ORDER BY ID LIMIT %d", rowColumns, col, pageSize)
+	for last := ""; ; {
+		rows, err := a.DB.QueryContext(ctx, query, last)
+		if err != nil {
+			return err
+		}
+		var page []*row
+		for rows.Next() {
+			r, err := scanRow(rows)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			page = append(page, r)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		for _, r := range page {
+			if err := fn(r); err != nil {
+				return err
+			}
+		}
+		if len(page) < pageSize {
+			return nil
+		}
+		last = page[len(page)-1].ID
+	}
+}
+
+// CollectWithThreshold removes from this Assoc any objects whose keys are not in the
+// liveset and have not been accessed more recently than the liveset's threshold
+func (a *Assoc) CollectWithThreshold(ctx context.Context, live liveset.Liveset, dead liveset.Liveset, kind assoc.Kind, threshold time.Time, limit int64, dryRun bool) error {
+	log.Debug("Collecting association")
+	var (
+		itemsCheckedCount, liveItemsCount, afterThresholdCount, itemsCollectedCount, deadFilterCount int64
+		start                                                                                        = time.Now()
+		collect                                                                                      []digest.Digest
+	)
+	err := a.scan(ctx, kind, func(r *row) error {
+		d, err := reflow.Digester.Parse(r.ID)
+		if err != nil {
+			return fmt.Errorf("invalid sqlassoc entry %v", r.ID)
+		}
+		itemsCheckedCount++
+		if itemsCheckedCount%10000 == 0 {
+			// This can take a long time, we want to know it's doing something
+			log.Debugf("Checking item %d in association", itemsCheckedCount)
+		}
+		switch {
+		case live.Contains(d):
+			liveItemsCount++
+		case dead.Contains(d):
+			collect = append(collect, d)
+			itemsCollectedCount++
+			deadFilterCount++
+		case time.Unix(r.LastAccessTime, 0).After(threshold):
+			afterThresholdCount++
+		default:
+			collect = append(collect, d)
+			itemsCollectedCount++
+		}
+		return nil
+	})
+	if err == nil && !dryRun {
+		lim := rate.NewLimiter(rate.Inf, 1)
+		if limit > 0 {
+			lim = rate.NewLimiter(rate.Limit(limit), 1)
+		}
+		for _, d := range collect {
+			if err = lim.Wait(ctx); err != nil {
+				break
+			}
+			if err = a.Store(ctx, kind, d, digest.Digest{}); err != nil {
+				break
+			}
+		}
+	}
+
+	// Print what happened
+	log.Debugf("Time to collect %s: %s", a.File, time.Since(start))
+	log.Debugf("Checked %d associations, %d were live, %d were after the threshold.",
+		itemsCheckedCount, liveItemsCount, afterThresholdCount)
+	action := "would have been"
+	if !dryRun {
+		action = "were"
+	}
+	log.Printf("%d of %d associations (%.2f%%) %s collected (%d associations matched the dead set)",
+		itemsCollectedCount, itemsCheckedCount, float64(itemsCollectedCount)/float64(itemsCheckedCount)*100, action, deadFilterCount)
+	return err
+}
+
+// Count returns the number of associations in this mapping.
+func (a *Assoc) Count(ctx context.Context) (int64, error) {
+	var n int64
+	err := a.DB.QueryRowContext(ctx, "SELECT COUNT(*) FROM assoc").Scan(&n)
+	return n, err
+}
+
+// Scan calls the handler function for every association in the mapping.
+// Scan calls the handler from a single goroutine, in key order.
+func (a *Assoc) Scan(ctx context.Context, kind assoc.Kind, mappingHandler assoc.MappingHandler) error {
+	return a.scan(ctx, kind, func(r *row) error {
+		k, err := reflow.Digester.Parse(r.ID)
+		if err != nil {
+			log.Errorf("invalid sqlassoc entry %v", r.ID)
+			return nil
+		}
+		var vals []string
+		if kind == assoc.Fileset {
+			vals = []string{r.Value.String}
+		} else {
+			vals = *r.list(kind)
+		}
+		var v []digest.Digest
+		for _, s := range vals {
+			d, err := reflow.Digester.Parse(s)
+			if err != nil {
+				continue
+			}
+			v = append(v, d)
+		}
+		if v == nil {
+			log.Errorf("no valid digests of kind %v for sqlassoc entry %v", kind, r.ID)
+			return nil
+		}
+		mappingHandler.HandleMapping(k, v, kind, time.Unix(r.LastAccessTime, 0), r.Labels)
+		return nil
+	})
+}
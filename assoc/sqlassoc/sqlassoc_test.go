@@ -0,0 +1,207 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package sqlassoc
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/grailbio/base/digest"
+	"github.com/grailbio/reflow"
+	"github.com/grailbio/reflow/assoc"
+	"github.com/grailbio/reflow/errors"
+	"github.com/grailbio/reflow/pool"
+)
+
+type digestSet map[digest.Digest]bool
+
+func (s digestSet) Contains(d digest.Digest) bool { return s[d] }
+
+func newAssoc(t *testing.T) *Assoc {
+	t.Helper()
+	a, err := Open(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Labels = pool.Labels{"user": "test"}
+	return a
+}
+
+func TestStoreGet(t *testing.T) {
+	var (
+		ctx  = context.Background()
+		a    = newAssoc(t)
+		k    = reflow.Digester.Rand(nil)
+		v    = reflow.Digester.Rand(nil)
+		insp = []digest.Digest{reflow.Digester.Rand(nil), reflow.Digester.Rand(nil)}
+	)
+	if _, _, err := a.Get(ctx, assoc.Fileset, k); !errors.Is(errors.NotExist, err) {
+		t.Fatalf("expected NotExist, got %v", err)
+	}
+	if err := a.Store(ctx, assoc.Fileset, k, v); err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range insp {
+		if err := a.Store(ctx, assoc.ExecInspect, k, d); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, got, err := a.Get(ctx, assoc.Fileset, k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != v {
+		t.Errorf("got %v, want %v", got, v)
+	}
+	// Lists return the most recently stored value.
+	_, got, err = a.Get(ctx, assoc.ExecInspect, k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := insp[1]; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	abbrev := k
+	abbrev.Truncate(4)
+	kexp, got, err := a.Get(ctx, assoc.Fileset, abbrev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kexp != k || got != v {
+		t.Errorf("got %v %v, want %v %v", kexp, got, k, v)
+	}
+	if err := assoc.Delete(ctx, a, assoc.Fileset, k); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := a.Get(ctx, assoc.Fileset, k); !errors.Is(errors.NotExist, err) {
+		t.Errorf("expected NotExist, got %v", err)
+	}
+	if n, err := a.Count(ctx); err != nil || n != 1 {
+		t.Errorf("got %v, %v, want 1", n, err)
+	}
+	if err := assoc.Delete(ctx, a, assoc.ExecInspect, k); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := a.Count(ctx); err != nil || n != 0 {
+		t.Errorf("got %v, %v, want 0", n, err)
+	}
+	if err := a.Store(ctx, assoc.Kind(100), k, v); !errors.Is(errors.NotSupported, err) {
+		t.Errorf("expected NotSupported, got %v", err)
+	}
+}
+
+func TestAbbrevAmbiguous(t *testing.T) {
+	var (
+		ctx = context.Background()
+		a   = newAssoc(t)
+		k1  = reflow.Digester.Rand(nil)
+	)
+	// Construct a key which shares its 4-byte prefix with k1.
+	hex := []byte(k1.Hex())
+	if hex[len(hex)-1] == '0' {
+		hex[len(hex)-1] = '1'
+	} else {
+		hex[len(hex)-1] = '0'
+	}
+	k2, err := reflow.Digester.Parse("sha256:" + string(hex))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []digest.Digest{k1, k2} {
+		if err := a.Store(ctx, assoc.Fileset, k, reflow.Digester.Rand(nil)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	abbrev := k1
+	abbrev.Truncate(4)
+	if _, _, err := a.Get(ctx, assoc.Fileset, abbrev); !errors.Is(errors.Invalid, err) {
+		t.Errorf("expected Invalid, got %v", err)
+	}
+}
+
+func TestBatchGet(t *testing.T) {
+	var (
+		ctx   = context.Background()
+		a     = newAssoc(t)
+		batch = make(assoc.Batch)
+		want  = make(map[assoc.Key]digest.Digest)
+	)
+	for i := 0; i < 2*maxBatchParams+10; i++ {
+		k := reflow.Digester.Rand(nil)
+		key := assoc.Key{Kind: assoc.Fileset, Digest: k}
+		batch.Add(key)
+		if i%3 == 0 {
+			continue
+		}
+		v := reflow.Digester.Rand(nil)
+		if err := a.Store(ctx, assoc.Fileset, k, v); err != nil {
+			t.Fatal(err)
+		}
+		want[key] = v
+	}
+	if err := a.BatchGet(ctx, batch); err != nil {
+		t.Fatal(err)
+	}
+	for key, res := range batch {
+		if v, ok := want[key]; ok {
+			if !batch.Found(key) || res.Digest != v {
+				t.Errorf("key %v: got %v, want %v", key, res, v)
+			}
+		} else if batch.Found(key) {
+			t.Errorf("key %v: unexpected %v", key, res)
+		}
+	}
+}
+
+func TestScanCollect(t *testing.T) {
+	var (
+		ctx                     = context.Background()
+		a                       = newAssoc(t)
+		live, dead, old, recent = reflow.Digester.Rand(nil), reflow.Digester.Rand(nil), reflow.Digester.Rand(nil), reflow.Digester.Rand(nil)
+	)
+	for _, k := range []digest.Digest{live, dead, old, recent} {
+		if err := a.Store(ctx, assoc.Fileset, k, reflow.Digester.Rand(nil)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := a.DB.Exec("UPDATE assoc SET LastAccessTime = 0 WHERE ID IN (?, ?)", live.String(), old.String()); err != nil {
+		t.Fatal(err)
+	}
+	scanned := make(map[digest.Digest]time.Time)
+	err := a.Scan(ctx, assoc.Fileset, assoc.MappingHandlerFunc(func(k digest.Digest, v []digest.Digest, kind assoc.Kind, lastAccessTime time.Time, labels []string) {
+		if got, want := labels, []string{"user=test"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+		scanned[k] = lastAccessTime
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(scanned), 4; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if got, want := scanned[old], time.Unix(0, 0); !got.Equal(want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	threshold := time.Now().Add(-time.Hour)
+	// Dry runs should not remove anything.
+	if err := a.CollectWithThreshold(ctx, digestSet{live: true}, digestSet{dead: true}, assoc.Fileset, threshold, 0, true); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := a.Count(ctx); n != 4 {
+		t.Errorf("got %v, want 4", n)
+	}
+	if err := a.CollectWithThreshold(ctx, digestSet{live: true}, digestSet{dead: true}, assoc.Fileset, threshold, 100, false); err != nil {
+		t.Fatal(err)
+	}
+	for k, want := range map[digest.Digest]bool{live: true, dead: false, old: false, recent: true} {
+		_, _, err := a.Get(ctx, assoc.Fileset, k)
+		if got := err == nil; got != want {
+			t.Errorf("key %v: got %v, want %v (%v)", k, got, want, err)
+		}
+	}
+}
@@ -0,0 +1,23 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+// +build !linux
+
+package fileblob
+
+import (
+	"os"
+
+	"github.com/grailbio/base/digest"
+)
+
+func fileID(info os.FileInfo) (dev, ino uint64) {
+	return 0, 0
+}
+
+func getContentHash(path string) digest.Digest {
+	return digest.Digest{}
+}
+
+func setContentHash(path, contentHash string) {}
@@ -0,0 +1,50 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+// +build linux
+
+package fileblob
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/grailbio/base/digest"
+	"github.com/grailbio/reflow"
+)
+
+// contentHashAttr is the extended attribute in which a file's content
+// hash is stored.
+const contentHashAttr = "user.reflow.sha256"
+
+// fileID returns the device and inode numbers of the file described by info.
+func fileID(info os.FileInfo) (dev, ino uint64) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0
+	}
+	return uint64(st.Dev), uint64(st.Ino)
+}
+
+// getContentHash returns the content hash recorded for the file at
+// path, or a zero digest if none is recorded.
+func getContentHash(path string) digest.Digest {
+	buf := make([]byte, 128)
+	n, err := syscall.Getxattr(path, contentHashAttr, buf)
+	if err != nil || n == 0 {
+		return digest.Digest{}
+	}
+	d, err := reflow.Digester.Parse(string(buf[:n]))
+	if err != nil {
+		return digest.Digest{}
+	}
+	return d
+}
+
+// setContentHash records the content hash for the file at path.
+// Errors are ignored: not all filesystems support extended attributes,
+// and content hashes are advisory.
+func setContentHash(path, contentHash string) {
+	_ = syscall.Setxattr(path, contentHashAttr, []byte(contentHash), 0)
+}
@@ -0,0 +1,457 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+// Package fileblob implements the blob interfaces on top of a local
+// (or network mounted) filesystem. Keys map directly to paths below
+// a bucket's root directory.
+package fileblob
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/grailbio/base/digest"
+	"github.com/grailbio/base/traverse"
+	"github.com/grailbio/reflow"
+	"github.com/grailbio/reflow/blob"
+	"github.com/grailbio/reflow/errors"
+)
+
+// tmpPrefix is the prefix of temporary files used to implement atomic
+// writes. Files with this prefix are never returned by scans.
+const tmpPrefix = ".fileblob-"
+
+const (
+	// downloadPartSize is the size of the parts in which files are
+	// downloaded.
+	downloadPartSize = 64 << 20
+	// downloadConcurrency is the maximum number of parts of a single
+	// file downloaded concurrently.
+	downloadConcurrency = 8
+)
+
+// Store implements blob.Store for a filesystem. Bucket names are
+// interpreted as directories relative to the store's root; the empty
+// bucket name refers to the root itself.
+type Store struct {
+	root string
+}
+
+// New returns a new store rooted at the provided directory.
+func New(root string) *Store {
+	return &Store{root: root}
+}
+
+// Bucket returns the bucket with the provided name. An errors.NotExist
+// error is returned if the bucket's directory does not exist.
+func (s *Store) Bucket(ctx context.Context, name string) (blob.Bucket, error) {
+	dir := filepath.Join(s.root, filepath.FromSlash(name))
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, errors.E("fileblob.Bucket", name, err)
+	}
+	if !info.IsDir() {
+		return nil, errors.E("fileblob.Bucket", name, errors.NotExist, errors.Errorf("%s is not a directory", dir))
+	}
+	return NewBucket(name, dir), nil
+}
+
+// Bucket is a blob.Bucket rooted at a directory.
+type Bucket struct {
+	name, dir string
+}
+
+// NewBucket returns a new bucket with the provided name whose keys
+// are stored below the directory dir.
+func NewBucket(name, dir string) *Bucket {
+	return &Bucket{name: name, dir: dir}
+}
+
+// path returns the filesystem path for key. Keys that would resolve
+// outside of the bucket's directory are rejected.
+func (b *Bucket) path(key string) (string, error) {
+	p := filepath.Join(b.dir, filepath.FromSlash(key))
+	if p != b.dir && !strings.HasPrefix(p, strings.TrimSuffix(b.dir, string(filepath.Separator))+string(filepath.Separator)) {
+		return "", errors.E(errors.Invalid, errors.Errorf("key %q is outside of bucket %s", key, b.name))
+	}
+	return p, nil
+}
+
+func (b *Bucket) file(key, path string, info os.FileInfo) reflow.File {
+	file := reflow.File{
+		Source:       b.Location() + key,
+		Size:         info.Size(),
+		LastModified: info.ModTime(),
+		ContentHash:  getContentHash(path),
+	}
+	file.ETag = etag(info, file.ContentHash)
+	return file
+}
+
+// etag computes an entity tag from the file's identity (device and
+// inode), its modification time and size, and its content hash, if
+// known. Since Put replaces files by renaming, any write to a key
+// changes at least its inode.
+func etag(info os.FileInfo, contentHash digest.Digest) string {
+	dev, ino := fileID(info)
+	w := reflow.Digester.NewWriter()
+	fmt.Fprintf(w, "%d %d %d %d", dev, ino, info.ModTime().UnixNano(), info.Size())
+	if !contentHash.IsZero() {
+		io.WriteString(w, contentHash.String())
+	}
+	return w.Digest().HexN(16)
+}
+
+// File returns metadata for the provided key.
+func (b *Bucket) File(ctx context.Context, key string) (reflow.File, error) {
+	p, err := b.path(key)
+	if err != nil {
+		return reflow.File{}, errors.E("fileblob.File", b.name, key, err)
+	}
+	info, err := os.Stat(p)
+	if err == nil && info.IsDir() {
+		err = errors.E(errors.NotExist, errors.Errorf("%s is a directory", p))
+	}
+	if err != nil {
+		return reflow.File{}, errors.E("fileblob.File", b.name, key, err)
+	}
+	return b.file(key, p, info), nil
+}
+
+// scanner scans the keys with a prefix in lexicographic order. It
+// walks the bucket's directory tree lazily, keeping a stack of
+// directory listings. Entries in each listing are ordered by the key
+// they contribute: directories sort as if they had a trailing slash,
+// so that their contents are visited in key order relative to their
+// siblings.
+type scanner struct {
+	b      *Bucket
+	prefix string
+	stack  [][]entry
+	key    string
+	file   reflow.File
+	err    error
+	init   bool
+}
+
+type entry struct {
+	// key is the entry's key, including a trailing slash for directories.
+	key  string
+	info os.FileInfo
+}
+
+func (s *scanner) Scan(ctx context.Context) bool {
+	if s.err != nil {
+		return false
+	}
+	if !s.init {
+		s.init = true
+		dir := s.prefix
+		if i := strings.LastIndex(dir, "/"); i >= 0 {
+			dir = dir[:i+1]
+		} else {
+			dir = ""
+		}
+		if s.err = s.push(dir); s.err != nil {
+			return false
+		}
+	}
+	for len(s.stack) > 0 {
+		if s.err = ctx.Err(); s.err != nil {
+			return false
+		}
+		top := s.stack[len(s.stack)-1]
+		if len(top) == 0 {
+			s.stack = s.stack[:len(s.stack)-1]
+			continue
+		}
+		e := top[0]
+		s.stack[len(s.stack)-1] = top[1:]
+		if e.info.IsDir() {
+			// Descend only into directories which may contain keys with
+			// the prefix.
+			if strings.HasPrefix(e.key, s.prefix) || strings.HasPrefix(s.prefix, e.key) {
+				if s.err = s.push(e.key); s.err != nil {
+					return false
+				}
+			}
+			continue
+		}
+		if !strings.HasPrefix(e.key, s.prefix) {
+			continue
+		}
+		p, err := s.b.path(e.key)
+		if err != nil {
+			s.err = err
+			return false
+		}
+		s.key = e.key
+		s.file = s.b.file(e.key, p, e.info)
+		return true
+	}
+	return false
+}
+
+// push lists the directory with the provided key prefix (which is
+// empty or ends in a slash) and pushes its sorted entries onto the
+// scanner's stack. Missing directories are treated as empty.
+func (s *scanner) push(dir string) error {
+	p, err := s.b.path(dir)
+	if err != nil {
+		return err
+	}
+	if info, err := os.Stat(p); os.IsNotExist(err) || (err == nil && !info.IsDir()) {
+		return nil
+	}
+	infos, err := ioutil.ReadDir(p)
+	if err != nil {
+		return err
+	}
+	entries := make([]entry, 0, len(infos))
+	for _, info := range infos {
+		if strings.HasPrefix(info.Name(), tmpPrefix) {
+			continue
+		}
+		key := dir + info.Name()
+		if info.IsDir() {
+			key += "/"
+		} else if !info.Mode().IsRegular() {
+			// Follow symbolic links to regular files and directories.
+			target, err := os.Stat(filepath.Join(p, info.Name()))
+			if err != nil || !(target.Mode().IsRegular() || target.IsDir()) {
+				continue
+			}
+			info = target
+			if info.IsDir() {
+				key += "/"
+			}
+		}
+		entries = append(entries, entry{key, info})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].key < entries[j].key })
+	s.stack = append(s.stack, entries)
+	return nil
+}
+
+func (s *scanner) Err() error        { return s.err }
+func (s *scanner) Key() string       { return s.key }
+func (s *scanner) File() reflow.File { return s.file }
+
+// Scan returns a scanner of the keys with the provided prefix. Keys
+// are returned in lexicographic order.
+func (b *Bucket) Scan(prefix string) blob.Scanner {
+	return &scanner{b: b, prefix: prefix}
+}
+
+// open opens the file at key and checks the provided etag, if any.
+func (b *Bucket) open(key, etag string) (*os.File, reflow.File, error) {
+	p, err := b.path(key)
+	if err != nil {
+		return nil, reflow.File{}, err
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, reflow.File{}, err
+	}
+	info, err := f.Stat()
+	if err == nil && info.IsDir() {
+		err = errors.E(errors.NotExist, errors.Errorf("%s is a directory", p))
+	}
+	if err != nil {
+		f.Close()
+		return nil, reflow.File{}, err
+	}
+	file := b.file(key, p, info)
+	if etag != "" && etag != file.ETag {
+		f.Close()
+		return nil, reflow.File{}, errors.E(errors.Precondition, errors.Errorf("etag %s does not match %s", etag, file.ETag))
+	}
+	return f, file, nil
+}
+
+// Download copies the contents of the provided key to w. Files larger
+// than downloadPartSize are downloaded in parts, concurrently.
+func (b *Bucket) Download(ctx context.Context, key, etag string, size int64, w io.WriterAt) (int64, error) {
+	f, file, err := b.open(key, etag)
+	if err != nil {
+		return -1, errors.E("fileblob.Download", b.name, key, err)
+	}
+	defer f.Close()
+	if size > 0 && size != file.Size {
+		return -1, errors.E("fileblob.Download", b.name, key, errors.Precondition,
+			errors.Errorf("expected size %d, got %d", size, file.Size))
+	}
+	nparts := int((file.Size + downloadPartSize - 1) / downloadPartSize)
+	err = traverse.Limit(downloadConcurrency).Each(nparts, func(i int) error {
+		off := int64(i) * downloadPartSize
+		n := file.Size - off
+		if n > downloadPartSize {
+			n = downloadPartSize
+		}
+		return copyRange(ctx, w, f, off, n)
+	})
+	if err != nil {
+		return -1, errors.E("fileblob.Download", b.name, key, err)
+	}
+	return file.Size, nil
+}
+
+// copyRange copies n bytes at offset off from r to w.
+func copyRange(ctx context.Context, w io.WriterAt, r io.ReaderAt, off, n int64) error {
+	buf := make([]byte, 1<<20)
+	for n > 0 {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if int64(len(buf)) > n {
+			buf = buf[:n]
+		}
+		m, err := r.ReadAt(buf, off)
+		if m > 0 {
+			if _, err := w.WriteAt(buf[:m], off); err != nil {
+				return err
+			}
+			off += int64(m)
+			n -= int64(m)
+		}
+		if err == io.EOF && n > 0 {
+			return io.ErrUnexpectedEOF
+		}
+		if err != nil && err != io.EOF {
+			return err
+		}
+	}
+	return nil
+}
+
+// Get returns a reader of the contents of the provided key.
+func (b *Bucket) Get(ctx context.Context, key, etag string) (io.ReadCloser, reflow.File, error) {
+	f, file, err := b.open(key, etag)
+	if err != nil {
+		return nil, reflow.File{}, errors.E("fileblob.Get", b.name, key, err)
+	}
+	return f, file, nil
+}
+
+// Put atomically stores the contents of body at the provided key: the
+// contents are first written to a temporary file in the destination
+// directory, which is then renamed into place. A nonempty contentHash
+// is recorded with the file, where the filesystem supports it.
+func (b *Bucket) Put(ctx context.Context, key string, size int64, body io.Reader, contentHash string) error {
+	if err := b.put(key, body, contentHash); err != nil {
+		return errors.E("fileblob.Put", b.name, key, err)
+	}
+	return nil
+}
+
+func (b *Bucket) put(key string, body io.Reader, contentHash string) error {
+	p, err := b.path(key)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(p)
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, tmpPrefix)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, body); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if contentHash != "" {
+		setContentHash(f.Name(), contentHash)
+	}
+	if err := os.Rename(f.Name(), p); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
+
+// Snapshot returns an un-loaded Reflow fileset of the contents at the
+// provided prefix.
+func (b *Bucket) Snapshot(ctx context.Context, prefix string) (reflow.Fileset, error) {
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		file, err := b.File(ctx, prefix)
+		if err != nil {
+			return reflow.Fileset{}, errors.E("fileblob.Snapshot", b.name, prefix, err)
+		}
+		return reflow.Fileset{Map: map[string]reflow.File{".": file}}, nil
+	}
+	var (
+		dir  = reflow.Fileset{Map: make(map[string]reflow.File)}
+		scan = b.Scan(prefix)
+	)
+	for scan.Scan(ctx) {
+		dir.Map[scan.Key()[len(prefix):]] = scan.File()
+	}
+	return dir, scan.Err()
+}
+
+// Copy copies key src to key dst. A nonempty contentHash is recorded
+// with dst, unless src's content hash is already known.
+func (b *Bucket) Copy(ctx context.Context, src, dst, contentHash string) error {
+	if err := b.copyFrom(b, src, dst, contentHash); err != nil {
+		return errors.E("fileblob.Copy", b.name, src, dst, err)
+	}
+	return nil
+}
+
+// CopyFrom copies from bucket src and key srcKey into this bucket.
+// The source bucket must also be a fileblob bucket.
+func (b *Bucket) CopyFrom(ctx context.Context, srcBucket blob.Bucket, src, dst string) error {
+	srcB, ok := srcBucket.(*Bucket)
+	if !ok {
+		return errors.E(errors.NotSupported, "fileblob.CopyFrom", srcBucket.Location())
+	}
+	if err := b.copyFrom(srcB, src, dst, ""); err != nil {
+		return errors.E("fileblob.CopyFrom", b.Location(), dst, srcBucket.Location(), src, err)
+	}
+	return nil
+}
+
+func (b *Bucket) copyFrom(srcB *Bucket, src, dst, contentHash string) error {
+	f, file, err := srcB.open(src, "")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if !file.ContentHash.IsZero() {
+		contentHash = file.ContentHash.Hex()
+	}
+	return b.put(dst, f, contentHash)
+}
+
+// Delete removes the provided keys. Keys which do not exist are ignored.
+func (b *Bucket) Delete(ctx context.Context, keys ...string) error {
+	for _, key := range keys {
+		p, err := b.path(key)
+		if err != nil {
+			return errors.E("fileblob.Delete", b.name, key, err)
+		}
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return errors.E("fileblob.Delete", b.name, key, err)
+		}
+	}
+	return nil
+}
+
+// Location returns the URL of this bucket, e.g., file:///.
+func (b *Bucket) Location() string {
+	return "file://" + b.name + "/"
+}
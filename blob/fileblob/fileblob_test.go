@@ -0,0 +1,279 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package fileblob
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/grailbio/reflow/blob"
+	"github.com/grailbio/reflow/errors"
+)
+
+func newBucket(t *testing.T) (*Bucket, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "fileblob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "bucket"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	b, err := New(dir).Bucket(context.Background(), "bucket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b.(*Bucket), func() { os.RemoveAll(dir) }
+}
+
+func put(t *testing.T, b blob.Bucket, key, contents string) {
+	t.Helper()
+	if err := b.Put(context.Background(), key, int64(len(contents)), strings.NewReader(contents), ""); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func get(t *testing.T, b blob.Bucket, key string) string {
+	t.Helper()
+	rc, _, err := b.Get(context.Background(), key, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	p, err := ioutil.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(p)
+}
+
+func TestPutGet(t *testing.T) {
+	ctx := context.Background()
+	b, cleanup := newBucket(t)
+	defer cleanup()
+	put(t, b, "a/b/c", "hello world")
+	if got, want := get(t, b, "a/b/c"), "hello world"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	file, err := b.File(ctx, "a/b/c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := file.Size, int64(11); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := file.Source, "file://bucket/a/b/c"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if _, _, err := b.Get(ctx, "a/b/c", "bogus"); !errors.Is(errors.Precondition, err) {
+		t.Errorf("expected Precondition, got %v", err)
+	}
+	var buf bytesWriterAt
+	n, err := b.Download(ctx, "a/b/c", file.ETag, file.Size, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := n, file.Size; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := string(buf.Bytes()), "hello world"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	for _, key := range []string{"a/b", "a/b/d", "x"} {
+		if _, err := b.File(ctx, key); !errors.Is(errors.NotExist, err) {
+			t.Errorf("%s: expected NotExist, got %v", key, err)
+		}
+	}
+	if _, err := b.File(ctx, "../escape"); !errors.Is(errors.Invalid, err) {
+		t.Errorf("expected Invalid, got %v", err)
+	}
+	if err := b.Delete(ctx, "a/b/c", "nonexistent"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.File(ctx, "a/b/c"); !errors.Is(errors.NotExist, err) {
+		t.Errorf("expected NotExist, got %v", err)
+	}
+}
+
+func TestScanSnapshot(t *testing.T) {
+	ctx := context.Background()
+	b, cleanup := newBucket(t)
+	defer cleanup()
+	keys := []string{"dir/z", "dir/a", "dir/sub/b", "dirx", "other/c"}
+	for _, key := range keys {
+		put(t, b, key, key)
+	}
+	var scanned []string
+	scan := b.Scan("dir")
+	for scan.Scan(ctx) {
+		scanned = append(scanned, scan.Key())
+	}
+	if err := scan.Err(); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"dir/a", "dir/sub/b", "dir/z", "dirx"}
+	if !sort.StringsAreSorted(scanned) || !reflect.DeepEqual(scanned, want) {
+		t.Errorf("got %v, want %v", scanned, want)
+	}
+	fs, err := b.Snapshot(ctx, "dir/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for path := range fs.Map {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	if got, want := paths, []string{"a", "sub/b", "z"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	fs, err = b.Snapshot(ctx, "dirx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fs.Map["."].Size, int64(4); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	scan = b.Scan("nonexistent/")
+	if scan.Scan(ctx) || scan.Err() != nil {
+		t.Errorf("expected empty scan, got %v", scan.Err())
+	}
+}
+
+func TestCopy(t *testing.T) {
+	ctx := context.Background()
+	b, cleanup := newBucket(t)
+	defer cleanup()
+	put(t, b, "src", "contents")
+	if err := b.Copy(ctx, "src", "dst/x", ""); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := get(t, b, "dst/x"), "contents"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	other, cleanup2 := newBucket(t)
+	defer cleanup2()
+	if err := other.CopyFrom(ctx, b, "src", "copied"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := get(t, other, "copied"), "contents"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestScanOrder(t *testing.T) {
+	ctx := context.Background()
+	b, cleanup := newBucket(t)
+	defer cleanup()
+	// Directory traversal order differs from key order: "a.txt" sorts
+	// before "a/b" since '.' < '/'.
+	keys := []string{"a/b", "a.txt", "a/c/d", "a0", "b"}
+	for _, key := range keys {
+		put(t, b, key, key)
+	}
+	for _, prefix := range []string{"", "a", "a/", "a/c"} {
+		var want []string
+		for _, key := range keys {
+			if strings.HasPrefix(key, prefix) {
+				want = append(want, key)
+			}
+		}
+		sort.Strings(want)
+		var got []string
+		scan := b.Scan(prefix)
+		for scan.Scan(ctx) {
+			got = append(got, scan.Key())
+		}
+		if err := scan.Err(); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("prefix %q: got %v, want %v", prefix, got, want)
+		}
+	}
+}
+
+func TestETag(t *testing.T) {
+	ctx := context.Background()
+	b, cleanup := newBucket(t)
+	defer cleanup()
+	put(t, b, "x", "contents")
+	f1, err := b.File(ctx, "x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f2, _ := b.File(ctx, "x"); f1.ETag != f2.ETag {
+		t.Errorf("etag not stable: %v, %v", f1.ETag, f2.ETag)
+	}
+	// Overwriting the key with identical contents still changes the etag.
+	put(t, b, "x", "contents")
+	f2, err := b.File(ctx, "x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f1.ETag == f2.ETag {
+		t.Errorf("etag did not change after put: %v", f1.ETag)
+	}
+	if _, _, err := b.Get(ctx, "x", f1.ETag); !errors.Is(errors.Precondition, err) {
+		t.Errorf("expected Precondition, got %v", err)
+	}
+	var w bytesWriterAt
+	if _, err := b.Download(ctx, "x", f1.ETag, 0, &w); !errors.Is(errors.Precondition, err) {
+		t.Errorf("expected Precondition, got %v", err)
+	}
+}
+
+func TestMux(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "fileblob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	mux := blob.Mux{"file": New("/")}
+	u := "file://" + filepath.ToSlash(dir) + "/data/"
+	for _, key := range []string{"x", "y/z"} {
+		if err := mux.Put(ctx, u+key, 1, strings.NewReader(key), ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fs, err := mux.Snapshot(ctx, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(fs.Map), 2; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if got, want := fs.Map["y/z"].Source, u+"y/z"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	file, err := mux.File(ctx, u+"y/z")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := file.ETag, fs.Map["y/z"].ETag; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+// bytesWriterAt is an in-memory io.WriterAt.
+type bytesWriterAt struct {
+	p []byte
+}
+
+func (w *bytesWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	if end := int(off) + len(p); end > len(w.p) {
+		w.p = append(w.p, make([]byte, end-len(w.p))...)
+	}
+	return copy(w.p[off:], p), nil
+}
+
+func (w *bytesWriterAt) Bytes() []byte { return w.p }
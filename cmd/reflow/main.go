@@ -17,17 +17,28 @@ import (
 	"github.com/grailbio/reflow"
 	"github.com/grailbio/reflow/assoc"
 	_ "github.com/grailbio/reflow/assoc/dydbassoc"
+	_ "github.com/grailbio/reflow/assoc/sqlassoc"
 	_ "github.com/grailbio/reflow/ec2cluster"
+	_ "github.com/grailbio/reflow/hostcluster"
+	_ "github.com/grailbio/reflow/hpccluster"
 	infra2 "github.com/grailbio/reflow/infra"
+	_ "github.com/grailbio/reflow/k8scluster"
+	"github.com/grailbio/reflow/local"
 	"github.com/grailbio/reflow/log"
 	"github.com/grailbio/reflow/pool"
+	_ "github.com/grailbio/reflow/repository/file"
 	_ "github.com/grailbio/reflow/repository/s3"
 	"github.com/grailbio/reflow/runner"
+	"github.com/grailbio/reflow/sched"
+	"github.com/grailbio/reflow/secrets"
 	"github.com/grailbio/reflow/taskdb"
 	_ "github.com/grailbio/reflow/taskdb/dynamodbtask"
+	_ "github.com/grailbio/reflow/taskdb/sqltask"
 	"github.com/grailbio/reflow/tool"
 	"github.com/grailbio/reflow/trace"
 	_ "github.com/grailbio/reflow/trace"
+	_ "github.com/grailbio/reflow/trace/chrometrace"
+	_ "github.com/grailbio/reflow/trace/otlptrace"
 	_ "github.com/grailbio/reflow/trace/xraytrace"
 )
 
@@ -48,7 +59,37 @@ which elastically provisions (and tears down) compute resources as
 they are needed.
 
 The command setup-ec2 configures an AWS account to be used by
-Reflow's cluster manager.
+Reflow's cluster manager. Alternatively, the hostcluster provider
+configures a cluster from a static list of reflowlets, started with
+"reflow serve" on machines that are managed outside of Reflow:
+
+	cluster: hostcluster
+	hostcluster:
+	  hosts: [worker1, worker2:9000]
+
+While a command using a host cluster runs with the diagnostic HTTP
+server enabled (flag -http), its hosts may be listed, cordoned,
+uncordoned, and drained through the server's /hostcluster/ path:
+
+	curl localhost:9090/hostcluster/hosts
+	curl -d host=worker1 localhost:9090/hostcluster/drain
+
+On HPC systems, the hpccluster provider launches reflowlets as Slurm
+or PBS batch jobs, sized according to the configured instance types:
+
+	cluster: hpccluster
+	hpccluster:
+	  scheduler: slurm
+	  instancetypes:
+	  - {name: standard, cpu: 32, mem: 128, args: [--partition=standard]}
+
+On Kubernetes, the k8scluster provider runs reflowlets as pods that
+are sized to each allocation's resource requirements:
+
+	cluster: k8scluster
+	k8scluster:
+	  image: example.com/reflow:latest
+	  namespace: reflow
 
 Reflow may also use a distributed cache to automatically store and
 reuse intermediate results. Caching requires setting up a global
@@ -95,6 +136,9 @@ func main() {
 		infra2.Tracer:     new(trace.Tracer),
 		infra2.TaskDB:     new(taskdb.TaskDB),
 		infra2.Docker:     new(infra2.DockerConfig),
+		infra2.Runtime:    new(local.ContainerRuntime),
+		infra2.Secrets:    new(secrets.Secrets),
+		infra2.FairShare:  new(sched.FairShare),
 	}
 	cmd.SchemaKeys = infra.Keys{
 		infra2.AWSCreds:  "awscreds",
@@ -111,6 +155,8 @@ func main() {
 		infra2.Username:  "user",
 		infra2.Tracer:    "xray",
 		infra2.Docker:    "docker,memlimit=soft",
+		infra2.Runtime:   "dockerruntime",
+		infra2.FairShare: "fairshare",
 	}
 	cmd.BootstrapBinary = bootstrapimage
 	cmd.Flags().Parse(os.Args[1:])
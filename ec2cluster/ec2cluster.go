@@ -353,6 +353,12 @@ func (c *Cluster) Allocate(ctx context.Context, req reflow.Requirements, labels
 	}
 }
 
+// Interruptible implements pool.Interrupter. Allocs may be
+// interrupted if they are on spot instances.
+func (c *Cluster) Interruptible(alloc pool.Alloc) bool {
+	return c.state.Interruptible(alloc.Pool().ID())
+}
+
 // QueryTags returns the list of tags to use to query for instances belonging to this cluster.
 // This includes all InstanceTags that are set on any instance brought up by this cluster,
 // and a "reflowlet:version" tag (set on the instance by the reflowlet once it comes up)
@@ -623,6 +629,8 @@ func (c *Cluster) loop() {
 type reflowletPool struct {
 	inst *reflowletInstance
 	pool pool.Pool
+	// cancel stops the pool's termination watcher, if any.
+	cancel func()
 }
 
 // state helps maintain the state of the underlying cluster.
@@ -654,8 +662,11 @@ func (s *state) Init() {
 			defer s.mu.Unlock()
 
 			// Remove from pool instances that are not available on EC2.
-			for id := range s.pool {
+			for id, p := range s.pool {
 				if instances[id] == nil {
+					if p.cancel != nil {
+						p.cancel()
+					}
 					delete(s.pool, id)
 				}
 			}
@@ -669,7 +680,13 @@ func (s *state) Init() {
 						continue
 					}
 					// Add instance to the pool.
-					s.pool[*inst.InstanceId] = reflowletPool{inst, clnt}
+					p := reflowletPool{inst: inst, pool: clnt}
+					if inst.spot() {
+						var wctx context.Context
+						wctx, p.cancel = context.WithCancel(ctx)
+						go s.watchTerminating(wctx, inst, clnt)
+					}
+					s.pool[*inst.InstanceId] = p
 				}
 			}
 			s.c.SetPools(vals(s.pool))
@@ -680,6 +697,36 @@ func (s *state) Init() {
 	s.sync = make(chan struct{})
 }
 
+// watchTerminating waits for the reflowlet on the given spot instance
+// to report that it is being interrupted, and then marks the
+// instance's type as interrupted so that new instances prefer other
+// types.
+func (s *state) watchTerminating(ctx context.Context, inst *reflowletInstance, clnt *client.Client) {
+	deadline, err := clnt.Terminating(ctx)
+	if err != nil {
+		if ctx.Err() == nil && !errors.Is(errors.NotSupported, err) {
+			s.c.Log.Debugf("instance %s: terminating: %v", *inst.InstanceId, err)
+		}
+		return
+	}
+	s.c.Log.Printf("spot instance %s (%s) is being interrupted (deadline %s)",
+		*inst.InstanceId, *inst.InstanceType, deadline.Format(time.RFC3339))
+	s.c.instanceState.Interrupted(*inst.InstanceType)
+}
+
+// Interruptible tells whether the pool with the given ID runs on a
+// spot instance.
+func (s *state) Interruptible(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, p := range s.pool {
+		if p.pool.ID() == id {
+			return p.inst.spot()
+		}
+	}
+	return false
+}
+
 // InstanceTypeCounts returns number of instances of each instance type present in the cluster pool.
 func (s *state) InstanceTypeCounts() map[string]int {
 	s.mu.Lock()
@@ -162,12 +162,14 @@ type instanceState struct {
 
 	mu          sync.Mutex
 	unavailable map[string]time.Time
+	interrupted map[string]time.Time
 }
 
 func newInstanceState(configs []instanceConfig, sleep time.Duration, region string) *instanceState {
 	s := &instanceState{
 		configs:     make([]instanceConfig, len(configs)),
 		unavailable: make(map[string]time.Time),
+		interrupted: make(map[string]time.Time),
 		sleepTime:   sleep,
 		region:      region,
 	}
@@ -185,6 +187,26 @@ func (s *instanceState) Unavailable(config instanceConfig) {
 	s.mu.Unlock()
 }
 
+// Interrupted marks the given instance type as having recently had
+// a spot instance interrupted. Interrupted types are deprioritized
+// for spot launches, but are still used when no other instance type
+// is viable.
+func (s *instanceState) Interrupted(typ string) {
+	s.mu.Lock()
+	s.interrupted[typ] = time.Now()
+	s.mu.Unlock()
+}
+
+// usable tells whether the config may currently be launched.
+// If avoidInterrupted is set, spot instance types that were
+// recently interrupted are also excluded. s.mu must be held.
+func (s *instanceState) usable(config instanceConfig, spot, avoidInterrupted bool) bool {
+	if time.Since(s.unavailable[config.Type]) < s.sleepTime || (spot && !config.SpotOk) {
+		return false
+	}
+	return !(spot && avoidInterrupted && time.Since(s.interrupted[config.Type]) < s.sleepTime)
+}
+
 // Available tells whether the provided resources are potentially
 // available as an EC2 instance.
 func (s *instanceState) Available(need reflow.Resources) bool {
@@ -200,16 +222,25 @@ func (s *instanceState) Available(need reflow.Resources) bool {
 // the required resources and is also believed to be currently
 // available. Spot restricts instances to those that may be launched
 // via EC2 spot market. MaxAvailable uses (Resources).ScoredDistance
-// to determine the largest instance type.
+// to determine the largest instance type. Spot instance types that
+// were recently interrupted are chosen only if no other type is
+// available.
 func (s *instanceState) MaxAvailable(need reflow.Resources, spot bool) (instanceConfig, bool) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	if best, ok := s.maxAvailable(need, spot, true); ok {
+		return best, ok
+	}
+	return s.maxAvailable(need, spot, false)
+}
+
+func (s *instanceState) maxAvailable(need reflow.Resources, spot, avoidInterrupted bool) (instanceConfig, bool) {
 	var (
 		best     instanceConfig
 		distance float64 = -math.MaxFloat64
 	)
 	for _, config := range s.configs {
-		if time.Since(s.unavailable[config.Type]) < s.sleepTime || (spot && !config.SpotOk) {
+		if !s.usable(config, spot, avoidInterrupted) {
 			continue
 		}
 		if !config.Resources.Available(need) {
@@ -226,10 +257,18 @@ func (s *instanceState) MaxAvailable(need reflow.Resources, spot bool) (instance
 // MinAvailable returns the cheapest instance type that has at least
 // the required resources and is also believed to be currently
 // available. Spot restricts instances to those that may be launched
-// via EC2 spot market.
+// via EC2 spot market. Spot instance types that were recently
+// interrupted are chosen only if no other type is available.
 func (s *instanceState) MinAvailable(need reflow.Resources, spot bool) (instanceConfig, bool) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	if best, ok := s.minAvailable(need, spot, true); ok {
+		return best, ok
+	}
+	return s.minAvailable(need, spot, false)
+}
+
+func (s *instanceState) minAvailable(need reflow.Resources, spot, avoidInterrupted bool) (instanceConfig, bool) {
 	var (
 		price     float64
 		best      instanceConfig
@@ -238,7 +277,7 @@ func (s *instanceState) MinAvailable(need reflow.Resources, spot bool) (instance
 		viable    []instanceConfig
 	)
 	for _, config := range s.configs {
-		if time.Since(s.unavailable[config.Type]) < s.sleepTime || (spot && !config.SpotOk) {
+		if !s.usable(config, spot, avoidInterrupted) {
 			continue
 		}
 		if !config.Resources.Available(need) {
@@ -331,6 +370,11 @@ type reflowletInstance struct {
 	Digest string
 }
 
+// spot tells whether the instance is a spot instance.
+func (i *reflowletInstance) spot() bool {
+	return i.InstanceLifecycle != nil && *i.InstanceLifecycle == ec2.InstanceLifecycleTypeSpot
+}
+
 func newReflowletInstance(inst *ec2.Instance) *reflowletInstance {
 	ri := &reflowletInstance{Instance: *inst}
 	ri.update()
@@ -35,6 +35,37 @@ func TestInstanceState(t *testing.T) {
 	}
 }
 
+func TestInstanceStateInterrupted(t *testing.T) {
+	var instances []instanceConfig
+	for _, config := range instanceTypes {
+		config.Resources["disk"] = float64(2000 << 30)
+		instances = append(instances, config)
+	}
+	is := newInstanceState(instances, time.Minute, "us-west-2")
+	need := reflow.Resources{"mem": 2 << 30, "cpu": 1, "disk": 10 << 30}
+	is.Interrupted("c5.large")
+	if got, _ := is.MinAvailable(need, true); got.Type == "c5.large" {
+		t.Errorf("got %v for spot after interruption", got.Type)
+	}
+	if got, _ := is.MinAvailable(need, false); got.Type != "c5.large" {
+		t.Errorf("got %v, want c5.large for on-demand", got.Type)
+	}
+
+	// Interrupted types are still used when nothing else is available.
+	config, ok := is.Type("c5.large")
+	if !ok {
+		t.Fatal("missing c5.large")
+	}
+	is = newInstanceState([]instanceConfig{config}, time.Minute, "us-west-2")
+	is.Interrupted("c5.large")
+	if got, ok := is.MinAvailable(need, true); !ok || got.Type != "c5.large" {
+		t.Errorf("got %v, %v, want c5.large", got.Type, ok)
+	}
+	if got, ok := is.MaxAvailable(need, true); !ok || got.Type != "c5.large" {
+		t.Errorf("got %v, %v, want c5.large", got.Type, ok)
+	}
+}
+
 func TestConfigureEBS(t *testing.T) {
 	type ebsInfo struct {
 		ebsType string
@@ -73,6 +73,9 @@ const (
 	Precondition
 	// OOM indicates a out-of-memory error.
 	OOM
+	// ExecTimeout indicates that an exec was killed because it
+	// exceeded its timeout.
+	ExecTimeout
 
 	maxKind
 )
@@ -114,6 +117,8 @@ func (k Kind) String() string {
 		return "precondition was not met"
 	case OOM:
 		return "OOM error"
+	case ExecTimeout:
+		return "exec timed out"
 	}
 }
 
@@ -135,6 +140,7 @@ var kind2string = [maxKind]string{
 	Net:                "Net",
 	Precondition:       "Precondition",
 	OOM:                "OOM",
+	ExecTimeout:        "ExecTimeout",
 }
 
 var string2kind = map[string]Kind{
@@ -155,6 +161,7 @@ var string2kind = map[string]Kind{
 	"Net":                Net,
 	"Precondition":       Precondition,
 	"OOM":                OOM,
+	"ExecTimeout":        ExecTimeout,
 }
 
 // Error defines a Reflow error. It is used to indicate an error
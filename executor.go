@@ -109,6 +109,21 @@ type ExecConfig struct {
 	// OutputIsDir tells whether an output argument (by index)
 	// is a directory.
 	OutputIsDir []bool `json:",omitempty"`
+
+	// Env is the set of environment variables defined for the exec's
+	// command, in addition to those defined by the executor.
+	Env map[string]string `json:",omitempty"`
+
+	// Secrets names the secrets that are defined as environment
+	// variables for the exec's command. Secrets are resolved by the
+	// executor when the exec is started.
+	Secrets []string `json:",omitempty"`
+
+	// Timeout is the maximum amount of time for which the exec's
+	// command may run. Execs that exceed their timeout are killed,
+	// and fail with an error of kind errors.ExecTimeout. Execs
+	// without a timeout may run indefinitely.
+	Timeout time.Duration `json:",omitempty"`
 }
 
 func (e ExecConfig) String() string {
@@ -126,6 +141,20 @@ func (e ExecConfig) String() string {
 			}
 		}
 		s += fmt.Sprintf(" image %s cmd %q args [%s]", e.Image, e.Cmd, strings.Join(args, ", "))
+		if len(e.Env) > 0 {
+			keys := make([]string, 0, len(e.Env))
+			for k := range e.Env {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			s += fmt.Sprintf(" env [%s]", strings.Join(keys, ", "))
+		}
+		if len(e.Secrets) > 0 {
+			s += fmt.Sprintf(" secrets [%s]", strings.Join(e.Secrets, ", "))
+		}
+		if e.Timeout > 0 {
+			s += fmt.Sprintf(" timeout %s", e.Timeout)
+		}
 	}
 	s += fmt.Sprintf(" resources %s", e.Resources)
 	return s
@@ -0,0 +1,82 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package flow
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+
+	"github.com/grailbio/reflow"
+	"github.com/grailbio/reflow/errors"
+)
+
+// MaxContentsSize is the maximum size of a file that may be read
+// by a Contents node.
+const MaxContentsSize = 200 << 20
+
+// refGetter is implemented by snapshotters (e.g., blob.Mux) that
+// can retrieve the contents of file references.
+type refGetter interface {
+	Get(ctx context.Context, url, etag string) (io.ReadCloser, reflow.File, error)
+}
+
+// contents returns the contents of the provided file. Files are read
+// from the evaluator's repository; if a file is missing from it (for
+// example, because it was retrieved from cache), it is read from the
+// evaluator's (cache) repository instead. File references are read
+// through the evaluator's snapshotter.
+func (e *Eval) contents(ctx context.Context, file reflow.File) (string, error) {
+	if file.IsRef() {
+		getter, ok := e.Snapshotter.(refGetter)
+		if !ok {
+			return "", errors.E("contents", file.Source, errors.NotSupported,
+				errors.New("cannot read unresolved file reference"))
+		}
+		rc, _, err := getter.Get(ctx, file.Source, file.ETag)
+		if err != nil {
+			return "", errors.E("contents", file.Source, err)
+		}
+		defer rc.Close()
+		return readContents(rc, file.Source)
+	}
+	s, err := repositoryContents(ctx, e.repo, file)
+	if errors.Is(errors.NotExist, err) && e.Repository != nil && e.Repository != e.repo {
+		s, err = repositoryContents(ctx, e.Repository, file)
+	}
+	return s, err
+}
+
+// repositoryContents returns the contents of the provided file,
+// as stored in repository repo.
+func repositoryContents(ctx context.Context, repo reflow.Repository, file reflow.File) (string, error) {
+	if file.Size > MaxContentsSize {
+		return "", errors.E("contents", file.ID, errors.Invalid,
+			errors.Errorf("file is too large (%dMB); files may not exceed %dMB", file.Size>>20, MaxContentsSize>>20))
+	}
+	if repo == nil {
+		return "", errors.E("contents", file.ID, errors.NotSupported, errors.New("no repository"))
+	}
+	rc, err := repo.Get(ctx, file.ID)
+	if err != nil {
+		return "", errors.E("contents", file.ID, err)
+	}
+	defer rc.Close()
+	return readContents(rc, file.ID)
+}
+
+// readContents reads the contents of r, failing if they exceed
+// MaxContentsSize. The argument name is used in error messages.
+func readContents(r io.Reader, name interface{}) (string, error) {
+	b, err := ioutil.ReadAll(io.LimitReader(r, MaxContentsSize+1))
+	if err != nil {
+		return "", errors.E("contents", name, err)
+	}
+	if len(b) > MaxContentsSize {
+		return "", errors.E("contents", name, errors.Invalid,
+			errors.Errorf("file is too large; files may not exceed %dMB", MaxContentsSize>>20))
+	}
+	return string(b), nil
+}
@@ -53,12 +53,6 @@ const (
 	// printAllTasks can be set to aid testing and debugging.
 	printAllTasks = false
 
-	// maxOOMRetries is the maximum number of times a task can be retried due to an OOM.
-	maxOOMRetries = 3
-
-	// memMultiplier is the increase in memory that will be allocated to a task which OOMs.
-	memMultiplier = 1.5
-
 	// memSuggestThreshold is the minimum fraction of allocated memory an exec can use before a suggestion is
 	// displayed to use less memory.
 	memSuggestThreshold = 0.6
@@ -170,6 +164,22 @@ type EvalConfig struct {
 
 	// Labels is the labels for this run.
 	Labels pool.Labels
+
+	// DryRun determines whether the evaluator plans, rather than
+	// performs, the evaluation: cache lookups and assertion checks
+	// are performed as usual, but nodes that would need to be executed
+	// are not submitted, and nothing is written to the cache. The
+	// resulting plan is retrieved by (*Eval).Plan.
+	DryRun bool
+
+	// ExecTimeout is the timeout of execs that do not define their
+	// own. If zero, such execs may run indefinitely.
+	ExecTimeout time.Duration
+
+	// RecordGraph determines whether the evaluator records the state
+	// transitions of each node, for inclusion in the flow graph
+	// returned by (*Eval).Graph.
+	RecordGraph bool
 }
 
 // String returns a human-readable form of the evaluation configuration.
@@ -200,6 +210,9 @@ func (e EvalConfig) String() string {
 			flags = append(flags, "cachewrite")
 		}
 	}
+	if e.DryRun {
+		flags = append(flags, "dryrun")
+	}
 	if e.GC {
 		flags = append(flags, "gc")
 	} else {
@@ -218,6 +231,9 @@ func (e EvalConfig) String() string {
 	fmt.Fprintf(&b, " flags %s", strings.Join(flags, ","))
 	fmt.Fprintf(&b, " flowconfig %s", e.Config)
 	fmt.Fprintf(&b, " cachelookuptimeout %s", e.CacheLookupTimeout)
+	if e.ExecTimeout > 0 {
+		fmt.Fprintf(&b, " exectimeout %s", e.ExecTimeout)
+	}
 	fmt.Fprintf(&b, " imagemap %v", e.ImageMap)
 	return b.String()
 }
@@ -292,6 +308,9 @@ type Eval struct {
 	// so we limit how many we load concurrently.
 	// TODO(swami): Better solution is to use a more optimized file format (instead of JSON).
 	marshalLimiter *limiter.Limiter
+
+	// planner accumulates the evaluation plan in dry runs.
+	planner *planner
 }
 
 // NewEval creates and initializes a new evaluator using the provided
@@ -308,6 +327,10 @@ func NewEval(root *Flow, config EvalConfig) *Eval {
 		}
 		config.CacheMode = infra2.CacheOff
 	}
+	if config.DryRun {
+		config.CacheMode &^= infra2.CacheWrite
+		config.GC = false
+	}
 
 	e := &Eval{
 		EvalConfig:     config,
@@ -331,9 +354,13 @@ func NewEval(root *Flow, config EvalConfig) *Eval {
 		e.repo = e.Repository
 	}
 	// We only support delayed loads when using a scheduler.
-	if e.Scheduler == nil {
+	// Dry runs use the snapshotter only to resolve interns.
+	if e.Scheduler == nil && !e.DryRun {
 		e.Snapshotter = nil
 	}
+	if e.DryRun {
+		e.planner = newPlanner()
+	}
 	if e.CacheLookupTimeout == time.Duration(0) {
 		e.CacheLookupTimeout = defaultCacheLookupTimeout
 	}
@@ -360,11 +387,16 @@ func (e *Eval) Value() values.T {
 	return e.root.Value
 }
 
-// Err returns the root evaluation error, if any.
+// Err returns the root evaluation error, if any. In dry runs, Err
+// does not report the (placeholder) errors of nodes that would be
+// executed.
 func (e *Eval) Err() error {
 	if e.root.Err == nil {
 		return nil
 	}
+	if e.DryRun && errors.Match(errDryRun, e.root.Err) {
+		return nil
+	}
 	return e.root.Err
 }
 
@@ -505,11 +537,27 @@ func (e *Eval) Do(ctx context.Context) error {
 						e.Log.Printf("must intern %q: resolve: %v", f.URL, err)
 						e.Mutate(f, Ready, MustIntern)
 					} else {
+						if e.DryRun {
+							e.planner.Add(f, PlanTransfer, fs.Size())
+						}
 						e.Mutate(f, fs, Done)
 					}
 					return nil
 				})
 				continue dequeue
+			} else if e.DryRun && f.Op.External() {
+				switch f.State {
+				case NeedTransfer, Ready:
+					// The node would have to be executed: it is recorded in
+					// the plan instead.
+					e.Mutate(f, Running, NoStatus)
+					e.pending.Add(f)
+					e.step(f, func(f *Flow) error {
+						e.plan(f)
+						return nil
+					})
+					continue dequeue
+				}
 			} else if e.Scheduler != nil && f.Op.External() {
 				switch f.State {
 				case NeedTransfer, Ready:
@@ -596,29 +644,40 @@ func (e *Eval) Do(ctx context.Context) error {
 				task := e.newTask(f)
 				tasks = append(tasks, task)
 				e.step(f, func(f *Flow) error {
-					if err := e.taskWait(f, task, ctx); err != nil {
-						return err
-					}
-					// Retry OOMs if needed.
-					for retries := 0; retries < maxOOMRetries && task.Result.Err != nil && errors.Is(errors.OOM, task.Result.Err); retries++ {
-						// Increase the flow's reserved resources and generate a new ExecId
-						// TODO(dnicolaou) Get amount of memory at OOM from /dev/kmsg multiply that by memMultiplier to
-						// reallocate memory.
-						newReserved := reflow.Resources{}
-						newReserved.Set(f.Reserved)
-						newReserved["mem"] *= memMultiplier
+					policy := f.RetryPolicy()
+					for {
+						if err := e.taskWait(f, task, ctx); err != nil {
+							return err
+						}
+						var err error
+						if task.Err != nil {
+							err = task.Err
+						} else if task.Result.Err != nil {
+							err = task.Result.Err
+						}
+						next, oom, ok := policy.Next(task.Attempt, f.Reserved, err)
+						if !ok || ctx.Err() != nil {
+							break
+						}
+						// TODO(dnicolaou) Get amount of memory at OOM from /dev/kmsg multiply that by the policy's
+						// MemFactor to reallocate memory.
+						//
 						// Set f.ExecId to the zero digest so that Eval.Mutate() will generate a new random ExecId. Once f.ExecId
 						// is no longer required for the scheduler mode tests in eval_test.go, this will no longer be necessary.
 						// See TODO in Eval.Mutate() for more inforamtion.
 						f.ExecId = digest.Digest{}
-						e.Mutate(f, Unreserve(f.Reserved), Reserve(newReserved), Execing)
+						e.Mutate(f, Unreserve(f.Reserved), Reserve(next), Execing)
+						attempt := task.Attempt + 1
 						task = e.newTask(f)
-						e.Log.Printf("flow %s: OOM: re-submitting task %s with %v of memory (%v/%v)", task.FlowID.Short(), task.ID.IDShort(), data.Size(task.Config.Resources["mem"]), retries+1, maxOOMRetries)
-						e.Scheduler.Submit(task)
-						if err := e.taskWait(f, task, ctx); err != nil {
-							return err
+						task.Attempt = attempt
+						if oom {
+							e.Log.Printf("flow %s: OOM: re-submitting task %s with %v of memory (%v/%v)", task.FlowID.Short(), task.ID.IDShort(), data.Size(task.Config.Resources["mem"]), attempt, policy.Retries)
+						} else {
+							e.Log.Printf("flow %s: %v: re-submitting task %s (%v/%v)", task.FlowID.Short(), err, task.ID.IDShort(), attempt, policy.Retries)
 						}
+						e.Scheduler.Submit(task)
 					}
+					e.taskDone(f, task)
 					// Write to the cache only if a task was successfully completed.
 					if e.CacheMode.Writing() && task.Err == nil && task.Result.Err == nil {
 						e.Mutate(f, Incr) // just so the cache write can decr it
@@ -665,8 +724,9 @@ func (e *Eval) Do(ctx context.Context) error {
 	// In the case of error, we return immediately. On success, we flush
 	// all pending tasks so that all logs are properly displayed. We
 	// also perform another collection, so that the executor may be
-	// archived without data.
-	if root.Err != nil {
+	// archived without data. Dry runs always wait for pending lookups
+	// so that the plan is complete.
+	if root.Err != nil && !e.DryRun {
 		return nil
 	}
 	for e.pending.N() > 0 {
@@ -1149,11 +1209,13 @@ func (e *Eval) todo(f *Flow, visited flowOnce, v *FlowVisitor) {
 		// In the case of multiple dependencies, we short-circuit
 		// computation on error. This is because we want to return early,
 		// in case it can be dealt with (e.g., by restarting evaluation).
+		// Dry runs do not short-circuit, since all dependencies must be
+		// planned.
 		for _, dep := range f.Deps {
 			if dep == nil {
 				panic(fmt.Sprintf("op %s n %d", f.Op, len(f.Deps)))
 			}
-			if dep.State == Done && dep.Err != nil {
+			if dep.State == Done && dep.Err != nil && !e.DryRun {
 				e.Mutate(f, Ready)
 				v.Push(f)
 				return
@@ -1197,6 +1259,11 @@ func (e *Eval) eval(ctx context.Context, f *Flow) (err error) {
 	// Propagate errors immediately.
 	for _, dep := range f.Deps {
 		if err := dep.Err; err != nil {
+			// In dry runs, maps and continuations cannot be expanded
+			// without the values of the nodes that would be executed.
+			if e.DryRun && (f.Op == Map || f.Op == K) && errors.Match(errDryRun, err) {
+				e.planner.Partial()
+			}
 			e.Mutate(f, err, Done)
 			return nil
 		}
@@ -1323,7 +1390,14 @@ func (e *Eval) eval(ctx context.Context, f *Flow) (err error) {
 	case Requirements:
 		e.Mutate(f, Value{f.Deps[0].Value}, Incr, Done)
 	case Data:
-		if id, err := e.repo.Put(ctx, bytes.NewReader(f.Data)); err != nil {
+		if e.DryRun {
+			// Dry runs do not write to the repository.
+			e.Mutate(f, reflow.Fileset{
+				Map: map[string]reflow.File{
+					".": {ID: reflow.Digester.FromBytes(f.Data), Size: int64(len(f.Data))},
+				},
+			}, Incr, Done)
+		} else if id, err := e.repo.Put(ctx, bytes.NewReader(f.Data)); err != nil {
 			e.Mutate(f, err, Incr, Done)
 		} else {
 			e.Mutate(f, reflow.Fileset{
@@ -1332,6 +1406,17 @@ func (e *Eval) eval(ctx context.Context, f *Flow) (err error) {
 				},
 			}, Incr, Done)
 		}
+	case Contents:
+		if e.DryRun {
+			// Dry runs cannot read file contents: the file may not exist,
+			// and computations depending on it cannot be planned.
+			e.planner.Partial()
+			e.Mutate(f, errDryRun, Incr, Done)
+		} else if v, err := e.contents(ctx, f.Deps[0].Value.(reflow.File)); err != nil {
+			e.Mutate(f, err, Incr, Done)
+		} else {
+			e.Mutate(f, Value{v}, Incr, Done)
+		}
 	default:
 		panic(fmt.Sprintf("bug %v", f))
 	}
@@ -1513,9 +1598,12 @@ func (e *Eval) batchLookup(ctx context.Context, flows ...*Flow) {
 		}
 	}
 	{
+		ctx, done := trace.Start(ctx, trace.Cache, digest.Digest{}, "cache lookup")
+		trace.Note(ctx, "keys", len(batch))
 		ctx, cancel := context.WithTimeout(ctx, e.CacheLookupTimeout)
 		err := e.Assoc.BatchGet(ctx, batch)
 		cancel()
+		done()
 		if err != nil {
 			e.Log.Errorf("assoc.BatchGet: %v", err)
 			for _, f := range flows {
@@ -1603,6 +1691,9 @@ func (e *Eval) batchLookup(ctx context.Context, flows ...*Flow) {
 							e.Log.Debugf("flow %s assertions diff:\n%s\n", f.Digest().Short(), diff)
 						}
 					}
+					if e.DryRun {
+						e.planner.Invalidate(f)
+					}
 					e.lookupFailed(f)
 					return nil
 				}
@@ -1612,6 +1703,11 @@ func (e *Eval) batchLookup(ctx context.Context, flows ...*Flow) {
 				e.lookupFailed(f)
 				return nil
 			}
+			if e.DryRun {
+				e.planner.Add(f, PlanCache, fs.Size())
+				e.Mutate(f, fs, Cached, Done)
+				return nil
+			}
 			// Perform read repair: asynchronously write back all non existent keys.
 			writeback := keys[:0]
 			for _, key := range keys {
@@ -1816,7 +1912,7 @@ func (e *Eval) exec(ctx context.Context, f *Flow) error {
 		n   = 0
 		s   = statePut
 		id  = f.Digest()
-		cfg = f.ExecConfig()
+		cfg = e.execConfig(f)
 	)
 
 	// TODO(marius): we should distinguish between fatal and nonfatal errors.
@@ -1837,7 +1933,7 @@ func (e *Eval) exec(ctx context.Context, f *Flow) error {
 			)
 			if e.TaskDB != nil {
 				tctx, tcancel = context.WithCancel(ctx)
-				err = e.TaskDB.CreateTask(tctx, f.TaskID, e.RunID, id, x.URI())
+				err = e.TaskDB.CreateTask(tctx, f.TaskID, e.RunID, id, 0, x.URI())
 				if err != nil {
 					tcancel()
 					e.Log.Debugf("taskdb createtask: %v\n", err)
@@ -1969,6 +2065,9 @@ func (e *Eval) Mutate(f *Flow, muts ...interface{}) {
 			prevState = f.State
 			thisState = arg
 			f.State = arg
+			if e.RecordGraph && prevState != thisState {
+				f.Transitions = append(f.Transitions, Transition{State: arg, Time: time.Now()})
+			}
 		case reflow.Fileset:
 			f.Value = values.T(arg)
 		case Fork:
@@ -2334,7 +2433,9 @@ func (e *Eval) LogFlow(ctx context.Context, f *Flow) {
 	}
 }
 
-// taskWait waits for a task to finish running and updates the flow, cache, and taskdb accordingly.
+// taskWait waits for a task to finish running and records its exec and inspect output
+// in the flow and taskdb. The flow is marked done separately, by taskDone, since
+// failed tasks may be retried.
 func (e *Eval) taskWait(f *Flow, task *sched.Task, ctx context.Context) error {
 	if err := task.Wait(ctx, sched.TaskRunning); err != nil {
 		return err
@@ -2346,15 +2447,19 @@ func (e *Eval) taskWait(f *Flow, task *sched.Task, ctx context.Context) error {
 		return err
 	}
 	f.Inspect = task.Inspect
+	if e.TaskDB != nil {
+		e.taskdbWriteAsync(ctx, f.Op, task.Inspect, task.Exec, task.ID)
+	}
+	return nil
+}
+
+// taskDone marks the flow f, whose exec was performed by task, as done.
+func (e *Eval) taskDone(f *Flow, task *sched.Task) {
 	if task.Err != nil {
 		e.Mutate(f, task.Err, Done)
 	} else {
 		e.Mutate(f, task.Result.Err, task.Result.Fileset, Propagate, Done)
 	}
-	if e.TaskDB != nil {
-		e.taskdbWriteAsync(ctx, f.Op, task.Inspect, task.Exec, task.ID)
-	}
-	return nil
 }
 
 func (e *Eval) newTask(f *Flow) *sched.Task {
@@ -2362,11 +2467,23 @@ func (e *Eval) newTask(f *Flow) *sched.Task {
 	t.ID = taskdb.TaskID(f.ExecId)
 	t.RunID = e.RunID
 	t.FlowID = f.Digest()
-	t.Config = f.ExecConfig()
+	t.Labels = e.Labels
+	t.Config = e.execConfig(f)
 	t.Log = e.Log.Prefixf("task %s from flow %s: ", t.ID.IDShort(), t.FlowID.Short())
 	return t
 }
 
+// execConfig returns the exec config of flow f, applying the
+// evaluator's default exec timeout to execs that do not define
+// their own.
+func (e *Eval) execConfig(f *Flow) reflow.ExecConfig {
+	cfg := f.ExecConfig()
+	if cfg.Type == "exec" && cfg.Timeout == 0 {
+		cfg.Timeout = e.ExecTimeout
+	}
+	return cfg
+}
+
 func accumulate(flows []*Flow) (int, string) {
 	count := map[string]int{}
 	n := 0
@@ -1013,6 +1013,51 @@ func TestData(t *testing.T) {
 	}
 }
 
+func TestContents(t *testing.T) {
+	hello := []byte("hello, world!")
+	file := &flow.Flow{
+		Op:         flow.Coerce,
+		Deps:       []*flow.Flow{op.Data(hello)},
+		FlowDigest: reflow.Digester.FromString("test.file"),
+		Coerce: func(v values.T) (values.T, error) {
+			return v.(reflow.Fileset).Map["."], nil
+		},
+	}
+	e := testutil.Executor{Have: testutil.Resources}
+	e.Init()
+	e.Repo = testutil.NewInmemoryRepository()
+	eval := flow.NewEval(op.Contents(file), flow.EvalConfig{
+		Executor: &e,
+		Log:      logger(),
+		Trace:    logger(),
+	})
+	r := <-testutil.EvalFlowAsync(context.Background(), eval)
+	if r.Err != nil {
+		t.Fatal(r.Err)
+	}
+	if got, want := r.Val, string(hello); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	missing := op.Contents(&flow.Flow{
+		Op:         flow.Val,
+		Value:      reflow.File{ID: reflow.Digester.FromString("missing"), Size: 7},
+		FlowDigest: reflow.Digester.FromString("test.missing"),
+	})
+	eval = flow.NewEval(missing, flow.EvalConfig{
+		Executor: &e,
+		Log:      logger(),
+		Trace:    logger(),
+	})
+	r = <-testutil.EvalFlowAsync(context.Background(), eval)
+	if r.Err == nil {
+		t.Fatal("expected error")
+	}
+	if !errors.Is(errors.NotExist, r.Err) {
+		t.Errorf("expected NotExist error, got %v", r.Err)
+	}
+}
+
 func TestPropagateAssertions(t *testing.T) {
 	fuzz := testutil.NewFuzz(nil)
 	internNoFs := op.Intern("url")
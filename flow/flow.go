@@ -16,6 +16,7 @@ import (
 	"math"
 	"net/url"
 	"regexp"
+	"sort"
 	"strings"
 	"sync"
 	"time" // This is imported for the sha256 implementation, which is always required for Reflow.
@@ -94,6 +95,9 @@ const (
 	Requirements
 	// Data evaluates to a literal (inline) piece of data.
 	Data
+	// Contents reads the contents of the file produced by
+	// the flow's (single) dependency into a string value.
+	Contents
 
 	maxOp
 )
@@ -113,6 +117,7 @@ var opStrings = [maxOp]string{
 	Coerce:       "coerce",
 	Requirements: "requirements",
 	Data:         "data",
+	Contents:     "contents",
 }
 
 func (o Op) String() string {
@@ -278,6 +283,10 @@ type Flow struct {
 	// for details.
 	State State
 
+	// Transitions records the node's state transitions during
+	// evaluation, together with the times at which they occurred.
+	Transitions []Transition
+
 	// Resources indicates the expected resource usage of this node.
 	// Currently it is only defined for OpExec.
 	Resources reflow.Resources
@@ -352,6 +361,27 @@ type Flow struct {
 	// NonDeterministic, in the case of Execs, denotes if the exec is non-deterministic.
 	NonDeterministic bool
 
+	// Retry, in the case of Execs, is the exec's retry policy.
+	// If nil, DefaultRetryPolicy is used. Retry policies apply only
+	// in scheduler mode.
+	Retry *RetryPolicy
+
+	// Env, in the case of Execs, defines additional environment
+	// variables for the exec's command. Env is part of the flow's
+	// digest.
+	Env map[string]string
+
+	// Secrets, in the case of Execs, names the secrets that are
+	// defined in the exec's environment. Secrets are resolved by the
+	// executor, and are not part of the flow's digest.
+	Secrets []string
+
+	// Timeout, in the case of Execs, is the maximum amount of time
+	// for which the exec's command may run. If zero, the evaluator's
+	// default timeout applies. Timeout is not part of the flow's
+	// digest.
+	Timeout time.Duration
+
 	digestOnce sync.Once
 	digest     digest.Digest
 }
@@ -364,6 +394,9 @@ func (f *Flow) Copy() *Flow {
 	for i := range f.Deps {
 		c.Deps[i] = f.Deps[i]
 	}
+	if f.Transitions != nil {
+		c.Transitions = append([]Transition(nil), f.Transitions...)
+	}
 	return &c
 }
 
@@ -520,6 +553,8 @@ func (f *Flow) DebugString() string {
 			dstr, f.FlowRequirements.Min, f.FlowRequirements.Width)
 	case Data:
 		fmt.Fprintf(b, "data<%s>(%s)", dstr, Digester.FromBytes(f.Data))
+	case Contents:
+		fmt.Fprintf(b, "contents<%s>(", dstr)
 	}
 	if len(f.Deps) != 0 {
 		deps := make([]string, len(f.Deps))
@@ -598,6 +633,8 @@ func (f *Flow) ExecString(cache bool) string {
 			s = "pullup " + strings.Join(args, " ")
 		case Data:
 			s = fmt.Sprintf("data %s", Digester.FromBytes(f.Data))
+		case Contents:
+			s = fmt.Sprintf("contents flow(%s)", f.Deps[0].Digest().Short())
 		}
 	} else {
 		switch f.Op {
@@ -670,6 +707,12 @@ func (f *Flow) ExecString(cache bool) string {
 			s = "pullup " + strings.Join(args, " ")
 		case Data:
 			s = fmt.Sprintf("data %s", Digester.FromBytes(f.Data))
+		case Contents:
+			if file, ok := f.Deps[0].Value.(reflow.File); ok {
+				s = fmt.Sprintf("contents %s", file.Short())
+			} else {
+				s = "contents ?"
+			}
 		}
 	}
 	var rate string
@@ -763,6 +806,9 @@ func (f *Flow) ExecConfig() reflow.ExecConfig {
 			Args:          args,
 			Resources:     f.Reserved,
 			OutputIsDir:   f.OutputIsDir,
+			Env:           f.Env,
+			Secrets:       f.Secrets,
+			Timeout:       f.Timeout,
 		}
 	default:
 		panic("no exec config for op " + f.Op.String())
@@ -861,6 +907,7 @@ func (f *Flow) WriteDigest(w io.Writer) {
 				writeN(w, arg.Index)
 			}
 		}
+		writeEnv(w, f.Env)
 	case Groupby:
 		io.WriteString(w, f.Re.String())
 	case Map:
@@ -923,6 +970,7 @@ func (f *Flow) physicalDigest(image string) digest.Digest {
 				writeN(w, arg.Index)
 			}
 		}
+		writeEnv(w, f.Env)
 	}
 	if !f.ExtraDigest.IsZero() {
 		digest.WriteDigest(w, f.ExtraDigest)
@@ -930,6 +978,27 @@ func (f *Flow) physicalDigest(image string) digest.Digest {
 	return w.Digest()
 }
 
+// writeEnv writes the digestible material of the environment env
+// to w, in key order. Empty environments write nothing, so that the
+// digests of execs that do not define an environment are unchanged.
+func writeEnv(w io.Writer, env map[string]string) {
+	if len(env) == 0 {
+		return
+	}
+	keys := make([]string, 0, len(env))
+	for k := range env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	io.WriteString(w, "env")
+	for _, k := range keys {
+		writeN(w, len(k))
+		io.WriteString(w, k)
+		writeN(w, len(env[k]))
+		io.WriteString(w, env[k])
+	}
+}
+
 // physicalDigests computes the physical digests of the Flow f,
 // reflecting the actual underlying operation to be performed, and
 // not the logical one. If there are multiple representations of
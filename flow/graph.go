@@ -0,0 +1,220 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package flow
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/grailbio/base/digest"
+	"github.com/grailbio/reflow"
+)
+
+// Transition records a flow node's transition into a state.
+type Transition struct {
+	// State is the state into which the node transitioned.
+	State State
+	// Time is the time of the transition.
+	Time time.Time
+}
+
+// GraphTransition is the serialized form of a Transition.
+type GraphTransition struct {
+	State string    `json:"state"`
+	Time  time.Time `json:"time"`
+}
+
+// GraphNode is the serialized form of a flow node, as it was
+// evaluated.
+type GraphNode struct {
+	// ID identifies the node within its graph.
+	ID int `json:"id"`
+	// Op is the node's operation.
+	Op string `json:"op"`
+	// Ident and Position identify the node in the program source.
+	Ident    string `json:"ident,omitempty"`
+	Position string `json:"position,omitempty"`
+	// Digest is the node's digest.
+	Digest digest.Digest `json:"digest"`
+	// State is the node's final evaluation state.
+	State string `json:"state"`
+	// Transitions are the node's state transitions, in order.
+	Transitions []GraphTransition `json:"transitions,omitempty"`
+	// Cache is "hit" if the node's result was retrieved from cache,
+	// "miss" if it was looked up but not found, and empty if the node
+	// was not looked up.
+	Cache string `json:"cache,omitempty"`
+	// Requested is the amount of resources requested by an exec.
+	Requested reflow.Resources `json:"requested,omitempty"`
+	// Used is the amount of resources used by an exec, according to
+	// its profile: mean CPU, and maximum memory and disk usage.
+	Used reflow.Resources `json:"used,omitempty"`
+	// Runtime is the exec's runtime, in seconds.
+	Runtime float64 `json:"runtime,omitempty"`
+	// TransferSize is the number of bytes transferred for the node.
+	TransferSize int64 `json:"transfersize,omitempty"`
+	// Error is the node's evaluation error, if any.
+	Error string `json:"error,omitempty"`
+	// Deps are the IDs of the node's dependencies.
+	Deps []int `json:"deps,omitempty"`
+	// Parent is the ID of the node from which this node was forked,
+	// or zero.
+	Parent int `json:"parent,omitempty"`
+}
+
+// Graph is a serializable view of an evaluated flow graph.
+type Graph struct {
+	// Root is the ID of the graph's root node.
+	Root int `json:"root"`
+	// Nodes are the graph's nodes, ordered by ID.
+	Nodes []GraphNode `json:"nodes"`
+}
+
+// NewGraph returns the graph rooted at the provided flow. Nodes are
+// assigned IDs starting at 1, in order of traversal. NewGraph should
+// not be called while the flow is being evaluated.
+func NewGraph(root *Flow) *Graph {
+	ids := make(map[*Flow]int)
+	id := func(f *Flow) int {
+		if ids[f] == 0 {
+			ids[f] = len(ids) + 1
+		}
+		return ids[f]
+	}
+	g := &Graph{Root: id(root)}
+	for v := root.Visitor(); v.Walk(); v.Visit() {
+		if v.Parent != nil {
+			v.Push(v.Parent)
+		}
+		f := v.Flow
+		node := GraphNode{
+			ID:           id(f),
+			Op:           f.Op.String(),
+			Ident:        f.Ident,
+			Position:     f.Position,
+			Digest:       f.Digest(),
+			State:        strings.ToLower(f.State.String()),
+			TransferSize: int64(f.TransferSize),
+		}
+		var lookup bool
+		for _, t := range f.Transitions {
+			lookup = lookup || t.State == Lookup
+			node.Transitions = append(node.Transitions, GraphTransition{
+				State: strings.ToLower(t.State.String()),
+				Time:  t.Time,
+			})
+		}
+		switch {
+		case f.Cached:
+			node.Cache = "hit"
+		case lookup:
+			node.Cache = "miss"
+		}
+		if f.Op == Exec {
+			node.Requested = f.Resources
+			if p := f.Inspect.Profile; len(p) > 0 {
+				node.Used = make(reflow.Resources)
+				for _, key := range []string{"mem", "disk", "tmp"} {
+					if v := p[key].Max; v > 0 && !math.IsInf(v, 0) {
+						node.Used[key] = v
+					}
+				}
+				if v := p["cpu"].Mean; v > 0 && !math.IsNaN(v) && !math.IsInf(v, 0) {
+					node.Used["cpu"] = v
+				}
+			}
+			node.Runtime = f.Inspect.Runtime().Seconds()
+		}
+		if f.Err != nil {
+			node.Error = f.Err.Error()
+		}
+		for _, dep := range f.Deps {
+			node.Deps = append(node.Deps, id(dep))
+		}
+		if f.Parent != nil {
+			node.Parent = id(f.Parent)
+		}
+		g.Nodes = append(g.Nodes, node)
+	}
+	// Nodes are visited depth first, but may be assigned IDs
+	// (as dependencies) before they are visited.
+	nodes := make([]GraphNode, len(g.Nodes))
+	for _, node := range g.Nodes {
+		nodes[node.ID-1] = node
+	}
+	g.Nodes = nodes
+	return g
+}
+
+// Graph returns the graph of the evaluated flow. Graph should be
+// called only after Do has returned.
+func (e *Eval) Graph() *Graph {
+	return NewGraph(e.root)
+}
+
+// WriteJSON writes the graph to w in JSON format.
+func (g *Graph) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(g)
+}
+
+// WriteDOT writes the graph to w in the Graphviz DOT language. Edges
+// point from dependencies to their dependents; nodes are colored by
+// their outcome.
+func (g *Graph) WriteDOT(w io.Writer) error {
+	var b strings.Builder
+	b.WriteString("digraph reflow {\n")
+	b.WriteString("\tnode [shape=box, style=filled, fontname=\"Helvetica\"];\n")
+	for _, node := range g.Nodes {
+		label := node.Op
+		if node.Ident != "" {
+			label = node.Ident + "\\n" + label
+		}
+		if !node.Digest.IsZero() {
+			label += " " + node.Digest.Short()
+		}
+		label += "\\n" + node.State
+		if node.Cache != "" {
+			label += " (cache " + node.Cache + ")"
+		}
+		if node.Runtime > 0 {
+			label += fmt.Sprintf("\\n%s", time.Duration(node.Runtime*float64(time.Second)).Round(time.Second))
+		}
+		color := "lightgrey"
+		switch {
+		case node.Error != "":
+			color = "salmon"
+		case node.Cache == "hit":
+			color = "lightblue"
+		case node.State == "done":
+			color = "palegreen"
+		}
+		fmt.Fprintf(&b, "\tn%d [label=%s, fillcolor=%s", node.ID, dotQuote(label), color)
+		if node.Position != "" {
+			fmt.Fprintf(&b, ", tooltip=%s", dotQuote(node.Position))
+		}
+		b.WriteString("];\n")
+		for _, dep := range node.Deps {
+			fmt.Fprintf(&b, "\tn%d -> n%d;\n", dep, node.ID)
+		}
+		if node.Parent != 0 {
+			fmt.Fprintf(&b, "\tn%d -> n%d [style=dashed];\n", node.Parent, node.ID)
+		}
+	}
+	b.WriteString("}\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// dotQuote quotes s as a DOT string. Escape sequences (such as \n)
+// already present in s are retained.
+func dotQuote(s string) string {
+	return `"` + strings.Replace(s, `"`, `\"`, -1) + `"`
+}
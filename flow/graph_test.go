@@ -0,0 +1,134 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package flow_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/grailbio/reflow/flow"
+	"github.com/grailbio/reflow/infra"
+	op "github.com/grailbio/reflow/test/flow"
+	"github.com/grailbio/reflow/test/testutil"
+)
+
+func TestGraph(t *testing.T) {
+	intern := op.Intern("internurl")
+	cached := op.Exec("image", "cached", testutil.Resources, intern)
+	exec := op.Exec("image", "exec", testutil.Resources, cached)
+	testutil.AssignExecId(nil, intern, cached, exec)
+
+	e := testutil.Executor{Have: testutil.Resources}
+	e.Init()
+	e.Repo = testutil.NewInmemoryRepository()
+	eval := flow.NewEval(exec, flow.EvalConfig{
+		Executor:    &e,
+		CacheMode:   infra.CacheRead | infra.CacheWrite,
+		Assoc:       testutil.NewInmemoryAssoc(),
+		Transferer:  testutil.Transferer,
+		Repository:  testutil.NewInmemoryRepository(),
+		Log:         logger(),
+		Trace:       logger(),
+		RecordGraph: true,
+	})
+	testutil.WriteCache(eval, cached.Digest(), "a")
+	rc := testutil.EvalAsync(context.Background(), eval)
+	e.Ok(exec, testutil.WriteFiles(e.Repo, "b"))
+	if r := <-rc; r.Err != nil {
+		t.Fatal(r.Err)
+	}
+
+	g := eval.Graph()
+	var b bytes.Buffer
+	if err := g.WriteJSON(&b); err != nil {
+		t.Fatal(err)
+	}
+	g = new(flow.Graph)
+	if err := json.Unmarshal(b.Bytes(), g); err != nil {
+		t.Fatal(err)
+	}
+	nodes := make(map[string]flow.GraphNode)
+	for i, node := range g.Nodes {
+		if got, want := node.ID, i+1; got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+		nodes[node.Digest.String()] = node
+	}
+	root, ok := nodes[exec.Digest().String()]
+	if !ok {
+		t.Fatal("root node missing from graph")
+	}
+	if got, want := g.Root, root.ID; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := root.Cache, "miss"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := root.State, "done"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if !root.Requested.Equal(testutil.Resources) {
+		t.Errorf("got %v, want %v", root.Requested, testutil.Resources)
+	}
+	var states []string
+	for i, tr := range root.Transitions {
+		if i > 0 && tr.Time.Before(root.Transitions[i-1].Time) {
+			t.Errorf("transition %d precedes its predecessor", i)
+		}
+		states = append(states, tr.State)
+	}
+	if len(states) == 0 || states[len(states)-1] != "done" {
+		t.Errorf("bad transitions %v", states)
+	}
+	dep, ok := nodes[cached.Digest().String()]
+	if !ok {
+		t.Fatal("dependency missing from graph")
+	}
+	if got, want := dep.Cache, "hit"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := root.Deps, []int{dep.ID}; len(got) != 1 || got[0] != want[0] {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	b.Reset()
+	if err := g.WriteDOT(&b); err != nil {
+		t.Fatal(err)
+	}
+	dot := b.String()
+	if !strings.HasPrefix(dot, "digraph reflow {") {
+		t.Errorf("bad DOT output %q", dot)
+	}
+	if edge := fmt.Sprintf("n%d -> n%d;", dep.ID, root.ID); !strings.Contains(dot, edge) {
+		t.Errorf("DOT output is missing edge %s:\n%s", edge, dot)
+	}
+}
+
+func TestGraphNoTransitions(t *testing.T) {
+	exec := op.Exec("image", "exec", testutil.Resources)
+	testutil.AssignExecId(nil, exec)
+
+	e := testutil.Executor{Have: testutil.Resources}
+	e.Init()
+	e.Repo = testutil.NewInmemoryRepository()
+	eval := flow.NewEval(exec, flow.EvalConfig{
+		Executor:   &e,
+		Transferer: testutil.Transferer,
+		Repository: testutil.NewInmemoryRepository(),
+		Log:        logger(),
+	})
+	rc := testutil.EvalAsync(context.Background(), eval)
+	e.Ok(exec, testutil.WriteFiles(e.Repo, "a"))
+	if r := <-rc; r.Err != nil {
+		t.Fatal(r.Err)
+	}
+	if n := len(exec.Transitions); n != 0 {
+		t.Errorf("recorded %d transitions without RecordGraph", n)
+	}
+}
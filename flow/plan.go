@@ -0,0 +1,237 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package flow
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/grailbio/base/digest"
+	"github.com/grailbio/reflow"
+	"github.com/grailbio/reflow/errors"
+)
+
+// errDryRun is the error with which the evaluator completes nodes
+// that would have to be executed during a dry run.
+var errDryRun = errors.E(errors.NotSupported, "dry run")
+
+// PlanState describes what an evaluation would do with a flow node.
+type PlanState int
+
+const (
+	// PlanCache indicates that the node's result would be retrieved
+	// from cache.
+	PlanCache PlanState = iota
+	// PlanExec indicates that the node would be executed.
+	PlanExec
+	// PlanTransfer indicates that the node (an intern or extern)
+	// would transfer data.
+	PlanTransfer
+	// PlanInvalidated indicates that the node's cached result would
+	// be invalidated by its assertions, and the node would be executed.
+	PlanInvalidated
+)
+
+var planStates = [...]string{
+	PlanCache:       "cache",
+	PlanExec:        "exec",
+	PlanTransfer:    "transfer",
+	PlanInvalidated: "invalidated",
+}
+
+// String returns the name of the plan state.
+func (s PlanState) String() string {
+	if s < 0 || int(s) >= len(planStates) {
+		return fmt.Sprintf("PlanState(%d)", s)
+	}
+	return planStates[s]
+}
+
+// MarshalJSON implements json.Marshaler.
+func (s PlanState) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (s *PlanState) UnmarshalJSON(b []byte) error {
+	var str string
+	if err := json.Unmarshal(b, &str); err != nil {
+		return err
+	}
+	for i, name := range planStates {
+		if name == str {
+			*s = PlanState(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid plan state %q", str)
+}
+
+// PlanNode describes the planned evaluation of a single flow node.
+type PlanNode struct {
+	// Digest is the node's digest.
+	Digest digest.Digest `json:"digest"`
+	// Ident is the node's identifier.
+	Ident string `json:"ident,omitempty"`
+	// Op is the node's operation.
+	Op string `json:"op"`
+	// State is what the evaluator would do with the node.
+	State PlanState `json:"state"`
+	// Cmd is the (abbreviated) command of exec nodes.
+	Cmd string `json:"cmd,omitempty"`
+	// URL is the URL of intern and extern nodes.
+	URL string `json:"url,omitempty"`
+	// Resources is the resources that would be reserved for the node,
+	// if it is executed.
+	Resources reflow.Resources `json:"resources,omitempty"`
+	// Size is the size in bytes of the node's cached result, or, for
+	// transfers, the number of bytes that would be transferred. Size
+	// is zero if the amount is not known ahead of time.
+	Size int64 `json:"size,omitempty"`
+}
+
+// Plan is the result of a dry run evaluation (see EvalConfig.DryRun).
+type Plan struct {
+	// Nodes is the set of planned nodes, ordered by identifier.
+	Nodes []PlanNode `json:"nodes"`
+	// Partial is true if parts of the flow graph could not be
+	// planned because their structure depends on the results of
+	// nodes that would be executed.
+	Partial bool `json:"partial"`
+}
+
+// Count returns the number of nodes in the plan with the given state.
+func (p *Plan) Count(state PlanState) int {
+	var n int
+	for _, node := range p.Nodes {
+		if node.State == state {
+			n++
+		}
+	}
+	return n
+}
+
+// Resources returns the total resources of the nodes that would be
+// executed.
+func (p *Plan) Resources() reflow.Resources {
+	var total reflow.Resources
+	for _, node := range p.Nodes {
+		if node.State == PlanExec || node.State == PlanInvalidated {
+			total.Add(total, node.Resources)
+		}
+	}
+	return total
+}
+
+// TransferSize returns the total number of bytes that are known to be
+// transferred by the plan.
+func (p *Plan) TransferSize() int64 {
+	var n int64
+	for _, node := range p.Nodes {
+		if node.State == PlanTransfer {
+			n += node.Size
+		}
+	}
+	return n
+}
+
+// planner accumulates a plan during a dry run evaluation.
+type planner struct {
+	mu          sync.Mutex
+	nodes       map[*Flow]PlanNode
+	invalidated map[*Flow]bool
+	partial     bool
+}
+
+func newPlanner() *planner {
+	return &planner{
+		nodes:       make(map[*Flow]PlanNode),
+		invalidated: make(map[*Flow]bool),
+	}
+}
+
+// Add records the planned state of node f.
+func (p *planner) Add(f *Flow, state PlanState, size int64) {
+	node := PlanNode{
+		Digest: f.Digest(),
+		Ident:  f.Ident,
+		Op:     f.Op.String(),
+		State:  state,
+		Cmd:    f.AbbrevCmd(),
+		Size:   size,
+	}
+	if f.URL != nil {
+		node.URL = f.URL.String()
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if state == PlanExec {
+		node.Resources = f.Resources
+		if p.invalidated[f] {
+			node.State = PlanInvalidated
+		}
+	}
+	p.nodes[f] = node
+}
+
+// Invalidate records that node f's cached result was invalidated by
+// its assertions.
+func (p *planner) Invalidate(f *Flow) {
+	p.mu.Lock()
+	p.invalidated[f] = true
+	p.mu.Unlock()
+}
+
+// Partial records that the plan is incomplete.
+func (p *planner) Partial() {
+	p.mu.Lock()
+	p.partial = true
+	p.mu.Unlock()
+}
+
+// Plan returns the accumulated plan.
+func (p *planner) Plan() *Plan {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	plan := &Plan{Partial: p.partial}
+	for _, node := range p.nodes {
+		plan.Nodes = append(plan.Nodes, node)
+	}
+	sort.Slice(plan.Nodes, func(i, j int) bool {
+		if plan.Nodes[i].Ident != plan.Nodes[j].Ident {
+			return plan.Nodes[i].Ident < plan.Nodes[j].Ident
+		}
+		return plan.Nodes[i].Digest.Less(plan.Nodes[j].Digest)
+	})
+	return plan
+}
+
+// plan completes node f, which would otherwise be executed, during
+// a dry run.
+func (e *Eval) plan(f *Flow) {
+	state, size := PlanExec, int64(0)
+	switch f.Op {
+	case Intern:
+		state = PlanTransfer
+	case Extern:
+		state = PlanTransfer
+		if dep := f.Deps[0]; dep.State == Done && dep.Err == nil {
+			size = dep.Value.(reflow.Fileset).Size()
+		}
+	}
+	e.planner.Add(f, state, size)
+	e.Mutate(f, errDryRun, Done)
+}
+
+// Plan returns the plan computed by a dry run evaluation. Plan should
+// be called only after Do has returned.
+func (e *Eval) Plan() *Plan {
+	if e.planner == nil {
+		return nil
+	}
+	return e.planner.Plan()
+}
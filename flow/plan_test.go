@@ -0,0 +1,111 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package flow_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/grailbio/base/digest"
+	"github.com/grailbio/reflow"
+	"github.com/grailbio/reflow/flow"
+	"github.com/grailbio/reflow/infra"
+	op "github.com/grailbio/reflow/test/flow"
+	"github.com/grailbio/reflow/test/testutil"
+)
+
+func newDryRunEval(root *flow.Flow) *flow.Eval {
+	return flow.NewEval(root, flow.EvalConfig{
+		DryRun:             true,
+		CacheMode:          infra.CacheRead | infra.CacheWrite,
+		Assoc:              testutil.NewInmemoryAssoc(),
+		AssertionGenerator: newTestGenerator(map[string]string{"c": "v1"}),
+		Assert:             reflow.AssertExact,
+		Repository:         testutil.NewInmemoryRepository(),
+		Log:                logger(),
+		Trace:              logger(),
+	})
+}
+
+func TestDryRun(t *testing.T) {
+	intern := op.Intern("internurl")
+	cached := op.Exec("image", "cached", testutil.Resources, intern)
+	exec := op.Exec("image", "exec", testutil.Resources, cached)
+	invalid := op.Exec("image", "invalid", testutil.Resources, intern)
+	extern := op.Extern("externurl", op.Merge(exec, invalid))
+	testutil.AssignExecId(nil, intern, cached, exec, invalid, extern)
+
+	eval := newDryRunEval(extern)
+	testutil.WriteCache(eval, cached.Digest(), "a")
+	fs := testutil.WriteFiles(eval.Repository, "c")
+	_ = fs.AddAssertions(reflow.AssertionsFromEntry(
+		reflow.AssertionKey{Subject: "c", Namespace: "namespace"}, map[string]string{"tag": "v2"}))
+	testutil.WriteCacheFileset(eval, invalid.Digest(), fs)
+
+	if err := eval.Do(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := eval.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if eval.CacheMode.Writing() {
+		t.Error("dry runs should not write to the cache")
+	}
+	plan := eval.Plan()
+	if plan.Partial {
+		t.Error("unexpected partial plan")
+	}
+	states := make(map[digest.Digest]flow.PlanState)
+	for _, node := range plan.Nodes {
+		states[node.Digest] = node.State
+	}
+	for _, c := range []struct {
+		f     *flow.Flow
+		state flow.PlanState
+	}{
+		{intern, flow.PlanTransfer},
+		{cached, flow.PlanCache},
+		{exec, flow.PlanExec},
+		{invalid, flow.PlanInvalidated},
+		{extern, flow.PlanTransfer},
+	} {
+		state, ok := states[c.f.Digest()]
+		if !ok {
+			t.Errorf("%v: missing from plan", c.f)
+			continue
+		}
+		if got, want := state, c.state; got != want {
+			t.Errorf("%v: got %v, want %v", c.f, got, want)
+		}
+	}
+	if got, want := len(plan.Nodes), 5; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	var want reflow.Resources
+	want.Add(testutil.Resources, testutil.Resources)
+	if got := plan.Resources(); !got.Equal(want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestDryRunPartial(t *testing.T) {
+	exec := op.Exec("image", "exec", testutil.Resources)
+	mapped := op.Map(func(f *flow.Flow) *flow.Flow {
+		return op.Exec("image", "mapped", testutil.Resources, f)
+	}, exec)
+	testutil.AssignExecId(nil, exec, mapped)
+
+	eval := newDryRunEval(mapped)
+	if err := eval.Do(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	plan := eval.Plan()
+	if !plan.Partial {
+		t.Error("expected partial plan")
+	}
+	if got, want := plan.Count(flow.PlanExec), 1; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
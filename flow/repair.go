@@ -253,6 +253,13 @@ func (r *Repair) eval(f *Flow) {
 			},
 		}
 		f.State = Done
+	case Contents:
+		if v, err := repositoryContents(context.Background(), r.Repository, f.Deps[0].Value.(reflow.File)); err != nil {
+			f.Err = errors.Recover(err)
+		} else {
+			f.Value = v
+		}
+		f.State = Done
 	default:
 		panic(fmt.Sprintf("bug %v", f))
 	}
@@ -0,0 +1,95 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package flow
+
+import (
+	"fmt"
+
+	"github.com/grailbio/reflow"
+	"github.com/grailbio/reflow/errors"
+)
+
+// RetryPolicy determines how an exec that fails is retried by the
+// evaluator. Execs that fail with transient errors (for example,
+// because their alloc was lost, or because of errors from the
+// container runtime) are retried with the same resources; execs that
+// run out of memory are retried with more memory. Execs that exceed
+// their timeout are retried only if the policy's Timeouts is set.
+//
+// Retry policies apply only when the evaluator runs tasks through a
+// scheduler (Eval.Scheduler). Otherwise, as with local evaluation,
+// each step of an exec is merely retried a few times on error, with
+// the same resources.
+type RetryPolicy struct {
+	// Retries is the maximum number of times an exec is retried.
+	Retries int
+	// MemFactor is the factor by which an exec's memory is
+	// multiplied each time it is retried after running out of memory.
+	MemFactor float64
+	// MaxMem is the maximum amount of memory, in bytes, an exec
+	// is given when retried. MaxMem is not enforced if it is zero.
+	MaxMem float64
+	// Timeouts determines whether execs that exceed their timeout
+	// (for example, because of a stuck network mount) are retried.
+	Timeouts bool
+}
+
+// DefaultRetryPolicy is the retry policy of execs that do not
+// define their own.
+var DefaultRetryPolicy = RetryPolicy{Retries: 3, MemFactor: 1.5}
+
+// String returns a human-readable description of the retry policy.
+func (p RetryPolicy) String() string {
+	s := fmt.Sprintf("retries:%d memfactor:%g", p.Retries, p.MemFactor)
+	if p.MaxMem > 0 {
+		s += fmt.Sprintf(" maxmem:%g", p.MaxMem)
+	}
+	if p.Timeouts {
+		s += " timeouts"
+	}
+	return s
+}
+
+// Next determines whether the attempt'th attempt (counting from
+// zero) of an exec that was given the provided resources and failed
+// with err should be retried. If so, Next returns the resources that
+// should be reserved for the next attempt, and whether the exec ran
+// out of memory.
+func (p RetryPolicy) Next(attempt int, resources reflow.Resources, err error) (next reflow.Resources, oom, ok bool) {
+	if err == nil || attempt >= p.Retries {
+		return nil, false, false
+	}
+	switch {
+	case errors.Is(errors.OOM, err):
+		mem := resources["mem"]
+		if p.MaxMem > 0 && mem >= p.MaxMem {
+			return nil, true, false
+		}
+		if p.MemFactor > 1 {
+			mem *= p.MemFactor
+		}
+		if p.MaxMem > 0 && mem > p.MaxMem {
+			mem = p.MaxMem
+		}
+		next = make(reflow.Resources)
+		next.Set(resources)
+		next["mem"] = mem
+		return next, true, true
+	case errors.Restartable(err), p.Timeouts && errors.Is(errors.ExecTimeout, err):
+		next = make(reflow.Resources)
+		next.Set(resources)
+		return next, false, true
+	default:
+		return nil, false, false
+	}
+}
+
+// RetryPolicy returns the retry policy for flow f.
+func (f *Flow) RetryPolicy() RetryPolicy {
+	if f.Retry != nil {
+		return *f.Retry
+	}
+	return DefaultRetryPolicy
+}
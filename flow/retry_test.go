@@ -0,0 +1,143 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package flow_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/grailbio/base/digest"
+	"github.com/grailbio/reflow"
+	"github.com/grailbio/reflow/errors"
+	"github.com/grailbio/reflow/flow"
+	op "github.com/grailbio/reflow/test/flow"
+	"github.com/grailbio/reflow/test/testutil"
+)
+
+func TestRetryPolicyNext(t *testing.T) {
+	var (
+		policy    = flow.RetryPolicy{Retries: 2, MemFactor: 2, MaxMem: 3 << 30}
+		resources = reflow.Resources{"mem": 1 << 30, "cpu": 1}
+		oom       = errors.E(errors.OOM, "killed")
+		transient = errors.E(errors.Unavailable, "daemon unavailable")
+		timeout   = errors.E(errors.ExecTimeout, "killed")
+	)
+	for _, c := range []struct {
+		attempt   int
+		resources reflow.Resources
+		err       error
+		want      reflow.Resources
+		oom, ok   bool
+	}{
+		{0, resources, nil, nil, false, false},
+		{0, resources, errors.E(errors.Invalid, "bad"), nil, false, false},
+		{0, resources, transient, resources, false, true},
+		{0, resources, oom, reflow.Resources{"mem": 2 << 30, "cpu": 1}, true, true},
+		{1, reflow.Resources{"mem": 2 << 30}, oom, reflow.Resources{"mem": 3 << 30}, true, true},
+		{1, reflow.Resources{"mem": 3 << 30}, oom, nil, true, false},
+		{2, resources, transient, nil, false, false},
+		{1, resources, timeout, nil, false, false},
+	} {
+		next, oom, ok := policy.Next(c.attempt, c.resources, c.err)
+		if got, want := ok, c.ok; got != want {
+			t.Errorf("%d %v: got %v, want %v", c.attempt, c.err, got, want)
+			continue
+		}
+		if got, want := oom, c.oom; got != want {
+			t.Errorf("%d %v: got oom %v, want %v", c.attempt, c.err, got, want)
+		}
+		if ok && !next.Equal(c.want) {
+			t.Errorf("%d %v: got %v, want %v", c.attempt, c.err, next, c.want)
+		}
+	}
+	// Timeouts are retried only if the policy says so.
+	policy.Timeouts = true
+	if next, _, ok := policy.Next(1, resources, timeout); !ok || !next.Equal(resources) {
+		t.Errorf("got %v, %v, want %v, true", next, ok, resources)
+	}
+	if _, _, ok := policy.Next(2, resources, timeout); ok {
+		t.Error("expected no retry")
+	}
+}
+
+// waitExec waits for the executor to define a new exec (i.e., one
+// not in seen), which it returns.
+func waitExec(t *testing.T, e *testutil.Executor, seen map[digest.Digest]bool) *testutil.Exec {
+	t.Helper()
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		execs, _ := e.Execs(context.Background())
+		for _, x := range execs {
+			if !seen[x.ID()] {
+				seen[x.ID()] = true
+				return x.(*testutil.Exec)
+			}
+		}
+	}
+	t.Fatal("timed out waiting for exec")
+	return nil
+}
+
+func TestSchedulerRetry(t *testing.T) {
+	e, config, done := newTestScheduler()
+	defer done()
+
+	exec := op.Exec("image", "command", testutil.Resources)
+	exec.Retry = &flow.RetryPolicy{Retries: 3, MemFactor: 1.5, MaxMem: 900 << 20}
+	testutil.AssignExecIdRandom(exec)
+
+	eval := flow.NewEval(exec, config)
+	rc := testutil.EvalAsync(context.Background(), eval)
+	seen := make(map[digest.Digest]bool)
+	for _, c := range []struct {
+		mem float64
+		err error
+	}{
+		{500 << 20, errors.E(errors.Unavailable, "daemon unavailable")},
+		{500 << 20, errors.E(errors.OOM, "killed")},
+		{750 << 20, errors.E(errors.OOM, "killed")},
+		{900 << 20, errors.E(errors.OOM, "killed")},
+	} {
+		x := waitExec(t, &e.Executor, seen)
+		if got, want := x.Config().Resources["mem"], c.mem; got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+		x.Ok(reflow.Result{Err: errors.Recover(c.err)})
+	}
+	r := <-rc
+	if r.Err == nil {
+		t.Fatal("expected error")
+	}
+	if !errors.Is(errors.OOM, r.Err) {
+		t.Errorf("expected OOM error, got %v", r.Err)
+	}
+}
+
+func TestSchedulerExecTimeout(t *testing.T) {
+	e, config, done := newTestScheduler()
+	defer done()
+	config.ExecTimeout = time.Hour
+
+	exec := op.Exec("image", "command", testutil.Resources)
+	exec.Retry = &flow.RetryPolicy{Retries: 1, Timeouts: true}
+	testutil.AssignExecIdRandom(exec)
+	eval := flow.NewEval(exec, config)
+	rc := testutil.EvalAsync(context.Background(), eval)
+	seen := make(map[digest.Digest]bool)
+	for i := 0; i < 2; i++ {
+		x := waitExec(t, &e.Executor, seen)
+		if got, want := x.Config().Timeout, time.Hour; got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+		x.Ok(reflow.Result{Err: errors.Recover(errors.E(errors.ExecTimeout, "killed"))})
+	}
+	r := <-rc
+	if r.Err == nil {
+		t.Fatal("expected error")
+	}
+	if !errors.Is(errors.ExecTimeout, r.Err) {
+		t.Errorf("expected exec timeout error, got %v", r.Err)
+	}
+}
@@ -20,6 +20,7 @@ require (
 	github.com/grailbio/base v0.0.7-0.20191216215904-c504fd73cad7
 	github.com/grailbio/infra v0.0.1
 	github.com/grailbio/testutil v0.0.3
+	github.com/mattn/go-sqlite3 v1.11.0
 	github.com/opencontainers/go-digest v1.0.0-rc1 // indirect
 	github.com/opencontainers/image-spec v1.0.1 // indirect
 	github.com/sirupsen/logrus v1.3.0 // indirect
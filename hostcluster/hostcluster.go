@@ -0,0 +1,455 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+// Package hostcluster implements a Reflow cluster made up of a
+// static list of reflowlets, for example reflowlets started with
+// "reflow serve" on machines that are managed outside of Reflow.
+//
+// The cluster periodically checks the health of each reflowlet
+// through its pool REST API; only healthy reflowlets participate in
+// the cluster's pool. Reflowlets may be cordoned, so that they no
+// longer accept new allocs, and drained, so that their existing
+// allocs complete before they are taken out of service. Hosts are
+// administered through the cluster's HTTP handler (see ServeHTTP),
+// which the reflow command serves on its diagnostic HTTP server
+// (flag -http) under /hostcluster/.
+package hostcluster
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grailbio/base/status"
+	"github.com/grailbio/base/traverse"
+	"github.com/grailbio/infra"
+	"github.com/grailbio/infra/tls"
+	"github.com/grailbio/reflow"
+	"github.com/grailbio/reflow/errors"
+	"github.com/grailbio/reflow/internal/clusterutil"
+	"github.com/grailbio/reflow/log"
+	"github.com/grailbio/reflow/pool"
+	"github.com/grailbio/reflow/pool/client"
+	"golang.org/x/net/http2"
+)
+
+func init() {
+	infra.Register("hostcluster", new(Cluster))
+}
+
+const (
+	defaultPort           = 9000
+	defaultHealthInterval = 30 * time.Second
+	healthTimeout         = 10 * time.Second
+	allocateTimeout       = 30 * time.Second
+)
+
+// A Cluster implements a runner.Cluster on top of a fixed set of
+// reflowlets. Allocations are placed on the healthy, uncordoned
+// reflowlets; when none has enough free resources, Allocate waits
+// until resources are freed, so that the cluster applies back-pressure
+// instead of failing runs.
+type Cluster struct {
+	clusterutil.Mux `yaml:"-"`
+	// HTTPClient is used to communicate with the reflowlets.
+	HTTPClient *http.Client `yaml:"-"`
+	// Log is used to report cluster events.
+	Log *log.Logger `yaml:"-"`
+	// Status is used to report cluster status.
+	Status *status.Group `yaml:"-"`
+
+	// Hosts is the list of reflowlet endpoints that make up the
+	// cluster. Each endpoint is either a host name, optionally
+	// followed by a port (default 9000), or the base URL of the
+	// reflowlet's API, e.g., https://host:9000/v1/.
+	Hosts []string `yaml:"hosts"`
+	// Cordoned is the list of endpoints (from Hosts) that are
+	// initially cordoned.
+	Cordoned []string `yaml:"cordoned,omitempty"`
+	// HealthInterval is the interval between health checks, as parsed
+	// by time.ParseDuration. It defaults to 30s.
+	HealthInterval string `yaml:"healthinterval,omitempty"`
+
+	interval time.Duration
+
+	mu    sync.Mutex
+	nodes []*node
+}
+
+// A node is a single reflowlet in the cluster.
+type node struct {
+	// name is the endpoint as configured.
+	name string
+	pool pool.Pool
+
+	healthy  bool
+	cordoned bool
+	err      error
+	// capacity is the total amount of resources of the reflowlet,
+	// as of the last successful health check; nil if unknown.
+	capacity reflow.Resources
+	// nalloc is the number of allocs on the reflowlet, as of the
+	// last successful health check.
+	nalloc int
+}
+
+// Help implements infra.Provider.
+func (*Cluster) Help() string {
+	return "configure a cluster from a static list of reflowlets"
+}
+
+// Config implements infra.Provider.
+func (c *Cluster) Config() interface{} {
+	return c
+}
+
+// Init implements infra.Provider. The cluster is maintained for the
+// lifetime of the process.
+func (c *Cluster) Init(tls tls.Certs, logger *log.Logger) error {
+	clientConfig, _, err := tls.HTTPS()
+	if err != nil {
+		return err
+	}
+	transport := &http.Transport{TLSClientConfig: clientConfig}
+	if err := http2.ConfigureTransport(transport); err != nil {
+		return err
+	}
+	c.HTTPClient = &http.Client{Transport: transport}
+	c.Log = logger.Tee(nil, "hostcluster: ")
+	return c.initialize(context.Background(), func(host string) (pool.Pool, error) {
+		baseurl, err := hostURL(host)
+		if err != nil {
+			return nil, err
+		}
+		return client.New(baseurl, c.HTTPClient, nil)
+	})
+}
+
+// hostURL returns the base URL of the reflowlet API served at host.
+func hostURL(host string) (string, error) {
+	if strings.Contains(host, "://") {
+		u, err := url.Parse(host)
+		if err != nil {
+			return "", err
+		}
+		if u.Path == "" || u.Path == "/" {
+			u.Path = "/v1/"
+		} else if !strings.HasSuffix(u.Path, "/") {
+			u.Path += "/"
+		}
+		return u.String(), nil
+	}
+	if host == "" || strings.Contains(host, "/") {
+		return "", errors.Errorf("invalid host %q", host)
+	}
+	if !strings.Contains(host, ":") {
+		host = fmt.Sprintf("%s:%d", host, defaultPort)
+	}
+	return "https://" + host + "/v1/", nil
+}
+
+// initialize sets up the cluster's nodes using the provided dial
+// function, performs an initial health check, and then maintains the
+// cluster until the provided context is done.
+func (c *Cluster) initialize(ctx context.Context, dial func(host string) (pool.Pool, error)) error {
+	if len(c.Hosts) == 0 {
+		return errors.New("no hosts configured")
+	}
+	c.interval = defaultHealthInterval
+	if c.HealthInterval != "" {
+		d, err := time.ParseDuration(c.HealthInterval)
+		if err != nil {
+			return errors.E("healthinterval", c.HealthInterval, err)
+		}
+		if d <= 0 {
+			return errors.Errorf("healthinterval %s: must be positive", d)
+		}
+		c.interval = d
+	}
+	cordoned := make(map[string]bool)
+	for _, host := range c.Cordoned {
+		cordoned[host] = true
+	}
+	seen := make(map[string]bool)
+	c.nodes = nil
+	for _, host := range c.Hosts {
+		p, err := dial(host)
+		if err != nil {
+			return errors.E("host", host, err)
+		}
+		if seen[p.ID()] {
+			return errors.Errorf("host %s: duplicate reflowlet %s", host, p.ID())
+		}
+		seen[p.ID()] = true
+		n := &node{name: host, pool: p, cordoned: cordoned[host] || cordoned[p.ID()]}
+		delete(cordoned, host)
+		delete(cordoned, p.ID())
+		c.nodes = append(c.nodes, n)
+	}
+	for host := range cordoned {
+		return errors.Errorf("cordoned host %s is not in the list of hosts", host)
+	}
+	c.check(ctx)
+	go clusterutil.Maintain(ctx, c.interval, c.check)
+	return nil
+}
+
+// check checks the health of every node in the cluster, updates the
+// set of pools, and wakes up waiting allocations. A node is healthy
+// if its offers and allocs can be listed within the health timeout.
+func (c *Cluster) check(ctx context.Context) {
+	type result struct {
+		capacity reflow.Resources
+		nalloc   int
+		err      error
+	}
+	c.mu.Lock()
+	nodes := append([]*node(nil), c.nodes...)
+	c.mu.Unlock()
+	results := make([]result, len(nodes))
+	_ = traverse.Each(len(nodes), func(i int) error {
+		ctx, cancel := context.WithTimeout(ctx, healthTimeout)
+		defer cancel()
+		r := &results[i]
+		offers, err := nodes[i].pool.Offers(ctx)
+		if err != nil {
+			r.err = err
+			return nil
+		}
+		allocs, err := nodes[i].pool.Allocs(ctx)
+		if err != nil {
+			r.err = err
+			return nil
+		}
+		r.capacity = make(reflow.Resources)
+		for _, o := range offers {
+			r.capacity.Add(r.capacity, o.Available())
+		}
+		for _, a := range allocs {
+			r.capacity.Add(r.capacity, a.Resources())
+		}
+		r.nalloc = len(allocs)
+		return nil
+	})
+	if ctx.Err() != nil {
+		return
+	}
+	c.mu.Lock()
+	for i, n := range nodes {
+		r := results[i]
+		switch {
+		case r.err != nil && n.healthy:
+			c.Log.Errorf("host %s is unhealthy: %v", n.name, r.err)
+		case r.err == nil && !n.healthy:
+			c.Log.Printf("host %s is healthy: resources%s allocs:%d", n.name, r.capacity, r.nalloc)
+		}
+		n.healthy, n.err = r.err == nil, r.err
+		if r.err == nil {
+			n.capacity, n.nalloc = r.capacity, r.nalloc
+		}
+	}
+	c.updateLocked()
+	c.mu.Unlock()
+}
+
+// updateLocked sets the cluster's pools to its healthy nodes. It
+// must be called with c.mu held.
+func (c *Cluster) updateLocked() {
+	var (
+		pools    []pool.Pool
+		total    reflow.Resources
+		cordoned int
+	)
+	for _, n := range c.nodes {
+		if n.healthy {
+			pools = append(pools, n.pool)
+			total.Add(total, n.capacity)
+		}
+		if n.cordoned {
+			cordoned++
+		}
+	}
+	c.Set(pools)
+	c.Status.Printf("%d hosts: healthy:%d, cordoned:%d, total%s", len(c.nodes), len(pools), cordoned, total)
+}
+
+// Offers returns the current offers of the cluster's healthy,
+// uncordoned reflowlets.
+func (c *Cluster) Offers(ctx context.Context) ([]pool.Offer, error) {
+	offers, err := c.Mux.Offers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var filtered []pool.Offer
+	for _, o := range offers {
+		if n := c.lookupLocked(o.Pool().ID()); n == nil || !n.cordoned {
+			filtered = append(filtered, o)
+		}
+	}
+	return filtered, nil
+}
+
+// Offer looks up the offer named by the given URI. Offers from
+// cordoned reflowlets do not exist.
+func (c *Cluster) Offer(ctx context.Context, uri string) (pool.Offer, error) {
+	c.mu.Lock()
+	n := c.lookupLocked(strings.SplitN(uri, "/", 2)[0])
+	cordoned := n != nil && n.cordoned
+	c.mu.Unlock()
+	if cordoned {
+		return nil, errors.E("offer", uri, errors.NotExist, errors.New("host is cordoned"))
+	}
+	return c.Mux.Offer(ctx, uri)
+}
+
+// Allocate reserves an alloc within the resource requirement
+// boundaries from one of the cluster's reflowlets. If no reflowlet
+// currently has sufficient resources available, Allocate waits until
+// resources are freed or the provided context is done. Allocate fails
+// with errors.ResourcesExhausted if no uncordoned reflowlet is large
+// enough to ever satisfy the requirements.
+func (c *Cluster) Allocate(ctx context.Context, req reflow.Requirements, labels pool.Labels) (pool.Alloc, error) {
+	c.Log.Debugf("allocate %s", req)
+	for {
+		wait := c.Wait()
+		c.mu.Lock()
+		fits := c.fitsLocked(req.Min)
+		c.mu.Unlock()
+		if !fits {
+			return nil, errors.E(errors.ResourcesExhausted,
+				errors.Errorf("requested resources %s not satisfiable by any uncordoned host", req))
+		}
+		actx, cancel := context.WithTimeout(ctx, allocateTimeout)
+		alloc, err := pool.Allocate(actx, c, req, labels)
+		cancel()
+		if err == nil {
+			return c.NotifyFree(alloc), nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if !errors.Is(errors.Unavailable, err) {
+			c.Log.Errorf("allocate %s: %v", req, err)
+		}
+		c.Log.Debugf("allocate %s: waiting for resources", req)
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// fitsLocked tells whether an uncordoned node could accommodate an
+// alloc of at least min resources. Nodes whose capacity is not yet
+// known are assumed to fit. It must be called with c.mu held.
+func (c *Cluster) fitsLocked(min reflow.Resources) bool {
+	for _, n := range c.nodes {
+		if n.cordoned {
+			continue
+		}
+		if n.capacity == nil || n.capacity.Available(min) {
+			return true
+		}
+	}
+	return false
+}
+
+// Cordon marks the named host so that it no longer accepts new
+// allocs. Existing allocs are unaffected. Hosts are named either as
+// configured or by their pool ID.
+func (c *Cluster) Cordon(host string) error {
+	return c.setCordoned(host, true)
+}
+
+// Uncordon makes a cordoned host accept new allocs again.
+func (c *Cluster) Uncordon(host string) error {
+	return c.setCordoned(host, false)
+}
+
+func (c *Cluster) setCordoned(host string, cordoned bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := c.lookupLocked(host)
+	if n == nil {
+		return errors.E("cordon", host, errors.NotExist)
+	}
+	if n.cordoned == cordoned {
+		return nil
+	}
+	n.cordoned = cordoned
+	if cordoned {
+		c.Log.Printf("host %s cordoned", n.name)
+	} else {
+		c.Log.Printf("host %s uncordoned", n.name)
+	}
+	c.updateLocked()
+	return nil
+}
+
+// Drain cordons the named host and then waits until all of its
+// allocs have been freed or have expired, or until the provided
+// context is done.
+func (c *Cluster) Drain(ctx context.Context, host string) error {
+	if err := c.Cordon(host); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	n := c.lookupLocked(host)
+	c.mu.Unlock()
+	for {
+		wait := c.Wait()
+		allocs, err := n.pool.Allocs(ctx)
+		if err == nil && len(allocs) == 0 {
+			c.Log.Printf("host %s drained", n.name)
+			return nil
+		}
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return errors.E("drain", host, ctx.Err())
+		}
+	}
+}
+
+// HostStatus returns a description of the state of each of the cluster's
+// hosts.
+func (c *Cluster) HostStatus() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	status := make([]string, len(c.nodes))
+	for i, n := range c.nodes {
+		var state string
+		switch {
+		case !n.healthy && n.err != nil:
+			state = fmt.Sprintf("unhealthy (%v)", n.err)
+		case !n.healthy:
+			state = "unknown"
+		default:
+			state = fmt.Sprintf("healthy resources%s allocs:%d", n.capacity, n.nalloc)
+		}
+		if n.cordoned {
+			state += " cordoned"
+		}
+		status[i] = fmt.Sprintf("%s: %s", n.name, state)
+	}
+	return status
+}
+
+// lookupLocked returns the node named by host, either as configured
+// or by its pool ID. It must be called with c.mu held.
+func (c *Cluster) lookupLocked(host string) *node {
+	for _, n := range c.nodes {
+		if n.name == host || n.pool.ID() == host {
+			return n
+		}
+	}
+	return nil
+}
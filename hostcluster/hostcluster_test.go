@@ -0,0 +1,346 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package hostcluster
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/grailbio/reflow"
+	"github.com/grailbio/reflow/errors"
+	"github.com/grailbio/reflow/log"
+	"github.com/grailbio/reflow/pool"
+)
+
+// testPool is a pool with a fixed amount of resources, from which
+// a single offer of all available resources is made.
+type testPool struct {
+	id        string
+	resources reflow.Resources
+
+	mu     sync.Mutex
+	down   bool
+	allocs map[string]*testAlloc
+	nalloc int
+}
+
+func newTestPool(id string, resources reflow.Resources) *testPool {
+	return &testPool{id: id, resources: resources, allocs: make(map[string]*testAlloc)}
+}
+
+func (p *testPool) ID() string { return p.id }
+
+func (p *testPool) setDown(down bool) {
+	p.mu.Lock()
+	p.down = down
+	p.mu.Unlock()
+}
+
+func (p *testPool) Alloc(ctx context.Context, id string) (pool.Alloc, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if a := p.allocs[id]; a != nil {
+		return a, nil
+	}
+	return nil, errors.E("alloc", id, errors.NotExist)
+}
+
+func (p *testPool) Allocs(ctx context.Context) ([]pool.Alloc, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.down {
+		return nil, errors.E(errors.Unavailable, errors.New("down"))
+	}
+	var allocs []pool.Alloc
+	for _, a := range p.allocs {
+		allocs = append(allocs, a)
+	}
+	return allocs, nil
+}
+
+func (p *testPool) Offer(ctx context.Context, id string) (pool.Offer, error) {
+	return nil, errors.E("offer", id, errors.NotExist)
+}
+
+func (p *testPool) Offers(ctx context.Context) ([]pool.Offer, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.down {
+		return nil, errors.E(errors.Unavailable, errors.New("down"))
+	}
+	var avail reflow.Resources
+	avail.Set(p.resources)
+	for _, a := range p.allocs {
+		avail.Sub(avail, a.resources)
+	}
+	if avail["cpu"] <= 0 {
+		return nil, nil
+	}
+	return []pool.Offer{&testOffer{p, avail}}, nil
+}
+
+type testOffer struct {
+	pool      *testPool
+	available reflow.Resources
+}
+
+func (o *testOffer) ID() string                  { return o.pool.id + "/offer" }
+func (o *testOffer) Pool() pool.Pool             { return o.pool }
+func (o *testOffer) Available() reflow.Resources { return o.available }
+
+func (o *testOffer) Accept(ctx context.Context, meta pool.AllocMeta) (pool.Alloc, error) {
+	p := o.pool
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.nalloc++
+	a := &testAlloc{pool: p, id: fmt.Sprint(p.nalloc), resources: meta.Want}
+	p.allocs[a.id] = a
+	return a, nil
+}
+
+type testAlloc struct {
+	pool.Alloc
+	pool      *testPool
+	id        string
+	resources reflow.Resources
+}
+
+func (a *testAlloc) ID() string                  { return a.pool.id + "/" + a.id }
+func (a *testAlloc) Pool() pool.Pool             { return a.pool }
+func (a *testAlloc) Resources() reflow.Resources { return a.resources }
+
+func (a *testAlloc) Free(ctx context.Context) error {
+	a.pool.mu.Lock()
+	delete(a.pool.allocs, a.id)
+	a.pool.mu.Unlock()
+	return nil
+}
+
+func newTestCluster(t *testing.T, pools ...*testPool) (*Cluster, context.CancelFunc) {
+	t.Helper()
+	byID := make(map[string]*testPool)
+	c := &Cluster{Log: log.Std, HealthInterval: "1h"}
+	for _, p := range pools {
+		byID[p.id] = p
+		c.Hosts = append(c.Hosts, p.id)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	err := c.initialize(ctx, func(host string) (pool.Pool, error) {
+		return byID[host], nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, cancel
+}
+
+func resources(cpu float64) reflow.Resources {
+	return reflow.Resources{"cpu": cpu, "mem": 1 << 30, "disk": 1 << 30}
+}
+
+func requirements(cpu float64) reflow.Requirements {
+	return reflow.Requirements{Min: reflow.Resources{"cpu": cpu}}
+}
+
+func TestHostURL(t *testing.T) {
+	for _, c := range []struct{ host, url string }{
+		{"worker1", "https://worker1:9000/v1/"},
+		{"worker1:8000", "https://worker1:8000/v1/"},
+		{"https://worker1:9000", "https://worker1:9000/v1/"},
+		{"http://worker1:9000/api/v1", "http://worker1:9000/api/v1/"},
+	} {
+		u, err := hostURL(c.host)
+		if err != nil {
+			t.Errorf("%s: %v", c.host, err)
+			continue
+		}
+		if got, want := u, c.url; got != want {
+			t.Errorf("%s: got %v, want %v", c.host, got, want)
+		}
+	}
+	if _, err := hostURL("worker1/v1"); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestHealth(t *testing.T) {
+	p1, p2 := newTestPool("p1", resources(4)), newTestPool("p2", resources(8))
+	c, cancel := newTestCluster(t, p1, p2)
+	defer cancel()
+	if got, want := c.Size(), 2; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	p2.setDown(true)
+	c.check(context.Background())
+	if got, want := c.Size(), 1; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if got, want := c.Pools()[0].ID(), "p1"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	p2.setDown(false)
+	c.check(context.Background())
+	if got, want := c.Size(), 2; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestAllocateBackPressure(t *testing.T) {
+	p := newTestPool("p", resources(4))
+	c, cancel := newTestCluster(t, p)
+	defer cancel()
+	ctx := context.Background()
+	alloc, err := c.Allocate(ctx, requirements(4), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Allocate(ctx, requirements(8), nil); !errors.Is(errors.ResourcesExhausted, err) {
+		t.Errorf("expected resources exhausted, got %v", err)
+	}
+
+	// The second allocation waits until the first is freed.
+	type result struct {
+		alloc pool.Alloc
+		err   error
+	}
+	resultc := make(chan result)
+	go func() {
+		alloc, err := c.Allocate(ctx, requirements(2), nil)
+		resultc <- result{alloc, err}
+	}()
+	select {
+	case r := <-resultc:
+		t.Fatalf("allocation did not wait: %v, %v", r.alloc, r.err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if err := alloc.Free(ctx); err != nil {
+		t.Fatal(err)
+	}
+	r := <-resultc
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	if got, want := r.alloc.Resources()["cpu"], 2.0; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// A waiting allocation is abandoned when its context is done.
+	ctx, cancelAlloc := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancelAlloc()
+	if _, err := c.Allocate(ctx, requirements(3), nil); err != context.DeadlineExceeded {
+		t.Errorf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestCordonDrain(t *testing.T) {
+	p1, p2 := newTestPool("p1", resources(4)), newTestPool("p2", resources(4))
+	c, cancel := newTestCluster(t, p1, p2)
+	defer cancel()
+	ctx := context.Background()
+	if err := c.Cordon("p1"); err != nil {
+		t.Fatal(err)
+	}
+	offers, err := c.Offers(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(offers), 1; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if got, want := offers[0].Pool().ID(), "p2"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if err := c.Cordon("p3"); !errors.Is(errors.NotExist, err) {
+		t.Errorf("expected not exist, got %v", err)
+	}
+	if err := c.Uncordon("p1"); err != nil {
+		t.Fatal(err)
+	}
+
+	alloc, err := c.Allocate(ctx, reflow.Requirements{Min: resources(4)}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	host := alloc.Pool().ID()
+	drained := make(chan error)
+	go func() { drained <- c.Drain(ctx, host) }()
+	select {
+	case err := <-drained:
+		t.Fatalf("drain did not wait: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	// The draining host is cordoned, so new allocs go elsewhere.
+	other, err := c.Allocate(ctx, requirements(1), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.Pool().ID() == host {
+		t.Errorf("allocated on draining host %s", host)
+	}
+	if err := alloc.Free(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-drained; err != nil {
+		t.Fatal(err)
+	}
+
+	// With every host cordoned, no allocation can be satisfied.
+	if err := c.Cordon(other.Pool().ID()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Allocate(ctx, requirements(1), nil); !errors.Is(errors.ResourcesExhausted, err) {
+		t.Errorf("expected resources exhausted, got %v", err)
+	}
+}
+
+func TestHTTP(t *testing.T) {
+	p1, p2 := newTestPool("p1", resources(4)), newTestPool("p2", resources(4))
+	c, cancel := newTestCluster(t, p1, p2)
+	defer cancel()
+	do := func(method, url string) (int, string) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		c.ServeHTTP(w, httptest.NewRequest(method, url, nil))
+		return w.Code, w.Body.String()
+	}
+	if code, body := do("POST", "/hostcluster/cordon?host=p1"); code != http.StatusOK {
+		t.Fatalf("cordon: %d %s", code, body)
+	}
+	code, body := do("GET", "/hostcluster/hosts")
+	if code != http.StatusOK {
+		t.Fatalf("hosts: %d %s", code, body)
+	}
+	if want := "p1: healthy resources{mem:1.0GiB cpu:4 disk:1.0GiB} allocs:0 cordoned\n"; !strings.HasPrefix(body, want) {
+		t.Errorf("got %q, want prefix %q", body, want)
+	}
+	if code, body := do("POST", "/hostcluster/uncordon?host=p1"); code != http.StatusOK {
+		t.Fatalf("uncordon: %d %s", code, body)
+	}
+	if code, body := do("POST", "/hostcluster/drain?host=p2"); code != http.StatusOK {
+		t.Fatalf("drain: %d %s", code, body)
+	}
+	for _, test := range []struct {
+		method, url string
+		code        int
+	}{
+		{"POST", "/hostcluster/cordon?host=p3", http.StatusNotFound},
+		{"POST", "/hostcluster/cordon", http.StatusBadRequest},
+		{"GET", "/hostcluster/cordon?host=p1", http.StatusMethodNotAllowed},
+		{"POST", "/hostcluster/reboot?host=p1", http.StatusNotFound},
+	} {
+		if code, body := do(test.method, test.url); code != test.code {
+			t.Errorf("%s %s: got %d (%s), want %d", test.method, test.url, code, body, test.code)
+		}
+	}
+	if got, want := c.HostStatus()[1], "cordoned"; !strings.HasSuffix(got, want) {
+		t.Errorf("got %q, want suffix %q", got, want)
+	}
+}
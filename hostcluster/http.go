@@ -0,0 +1,67 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package hostcluster
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+
+	"github.com/grailbio/reflow/errors"
+)
+
+// ServeHTTP implements http.Handler, so that the cluster's hosts may
+// be administered while the cluster is in use. The last element of
+// the request path names the operation:
+//
+//	GET  .../hosts                 print the status of each host
+//	POST .../cordon?host=name      cordon the named host
+//	POST .../uncordon?host=name    uncordon the named host
+//	POST .../drain?host=name       drain the named host
+//
+// Drain requests return once the host is drained, or fail when the
+// request is canceled. Hosts are named as in Cordon.
+func (c *Cluster) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	op := path.Base(r.URL.Path)
+	if op == "hosts" {
+		if r.Method != "GET" {
+			http.Error(w, "bad method", http.StatusMethodNotAllowed)
+			return
+		}
+		for _, status := range c.HostStatus() {
+			fmt.Fprintln(w, status)
+		}
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "bad method", http.StatusMethodNotAllowed)
+		return
+	}
+	host := r.FormValue("host")
+	if host == "" {
+		http.Error(w, "missing host", http.StatusBadRequest)
+		return
+	}
+	var err error
+	switch op {
+	case "cordon":
+		err = c.Cordon(host)
+	case "uncordon":
+		err = c.Uncordon(host)
+	case "drain":
+		err = c.Drain(r.Context(), host)
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	switch {
+	case err == nil:
+		fmt.Fprintf(w, "%s: %sed\n", host, op)
+	case errors.Is(errors.NotExist, err):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,466 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+// Package hpccluster implements a Reflow cluster on top of an HPC
+// batch scheduler such as Slurm or PBS.
+//
+// Reflowlets are launched as batch jobs: each job runs "reflow
+// serve" on a compute node and registers the reflowlet's address in
+// a file in a directory that is shared between the driver and the
+// compute nodes. Once registered, the reflowlet joins the cluster's
+// pool. Jobs are cancelled when their allocs are freed, or when
+// their reflowlets have been idle for a while.
+//
+// Jobs are sized according to a configured set of instance types,
+// which describe the compute nodes (or node partitions) available to
+// the scheduler; the smallest instance type that satisfies a
+// resource request is used, in the same way that ec2cluster selects
+// EC2 instance types.
+package hpccluster
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grailbio/base/status"
+	"github.com/grailbio/infra"
+	"github.com/grailbio/infra/tls"
+	"github.com/grailbio/reflow"
+	"github.com/grailbio/reflow/errors"
+	"github.com/grailbio/reflow/internal/clusterutil"
+	"github.com/grailbio/reflow/log"
+	"github.com/grailbio/reflow/pool"
+	"golang.org/x/net/http2"
+)
+
+func init() {
+	infra.Register("hpccluster", new(Cluster))
+}
+
+const (
+	defaultScheduler    = "slurm"
+	defaultPort         = 9000
+	defaultMaxJobs      = 100
+	defaultPollInterval = 10 * time.Second
+	defaultIdleTimeout  = 10 * time.Minute
+	// unavailableTime is the amount of time for which an instance
+	// type is considered unavailable after a job of that type failed
+	// to start.
+	unavailableTime = 5 * time.Minute
+	allocateTimeout = 30 * time.Second
+)
+
+// A Cluster implements a runner.Cluster whose reflowlets are
+// launched as jobs by an HPC batch scheduler. The cluster expands
+// with demand, up to MaxJobs concurrent jobs, and jobs are cancelled
+// once they are no longer needed.
+type Cluster struct {
+	clusterutil.Mux `yaml:"-"`
+	// HTTPClient is used to communicate with the reflowlets.
+	HTTPClient *http.Client `yaml:"-"`
+	// Log is used to report cluster events.
+	Log *log.Logger `yaml:"-"`
+	// Status is used to report cluster and job status.
+	Status *status.Group `yaml:"-"`
+
+	// Scheduler is the batch scheduler used to launch reflowlets,
+	// either "slurm" (the default) or "pbs". It determines the
+	// default commands and job script template.
+	Scheduler string `yaml:"scheduler,omitempty"`
+	// SubmitCommand is the command used to submit job scripts. The
+	// path of the job script is appended to the command, which must
+	// print the ID of the submitted job as the last word of its
+	// output (optionally followed by ";" and a cluster name).
+	SubmitCommand []string `yaml:"submit,omitempty"`
+	// CancelCommand is the command used to cancel jobs. The job ID
+	// is appended to the command.
+	CancelCommand []string `yaml:"cancel,omitempty"`
+	// StatusCommand is the command used to query the state of jobs.
+	// The job ID is appended to the command, which must print the
+	// job's state, either as its first word (as "squeue -o %T" does)
+	// or in a "job_state = X" line (as "qstat -f" does). A job whose
+	// status command fails or prints nothing is assumed to be done.
+	StatusCommand []string `yaml:"status,omitempty"`
+	// Template is the text/template used to generate job scripts;
+	// see jobData for the fields available to it. The script must
+	// write the reflowlet's address to the registration file before
+	// starting the reflowlet.
+	Template string `yaml:"template,omitempty"`
+	// InstanceTypes is the set of instance types from which jobs
+	// are sized. The reflowlet offers the resources of the node on
+	// which it runs, so the default templates request exclusive
+	// nodes, and instance types should describe whole nodes.
+	InstanceTypes []InstanceType `yaml:"instancetypes"`
+	// Dir is the directory in which job scripts, job logs, and
+	// registration files are stored. It must be shared with the
+	// compute nodes. It defaults to $HOME/.reflow/hpccluster.
+	Dir string `yaml:"dir,omitempty"`
+	// Reflow is the path of the reflow binary on the compute nodes.
+	// It defaults to the path of the running binary.
+	Reflow string `yaml:"reflow,omitempty"`
+	// ReflowConfig is the path of the configuration file used by the
+	// reflowlets. If empty, the reflowlets use their default
+	// configuration file.
+	ReflowConfig string `yaml:"reflowconfig,omitempty"`
+	// ReflowletDir is the reflowlets' runtime data directory on the
+	// compute nodes. If empty, the reflowlet default is used.
+	ReflowletDir string `yaml:"reflowletdir,omitempty"`
+	// Port is the port on which reflowlets listen; it defaults to 9000.
+	Port int `yaml:"port,omitempty"`
+	// MaxJobs is the maximum number of concurrent jobs; it defaults to 100.
+	MaxJobs int `yaml:"maxjobs,omitempty"`
+	// PollInterval is the interval at which job states and reflowlet
+	// registrations are polled, as parsed by time.ParseDuration. It
+	// defaults to 10s.
+	PollInterval string `yaml:"pollinterval,omitempty"`
+	// IdleTimeout is the amount of time after which a job whose
+	// reflowlet has no allocs is cancelled, as parsed by
+	// time.ParseDuration. It defaults to 10m.
+	IdleTimeout string `yaml:"idletimeout,omitempty"`
+
+	types        *typeState
+	pollInterval time.Duration
+	idleTimeout  time.Duration
+
+	mu sync.Mutex
+	// jobs are the running jobs whose reflowlets have registered,
+	// keyed by pool ID.
+	jobs map[string]*job
+}
+
+// An InstanceType describes the compute nodes on which jobs of the
+// type are run.
+type InstanceType struct {
+	// Name is the name of the instance type.
+	Name string `yaml:"name"`
+	// CPU is the number of CPUs of the node.
+	CPU int `yaml:"cpu"`
+	// Mem is the amount of memory of the node, in GiB.
+	Mem float64 `yaml:"mem"`
+	// Disk is the amount of disk space available to the reflowlet,
+	// in GiB. If zero, disk requirements are not checked.
+	Disk float64 `yaml:"disk,omitempty"`
+	// Cost is the relative cost of the instance type. Among the
+	// instance types that satisfy a request, the cheapest one is
+	// used; ties are broken in favor of the smallest one.
+	Cost float64 `yaml:"cost,omitempty"`
+	// Args are additional arguments passed to the submit command
+	// for jobs of this type, e.g., to select a partition or queue.
+	Args []string `yaml:"args,omitempty"`
+}
+
+// Help implements infra.Provider.
+func (*Cluster) Help() string {
+	return "configure a cluster of reflowlets launched as Slurm or PBS batch jobs"
+}
+
+// Config implements infra.Provider.
+func (c *Cluster) Config() interface{} {
+	return c
+}
+
+// Init implements infra.Provider. The cluster is maintained for the
+// lifetime of the process.
+func (c *Cluster) Init(tls tls.Certs, logger *log.Logger) error {
+	clientConfig, _, err := tls.HTTPS()
+	if err != nil {
+		return err
+	}
+	transport := &http.Transport{TLSClientConfig: clientConfig}
+	if err := http2.ConfigureTransport(transport); err != nil {
+		return err
+	}
+	c.HTTPClient = &http.Client{Transport: transport}
+	c.Log = logger.Tee(nil, "hpccluster: ")
+	return c.initialize(context.Background())
+}
+
+// initialize validates the cluster's configuration, fills in
+// defaults, and maintains the cluster until the provided context is
+// done.
+func (c *Cluster) initialize(ctx context.Context) error {
+	if c.Scheduler == "" {
+		c.Scheduler = defaultScheduler
+	}
+	sched, ok := schedulers[c.Scheduler]
+	if !ok {
+		return errors.Errorf("unknown scheduler %q", c.Scheduler)
+	}
+	if len(c.SubmitCommand) == 0 {
+		c.SubmitCommand = sched.submit
+	}
+	if len(c.CancelCommand) == 0 {
+		c.CancelCommand = sched.cancel
+	}
+	if len(c.StatusCommand) == 0 {
+		c.StatusCommand = sched.status
+	}
+	if c.Template == "" {
+		c.Template = sched.template
+	}
+	if len(c.InstanceTypes) == 0 {
+		return errors.New("no instance types configured")
+	}
+	var configs []instanceConfig
+	for _, typ := range c.InstanceTypes {
+		if typ.Name == "" || typ.CPU <= 0 || typ.Mem <= 0 {
+			return errors.Errorf("instance type %q: name, cpu and mem must be set", typ.Name)
+		}
+		configs = append(configs, newInstanceConfig(typ))
+	}
+	c.types = newTypeState(configs, unavailableTime)
+	if c.Dir == "" {
+		c.Dir = os.ExpandEnv("$HOME/.reflow/hpccluster")
+	}
+	if err := os.MkdirAll(c.Dir, 0777); err != nil {
+		return err
+	}
+	if c.Reflow == "" {
+		var err error
+		if c.Reflow, err = os.Executable(); err != nil {
+			return err
+		}
+	}
+	if c.Port == 0 {
+		c.Port = defaultPort
+	}
+	if c.MaxJobs == 0 {
+		c.MaxJobs = defaultMaxJobs
+	}
+	var err error
+	if c.pollInterval, err = parseDuration("pollinterval", c.PollInterval, defaultPollInterval); err != nil {
+		return err
+	}
+	if c.idleTimeout, err = parseDuration("idletimeout", c.IdleTimeout, defaultIdleTimeout); err != nil {
+		return err
+	}
+	if c.HTTPClient == nil {
+		c.HTTPClient = http.DefaultClient
+	}
+	c.jobs = make(map[string]*job)
+	go clusterutil.Maintain(ctx, c.pollInterval, c.check)
+	return nil
+}
+
+func parseDuration(name, value string, def time.Duration) (time.Duration, error) {
+	if value == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, errors.E(name, value, err)
+	}
+	if d <= 0 {
+		return 0, errors.Errorf("%s %s: must be positive", name, d)
+	}
+	return d, nil
+}
+
+// Allocate reserves an alloc within the resource requirement
+// boundaries from the cluster. If an existing reflowlet can serve the
+// request, the alloc is placed there; otherwise a new job is
+// submitted, sized by the smallest instance type that satisfies the
+// requirements, and the alloc is placed on its reflowlet once it has
+// registered. When MaxJobs jobs are already running or pending,
+// Allocate waits for a job to finish.
+func (c *Cluster) Allocate(ctx context.Context, req reflow.Requirements, labels pool.Labels) (pool.Alloc, error) {
+	c.Log.Debugf("allocate %s", req)
+	if !c.types.Available(req.Min) {
+		return nil, errors.E(errors.ResourcesExhausted,
+			errors.Errorf("requested resources %s not satisfiable by any instance type", req))
+	}
+	tick := time.NewTicker(c.pollInterval)
+	defer tick.Stop()
+	for {
+		wait := c.Wait()
+		if c.Size() > 0 {
+			actx, cancel := context.WithTimeout(ctx, allocateTimeout)
+			alloc, err := pool.Allocate(actx, c, req, labels)
+			cancel()
+			if err == nil {
+				return c.alloc(alloc), nil
+			}
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			c.Log.Debugf("failed to allocate from existing pool: %v; submitting job", err)
+		}
+		config, ok := c.pick(req)
+		if !ok {
+			c.Log.Debugf("no currently available instance type can satisfy resource requirements %v", req.Min)
+		} else if c.Reserve(c.MaxJobs) {
+			j, err := c.launch(ctx, config)
+			c.Release()
+			if err != nil {
+				if ctx.Err() != nil {
+					return nil, ctx.Err()
+				}
+				if !errors.Is(errors.Unavailable, err) {
+					return nil, err
+				}
+				c.Log.Errorf("instance type %s: %v", config.Type, err)
+				c.types.Unavailable(config)
+				continue
+			}
+			actx, cancel := context.WithTimeout(ctx, allocateTimeout)
+			alloc, err := pool.Allocate(actx, j.pool, req, labels)
+			cancel()
+			c.add(j)
+			if err == nil {
+				return c.alloc(alloc), nil
+			}
+			c.Log.Errorf("failed to allocate from job %s: %v", j.id, err)
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-wait:
+		case <-tick.C:
+		}
+	}
+}
+
+// pick returns the instance type to use for a job that serves req.
+// As in ec2cluster, wide requests are served by the largest instance
+// type that supports up to req.Width allocations of req.Min.
+func (c *Cluster) pick(req reflow.Requirements) (instanceConfig, bool) {
+	best, ok := c.types.MinAvailable(req.Min)
+	if !ok {
+		return best, false
+	}
+	var need reflow.Resources
+	need.Set(req.Min)
+	for i := 1; i < req.Width; i++ {
+		need.Add(need, req.Min)
+		wbest, ok := c.types.MinAvailable(need)
+		if !ok {
+			break
+		}
+		best = wbest
+	}
+	return best, true
+}
+
+// add adds the registered job j to the cluster's pool.
+func (c *Cluster) add(j *job) {
+	c.mu.Lock()
+	c.jobs[j.pool.ID()] = j
+	c.updateLocked()
+	c.mu.Unlock()
+}
+
+// remove removes job j from the cluster's pool. The job is cancelled
+// unless it has already exited.
+func (c *Cluster) remove(j *job, reason string, exited bool) {
+	c.mu.Lock()
+	if c.jobs[j.pool.ID()] != j {
+		c.mu.Unlock()
+		return
+	}
+	delete(c.jobs, j.pool.ID())
+	c.updateLocked()
+	c.mu.Unlock()
+	c.Log.Printf("job %s (%s): %s", j.id, j.config.Type, reason)
+	if exited {
+		j.finish("exited")
+	} else {
+		j.cancel()
+	}
+}
+
+// updateLocked sets the cluster's pools to those of its jobs and
+// reports the cluster's status. It must be called with c.mu held.
+func (c *Cluster) updateLocked() {
+	var (
+		pools  []pool.Pool
+		total  reflow.Resources
+		counts = make(map[string]int)
+	)
+	for _, j := range c.jobs {
+		pools = append(pools, j.pool)
+		total.Add(total, j.config.Resources)
+		counts[j.config.Type]++
+	}
+	c.Set(pools)
+	var types []string
+	for typ, n := range counts {
+		types = append(types, fmt.Sprintf("%s:%d", typ, n))
+	}
+	sort.Strings(types)
+	c.Status.Printf("%d jobs: %s, total%s, pending:%d", len(c.jobs), strings.Join(types, ","), total, c.Pending())
+}
+
+// check removes jobs that are no longer running, and cancels jobs
+// whose reflowlets have been idle for longer than the idle timeout.
+func (c *Cluster) check(ctx context.Context) {
+	c.mu.Lock()
+	jobs := make([]*job, 0, len(c.jobs))
+	for _, j := range c.jobs {
+		jobs = append(jobs, j)
+	}
+	c.mu.Unlock()
+	for _, j := range jobs {
+		if ctx.Err() != nil {
+			return
+		}
+		alive, err := c.alive(ctx, j.id)
+		if err != nil {
+			c.Log.Errorf("job %s: %v", j.id, err)
+		} else if !alive {
+			c.remove(j, "job exited", true)
+			continue
+		}
+		allocs, err := j.allocs(ctx)
+		if err != nil {
+			c.Log.Errorf("job %s: %v", j.id, err)
+			continue
+		}
+		if len(allocs) > 0 {
+			j.idle = time.Time{}
+			continue
+		}
+		if j.idle.IsZero() {
+			j.idle = time.Now()
+		}
+		if time.Since(j.idle) >= c.idleTimeout {
+			c.remove(j, fmt.Sprintf("reflowlet idle for %s", c.idleTimeout), false)
+		}
+	}
+}
+
+// alloc wraps an alloc so that its job is cancelled when it is freed.
+func (c *Cluster) alloc(alloc pool.Alloc) pool.Alloc {
+	return &clusterAlloc{alloc, c}
+}
+
+// A clusterAlloc cancels the job that serves it when it is freed
+// and the job's reflowlet has no other allocs.
+type clusterAlloc struct {
+	pool.Alloc
+	c *Cluster
+}
+
+// Free frees the underlying alloc and cancels the job that serves
+// it if its reflowlet is now idle.
+func (a *clusterAlloc) Free(ctx context.Context) error {
+	err := a.Alloc.Free(ctx)
+	c := a.c
+	c.mu.Lock()
+	j := c.jobs[a.Pool().ID()]
+	c.mu.Unlock()
+	if j != nil {
+		if allocs, aerr := j.allocs(ctx); aerr == nil && len(allocs) == 0 {
+			c.remove(j, "alloc freed", false)
+		}
+	}
+	c.Notify()
+	return err
+}
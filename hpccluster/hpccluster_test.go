@@ -0,0 +1,339 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package hpccluster
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/grailbio/reflow"
+	"github.com/grailbio/reflow/errors"
+	"github.com/grailbio/reflow/log"
+	"github.com/grailbio/reflow/pool"
+	"github.com/grailbio/reflow/pool/server"
+	"github.com/grailbio/reflow/rest"
+)
+
+// Stand-ins for the scheduler's commands. Submit runs job scripts
+// synchronously, unless "--fail" is passed, in which case the job
+// exits immediately. Cancelled (and failed) jobs are recorded in
+// the file "cancelled", which is consulted by status.
+const (
+	submitScript = `#!/bin/sh
+dir=$(dirname "$0")
+n=$(($(cat "$dir/njobs" 2>/dev/null || echo 0) + 1))
+echo $n > "$dir/njobs"
+echo "$@" >> "$dir/submitted"
+for script; do :; done
+case "$1" in
+--fail) echo $n >> "$dir/cancelled" ;;
+*) sh "$script" ;;
+esac
+echo "$n;cluster"
+`
+	cancelScript = `#!/bin/sh
+echo "$1" >> "$(dirname "$0")/cancelled"
+`
+	statusScript = `#!/bin/sh
+grep -qx "$1" "$(dirname "$0")/cancelled" 2>/dev/null && exit 1
+echo RUNNING
+`
+)
+
+// testPool is a pool with a fixed amount of resources, from which
+// a single offer of all available resources is made.
+type testPool struct {
+	resources reflow.Resources
+
+	mu     sync.Mutex
+	allocs map[string]*testAlloc
+	nalloc int
+}
+
+func (p *testPool) ID() string { return "test" }
+
+func (p *testPool) Alloc(ctx context.Context, id string) (pool.Alloc, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if a := p.allocs[id]; a != nil {
+		return a, nil
+	}
+	return nil, errors.E("alloc", id, errors.NotExist)
+}
+
+func (p *testPool) Allocs(ctx context.Context) ([]pool.Alloc, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var allocs []pool.Alloc
+	for _, a := range p.allocs {
+		allocs = append(allocs, a)
+	}
+	return allocs, nil
+}
+
+func (p *testPool) Offer(ctx context.Context, id string) (pool.Offer, error) {
+	offers, _ := p.Offers(ctx)
+	if len(offers) == 0 || id != "offer" {
+		return nil, errors.E("offer", id, errors.NotExist)
+	}
+	return offers[0], nil
+}
+
+func (p *testPool) Offers(ctx context.Context) ([]pool.Offer, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var avail reflow.Resources
+	avail.Set(p.resources)
+	for _, a := range p.allocs {
+		avail.Sub(avail, a.resources)
+	}
+	if avail["cpu"] <= 0 {
+		return nil, nil
+	}
+	return []pool.Offer{&testOffer{p, avail}}, nil
+}
+
+type testOffer struct {
+	pool      *testPool
+	available reflow.Resources
+}
+
+func (o *testOffer) ID() string                  { return "offer" }
+func (o *testOffer) Pool() pool.Pool             { return o.pool }
+func (o *testOffer) Available() reflow.Resources { return o.available }
+
+func (o *testOffer) Accept(ctx context.Context, meta pool.AllocMeta) (pool.Alloc, error) {
+	p := o.pool
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.nalloc++
+	a := &testAlloc{pool: p, id: fmt.Sprint(p.nalloc), resources: meta.Want}
+	p.allocs[a.id] = a
+	return a, nil
+}
+
+type testAlloc struct {
+	pool.Alloc
+	pool      *testPool
+	id        string
+	resources reflow.Resources
+}
+
+func (a *testAlloc) ID() string                  { return a.id }
+func (a *testAlloc) Pool() pool.Pool             { return a.pool }
+func (a *testAlloc) Resources() reflow.Resources { return a.resources }
+
+func (a *testAlloc) Free(ctx context.Context) error {
+	a.pool.mu.Lock()
+	delete(a.pool.allocs, a.id)
+	a.pool.mu.Unlock()
+	return nil
+}
+
+const gib = 1 << 30
+
+func readLines(t *testing.T, path string) []string {
+	t.Helper()
+	p, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSpace(string(p)), "\n")
+}
+
+func TestCluster(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hpccluster")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for name, script := range map[string]string{
+		"submit.sh": submitScript,
+		"cancel.sh": cancelScript,
+		"status.sh": statusScript,
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p := &testPool{
+		resources: reflow.Resources{"cpu": 4, "mem": 8 * gib, "disk": 100 * gib},
+		allocs:    make(map[string]*testAlloc),
+	}
+	srv := httptest.NewServer(rest.Handler(server.NewNode(p), nil))
+	defer srv.Close()
+
+	c := &Cluster{
+		Log:           log.Std,
+		SubmitCommand: []string{filepath.Join(dir, "submit.sh")},
+		CancelCommand: []string{filepath.Join(dir, "cancel.sh")},
+		StatusCommand: []string{filepath.Join(dir, "status.sh")},
+		// The job registers the test server as its reflowlet.
+		Template: "#!/bin/sh\necho " + srv.URL + " > {{quote .Register}}\n",
+		InstanceTypes: []InstanceType{
+			{Name: "broken", CPU: 8, Mem: 16, Args: []string{"--fail"}},
+			{Name: "small", CPU: 4, Mem: 8, Cost: 1, Args: []string{"--partition=small"}},
+			{Name: "large", CPU: 16, Mem: 64, Cost: 2, Args: []string{"--partition=large"}},
+		},
+		Dir:          filepath.Join(dir, "jobs"),
+		Reflow:       "/bin/reflow",
+		PollInterval: "10ms",
+		IdleTimeout:  "50ms",
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := c.initialize(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// The cheapest instance type fails to start, so the next cheapest
+	// is used.
+	req := reflow.Requirements{Min: reflow.Resources{"cpu": 2, "mem": gib}}
+	alloc, err := c.Allocate(ctx, req, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := alloc.Resources()["cpu"], 2.0; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	submitted := readLines(t, filepath.Join(dir, "submitted"))
+	if got, want := len(submitted), 2; got != want {
+		t.Fatalf("got %v, want %v: %v", got, want, submitted)
+	}
+	if !strings.HasPrefix(submitted[0], "--fail ") || !strings.HasPrefix(submitted[1], "--partition=small ") {
+		t.Errorf("unexpected submissions %v", submitted)
+	}
+	if got, want := c.Size(), 1; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	if _, err := c.Allocate(ctx, reflow.Requirements{Min: reflow.Resources{"cpu": 32}}, nil); !errors.Is(errors.ResourcesExhausted, err) {
+		t.Errorf("expected resources exhausted, got %v", err)
+	}
+
+	// Freeing the alloc cancels its job. (Job 1 failed by itself.)
+	if err := alloc.Free(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := readLines(t, filepath.Join(dir, "cancelled")), []string{"1", "2"}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := c.Size(), 0; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// Jobs whose reflowlets are idle are cancelled. The broken
+	// instance type is still considered unavailable.
+	alloc, err = c.Allocate(ctx, req, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := alloc.(*clusterAlloc).Alloc.Free(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(10 * time.Second); ; {
+		cancelled := readLines(t, filepath.Join(dir, "cancelled"))
+		if len(cancelled) == 3 && cancelled[2] == "3" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("idle job was not cancelled: %v", cancelled)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTemplates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hpccluster")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, sched := range []string{"slurm", "pbs"} {
+		out := filepath.Join(dir, sched+".sh")
+		c := &Cluster{
+			Log:       log.Std,
+			Scheduler: sched,
+			// The submit command copies the job script to out.
+			SubmitCommand: []string{"sh", "-c", `cp "$1" "$0" && echo 7`, out},
+			InstanceTypes: []InstanceType{{Name: "node", CPU: 4, Mem: 8}},
+			Dir:           dir,
+			Reflow:        "/bin/reflow",
+			ReflowConfig:  "/shared/reflow config.yaml",
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		if err := c.initialize(ctx); err != nil {
+			t.Fatal(err)
+		}
+		j := &job{name: "reflowlet-x", config: c.types.configs[0], script: filepath.Join(dir, "x.sh"), register: "/shared/x.addr", log: "/shared/x.log", c: c}
+		if err := j.submit(ctx); err != nil {
+			t.Fatal(err)
+		}
+		cancel()
+		if got, want := j.id, "7"; got != want {
+			t.Errorf("%s: got %v, want %v", sched, got, want)
+		}
+		script := strings.Join(readLines(t, out), "\n")
+		for _, want := range []string{
+			map[string]string{"slurm": "#SBATCH --cpus-per-task=4", "pbs": "#PBS -l select=1:ncpus=4"}[sched],
+			`echo "$(hostname):9000" > /shared/x.addr.tmp`,
+			`exec /bin/reflow -config '/shared/reflow config.yaml' serve -addr :9000`,
+		} {
+			if !strings.Contains(script, want) {
+				t.Errorf("%s: script does not contain %q:\n%s", sched, want, script)
+			}
+		}
+	}
+}
+
+func TestPick(t *testing.T) {
+	c := &Cluster{}
+	c.types = newTypeState([]instanceConfig{
+		newInstanceConfig(InstanceType{Name: "small", CPU: 4, Mem: 8}),
+		newInstanceConfig(InstanceType{Name: "large", CPU: 16, Mem: 64}),
+		newInstanceConfig(InstanceType{Name: "disk", CPU: 4, Mem: 8, Disk: 1000, Cost: 1}),
+	}, time.Minute)
+	for _, test := range []struct {
+		req  reflow.Requirements
+		want string
+	}{
+		{reflow.Requirements{Min: reflow.Resources{"cpu": 2}}, "small"},
+		{reflow.Requirements{Min: reflow.Resources{"cpu": 8}}, "large"},
+		{reflow.Requirements{Min: reflow.Resources{"cpu": 2}, Width: 4}, "large"},
+		{reflow.Requirements{Min: reflow.Resources{"cpu": 2, "disk": 500 * gib}}, "small"},
+		{reflow.Requirements{Min: reflow.Resources{"cpu": 32}}, ""},
+	} {
+		config, ok := c.pick(test.req)
+		if got, want := config.Type, test.want; got != want || ok != (want != "") {
+			t.Errorf("%s: got %v (%v), want %v", test.req, got, ok, want)
+		}
+	}
+	c.types.Unavailable(instanceConfig{Type: "small"})
+	if config, _ := c.pick(reflow.Requirements{Min: reflow.Resources{"cpu": 2}}); config.Type != "large" {
+		t.Errorf("got %v, want large", config.Type)
+	}
+}
+
+func TestJobState(t *testing.T) {
+	for _, c := range []struct{ out, state string }{
+		{"RUNNING\n", "RUNNING"},
+		{"", ""},
+		{"Job Id: 12.server\n    Job_Name = reflowlet\n    job_state = Q\n    queue = workq\n", "Q"},
+	} {
+		if got, want := jobState(c.out), c.state; got != want {
+			t.Errorf("%q: got %v, want %v", c.out, got, want)
+		}
+	}
+}
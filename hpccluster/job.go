@@ -0,0 +1,504 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package hpccluster
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/grailbio/base/status"
+	"github.com/grailbio/reflow"
+	"github.com/grailbio/reflow/errors"
+	"github.com/grailbio/reflow/pool"
+	"github.com/grailbio/reflow/pool/client"
+)
+
+// memoryDiscount is the fraction of a node's memory that is reserved
+// by the reflowlet.
+const memoryDiscount = 0.05
+
+// commandTimeout is the timeout for scheduler commands.
+const commandTimeout = time.Minute
+
+// A scheduler holds the default commands and job script template
+// for a batch scheduler.
+type scheduler struct {
+	submit, cancel, status []string
+	template               string
+}
+
+var schedulers = map[string]scheduler{
+	"slurm": {
+		submit:   []string{"sbatch", "--parsable"},
+		cancel:   []string{"scancel"},
+		status:   []string{"squeue", "--noheader", "--format=%T", "--jobs"},
+		template: slurmTemplate,
+	},
+	"pbs": {
+		submit:   []string{"qsub"},
+		cancel:   []string{"qdel"},
+		status:   []string{"qstat", "-f"},
+		template: pbsTemplate,
+	},
+}
+
+const slurmTemplate = `#!/bin/sh
+#SBATCH --job-name={{.Name}}
+#SBATCH --output={{.Log}}
+#SBATCH --nodes=1
+#SBATCH --exclusive
+#SBATCH --cpus-per-task={{.CPU}}
+#SBATCH --mem=0
+{{template "register" .}}`
+
+const pbsTemplate = `#!/bin/sh
+#PBS -N {{.Name}}
+#PBS -o {{.Log}}
+#PBS -j oe
+#PBS -l select=1:ncpus={{.CPU}}
+#PBS -l place=excl
+{{template "register" .}}`
+
+// registerTemplate writes the reflowlet's address to the
+// registration file and then runs the reflowlet.
+const registerTemplate = `set -e
+echo "$(hostname):{{.Port}}" > {{quote .Register}}.tmp
+mv {{quote .Register}}.tmp {{quote .Register}}
+exec {{.Command}}
+`
+
+// jobStates is the set of job states (for Slurm and PBS) in which a
+// job is queued or running.
+var jobStates = map[string]bool{
+	// Slurm
+	"PENDING":     true,
+	"CONFIGURING": true,
+	"RUNNING":     true,
+	"COMPLETING":  true,
+	"REQUEUED":    true,
+	"RESIZING":    true,
+	"SUSPENDED":   true,
+	// PBS
+	"Q": true,
+	"H": true,
+	"W": true,
+	"T": true,
+	"R": true,
+	"B": true,
+	"S": true,
+}
+
+// jobData is the data with which job script templates are executed.
+type jobData struct {
+	// Name is the job's name.
+	Name string
+	// Type is the name of the job's instance type.
+	Type string
+	// CPU is the number of CPUs of the instance type.
+	CPU int
+	// Mem is the amount of memory of the instance type, in MiB.
+	Mem int
+	// Disk is the amount of disk space of the instance type, in MiB.
+	Disk int
+	// Port is the port on which the reflowlet listens.
+	Port int
+	// Register is the path of the registration file.
+	Register string
+	// Log is the path of the job's log file.
+	Log string
+	// Command is the (shell-quoted) command that runs the reflowlet.
+	Command string
+}
+
+// instanceConfig is an instance type together with the Reflow
+// resources that are presented by it.
+type instanceConfig struct {
+	// Type is the name of the instance type.
+	Type string
+	// Resources holds the Reflow resources that are presented by this configuration.
+	Resources reflow.Resources
+	// Cost is the relative cost of the instance type.
+	Cost float64
+	// Args are additional arguments to the submit command.
+	Args []string
+
+	typ InstanceType
+}
+
+func newInstanceConfig(typ InstanceType) instanceConfig {
+	config := instanceConfig{
+		Type: typ.Name,
+		Resources: reflow.Resources{
+			"cpu": float64(typ.CPU),
+			"mem": (1 - memoryDiscount) * typ.Mem * 1024 * 1024 * 1024,
+		},
+		Cost: typ.Cost,
+		Args: typ.Args,
+		typ:  typ,
+	}
+	if typ.Disk > 0 {
+		config.Resources["disk"] = typ.Disk * 1024 * 1024 * 1024
+	}
+	return config
+}
+
+// typeState stores what we know about the availability of instance
+// types, and implements instance type selection in the manner of
+// ec2cluster.
+type typeState struct {
+	configs   []instanceConfig
+	sleepTime time.Duration
+
+	mu          sync.Mutex
+	unavailable map[string]time.Time
+}
+
+func newTypeState(configs []instanceConfig, sleep time.Duration) *typeState {
+	s := &typeState{
+		configs:     make([]instanceConfig, len(configs)),
+		unavailable: make(map[string]time.Time),
+		sleepTime:   sleep,
+	}
+	copy(s.configs, configs)
+	sort.Slice(s.configs, func(i, j int) bool {
+		return s.configs[j].Resources["mem"] < s.configs[i].Resources["mem"]
+	})
+	return s
+}
+
+// Unavailable marks the given instance config as busy.
+func (s *typeState) Unavailable(config instanceConfig) {
+	s.mu.Lock()
+	s.unavailable[config.Type] = time.Now()
+	s.mu.Unlock()
+}
+
+// Available tells whether the provided resources are potentially
+// available from an instance type. Requirements for resources that
+// an instance type does not describe (such as disk, when it is not
+// configured) are assumed to be satisfied.
+func (s *typeState) Available(need reflow.Resources) bool {
+	for _, config := range s.configs {
+		if config.available(need) {
+			return true
+		}
+	}
+	return false
+}
+
+// MinAvailable returns the cheapest instance type that has at least
+// the required resources and is also believed to be currently
+// available. Ties are broken in favor of the smallest instance type,
+// as measured by (Resources).ScaledDistance.
+func (s *typeState) MinAvailable(need reflow.Resources) (instanceConfig, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var (
+		best      instanceConfig
+		found     bool
+		bestCost  = math.MaxFloat64
+		bestScore = math.MaxFloat64
+	)
+	for _, config := range s.configs {
+		if time.Since(s.unavailable[config.Type]) < s.sleepTime {
+			continue
+		}
+		if !config.available(need) {
+			continue
+		}
+		score := config.Resources.ScaledDistance(nil)
+		if config.Cost < bestCost || config.Cost == bestCost && score < bestScore {
+			best, bestCost, bestScore, found = config, config.Cost, score, true
+		}
+	}
+	return best, found
+}
+
+// available tells whether the config has at least the resources in
+// need. Disk requirements are ignored if the config's disk is
+// unknown.
+func (c instanceConfig) available(need reflow.Resources) bool {
+	if _, ok := c.Resources["disk"]; !ok && need["disk"] > 0 {
+		var tmp reflow.Resources
+		tmp.Set(need)
+		delete(tmp, "disk")
+		need = tmp
+	}
+	return c.Resources.Available(need)
+}
+
+// A job is a batch job that runs a reflowlet.
+type job struct {
+	// id is the scheduler's job ID.
+	id     string
+	name   string
+	config instanceConfig
+	// script, register, and log are the paths of the job script,
+	// registration file, and log file.
+	script, register, log string
+	// pool is the job's reflowlet, once it has registered.
+	pool pool.Pool
+	// idle is the time since which the job's reflowlet has had no
+	// allocs, if any.
+	idle time.Time
+
+	c    *Cluster
+	task *status.Task
+}
+
+// launch submits a job of the given instance type and waits for its
+// reflowlet to register and respond. The job is cancelled if the
+// context is done before then. Launch returns an errors.Unavailable
+// error if the job exits before its reflowlet is available.
+func (c *Cluster) launch(ctx context.Context, config instanceConfig) (*job, error) {
+	name := "reflowlet-" + newID()
+	j := &job{
+		name:     name,
+		config:   config,
+		script:   filepath.Join(c.Dir, name+".sh"),
+		register: filepath.Join(c.Dir, name+".addr"),
+		log:      filepath.Join(c.Dir, name+".log"),
+		c:        c,
+	}
+	j.task = c.Status.Startf("%s", config.Type)
+	if err := j.submit(ctx); err != nil {
+		j.task.Printf("%v", err)
+		j.task.Done()
+		return nil, err
+	}
+	c.Log.Debugf("submitted job %s (%s)", j.id, config.Type)
+	j.task.Printf("job %s: waiting for reflowlet", j.id)
+	tick := time.NewTicker(c.pollInterval)
+	defer tick.Stop()
+	for {
+		p, err := j.registered(ctx)
+		if err == nil {
+			j.pool = p
+			j.task.Printf("job %s: reflowlet %s", j.id, p.ID())
+			c.Log.Printf("job %s (%s): reflowlet %s registered", j.id, config.Type, p.ID())
+			return j, nil
+		}
+		if !os.IsNotExist(err) {
+			c.Log.Debugf("job %s: %v", j.id, err)
+		}
+		alive, err := c.alive(ctx, j.id)
+		switch {
+		case err != nil:
+			c.Log.Errorf("job %s: %v", j.id, err)
+		case !alive:
+			j.finish("exited")
+			return nil, errors.E(errors.Unavailable, errors.Errorf("job %s exited before its reflowlet became available; see %s", j.id, j.log))
+		}
+		select {
+		case <-tick.C:
+		case <-ctx.Done():
+			j.cancel()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// submit renders the job's script and submits it.
+func (j *job) submit(ctx context.Context) error {
+	c := j.c
+	tmpl, err := template.New("job").Funcs(template.FuncMap{"quote": shellQuote}).Parse(c.Template)
+	if err == nil {
+		_, err = tmpl.New("register").Parse(registerTemplate)
+	}
+	if err != nil {
+		return errors.E(errors.Fatal, "job template", err)
+	}
+	args := []string{c.Reflow}
+	if c.ReflowConfig != "" {
+		args = append(args, "-config", c.ReflowConfig)
+	}
+	args = append(args, "serve", "-addr", fmt.Sprintf(":%d", c.Port))
+	if c.ReflowletDir != "" {
+		args = append(args, "-dir", c.ReflowletDir)
+	}
+	for i := range args {
+		args[i] = shellQuote(args[i])
+	}
+	data := jobData{
+		Name:     j.name,
+		Type:     j.config.Type,
+		CPU:      j.config.typ.CPU,
+		Mem:      int(j.config.typ.Mem * 1024),
+		Disk:     int(j.config.typ.Disk * 1024),
+		Port:     c.Port,
+		Register: j.register,
+		Log:      j.log,
+		Command:  strings.Join(args, " "),
+	}
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, data); err != nil {
+		return errors.E(errors.Fatal, "job template", err)
+	}
+	if err := ioutil.WriteFile(j.script, b.Bytes(), 0755); err != nil {
+		return err
+	}
+	var submitArgs []string
+	submitArgs = append(submitArgs, j.config.Args...)
+	submitArgs = append(submitArgs, j.script)
+	out, err := c.command(ctx, c.SubmitCommand, submitArgs...)
+	if err != nil {
+		return errors.E("submit", j.script, err)
+	}
+	fields := strings.Fields(out)
+	if len(fields) == 0 {
+		return errors.E("submit", j.script, errors.New("no job ID printed"))
+	}
+	j.id = fields[len(fields)-1]
+	if i := strings.Index(j.id, ";"); i >= 0 {
+		j.id = j.id[:i]
+	}
+	return nil
+}
+
+// registered returns the job's reflowlet if it has registered and
+// responds to requests.
+func (j *job) registered(ctx context.Context) (pool.Pool, error) {
+	p, err := ioutil.ReadFile(j.register)
+	if err != nil {
+		return nil, err
+	}
+	baseurl, err := reflowletURL(strings.TrimSpace(string(p)))
+	if err != nil {
+		return nil, err
+	}
+	clnt, err := client.New(baseurl, j.c.HTTPClient, nil)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, commandTimeout)
+	defer cancel()
+	if _, err := clnt.Offers(ctx); err != nil {
+		return nil, err
+	}
+	return clnt, nil
+}
+
+// allocs returns the allocs of the job's reflowlet.
+func (j *job) allocs(ctx context.Context) ([]pool.Alloc, error) {
+	ctx, cancel := context.WithTimeout(ctx, commandTimeout)
+	defer cancel()
+	return j.pool.Allocs(ctx)
+}
+
+// cancel cancels the job.
+func (j *job) cancel() {
+	ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+	defer cancel()
+	if _, err := j.c.command(ctx, j.c.CancelCommand, j.id); err != nil {
+		j.c.Log.Errorf("cancel job %s: %v", j.id, err)
+	}
+	j.finish("cancelled")
+}
+
+// finish removes the job's script and registration file, and
+// reports its final state. The job's log is retained.
+func (j *job) finish(state string) {
+	os.Remove(j.script)
+	os.Remove(j.register)
+	j.task.Printf("job %s: %s", j.id, state)
+	j.task.Done()
+}
+
+// alive tells whether the job with the provided ID is queued or
+// running.
+func (c *Cluster) alive(ctx context.Context, id string) (bool, error) {
+	out, err := c.command(ctx, c.StatusCommand, id)
+	if err != nil {
+		if _, ok := errors.Recover(err).Err.(*exec.ExitError); ok {
+			return false, nil
+		}
+		return false, err
+	}
+	return jobStates[jobState(out)], nil
+}
+
+// jobState returns the job state printed by a status command.
+func jobState(out string) string {
+	for _, line := range strings.Split(out, "\n") {
+		if i := strings.Index(line, "job_state ="); i >= 0 {
+			return strings.TrimSpace(line[i+len("job_state ="):])
+		}
+	}
+	fields := strings.Fields(out)
+	if len(fields) == 0 {
+		return ""
+	}
+	return fields[0]
+}
+
+// command runs the command argv with the additional arguments args
+// and returns its output.
+func (c *Cluster) command(ctx context.Context, argv []string, args ...string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, commandTimeout)
+	defer cancel()
+	args = append(append([]string{}, argv[1:]...), args...)
+	out, err := exec.CommandContext(ctx, argv[0], args...).Output()
+	if err != nil {
+		if ee, ok := err.(*exec.ExitError); ok && len(ee.Stderr) > 0 {
+			return "", errors.E(argv[0], string(bytes.TrimSpace(ee.Stderr)), err)
+		}
+		return "", errors.E(argv[0], err)
+	}
+	return string(out), nil
+}
+
+// reflowletURL returns the base URL of the reflowlet API served at
+// the registered address addr, which is either host:port or a URL.
+func reflowletURL(addr string) (string, error) {
+	if !strings.Contains(addr, "://") {
+		if addr == "" || strings.Contains(addr, "/") {
+			return "", errors.Errorf("invalid reflowlet address %q", addr)
+		}
+		return "https://" + addr + "/v1/", nil
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		return "", err
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/v1/"
+	} else if !strings.HasSuffix(u.Path, "/") {
+		u.Path += "/"
+	}
+	return u.String(), nil
+}
+
+// shellQuote quotes s so that it is interpreted as a single word
+// by the shell.
+func shellQuote(s string) string {
+	if s != "" && strings.Trim(s, shellSafe) == "" {
+		return s
+	}
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+const shellSafe = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_-+=.,:/@%"
+
+func newID() string {
+	var b [8]byte
+	_, err := rand.Read(b[:])
+	if err != nil {
+		panic(err)
+	}
+	return fmt.Sprintf("%x", b[:])
+}
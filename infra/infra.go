@@ -51,6 +51,9 @@ const (
 	Tracer     = "tracer"
 	TaskDB     = "taskdb"
 	Docker     = "docker"
+	Runtime    = "runtime"
+	Secrets    = "secrets"
+	FairShare  = "fairshare"
 )
 
 // User is the infrastructure provider for username.
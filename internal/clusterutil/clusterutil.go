@@ -0,0 +1,117 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+// Package clusterutil implements the pool bookkeeping shared by
+// clusters that place allocs on a changing set of reflowlets (see
+// packages hostcluster, hpccluster, and k8scluster).
+package clusterutil
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/grailbio/reflow/pool"
+)
+
+// Mux is a pool.Mux over a cluster's current reflowlets. Allocations
+// that cannot currently be satisfied wait (see Wait) until the set of
+// pools changes or an alloc is freed. Mux also keeps track of the
+// reflowlets that are being launched, so that clusters can bound
+// their size. The zero Mux is ready to use.
+type Mux struct {
+	pool.Mux
+
+	mu       sync.Mutex
+	wait     chan struct{}
+	npending int
+}
+
+// Set sets the current pools and wakes up waiting allocations.
+func (m *Mux) Set(pools []pool.Pool) {
+	m.SetPools(pools)
+	m.Notify()
+}
+
+// Notify wakes up waiting allocations.
+func (m *Mux) Notify() {
+	m.mu.Lock()
+	if m.wait != nil {
+		close(m.wait)
+		m.wait = nil
+	}
+	m.mu.Unlock()
+}
+
+// Wait returns a channel that is closed at the next call to Set or
+// Notify. Callers should call Wait before examining the cluster's
+// state, so that no change is missed.
+func (m *Mux) Wait() <-chan struct{} {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.wait == nil {
+		m.wait = make(chan struct{})
+	}
+	return m.wait
+}
+
+// Reserve reserves a pending reflowlet, if fewer than max reflowlets
+// are current or pending. Reservations are released by Release.
+func (m *Mux) Reserve(max int) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.Size()+m.npending >= max {
+		return false
+	}
+	m.npending++
+	return true
+}
+
+// Release releases a reservation made by Reserve, once the
+// reflowlet has been added to the current pools or has failed to
+// launch.
+func (m *Mux) Release() {
+	m.mu.Lock()
+	m.npending--
+	m.mu.Unlock()
+}
+
+// Pending returns the number of reserved reflowlets.
+func (m *Mux) Pending() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.npending
+}
+
+// NotifyFree returns an alloc that wakes up waiting allocations
+// when it is freed.
+func (m *Mux) NotifyFree(alloc pool.Alloc) pool.Alloc {
+	return &notifyAlloc{alloc, m}
+}
+
+type notifyAlloc struct {
+	pool.Alloc
+	m *Mux
+}
+
+func (a *notifyAlloc) Free(ctx context.Context) error {
+	err := a.Alloc.Free(ctx)
+	a.m.Notify()
+	return err
+}
+
+// Maintain calls maintain every interval until the provided
+// context is done.
+func Maintain(ctx context.Context, interval time.Duration, maintain func(context.Context)) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+			maintain(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
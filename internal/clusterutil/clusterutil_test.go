@@ -0,0 +1,62 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package clusterutil
+
+import (
+	"testing"
+
+	"github.com/grailbio/reflow/pool"
+)
+
+// testPool is a pool.Pool whose methods are not used.
+type testPool struct{ pool.Pool }
+
+func closed(c <-chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestMux(t *testing.T) {
+	var m Mux
+	wait := m.Wait()
+	if closed(wait) {
+		t.Fatal("wait closed before any change")
+	}
+	if !m.Reserve(2) || !m.Reserve(2) {
+		t.Fatal("failed to reserve")
+	}
+	if m.Reserve(2) {
+		t.Error("reserved more than max")
+	}
+	if got, want := m.Pending(), 2; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	m.Release()
+	m.Set([]pool.Pool{testPool{}})
+	if !closed(wait) {
+		t.Error("wait not closed by Set")
+	}
+	// One pool and one pending reflowlet.
+	if m.Reserve(2) {
+		t.Error("reserved more than max")
+	}
+	m.Release()
+	if !m.Reserve(2) {
+		t.Error("failed to reserve")
+	}
+
+	wait = m.Wait()
+	m.Notify()
+	if !closed(wait) {
+		t.Error("wait not closed by Notify")
+	}
+	if closed(m.Wait()) {
+		t.Error("new wait closed")
+	}
+}
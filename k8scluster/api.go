@@ -0,0 +1,267 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package k8scluster
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/grailbio/reflow/errors"
+)
+
+// API is the subset of the Kubernetes API server's functionality
+// used by the cluster. All calls operate in a single namespace.
+type API interface {
+	// CreatePod creates the provided pod and returns it as created.
+	CreatePod(ctx context.Context, pod *Pod) (*Pod, error)
+	// GetPod returns the named pod. It returns an errors.NotExist
+	// error if the pod does not exist.
+	GetPod(ctx context.Context, name string) (*Pod, error)
+	// ListPods returns the pods that match the provided label
+	// selector, e.g., "app=reflowlet,cluster=default".
+	ListPods(ctx context.Context, selector string) ([]Pod, error)
+	// DeletePod deletes the named pod. Deleting a pod that does not
+	// exist is not an error.
+	DeletePod(ctx context.Context, name string) error
+	// CreateSecret creates the provided secret. It returns an
+	// errors.Precondition error if the secret already exists.
+	CreateSecret(ctx context.Context, secret *Secret) error
+}
+
+// Pod is a Kubernetes (v1) pod, restricted to the fields used by
+// the cluster.
+type Pod struct {
+	APIVersion string     `json:"apiVersion,omitempty"`
+	Kind       string     `json:"kind,omitempty"`
+	Metadata   ObjectMeta `json:"metadata"`
+	Spec       PodSpec    `json:"spec"`
+	Status     PodStatus  `json:"status,omitempty"`
+}
+
+// ObjectMeta is the metadata of a Kubernetes object.
+type ObjectMeta struct {
+	Name              string            `json:"name,omitempty"`
+	Namespace         string            `json:"namespace,omitempty"`
+	Labels            map[string]string `json:"labels,omitempty"`
+	Annotations       map[string]string `json:"annotations,omitempty"`
+	DeletionTimestamp string            `json:"deletionTimestamp,omitempty"`
+}
+
+// PodSpec is the specification of a pod.
+type PodSpec struct {
+	Containers         []Container       `json:"containers"`
+	Volumes            []Volume          `json:"volumes,omitempty"`
+	RestartPolicy      string            `json:"restartPolicy,omitempty"`
+	ServiceAccountName string            `json:"serviceAccountName,omitempty"`
+	NodeSelector       map[string]string `json:"nodeSelector,omitempty"`
+}
+
+// Container is a container in a pod.
+type Container struct {
+	Name         string               `json:"name"`
+	Image        string               `json:"image"`
+	Command      []string             `json:"command,omitempty"`
+	Args         []string             `json:"args,omitempty"`
+	Ports        []ContainerPort      `json:"ports,omitempty"`
+	Resources    ResourceRequirements `json:"resources,omitempty"`
+	VolumeMounts []VolumeMount        `json:"volumeMounts,omitempty"`
+}
+
+// ContainerPort is a port exposed by a container.
+type ContainerPort struct {
+	ContainerPort int `json:"containerPort"`
+}
+
+// ResourceRequirements are the compute resource requests and limits
+// of a container, as Kubernetes quantities.
+type ResourceRequirements struct {
+	Requests map[string]string `json:"requests,omitempty"`
+	Limits   map[string]string `json:"limits,omitempty"`
+}
+
+// Volume is a volume that may be mounted by a pod's containers.
+type Volume struct {
+	Name     string          `json:"name"`
+	Secret   *SecretVolume   `json:"secret,omitempty"`
+	EmptyDir *EmptyDirVolume `json:"emptyDir,omitempty"`
+}
+
+// SecretVolume is a volume populated by a secret.
+type SecretVolume struct {
+	SecretName string `json:"secretName"`
+}
+
+// EmptyDirVolume is a pod-local scratch volume.
+type EmptyDirVolume struct {
+	SizeLimit string `json:"sizeLimit,omitempty"`
+}
+
+// VolumeMount mounts a volume into a container.
+type VolumeMount struct {
+	Name      string `json:"name"`
+	MountPath string `json:"mountPath"`
+	ReadOnly  bool   `json:"readOnly,omitempty"`
+}
+
+// PodStatus is the observed status of a pod.
+type PodStatus struct {
+	// Phase is one of Pending, Running, Succeeded, Failed, or Unknown.
+	Phase   string `json:"phase,omitempty"`
+	Reason  string `json:"reason,omitempty"`
+	Message string `json:"message,omitempty"`
+	PodIP   string `json:"podIP,omitempty"`
+}
+
+// Secret is a Kubernetes (v1) secret.
+type Secret struct {
+	APIVersion string            `json:"apiVersion,omitempty"`
+	Kind       string            `json:"kind,omitempty"`
+	Metadata   ObjectMeta        `json:"metadata"`
+	Data       map[string][]byte `json:"data,omitempty"`
+}
+
+// podList is the response of a pod list call.
+type podList struct {
+	Items []Pod `json:"items"`
+}
+
+// apiStatus is the response of a failed API call.
+type apiStatus struct {
+	Message string `json:"message"`
+	Reason  string `json:"reason"`
+}
+
+// Client implements API by calling a Kubernetes API server's REST
+// API over HTTP.
+type Client struct {
+	// URL is the base URL of the API server, e.g.,
+	// https://kubernetes.default.svc.
+	URL string
+	// Namespace is the namespace in which objects are managed.
+	Namespace string
+	// Token, if not empty, is the bearer token used to authenticate
+	// to the API server.
+	Token string
+	// HTTPClient is the HTTP client used to call the API server.
+	HTTPClient *http.Client
+}
+
+// CreatePod implements API.
+func (c *Client) CreatePod(ctx context.Context, pod *Pod) (*Pod, error) {
+	created := new(Pod)
+	if err := c.do(ctx, "POST", "pods", pod, created); err != nil {
+		return nil, errors.E("createpod", pod.Metadata.Name, err)
+	}
+	return created, nil
+}
+
+// GetPod implements API.
+func (c *Client) GetPod(ctx context.Context, name string) (*Pod, error) {
+	pod := new(Pod)
+	if err := c.do(ctx, "GET", "pods/"+url.PathEscape(name), nil, pod); err != nil {
+		return nil, errors.E("getpod", name, err)
+	}
+	return pod, nil
+}
+
+// ListPods implements API.
+func (c *Client) ListPods(ctx context.Context, selector string) ([]Pod, error) {
+	var list podList
+	if err := c.do(ctx, "GET", "pods?labelSelector="+url.QueryEscape(selector), nil, &list); err != nil {
+		return nil, errors.E("listpods", selector, err)
+	}
+	return list.Items, nil
+}
+
+// DeletePod implements API.
+func (c *Client) DeletePod(ctx context.Context, name string) error {
+	err := c.do(ctx, "DELETE", "pods/"+url.PathEscape(name), nil, nil)
+	if err != nil && !errors.Is(errors.NotExist, err) {
+		return errors.E("deletepod", name, err)
+	}
+	return nil
+}
+
+// CreateSecret implements API.
+func (c *Client) CreateSecret(ctx context.Context, secret *Secret) error {
+	if err := c.do(ctx, "POST", "secrets", secret, nil); err != nil {
+		return errors.E("createsecret", secret.Metadata.Name, err)
+	}
+	return nil
+}
+
+// do performs an API call on the namespaced resource path. The
+// request body is marshaled from in, if it is not nil, and the
+// response body is unmarshaled into out, if it is not nil.
+func (c *Client) do(ctx context.Context, method, path string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	u := fmt.Sprintf("%s/api/v1/namespaces/%s/%s", strings.TrimSuffix(c.URL, "/"), url.PathEscape(c.Namespace), path)
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/json")
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	client := c.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return errors.E(errors.Net, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		var st apiStatus
+		b, _ := ioutil.ReadAll(resp.Body)
+		if json.Unmarshal(b, &st) != nil || st.Message == "" {
+			st.Message = strings.TrimSpace(string(b))
+		}
+		return errors.E(httpKind(resp.StatusCode), errors.Errorf("%s %s: %s: %s", method, path, resp.Status, st.Message))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// httpKind returns the error kind corresponding to an API server's
+// HTTP status code.
+func httpKind(code int) errors.Kind {
+	switch {
+	case code == http.StatusNotFound:
+		return errors.NotExist
+	case code == http.StatusConflict:
+		return errors.Precondition
+	case code == http.StatusUnauthorized || code == http.StatusForbidden:
+		return errors.NotAllowed
+	case code == http.StatusBadRequest || code == http.StatusUnprocessableEntity:
+		return errors.Invalid
+	case code == http.StatusTooManyRequests || code >= 500:
+		return errors.Temporary
+	default:
+		return errors.Other
+	}
+}
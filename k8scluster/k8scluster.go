@@ -0,0 +1,552 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+// Package k8scluster implements a Reflow cluster on top of
+// Kubernetes.
+//
+// Reflowlets are run as pods, each sized to the resource
+// requirements of the allocation that caused it to be created: CPU
+// and memory are requested (and limited) as container resources,
+// and disk as ephemeral storage. Pods are labeled so that, as with
+// ec2cluster, the cluster's state is recovered from the API server,
+// and may be shared by many Reflow processes. Idle pods are reused
+// for new allocations, and deleted once they have been idle for
+// longer than MaxAllocIdleTime.
+//
+// When a pod is evicted (or otherwise disappears), the allocs it
+// serves fail their keepalives with a fatal error, so that the
+// scheduler considers them dead and reschedules their tasks.
+package k8scluster
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grailbio/base/status"
+	"github.com/grailbio/infra"
+	infratls "github.com/grailbio/infra/tls"
+	"github.com/grailbio/reflow"
+	"github.com/grailbio/reflow/errors"
+	"github.com/grailbio/reflow/internal/clusterutil"
+	"github.com/grailbio/reflow/log"
+	"github.com/grailbio/reflow/pool"
+	"github.com/grailbio/reflow/pool/client"
+	"golang.org/x/net/http2"
+)
+
+func init() {
+	infra.Register("k8scluster", new(Cluster))
+}
+
+const (
+	defaultNamespace        = "default"
+	defaultClusterName      = "default"
+	defaultPort             = 9000
+	defaultMaxPods          = 100
+	defaultDisk             = 10
+	defaultPollInterval     = 10 * time.Second
+	defaultPendingTimeout   = 10 * time.Minute
+	defaultMaxAllocIdleTime = 5 * time.Minute
+	allocateTimeout         = 30 * time.Second
+
+	// serviceAccountDir is the directory in which Kubernetes mounts
+	// the credentials of a pod's service account.
+	serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+)
+
+// A Cluster implements a runner.Cluster whose reflowlets are run as
+// Kubernetes pods. The cluster expands with demand, up to MaxPods
+// pods, and pods are deleted once they have been idle for
+// MaxAllocIdleTime.
+type Cluster struct {
+	clusterutil.Mux `yaml:"-"`
+	// HTTPClient is used to communicate with the reflowlets.
+	HTTPClient *http.Client `yaml:"-"`
+	// Log is used to report cluster events.
+	Log *log.Logger `yaml:"-"`
+	// Status is used to report cluster status.
+	Status *status.Group `yaml:"-"`
+	// API is the API server client through which pods are managed.
+	API API `yaml:"-"`
+	// Configuration for this Reflow instantiation. It is provided to
+	// the reflowlets through a secret.
+	Configuration infra.Config `yaml:"-"`
+
+	// APIServer is the URL of the Kubernetes API server, e.g.,
+	// http://localhost:8001 when accessed through "kubectl proxy". If
+	// empty, the in-cluster API server is used, authenticated by the
+	// pod's service account.
+	APIServer string `yaml:"apiserver,omitempty"`
+	// TokenFile is the path of a file containing the bearer token
+	// used to authenticate to the API server.
+	TokenFile string `yaml:"tokenfile,omitempty"`
+	// CAFile is the path of the certificate authority bundle used to
+	// verify the API server's certificate.
+	CAFile string `yaml:"cafile,omitempty"`
+	// Namespace is the namespace in which pods are run.
+	Namespace string `yaml:"namespace,omitempty"`
+	// Name is the name of the cluster; pods are labeled with it so
+	// that several clusters may share a namespace. It defaults to
+	// "default".
+	Name string `yaml:"name,omitempty"`
+	// Image is the container image of the reflowlet pods. It must
+	// contain a reflow binary and provide access to a Docker daemon.
+	Image string `yaml:"image"`
+	// Command is the reflow binary's command in the image; it
+	// defaults to ["reflow"].
+	Command []string `yaml:"command,omitempty"`
+	// Args are additional arguments passed to "reflow serve".
+	Args []string `yaml:"args,omitempty"`
+	// ServiceAccount is the service account as which pods are run.
+	ServiceAccount string `yaml:"serviceaccount,omitempty"`
+	// NodeSelector constrains the nodes on which pods are run.
+	NodeSelector map[string]string `yaml:"nodeselector,omitempty"`
+	// Port is the port on which reflowlets listen; it defaults to 9000.
+	Port int `yaml:"port,omitempty"`
+	// MaxPods is the maximum number of pods; it defaults to 100.
+	MaxPods int `yaml:"maxpods,omitempty"`
+	// MaxCPU, MaxMem (in GiB), and MaxDisk (in GiB) bound the size
+	// of pods. Zero values are unbounded.
+	MaxCPU  int     `yaml:"maxcpu,omitempty"`
+	MaxMem  float64 `yaml:"maxmem,omitempty"`
+	MaxDisk float64 `yaml:"maxdisk,omitempty"`
+	// Disk is the minimum amount of ephemeral storage of pods, in
+	// GiB; it defaults to 10.
+	Disk float64 `yaml:"disk,omitempty"`
+	// PollInterval is the interval at which pods are polled, as
+	// parsed by time.ParseDuration. It defaults to 10s.
+	PollInterval string `yaml:"pollinterval,omitempty"`
+	// PendingTimeout is the amount of time a pod may remain pending
+	// before it is considered unschedulable and deleted. It defaults
+	// to 10m.
+	PendingTimeout string `yaml:"pendingtimeout,omitempty"`
+	// MaxAllocIdleTime is the amount of time after which a pod
+	// whose reflowlet has no allocs is deleted. It defaults to 5m.
+	MaxAllocIdleTime string `yaml:"maxallocidletime,omitempty"`
+
+	// dial returns a pool for the reflowlet at the provided URL.
+	dial func(url string) (pool.Pool, error)
+
+	max              reflow.Resources
+	pollInterval     time.Duration
+	pendingTimeout   time.Duration
+	maxAllocIdleTime time.Duration
+
+	secretMu   sync.Mutex
+	secretName string
+
+	mu sync.Mutex
+	// pods are the cluster's running pods, keyed by name.
+	pods map[string]*reflowletPod
+}
+
+// Help implements infra.Provider.
+func (*Cluster) Help() string {
+	return "configure a cluster of reflowlets running as Kubernetes pods"
+}
+
+// Config implements infra.Provider.
+func (c *Cluster) Config() interface{} {
+	return c
+}
+
+// Init implements infra.Provider. The cluster is maintained for the
+// lifetime of the process.
+func (c *Cluster) Init(certs infratls.Certs, logger *log.Logger) error {
+	clientConfig, _, err := certs.HTTPS()
+	if err != nil {
+		return err
+	}
+	transport := &http.Transport{TLSClientConfig: clientConfig}
+	if err := http2.ConfigureTransport(transport); err != nil {
+		return err
+	}
+	c.HTTPClient = &http.Client{Transport: transport}
+	c.Log = logger.Tee(nil, "k8scluster: ")
+	if c.API, err = c.apiClient(); err != nil {
+		return err
+	}
+	return c.initialize(context.Background())
+}
+
+// apiClient returns a client for the configured API server.
+func (c *Cluster) apiClient() (*Client, error) {
+	if c.APIServer == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			return nil, errors.New("apiserver must be configured when not running in a Kubernetes cluster")
+		}
+		c.APIServer = "https://" + net.JoinHostPort(host, port)
+		if c.TokenFile == "" {
+			c.TokenFile = filepath.Join(serviceAccountDir, "token")
+		}
+		if c.CAFile == "" {
+			c.CAFile = filepath.Join(serviceAccountDir, "ca.crt")
+		}
+		if c.Namespace == "" {
+			if b, err := ioutil.ReadFile(filepath.Join(serviceAccountDir, "namespace")); err == nil {
+				c.Namespace = strings.TrimSpace(string(b))
+			}
+		}
+	}
+	if c.Namespace == "" {
+		c.Namespace = defaultNamespace
+	}
+	client := &Client{URL: c.APIServer, Namespace: c.Namespace, HTTPClient: http.DefaultClient}
+	if c.TokenFile != "" {
+		b, err := ioutil.ReadFile(c.TokenFile)
+		if err != nil {
+			return nil, errors.E("tokenfile", c.TokenFile, err)
+		}
+		client.Token = strings.TrimSpace(string(b))
+	}
+	if c.CAFile != "" {
+		b, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, errors.E("cafile", c.CAFile, err)
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(b) {
+			return nil, errors.E("cafile", c.CAFile, errors.New("no certificates found"))
+		}
+		client.HTTPClient = &http.Client{
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}},
+		}
+	}
+	return client, nil
+}
+
+// initialize validates the cluster's configuration, fills in
+// defaults, and maintains the cluster until the provided context is
+// done.
+func (c *Cluster) initialize(ctx context.Context) error {
+	if c.Image == "" {
+		return errors.New("image must be configured")
+	}
+	if c.Namespace == "" {
+		c.Namespace = defaultNamespace
+	}
+	if c.Name == "" {
+		c.Name = defaultClusterName
+	}
+	if len(c.Command) == 0 {
+		c.Command = []string{"reflow"}
+	}
+	if c.Port == 0 {
+		c.Port = defaultPort
+	}
+	if c.MaxPods == 0 {
+		c.MaxPods = defaultMaxPods
+	}
+	if c.Disk == 0 {
+		c.Disk = defaultDisk
+	}
+	c.max = make(reflow.Resources)
+	if c.MaxCPU > 0 {
+		c.max["cpu"] = float64(c.MaxCPU)
+	}
+	if c.MaxMem > 0 {
+		c.max["mem"] = c.MaxMem * (1 << 30)
+	}
+	if c.MaxDisk > 0 {
+		c.max["disk"] = c.MaxDisk * (1 << 30)
+	}
+	var err error
+	if c.pollInterval, err = parseDuration("pollinterval", c.PollInterval, defaultPollInterval); err != nil {
+		return err
+	}
+	if c.pendingTimeout, err = parseDuration("pendingtimeout", c.PendingTimeout, defaultPendingTimeout); err != nil {
+		return err
+	}
+	if c.maxAllocIdleTime, err = parseDuration("maxallocidletime", c.MaxAllocIdleTime, defaultMaxAllocIdleTime); err != nil {
+		return err
+	}
+	if c.HTTPClient == nil {
+		c.HTTPClient = http.DefaultClient
+	}
+	if c.dial == nil {
+		c.dial = func(url string) (pool.Pool, error) {
+			return client.New(url, c.HTTPClient, nil)
+		}
+	}
+	c.pods = make(map[string]*reflowletPod)
+	c.maintain(ctx)
+	go clusterutil.Maintain(ctx, c.pollInterval, c.maintain)
+	return nil
+}
+
+func parseDuration(name, value string, def time.Duration) (time.Duration, error) {
+	if value == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, errors.E(name, value, err)
+	}
+	if d <= 0 {
+		return 0, errors.Errorf("%s %s: must be positive", name, d)
+	}
+	return d, nil
+}
+
+// Allocate reserves an alloc within the resource requirement
+// boundaries from the cluster. If an existing pod can serve the
+// request, the alloc is placed there; otherwise a new pod, sized to
+// the requirements, is created and the alloc is placed on its
+// reflowlet once it is serving. When MaxPods pods are already
+// running or pending, Allocate waits for a pod to become available.
+func (c *Cluster) Allocate(ctx context.Context, req reflow.Requirements, labels pool.Labels) (pool.Alloc, error) {
+	c.Log.Debugf("allocate %s", req)
+	if !c.fits(req.Min) {
+		return nil, errors.E(errors.ResourcesExhausted,
+			errors.Errorf("requested resources %s exceed the maximum pod size %s", req, c.max))
+	}
+	tick := time.NewTicker(c.pollInterval)
+	defer tick.Stop()
+	for {
+		wait := c.Wait()
+		if c.Size() > 0 {
+			actx, cancel := context.WithTimeout(ctx, allocateTimeout)
+			alloc, err := pool.Allocate(actx, c, req, labels)
+			cancel()
+			if err == nil {
+				return alloc, nil
+			}
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			c.Log.Debugf("failed to allocate from existing pods: %v; creating pod", err)
+		}
+		if c.Reserve(c.MaxPods) {
+			p, err := c.launch(ctx, c.podResources(req))
+			c.Release()
+			if err != nil {
+				if ctx.Err() != nil {
+					return nil, ctx.Err()
+				}
+				if errors.Is(errors.NotAllowed, err) || errors.Is(errors.Invalid, err) {
+					return nil, err
+				}
+				c.Log.Errorf("failed to launch pod: %v", err)
+			} else {
+				p = c.add(p)
+				actx, cancel := context.WithTimeout(ctx, allocateTimeout)
+				alloc, err := pool.Allocate(actx, p.pool, req, labels)
+				cancel()
+				if err == nil {
+					return alloc, nil
+				}
+				c.Log.Errorf("failed to allocate from pod %s: %v", p.name, err)
+				continue
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-wait:
+		case <-tick.C:
+		}
+	}
+}
+
+// fits tells whether the resources r fit within the cluster's
+// maximum pod size. Resources without a maximum are unbounded.
+func (c *Cluster) fits(r reflow.Resources) bool {
+	for k, v := range c.max {
+		if r[k] > v {
+			return false
+		}
+	}
+	return true
+}
+
+// podResources returns the resources of a pod that serves req: its
+// maximum requirements, rounded up to whole CPUs and to the minimum
+// disk size, and capped by the cluster's maximum pod size.
+func (c *Cluster) podResources(req reflow.Requirements) reflow.Resources {
+	var r reflow.Resources
+	r.Set(req.Max())
+	r["cpu"] = math.Max(1, math.Ceil(r["cpu"]))
+	if disk := c.Disk * (1 << 30); r["disk"] < disk {
+		r["disk"] = disk
+	}
+	for k, v := range c.max {
+		if r[k] > v {
+			r[k] = v
+		}
+	}
+	return r
+}
+
+// add adds the running pod p to the cluster's pool, and returns the
+// pod as tracked by the cluster: if p was already discovered by
+// reconciliation, the existing pod is returned.
+func (c *Cluster) add(p *reflowletPod) *reflowletPod {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if existing := c.pods[p.name]; existing != nil {
+		return existing
+	}
+	c.pods[p.name] = p
+	c.updateLocked()
+	return p
+}
+
+// remove removes pod p from the cluster's pool and marks it dead,
+// so that the allocs it serves fail their keepalives.
+func (c *Cluster) remove(p *reflowletPod, reason string) {
+	c.mu.Lock()
+	if c.pods[p.name] != p {
+		c.mu.Unlock()
+		return
+	}
+	delete(c.pods, p.name)
+	c.updateLocked()
+	c.mu.Unlock()
+	p.kill(reason)
+	c.Log.Printf("pod %s: %s", p.name, reason)
+}
+
+// updateLocked sets the cluster's pools to those of its pods and
+// reports the cluster's status. It must be called with c.mu held.
+func (c *Cluster) updateLocked() {
+	var (
+		pools []pool.Pool
+		total reflow.Resources
+	)
+	for _, p := range c.pods {
+		pools = append(pools, p.pool)
+		total.Add(total, p.resources)
+	}
+	sort.Slice(pools, func(i, j int) bool { return pools[i].ID() < pools[j].ID() })
+	c.Set(pools)
+	c.Status.Printf("%d pods: total%s, pending:%d", len(c.pods), total, c.Pending())
+}
+
+// maintain reconciles the cluster's state with the API server.
+func (c *Cluster) maintain(ctx context.Context) {
+	if err := c.reconcile(ctx); err != nil {
+		c.Log.Errorf("reconcile: %v", err)
+	}
+}
+
+// reconcile reconciles the cluster's pods with those known to the
+// API server: running pods that are not yet part of the cluster are
+// added; pods that have terminated, are being deleted, or no longer
+// exist are removed; and pods whose reflowlets have been idle for
+// longer than MaxAllocIdleTime are deleted.
+func (c *Cluster) reconcile(ctx context.Context) error {
+	pods, err := c.API.ListPods(ctx, c.selector())
+	if err != nil {
+		return err
+	}
+	live := make(map[string]bool)
+	for i := range pods {
+		pod := &pods[i]
+		name := pod.Metadata.Name
+		if reason, dead := podDead(pod); dead {
+			c.mu.Lock()
+			p := c.pods[name]
+			c.mu.Unlock()
+			if p != nil {
+				c.remove(p, reason)
+			}
+			if pod.Metadata.DeletionTimestamp == "" {
+				if err := c.API.DeletePod(ctx, name); err != nil {
+					c.Log.Errorf("pod %s: %v", name, err)
+				}
+			}
+			continue
+		}
+		live[name] = true
+		if pod.Status.Phase != "Running" || pod.Status.PodIP == "" {
+			continue
+		}
+		c.mu.Lock()
+		known := c.pods[name] != nil
+		c.mu.Unlock()
+		if known {
+			continue
+		}
+		p, err := c.newPod(pod)
+		if err != nil {
+			c.Log.Errorf("pod %s: %v", name, err)
+			continue
+		}
+		c.add(p)
+	}
+	c.mu.Lock()
+	var tracked []*reflowletPod
+	for _, p := range c.pods {
+		tracked = append(tracked, p)
+	}
+	c.mu.Unlock()
+	for _, p := range tracked {
+		if !live[p.name] {
+			c.remove(p, "pod deleted")
+			continue
+		}
+		allocs, err := p.pool.Pool.Allocs(ctx)
+		if err != nil {
+			c.Log.Errorf("pod %s: %v", p.name, err)
+			continue
+		}
+		if !p.idleFor(len(allocs) == 0, c.maxAllocIdleTime) {
+			continue
+		}
+		if err := c.API.DeletePod(ctx, p.name); err != nil {
+			c.Log.Errorf("pod %s: %v", p.name, err)
+			continue
+		}
+		c.remove(p, fmt.Sprintf("reflowlet idle for %s", c.maxAllocIdleTime))
+	}
+	return nil
+}
+
+// selector returns the label selector of the cluster's pods.
+func (c *Cluster) selector() string {
+	var selectors []string
+	for k, v := range c.labels() {
+		selectors = append(selectors, k+"="+v)
+	}
+	sort.Strings(selectors)
+	return strings.Join(selectors, ",")
+}
+
+// labels returns the labels of the cluster's pods.
+func (c *Cluster) labels() map[string]string {
+	return map[string]string{
+		"app":            "reflowlet",
+		"reflow-cluster": c.Name,
+	}
+}
+
+// podDead tells whether the provided pod is dead, and if so, why.
+func podDead(pod *Pod) (string, bool) {
+	switch {
+	case pod.Metadata.DeletionTimestamp != "":
+		return "pod deleted", true
+	case pod.Status.Phase == "Failed" && pod.Status.Reason == "Evicted":
+		return "pod evicted: " + pod.Status.Message, true
+	case pod.Status.Phase == "Failed" || pod.Status.Phase == "Succeeded":
+		msg := "pod " + strings.ToLower(pod.Status.Phase)
+		if pod.Status.Reason != "" {
+			msg += ": " + pod.Status.Reason
+		}
+		return msg, true
+	}
+	return "", false
+}
@@ -0,0 +1,486 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package k8scluster
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/grailbio/reflow"
+	"github.com/grailbio/reflow/errors"
+	"github.com/grailbio/reflow/log"
+	"github.com/grailbio/reflow/pool"
+)
+
+// fakeAPI is an in-memory Kubernetes API server that serves pods and
+// secrets in a single namespace. Created pods are immediately
+// scheduled and running.
+type fakeAPI struct {
+	mu      sync.Mutex
+	pods    map[string]*Pod
+	secrets map[string]*Secret
+	nip     int
+}
+
+func newFakeAPI() *fakeAPI {
+	return &fakeAPI{pods: make(map[string]*Pod), secrets: make(map[string]*Secret)}
+}
+
+func (f *fakeAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	const prefix = "/api/v1/namespaces/test/"
+	if !strings.HasPrefix(r.URL.Path, prefix) {
+		http.Error(w, `{"message": "no such namespace"}`, http.StatusNotFound)
+		return
+	}
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, prefix), "/", 2)
+	resource, name := parts[0], ""
+	if len(parts) > 1 {
+		name = parts[1]
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch {
+	case resource == "pods" && r.Method == "POST":
+		var pod Pod
+		if err := json.NewDecoder(r.Body).Decode(&pod); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if f.pods[pod.Metadata.Name] != nil {
+			http.Error(w, `{"message": "exists"}`, http.StatusConflict)
+			return
+		}
+		f.nip++
+		pod.Metadata.Namespace = "test"
+		pod.Status = PodStatus{Phase: "Running", PodIP: fmt.Sprintf("10.0.0.%d", f.nip)}
+		f.pods[pod.Metadata.Name] = &pod
+		json.NewEncoder(w).Encode(pod)
+	case resource == "pods" && r.Method == "GET" && name == "":
+		var list podList
+		for _, pod := range f.pods {
+			if matches(pod.Metadata.Labels, r.URL.Query().Get("labelSelector")) {
+				list.Items = append(list.Items, *pod)
+			}
+		}
+		json.NewEncoder(w).Encode(list)
+	case resource == "pods" && r.Method == "GET":
+		pod := f.pods[name]
+		if pod == nil {
+			http.Error(w, `{"message": "not found"}`, http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(pod)
+	case resource == "pods" && r.Method == "DELETE":
+		if f.pods[name] == nil {
+			http.Error(w, `{"message": "not found"}`, http.StatusNotFound)
+			return
+		}
+		delete(f.pods, name)
+	case resource == "secrets" && r.Method == "POST":
+		var secret Secret
+		if err := json.NewDecoder(r.Body).Decode(&secret); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if f.secrets[secret.Metadata.Name] != nil {
+			http.Error(w, `{"message": "exists"}`, http.StatusConflict)
+			return
+		}
+		f.secrets[secret.Metadata.Name] = &secret
+	default:
+		http.Error(w, "bad request", http.StatusMethodNotAllowed)
+	}
+}
+
+func matches(labels map[string]string, selector string) bool {
+	for _, s := range strings.Split(selector, ",") {
+		kv := strings.SplitN(s, "=", 2)
+		if len(kv) != 2 || labels[kv[0]] != kv[1] {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *fakeAPI) podList() []*Pod {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var pods []*Pod
+	for _, pod := range f.pods {
+		pods = append(pods, pod)
+	}
+	return pods
+}
+
+func (f *fakeAPI) setStatus(name string, status PodStatus) {
+	f.mu.Lock()
+	f.pods[name].Status = status
+	f.mu.Unlock()
+}
+
+// testPool is a reflowlet's pool. It offers all of the resources of
+// the (large) node on which the reflowlet runs.
+type testPool struct {
+	id string
+
+	mu     sync.Mutex
+	allocs map[string]*testAlloc
+	nalloc int
+}
+
+var nodeResources = reflow.Resources{"cpu": 64, "mem": 256 << 30, "disk": 1 << 40}
+
+func (p *testPool) ID() string { return p.id }
+
+func (p *testPool) Alloc(ctx context.Context, id string) (pool.Alloc, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if a := p.allocs[id]; a != nil {
+		return a, nil
+	}
+	return nil, errors.E("alloc", id, errors.NotExist)
+}
+
+func (p *testPool) Allocs(ctx context.Context) ([]pool.Alloc, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var allocs []pool.Alloc
+	for _, a := range p.allocs {
+		allocs = append(allocs, a)
+	}
+	return allocs, nil
+}
+
+func (p *testPool) Offer(ctx context.Context, id string) (pool.Offer, error) {
+	return nil, errors.E("offer", id, errors.NotExist)
+}
+
+func (p *testPool) Offers(ctx context.Context) ([]pool.Offer, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var avail reflow.Resources
+	avail.Set(nodeResources)
+	for _, a := range p.allocs {
+		avail.Sub(avail, a.resources)
+	}
+	return []pool.Offer{&testOffer{p, avail}}, nil
+}
+
+type testOffer struct {
+	pool      *testPool
+	available reflow.Resources
+}
+
+func (o *testOffer) ID() string                  { return "offer" }
+func (o *testOffer) Pool() pool.Pool             { return o.pool }
+func (o *testOffer) Available() reflow.Resources { return o.available }
+
+func (o *testOffer) Accept(ctx context.Context, meta pool.AllocMeta) (pool.Alloc, error) {
+	p := o.pool
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.nalloc++
+	a := &testAlloc{pool: p, id: fmt.Sprint(p.nalloc), resources: meta.Want}
+	p.allocs[a.id] = a
+	return a, nil
+}
+
+type testAlloc struct {
+	pool.Alloc
+	pool      *testPool
+	id        string
+	resources reflow.Resources
+}
+
+func (a *testAlloc) ID() string                  { return a.id }
+func (a *testAlloc) Pool() pool.Pool             { return a.pool }
+func (a *testAlloc) Resources() reflow.Resources { return a.resources }
+
+func (a *testAlloc) Keepalive(ctx context.Context, interval time.Duration) (time.Duration, error) {
+	return interval, nil
+}
+
+func (a *testAlloc) Free(ctx context.Context) error {
+	a.pool.mu.Lock()
+	delete(a.pool.allocs, a.id)
+	a.pool.mu.Unlock()
+	return nil
+}
+
+func newTestCluster(t *testing.T, c *Cluster) (*fakeAPI, context.CancelFunc) {
+	t.Helper()
+	api := newFakeAPI()
+	srv := httptest.NewServer(api)
+	var (
+		mu    sync.Mutex
+		pools = make(map[string]*testPool)
+	)
+	c.Log = log.Std
+	c.Image = "reflow"
+	c.Namespace = "test"
+	c.API = &Client{URL: srv.URL, Namespace: "test", HTTPClient: srv.Client()}
+	c.dial = func(url string) (pool.Pool, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if pools[url] == nil {
+			pools[url] = &testPool{id: url, allocs: make(map[string]*testAlloc)}
+		}
+		return pools[url], nil
+	}
+	if c.PollInterval == "" {
+		c.PollInterval = "1h"
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := c.initialize(ctx); err != nil {
+		t.Fatal(err)
+	}
+	return api, func() {
+		cancel()
+		srv.Close()
+	}
+}
+
+func requirements(cpu float64, memGiB float64) reflow.Requirements {
+	return reflow.Requirements{Min: reflow.Resources{"cpu": cpu, "mem": memGiB * (1 << 30)}}
+}
+
+func TestAllocate(t *testing.T) {
+	c := new(Cluster)
+	api, cancel := newTestCluster(t, c)
+	defer cancel()
+	ctx := context.Background()
+	a1, err := c.Allocate(ctx, requirements(1.5, 4), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pods := api.podList()
+	if got, want := len(pods), 1; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	spec := pods[0].Spec.Containers[0]
+	mem := 4.0 * (1 << 30)
+	for k, want := range map[string]string{
+		"cpu":               "2",
+		"memory":            fmt.Sprint(int64(mem / (1 - memoryDiscount))),
+		"ephemeral-storage": fmt.Sprint(10 << 30),
+	} {
+		if got := spec.Resources.Limits[k]; got != want {
+			t.Errorf("limit %s: got %v, want %v", k, got, want)
+		}
+		if got := spec.Resources.Requests[k]; got != want {
+			t.Errorf("request %s: got %v, want %v", k, got, want)
+		}
+	}
+	if got, want := pods[0].Metadata.Labels["reflow-cluster"], "default"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	// The alloc is limited to the pod's resources, not the node's.
+	if got, want := a1.Resources()["cpu"], 2.0; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// The pod is fully allocated, so a new pod is created.
+	a2, err := c.Allocate(ctx, requirements(1, 1), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a2.Pool().ID() == a1.Pool().ID() {
+		t.Error("allocated on a full pod")
+	}
+	if got, want := c.Size(), 2; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// Idle pods are reused.
+	if err := a1.Free(ctx); err != nil {
+		t.Fatal(err)
+	}
+	a3, err := c.Allocate(ctx, requirements(1, 1), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := a3.Pool().ID(), a1.Pool().ID(); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := len(api.podList()), 2; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestAllocateMaxPods(t *testing.T) {
+	c := &Cluster{MaxPods: 1, MaxCPU: 4}
+	_, cancel := newTestCluster(t, c)
+	defer cancel()
+	ctx := context.Background()
+	if _, err := c.Allocate(ctx, requirements(8, 1), nil); !errors.Is(errors.ResourcesExhausted, err) {
+		t.Errorf("expected resources exhausted, got %v", err)
+	}
+	alloc, err := c.Allocate(ctx, requirements(4, 1), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// No more pods may be created, so the allocation waits for the
+	// first alloc to be freed.
+	type result struct {
+		alloc pool.Alloc
+		err   error
+	}
+	resultc := make(chan result)
+	go func() {
+		alloc, err := c.Allocate(ctx, requirements(2, 1), nil)
+		resultc <- result{alloc, err}
+	}()
+	select {
+	case r := <-resultc:
+		t.Fatalf("allocation did not wait: %v, %v", r.alloc, r.err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if err := alloc.Free(ctx); err != nil {
+		t.Fatal(err)
+	}
+	r := <-resultc
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	if got, want := r.alloc.Pool().ID(), alloc.Pool().ID(); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	c := &Cluster{MaxAllocIdleTime: "1ms"}
+	api, cancel := newTestCluster(t, c)
+	defer cancel()
+	ctx := context.Background()
+
+	// Pods created by other processes are discovered.
+	resources := reflow.Resources{"cpu": 2, "mem": 1 << 30, "disk": 10 << 30}
+	if _, err := c.API.CreatePod(ctx, c.podSpec("other", resources, "")); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.reconcile(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := c.Size(), 1; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+
+	// Busy pods are kept, and idle ones deleted.
+	alloc, err := c.Allocate(ctx, requirements(1, 1), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.API.CreatePod(ctx, c.podSpec("idle", resources, "")); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := c.reconcile(ctx); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got, want := c.Size(), 1; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if pods := api.podList(); len(pods) != 1 || pods[0].Metadata.Name != "other" {
+		t.Fatalf("unexpected pods %v", pods)
+	}
+	if _, err := alloc.Keepalive(ctx, time.Minute); err != nil {
+		t.Errorf("unexpected keepalive error: %v", err)
+	}
+}
+
+func TestEviction(t *testing.T) {
+	c := new(Cluster)
+	api, cancel := newTestCluster(t, c)
+	defer cancel()
+	ctx := context.Background()
+	alloc, err := c.Allocate(ctx, requirements(1, 1), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pods := api.podList()
+	api.setStatus(pods[0].Metadata.Name, PodStatus{
+		Phase:   "Failed",
+		Reason:  "Evicted",
+		Message: "The node was low on resource: memory.",
+	})
+	if err := c.reconcile(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := c.Size(), 0; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := len(api.podList()), 0; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	// The alloc's keepalive fails fatally, so that the scheduler
+	// considers it dead without retrying.
+	err = pool.Keepalive(ctx, log.Std, alloc)
+	if !errors.Is(errors.Fatal, err) {
+		t.Fatalf("expected fatal error, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "evicted") {
+		t.Errorf("error %v does not mention eviction", err)
+	}
+}
+
+func TestPodSpec(t *testing.T) {
+	c := &Cluster{Image: "reflow", Command: []string{"reflow"}, Port: 9000, Name: "default", Args: []string{"-prefix", "/host"}}
+	resources := reflow.Resources{"cpu": 4, "mem": 8 << 30, "disk": 100 << 30}
+	pod := c.podSpec("p", resources, "reflowconfig-1234")
+	if got, want := strings.Join(pod.Spec.Containers[0].Args, " "),
+		"-config /etc/reflow/config.yaml serve -addr :9000 -dir /mnt/data/reflow -prefix /host"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := len(pod.Spec.Volumes), 2; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if got, want := pod.Spec.Volumes[1].Secret.SecretName, "reflowconfig-1234"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	var annotated reflow.Resources
+	if err := json.Unmarshal([]byte(pod.Metadata.Annotations[resourcesAnnotation]), &annotated); err != nil {
+		t.Fatal(err)
+	}
+	if !annotated.Equal(resources) {
+		t.Errorf("got %v, want %v", annotated, resources)
+	}
+	pod = c.podSpec("p", resources, "")
+	if got, want := pod.Spec.Containers[0].Args[0], "serve"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestClientErrors(t *testing.T) {
+	srv := httptest.NewServer(newFakeAPI())
+	defer srv.Close()
+	ctx := context.Background()
+	client := &Client{URL: srv.URL, Namespace: "test"}
+	if _, err := client.GetPod(ctx, "missing"); !errors.Is(errors.NotExist, err) {
+		t.Errorf("expected not exist, got %v", err)
+	}
+	if err := client.DeletePod(ctx, "missing"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	secret := &Secret{Metadata: ObjectMeta{Name: "s"}, Data: map[string][]byte{"k": []byte("v")}}
+	if err := client.CreateSecret(ctx, secret); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.CreateSecret(ctx, secret); !errors.Is(errors.Precondition, err) {
+		t.Errorf("expected precondition, got %v", err)
+	}
+	client.Namespace = "other"
+	if _, err := client.ListPods(ctx, "app=reflowlet"); !errors.Is(errors.NotExist, err) {
+		t.Errorf("expected not exist, got %v", err)
+	}
+}
@@ -0,0 +1,405 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package k8scluster
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/grailbio/infra"
+	"github.com/grailbio/reflow"
+	"github.com/grailbio/reflow/errors"
+	infra2 "github.com/grailbio/reflow/infra"
+	"github.com/grailbio/reflow/pool"
+	yaml "gopkg.in/yaml.v2"
+)
+
+const (
+	// resourcesAnnotation is the pod annotation that stores the
+	// (JSON-encoded) resources offered by the pod's reflowlet.
+	resourcesAnnotation = "reflow.grail.com/resources"
+	// memoryDiscount is the fraction of a pod's memory that is
+	// reserved for the reflowlet itself, as in ec2cluster.
+	memoryDiscount = 0.05
+
+	configDir  = "/etc/reflow"
+	configFile = "config.yaml"
+	dataDir    = "/mnt/data/reflow"
+)
+
+// A reflowletPod is a running pod whose reflowlet is part of the
+// cluster.
+type reflowletPod struct {
+	name      string
+	resources reflow.Resources
+	pool      *podPool
+
+	mu     sync.Mutex
+	reason string
+	idle   time.Time
+}
+
+// kill marks the pod dead for the provided reason.
+func (p *reflowletPod) kill(reason string) {
+	p.mu.Lock()
+	if p.reason == "" {
+		p.reason = reason
+	}
+	p.mu.Unlock()
+}
+
+// dead returns the reason the pod is dead, or an empty string if it
+// is alive.
+func (p *reflowletPod) dead() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.reason
+}
+
+// idleFor records whether the pod is currently idle, and tells
+// whether it has been idle for at least d.
+func (p *reflowletPod) idleFor(idle bool, d time.Duration) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !idle {
+		p.idle = time.Time{}
+		return false
+	}
+	if p.idle.IsZero() {
+		p.idle = time.Now()
+	}
+	return time.Since(p.idle) >= d
+}
+
+// newPod returns a reflowletPod for the provided running pod.
+func (c *Cluster) newPod(pod *Pod) (*reflowletPod, error) {
+	var resources reflow.Resources
+	if err := json.Unmarshal([]byte(pod.Metadata.Annotations[resourcesAnnotation]), &resources); err != nil {
+		return nil, errors.E("annotation", resourcesAnnotation, err)
+	}
+	url := fmt.Sprintf("https://%s/v1/", net.JoinHostPort(pod.Status.PodIP, strconv.Itoa(c.Port)))
+	clnt, err := c.dial(url)
+	if err != nil {
+		return nil, err
+	}
+	p := &reflowletPod{name: pod.Metadata.Name, resources: resources}
+	p.pool = &podPool{Pool: clnt, pod: p, c: c}
+	return p, nil
+}
+
+// launch creates a pod with the provided resources and waits for
+// its reflowlet to serve. The pod is deleted if it fails to start
+// within the pending timeout, or if the context is done first.
+func (c *Cluster) launch(ctx context.Context, resources reflow.Resources) (*reflowletPod, error) {
+	secret, err := c.secret(ctx)
+	if err != nil {
+		return nil, err
+	}
+	pod, err := c.API.CreatePod(ctx, c.podSpec("reflowlet-"+newID(), resources, secret))
+	if err != nil {
+		return nil, err
+	}
+	name := pod.Metadata.Name
+	c.Log.Printf("pod %s: created with resources %s", name, resources)
+	p, err := c.waitRunning(ctx, name)
+	if err != nil {
+		dctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		if derr := c.API.DeletePod(dctx, name); derr != nil {
+			c.Log.Errorf("pod %s: %v", name, derr)
+		}
+		cancel()
+		return nil, err
+	}
+	return p, nil
+}
+
+// waitRunning waits for the named pod to run and for its reflowlet
+// to serve.
+func (c *Cluster) waitRunning(ctx context.Context, name string) (*reflowletPod, error) {
+	deadline := time.Now().Add(c.pendingTimeout)
+	tick := time.NewTicker(c.pollInterval)
+	defer tick.Stop()
+	for {
+		pod, err := c.API.GetPod(ctx, name)
+		switch {
+		case err != nil:
+			if errors.Is(errors.NotExist, err) {
+				return nil, errors.E(errors.Unavailable, "pod", name, err)
+			}
+			c.Log.Debugf("pod %s: %v", name, err)
+		case pod.Status.Phase == "Running" && pod.Status.PodIP != "":
+			p, err := c.newPod(pod)
+			if err != nil {
+				return nil, err
+			}
+			if _, err := p.pool.Pool.Offers(ctx); err == nil {
+				return p, nil
+			}
+			c.Log.Debugf("pod %s: reflowlet not yet serving: %v", name, err)
+		default:
+			if reason, dead := podDead(pod); dead {
+				return nil, errors.E(errors.Unavailable, "pod", name, errors.New(reason))
+			}
+		}
+		if time.Now().After(deadline) {
+			return nil, errors.E(errors.Unavailable, "pod", name,
+				errors.Errorf("not running after %s", c.pendingTimeout))
+		}
+		select {
+		case <-tick.C:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// secret creates the secret containing the reflowlets'
+// configuration and returns its name. The secret is named by the
+// configuration's digest, so that it is shared by all clusters with
+// the same configuration. If the cluster has no configuration, no
+// secret is created and the reflowlets use their default
+// configuration.
+func (c *Cluster) secret(ctx context.Context) (string, error) {
+	if c.Configuration.Keys == nil {
+		return "", nil
+	}
+	c.secretMu.Lock()
+	defer c.secretMu.Unlock()
+	if c.secretName != "" {
+		return c.secretName, nil
+	}
+	b, err := reflowletConfig(c.Configuration)
+	if err != nil {
+		return "", err
+	}
+	name := fmt.Sprintf("reflowconfig-%x", sha256.Sum256(b))[:len("reflowconfig-")+16]
+	err = c.API.CreateSecret(ctx, &Secret{
+		APIVersion: "v1",
+		Kind:       "Secret",
+		Metadata:   ObjectMeta{Name: name, Labels: c.labels()},
+		Data:       map[string][]byte{configFile: b},
+	})
+	if err != nil && !errors.Is(errors.Precondition, err) {
+		return "", err
+	}
+	c.secretName = name
+	return name, nil
+}
+
+// reflowletConfig returns the marshaled configuration for the
+// reflowlets, which do not need a cluster implementation.
+func reflowletConfig(config infra.Config) ([]byte, error) {
+	b, err := config.Marshal(true)
+	if err != nil {
+		return nil, err
+	}
+	keys := make(infra.Keys)
+	if err := yaml.Unmarshal(b, &keys); err != nil {
+		return nil, err
+	}
+	delete(keys, infra2.Cluster)
+	return yaml.Marshal(keys)
+}
+
+// podSpec returns the pod named name, whose reflowlet offers the
+// provided resources and is configured by the named secret.
+func (c *Cluster) podSpec(name string, resources reflow.Resources, secret string) *Pod {
+	annotation, err := json.Marshal(resources)
+	if err != nil {
+		panic(err)
+	}
+	quantities := map[string]string{
+		"cpu":               strconv.Itoa(int(resources["cpu"])),
+		"memory":            strconv.FormatInt(int64(resources["mem"]/(1-memoryDiscount)), 10),
+		"ephemeral-storage": strconv.FormatInt(int64(resources["disk"]), 10),
+	}
+	var args []string
+	if secret != "" {
+		args = append(args, "-config", configDir+"/"+configFile)
+	}
+	args = append(args, "serve", "-addr", fmt.Sprintf(":%d", c.Port), "-dir", dataDir)
+	args = append(args, c.Args...)
+	container := Container{
+		Name:    "reflowlet",
+		Image:   c.Image,
+		Command: c.Command,
+		Args:    args,
+		Ports:   []ContainerPort{{ContainerPort: c.Port}},
+		Resources: ResourceRequirements{
+			Requests: quantities,
+			Limits:   quantities,
+		},
+		VolumeMounts: []VolumeMount{{Name: "data", MountPath: dataDir}},
+	}
+	volumes := []Volume{{
+		Name:     "data",
+		EmptyDir: &EmptyDirVolume{SizeLimit: quantities["ephemeral-storage"]},
+	}}
+	if secret != "" {
+		container.VolumeMounts = append(container.VolumeMounts,
+			VolumeMount{Name: "config", MountPath: configDir, ReadOnly: true})
+		volumes = append(volumes, Volume{Name: "config", Secret: &SecretVolume{SecretName: secret}})
+	}
+	return &Pod{
+		APIVersion: "v1",
+		Kind:       "Pod",
+		Metadata: ObjectMeta{
+			Name:        name,
+			Labels:      c.labels(),
+			Annotations: map[string]string{resourcesAnnotation: string(annotation)},
+		},
+		Spec: PodSpec{
+			Containers:         []Container{container},
+			Volumes:            volumes,
+			RestartPolicy:      "Never",
+			ServiceAccountName: c.ServiceAccount,
+			NodeSelector:       c.NodeSelector,
+		},
+	}
+}
+
+// A podPool is the pool of a pod's reflowlet. The reflowlet offers
+// the resources of the node on which it runs, so podPool limits its
+// offers to the resources of the pod.
+type podPool struct {
+	pool.Pool
+	pod *reflowletPod
+	c   *Cluster
+}
+
+// Alloc implements pool.Pool.
+func (p *podPool) Alloc(ctx context.Context, id string) (pool.Alloc, error) {
+	alloc, err := p.Pool.Alloc(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return &podAlloc{alloc, p}, nil
+}
+
+// Allocs implements pool.Pool.
+func (p *podPool) Allocs(ctx context.Context) ([]pool.Alloc, error) {
+	allocs, err := p.Pool.Allocs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for i := range allocs {
+		allocs[i] = &podAlloc{allocs[i], p}
+	}
+	return allocs, nil
+}
+
+// Offer implements pool.Pool.
+func (p *podPool) Offer(ctx context.Context, id string) (pool.Offer, error) {
+	offers, err := p.Offers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, offer := range offers {
+		if offer.ID() == id {
+			return offer, nil
+		}
+	}
+	return nil, errors.E("offer", id, errors.NotExist)
+}
+
+// Offers implements pool.Pool. The pod's offers are limited to the
+// pod's resources less those of its allocs. Dead pods make no
+// offers.
+func (p *podPool) Offers(ctx context.Context) ([]pool.Offer, error) {
+	if p.pod.dead() != "" {
+		return nil, nil
+	}
+	offers, err := p.Pool.Offers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	allocs, err := p.Pool.Allocs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var avail reflow.Resources
+	avail.Set(p.pod.resources)
+	for _, alloc := range allocs {
+		avail.Sub(avail, alloc.Resources())
+	}
+	var capped []pool.Offer
+	for _, offer := range offers {
+		var r reflow.Resources
+		r.Min(offer.Available(), avail)
+		if r["cpu"] <= 0 || r["mem"] <= 0 {
+			continue
+		}
+		capped = append(capped, &podOffer{offer, p, r})
+	}
+	return capped, nil
+}
+
+// A podOffer is an offer of a podPool.
+type podOffer struct {
+	pool.Offer
+	pool      *podPool
+	available reflow.Resources
+}
+
+// Pool implements pool.Offer.
+func (o *podOffer) Pool() pool.Pool { return o.pool }
+
+// Available implements pool.Offer.
+func (o *podOffer) Available() reflow.Resources { return o.available }
+
+// Accept implements pool.Offer.
+func (o *podOffer) Accept(ctx context.Context, meta pool.AllocMeta) (pool.Alloc, error) {
+	if !o.available.Available(meta.Want) {
+		return nil, errors.E("accept", o.ID(), errors.NotExist,
+			errors.Errorf("requested %s exceeds available %s", meta.Want, o.available))
+	}
+	alloc, err := o.Offer.Accept(ctx, meta)
+	if err != nil {
+		return nil, err
+	}
+	return &podAlloc{alloc, o.pool}, nil
+}
+
+// A podAlloc is an alloc on a pod's reflowlet. Its keepalives fail
+// fatally once the pod is dead, so that its tasks are rescheduled.
+type podAlloc struct {
+	pool.Alloc
+	pool *podPool
+}
+
+// Pool implements pool.Alloc.
+func (a *podAlloc) Pool() pool.Pool { return a.pool }
+
+// Keepalive implements pool.Alloc.
+func (a *podAlloc) Keepalive(ctx context.Context, interval time.Duration) (time.Duration, error) {
+	if reason := a.pool.pod.dead(); reason != "" {
+		return 0, errors.E("keepalive", a.ID(), errors.Fatal, errors.New(reason))
+	}
+	return a.Alloc.Keepalive(ctx, interval)
+}
+
+// Free implements pool.Alloc. Freeing an alloc wakes up allocations
+// that are waiting for resources.
+func (a *podAlloc) Free(ctx context.Context) error {
+	err := a.Alloc.Free(ctx)
+	a.pool.c.Notify()
+	return err
+}
+
+func newID() string {
+	var b [8]byte
+	_, err := rand.Read(b[:])
+	if err != nil {
+		panic(err)
+	}
+	return fmt.Sprintf("%x", b[:])
+}
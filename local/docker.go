@@ -14,16 +14,14 @@ import (
 	"io"
 	"os"
 	"path"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"docker.io/go-docker"
 	"docker.io/go-docker/api/types"
-	"docker.io/go-docker/api/types/container"
-	"docker.io/go-docker/api/types/network"
-	"github.com/docker/docker/pkg/stdcopy"
 	"github.com/grailbio/base/digest"
 	"github.com/grailbio/base/retry"
 	"github.com/grailbio/base/sync/once"
@@ -43,14 +41,15 @@ const (
 	objectPath   = "obj"
 )
 
-var dockerUser = fmt.Sprintf("%d:%d", os.Getuid(), os.Getgid())
-
 // dockerExec is a (local) exec attached to a local executor, from which it
 // is given its own subdirectory to operate. exec is responsible for
 // the lifecycle of an exec through an executor. It maintains a state
 // machine (invoked by exec.Go) to see the exec through completion.
 // Before every state change, exec saves its state to manifestPath,
 // and is always recoverable from the previous state.
+//
+// Despite its name, dockerExec runs its container through the
+// executor's ContainerRuntime, which need not be Docker.
 type dockerExec struct {
 	// The Executor that owns this exec.
 	Executor *Executor
@@ -58,7 +57,7 @@ type dockerExec struct {
 	Log *log.Logger
 
 	id      digest.Digest
-	client  *docker.Client
+	runtime ContainerRuntime
 	repo    *filerepo.Repository
 	staging filerepo.Repository
 	stdout  *log.Logger
@@ -80,12 +79,12 @@ func newDockerExec(id digest.Digest, x *Executor, cfg reflow.ExecConfig, stdout,
 	e := &dockerExec{
 		Executor: x,
 		// Fill in from executor:
-		Log:    x.Log.Tee(nil, fmt.Sprintf("%s: ", id)),
-		repo:   x.FileRepository,
-		id:     id,
-		client: x.Client,
-		stdout: stdout,
-		stderr: stderr,
+		Log:     x.Log.Tee(nil, fmt.Sprintf("%s: ", id)),
+		repo:    x.FileRepository,
+		id:      id,
+		runtime: x.Runtime,
+		stdout:  stdout,
+		stderr:  stderr,
 	}
 	e.staging.Root = e.path(objectsDir)
 	e.staging.Log = e.Log
@@ -134,16 +133,17 @@ func (e *dockerExec) containerName() string {
 // and are passed into the container as /arg. The output object is
 // placed in 'obj': the run directory is bound into the container as
 // '/return', and $out is set to /return/obj. This arrangement permits
-// for 'obj' to be either a file or a directory.
+// for 'obj' to be either a file or a directory. Runtimes that do not
+// mount binds refer to these directories by their host paths instead.
 //
-// We use Docker's host networking mode. In the future we'd like to
+// We use the host's network. In the future we'd like to
 // disable networking altogether (except for special execs like those
 // associated with interns and externs).
 func (e *dockerExec) create(ctx context.Context) (execState, error) {
-	if _, err := e.client.ContainerInspect(ctx, e.containerName()); err == nil {
+	if _, err := e.runtime.Inspect(ctx, e.containerName()); err == nil {
 		return execCreated, nil
-	} else if !docker.IsErrNotFound(err) {
-		return execInit, errors.E("ContainerInspect", e.containerName(), kind(err), err)
+	} else if !errors.Is(errors.NotExist, err) {
+		return execInit, err
 	}
 	// TODO: it might be worthwhile doing image pulling as a separate state.
 	for retries := 0; ; retries++ {
@@ -164,7 +164,7 @@ func (e *dockerExec) create(ctx context.Context) (execState, error) {
 	for i, iv := range e.Config.Args {
 		if iv.Out {
 			which := strconv.Itoa(iv.Index)
-			args[i] = path.Join("/return", which)
+			args[i] = e.containerPath("return", which)
 		} else {
 			flat := iv.Fileset.Flatten()
 			argv := make([]string, len(flat))
@@ -177,7 +177,7 @@ func (e *dockerExec) create(ctx context.Context) (execState, error) {
 				if err := e.repo.Materialize(e.path(argPath), binds); err != nil {
 					return execInit, err
 				}
-				argv[j] = "/" + argPath
+				argv[j] = e.containerPath(argPath)
 			}
 			args[i] = strings.Join(argv, " ")
 		}
@@ -185,37 +185,25 @@ func (e *dockerExec) create(ctx context.Context) (execState, error) {
 	// Set up temporary directory.
 	os.MkdirAll(e.path("tmp"), 0777)
 	os.MkdirAll(e.path("return"), 0777)
-	hostConfig := &container.HostConfig{
-		Binds: []string{
-			e.hostPath("arg") + ":/arg",
-			e.hostPath("tmp") + ":/tmp",
-			e.hostPath("return") + ":/return",
+	spec := ContainerSpec{
+		Image: e.Config.Image,
+		Binds: []Bind{
+			{e.hostPath("arg"), "/arg"},
+			{e.hostPath("tmp"), "/tmp"},
+			{e.hostPath("return"), "/return"},
 		},
-		NetworkMode: container.NetworkMode("host"),
-		// Try to ensure that jobs we control get killed before the reflowlet,
-		// so that we don't lose adjacent tasks unnecessarily and so that
-		// errors are more sensible to the user.
-		OomScoreAdj: 1000,
-	}
-
-	// Restrict docker memory usage if specified by the user.
-	// If the docker container memory limit (the cgroup limit) is exceeded
-	// before the OOM Killer kills the process, the following message
-	// is recorded in /dev/kmsg:
-	// Memory cgroup out of memory: Kill process <pid>
-	// If MemorySwap is not set to be equal Memory, the container will be
-	// able to swap up to twice the amount of memory set in the memory limit.
-	// In order to ensure that Memory is set to a hard limit, MemorySwap is also
-	// set equal to memory.
+		Labels: map[string]string{"reflow-id": e.id.Hex()},
+	}
+	// Restrict memory usage if specified by the user.
 	if mem := e.Config.Resources["mem"]; mem > 0 && e.Executor.HardMemLimit {
-		hostConfig.Resources.Memory = int64(mem)
-		hostConfig.Resources.MemorySwap = int64(mem)
+		spec.Memory = int64(mem)
 	}
 
+	tmp := e.containerPath("tmp")
 	env := []string{
-		"tmp=/tmp",
-		"TMPDIR=/tmp",
-		"HOME=/tmp",
+		"tmp=" + tmp,
+		"TMPDIR=" + tmp,
+		"HOME=" + tmp,
 	}
 	if outputs := e.Config.OutputIsDir; outputs != nil {
 		for i, isdir := range outputs {
@@ -224,7 +212,7 @@ func (e *dockerExec) create(ctx context.Context) (execState, error) {
 			}
 		}
 	} else {
-		env = append(env, "out=/return/default")
+		env = append(env, "out="+e.containerPath("return", "default"))
 	}
 	// TODO(marius): this is a hack for Earl to use the AWS tool.
 	if e.Config.NeedAWSCreds {
@@ -240,83 +228,121 @@ func (e *dockerExec) create(ctx context.Context) (execState, error) {
 		env = append(env, "AWS_SECRET_ACCESS_KEY="+creds.SecretAccessKey)
 		env = append(env, "AWS_SESSION_TOKEN="+creds.SessionToken)
 	}
-	config := &container.Config{
-		Image: e.Config.Image,
-		// We use a login shell here as many Docker images are configured
-		// with /root/.profile, etc.
-		Entrypoint: []string{"/bin/bash", "-e", "-l", "-o", "pipefail", "-c", fmt.Sprintf(e.Config.Cmd, args...)},
-		Cmd:        []string{},
-		Env:        env,
-		Labels:     map[string]string{"reflow-id": e.id.Hex()},
-		User:       dockerUser,
-	}
-	networkingConfig := &network.NetworkingConfig{}
-	if _, err := e.client.ContainerCreate(ctx, config, hostConfig, networkingConfig, e.containerName()); err != nil {
-		return execInit, errors.E(
-			"ContainerCreate",
-			kind(err),
-			e.containerName(),
-			fmt.Sprint(config), fmt.Sprint(hostConfig), fmt.Sprint(networkingConfig),
-			err,
-		)
+	if len(e.Config.Env) > 0 {
+		keys := make([]string, 0, len(e.Config.Env))
+		for k := range e.Config.Env {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			env = append(env, k+"="+e.Config.Env[k])
+		}
+	}
+	if len(e.Config.Secrets) > 0 {
+		if e.Executor.Secrets == nil {
+			return execInit, errors.E("run", e.id, errors.NotSupported,
+				errors.New("exec requests secrets, but no secrets provider is configured"))
+		}
+		for _, name := range e.Config.Secrets {
+			value, err := e.Executor.Secrets.Secret(ctx, name)
+			if err != nil {
+				return execInit, errors.E("run", e.id, "secret "+name, err)
+			}
+			env = append(env, name+"="+value)
+		}
+	}
+	// We use a login shell here as many Docker images are configured
+	// with /root/.profile, etc.
+	spec.Cmd = []string{"/bin/bash", "-e", "-l", "-o", "pipefail", "-c", fmt.Sprintf(e.Config.Cmd, args...)}
+	spec.Env = env
+	if err := e.runtime.Create(ctx, e.containerName(), spec); err != nil {
+		return execInit, err
 	}
 	return execCreated, nil
 }
 
-func scanLines(input io.ReadCloser, output *log.Logger) error {
+// inspect inspects the exec's container. The values of the exec's
+// secrets are removed from the container's environment, so that they
+// are not stored in the exec's manifest nor returned by Inspect.
+func (e *dockerExec) inspect(ctx context.Context) (types.ContainerJSON, error) {
+	info, err := e.runtime.Inspect(ctx, e.containerName())
+	if err != nil || len(e.Config.Secrets) == 0 || info.Config == nil {
+		return info, err
+	}
+	secret := make(map[string]bool, len(e.Config.Secrets))
+	for _, name := range e.Config.Secrets {
+		secret[name] = true
+	}
+	env := make([]string, 0, len(info.Config.Env))
+	for _, kv := range info.Config.Env {
+		if i := strings.Index(kv, "="); i >= 0 && secret[kv[:i]] {
+			continue
+		}
+		env = append(env, kv)
+	}
+	config := *info.Config
+	config.Env = env
+	info.Config = &config
+	return info, nil
+}
+
+// containerPath returns the path at which the provided path in the
+// exec's directory is visible to its command: binds are mounted at the
+// container's root; otherwise commands use the host path.
+func (e *dockerExec) containerPath(elems ...string) string {
+	if e.runtime.BindMounts() {
+		return path.Join(append([]string{"/"}, elems...)...)
+	}
+	return e.path(elems...)
+}
+
+// scanLines follows the container's output stream (stdout if
+// stdout is true; stderr otherwise), and prints each line to output.
+func (e *dockerExec) scanLines(ctx context.Context, stdout bool, output *log.Logger) error {
 	r, w := io.Pipe()
 	go func() {
-		stdcopy.StdCopy(w, w, input)
-		w.Close()
+		var err error
+		if stdout {
+			err = e.runtime.Logs(ctx, e.containerName(), w, nil, true)
+		} else {
+			err = e.runtime.Logs(ctx, e.containerName(), nil, w, true)
+		}
+		w.CloseWithError(err)
 	}()
 	s := bufio.NewScanner(r)
 	for s.Scan() {
 		output.Print(s.Text())
 	}
+	r.Close()
 	return s.Err()
 }
 
 // start starts the container that's been set up by exec.create.
 func (e *dockerExec) start(ctx context.Context) (execState, error) {
-	if err := e.client.ContainerStart(ctx, e.containerName(), types.ContainerStartOptions{}); err != nil {
-		return execCreated, errors.E("ContainerStart", e.containerName(), kind(err), err)
+	if err := e.runtime.Start(ctx, e.containerName()); err != nil {
+		return execCreated, err
 	}
 	var err error
-	e.Docker, err = e.client.ContainerInspect(ctx, e.containerName())
-	e.Manifest.PID = e.Docker.State.Pid
+	e.Docker, err = e.inspect(ctx)
 	if err != nil {
 		e.Log.Errorf("error inspecting container %q: %v", e.containerName(), err)
+	} else {
+		e.Manifest.PID = e.Docker.State.Pid
 	}
 
 	if e.stdout != nil {
-		rcStdout, err := e.client.ContainerLogs(ctx, e.containerName(),
-			types.ContainerLogsOptions{ShowStdout: true, Follow: true})
-		if err != nil {
-			e.Log.Errorf("docker.containerlogs %q: %v", e.containerName(), err)
-		} else {
-			go func() {
-				err := scanLines(rcStdout, e.stdout)
-				if err != nil {
-					log.Errorf("scanlines stdout: %v", err)
-				}
-				rcStdout.Close()
-			}()
-		}
+		go func() {
+			if err := e.scanLines(ctx, true, e.stdout); err != nil {
+				log.Errorf("scanlines stdout: %v", err)
+			}
+		}()
 	}
 	if e.stderr != nil {
-		rcStderr, err := e.client.ContainerLogs(ctx, e.containerName(),
-			types.ContainerLogsOptions{ShowStderr: true, Follow: true})
-		if err != nil {
-			e.Log.Errorf("docker.containerlogs %q: %v", e.containerName(), err)
-		} else {
-			go func() {
-				err := scanLines(rcStderr, e.stderr)
-				if err != nil {
-					log.Errorf("scanlines stderr: %v", err)
-				}
-				rcStderr.Close()
-			}()
-		}
+		go func() {
+			if err := e.scanLines(ctx, false, e.stderr); err != nil {
+				log.Errorf("scanlines stderr: %v", err)
+			}
+		}()
 	}
 	return execRunning, nil
 }
@@ -335,53 +361,61 @@ func (e *dockerExec) wait(ctx context.Context) (state execState, err error) {
 		profc <- e.profile(profctx)
 	}()
 
-	// The documentation for ContainerWait seems to imply that both channels will
-	// be sent. In practice it's one or the other, and it's also not buffered. Cool API.
-	respc, errc := e.client.ContainerWait(ctx, e.containerName(), container.WaitConditionNotRunning)
-	var code int64
-	select {
-	case err := <-errc:
+	var timedOut int32
+	if timeout := e.Config.Timeout; timeout > 0 {
+		// The deadline is computed from the container's start time so
+		// that it is maintained across executor restarts.
+		deadline := time.Now().Add(timeout)
+		if info, err := e.runtime.Inspect(ctx, e.containerName()); err == nil {
+			if started, err := time.Parse(time.RFC3339Nano, info.State.StartedAt); err == nil && !started.IsZero() {
+				deadline = started.Add(timeout)
+			}
+		}
+		timer := time.AfterFunc(time.Until(deadline), func() {
+			atomic.StoreInt32(&timedOut, 1)
+			e.Log.Printf("exec %s exceeded its timeout of %s; killing container", e.id, timeout)
+			if err := e.runtime.Kill(context.Background(), e.containerName()); err != nil {
+				e.Log.Errorf("failed to kill container %s: %v", e.containerName(), err)
+			}
+		})
+		defer timer.Stop()
+	}
+	code, err := e.runtime.Wait(ctx, e.containerName())
+	if err != nil {
 		cancelprof()
-		return execInit, errors.E("ContainerWait", e.containerName(), kind(err), err)
-	case resp := <-respc:
-		code = resp.StatusCode
+		return execInit, err
 	}
 	// Best-effort writing of log files.
-	rc, err := e.client.ContainerLogs(
-		ctx, e.containerName(),
-		types.ContainerLogsOptions{ShowStdout: true, ShowStderr: true})
-	if err == nil {
-		// TODO: these should be put into the repository.
-		stderr, err := os.Create(e.path("stderr"))
-		if err != nil {
-			e.Log.Errorf("failed to stderr log file %q: %s", e.path("stderr"), err)
-			stderr = nil
-		}
-		stdout, err := os.Create(e.path("stdout"))
-		if err != nil {
-			e.Log.Errorf("failed to stdout log file %q: %s", e.path("stdout"), err)
-			stdout = nil
-		}
-		_, err = stdcopy.StdCopy(stdout, stderr, rc)
-		if err != nil {
+	// TODO: these should be put into the repository.
+	stderr, err := os.Create(e.path("stderr"))
+	if err != nil {
+		e.Log.Errorf("failed to stderr log file %q: %s", e.path("stderr"), err)
+		stderr = nil
+	}
+	stdout, err := os.Create(e.path("stdout"))
+	if err != nil {
+		e.Log.Errorf("failed to stdout log file %q: %s", e.path("stdout"), err)
+		stdout = nil
+	}
+	if stdout != nil || stderr != nil {
+		if err := e.runtime.Logs(ctx, e.containerName(), writerOrNil(stdout), writerOrNil(stderr), false); err != nil {
 			e.Log.Errorf("failed to copy stdout and stderr logs: %s", err)
 		}
-		rc.Close()
-		if stderr != nil {
-			stderr.Close()
-		}
-		if stdout != nil {
-			stdout.Close()
-		}
 	}
-	e.Docker, err = e.client.ContainerInspect(ctx, e.containerName())
+	if stderr != nil {
+		stderr.Close()
+	}
+	if stdout != nil {
+		stdout.Close()
+	}
+	e.Docker, err = e.inspect(ctx)
 
 	// Retrieve the profile before we clean up the results.
 	cancelprof()
 	e.Manifest.Stats = <-profc
 
 	if err != nil {
-		return execInit, errors.E("ContainerInspect", e.containerName(), kind(err), err)
+		return execInit, err
 	}
 	// Docker can return inconsistent return codes between a ContainerWait and
 	// a ContainerInspect call. If either of these calls return a non zero exit code,
@@ -424,6 +458,9 @@ func (e *dockerExec) wait(ctx context.Context) (state execState, err error) {
 		if err := e.install(ctx); err != nil {
 			return execInit, err
 		}
+	case atomic.LoadInt32(&timedOut) == 1:
+		e.Manifest.Result.Err = errors.Recover(errors.E("exec", e.id, errors.ExecTimeout,
+			errors.Errorf("killed after exceeding its timeout of %s", e.Config.Timeout)))
 	// Note: /dev/kmsg only exists on linux. If the container is running on a non-linux machine isOOMSystem will
 	// always return false.
 	case e.Docker.State.OOMKilled || e.isOOMSystem():
@@ -498,54 +535,17 @@ func (e *dockerExec) profile(ctx context.Context) stats {
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		resp, err := e.client.ContainerStats(ctx, e.containerName(), true /*stream*/)
-		if err != nil {
-			e.Log.Error(errors.E("ContainerStats", kind(err), err))
-			return
-		}
-		defer resp.Body.Close()
-		dec := json.NewDecoder(resp.Body)
-		for {
-			// CPU and memory stats are obtained from the go-docker API. This means that CPU/memory profiling
-			// is entirely dependent on receiving a valid docker stats JSON. If no valid JSON is received before
-			// ctx is canceled, no profiling data for CPU or memory will be contained in gauges or stats.
-			var v types.StatsJSON
-			if err := dec.Decode(&v); err != nil {
-				if err == io.EOF {
-					return
-				}
-				dec = json.NewDecoder(io.MultiReader(dec.Buffered(), resp.Body))
-				select {
-				case <-time.After(100 * time.Millisecond):
-					continue
-				case <-ctx.Done():
-					return
-				}
-			}
-			var (
-				deltaCPU = float64(v.CPUStats.CPUUsage.TotalUsage - v.PreCPUStats.CPUUsage.TotalUsage)
-				deltaSys = float64(v.CPUStats.SystemUsage - v.PreCPUStats.SystemUsage)
-				ncpu     = float64(v.CPUStats.OnlineCPUs)
-			)
-
+		err := e.runtime.Stats(ctx, e.containerName(), func(sample reflow.Gauges) {
 			mu.Lock()
-			if deltaSys > 0 {
-				// We compute the CPU time here by looking at the proportion of
-				// this container's CPU time to total system time. This is normalized
-				// and so needs to be multiplied by the number of CPUs to get a
-				// portable load number.
-				load := ncpu * deltaCPU / deltaSys
-				stats.Observe("cpu", load)
-				gauges["cpu"] = load
+			for k, v := range sample {
+				stats.Observe(k, v)
+				gauges[k] = v
 			}
-			// We exclude page cache memory since this is not counted towards
-			// your limits.
-			mem := float64(v.MemoryStats.Usage - v.MemoryStats.Stats["cache"])
-
-			stats.Observe("mem", mem)
-			gauges["mem"] = mem
 			e.Manifest.Gauges = gauges.Snapshot()
 			mu.Unlock()
+		})
+		if err != nil && !errors.Is(errors.NotSupported, err) {
+			e.Log.Error(err)
 		}
 	}()
 
@@ -586,7 +586,7 @@ func (e *dockerExec) Go(ctx context.Context) {
 			err = e.save(state)
 		}
 		if state == execComplete {
-			if err := e.client.ContainerRemove(context.Background(), e.containerName(), types.ContainerRemoveOptions{}); err != nil {
+			if err := e.runtime.Remove(context.Background(), e.containerName()); err != nil {
 				e.Log.Errorf("failed to remove container %s: %s", e.containerName(), err)
 			}
 		}
@@ -594,7 +594,7 @@ func (e *dockerExec) Go(ctx context.Context) {
 }
 
 // Logs returns the stdout and/or stderr log files. Logs returns live
-// logs from the Docker daemon if the exec is still running;
+// logs from the container runtime if the exec is still running;
 // otherwise the saved logs are returned.
 //
 // Note that this is a bit racy (e.g., we could switch states between
@@ -615,17 +615,19 @@ func (e *dockerExec) Logs(ctx context.Context, stdout, stderr, follow bool) (io.
 	case execRunning:
 		// Note that this is technically racy (we may be competing with the completion
 		// routine), but since this is for user interaction, it's probably not a big deal.
-		opts := types.ContainerLogsOptions{ShowStdout: stdout, ShowStderr: stderr, Follow: follow}
-		rc, err := e.client.ContainerLogs(ctx, e.containerName(), opts)
-		if err != nil {
-			return nil, errors.E("ContainerLogs", e.containerName, fmt.Sprint(opts), kind(err), err)
-		}
+		ctx, cancel := context.WithCancel(ctx)
 		r, w := io.Pipe()
+		var wout, werr io.Writer
+		if stdout {
+			wout = w
+		}
+		if stderr {
+			werr = w
+		}
 		go func() {
-			stdcopy.StdCopy(w, w, rc)
-			w.Close()
+			w.CloseWithError(e.runtime.Logs(ctx, e.containerName(), wout, werr, follow))
 		}()
-		return newAllCloser(r, rc), nil
+		return newAllCloser(r, cancelCloser(cancel)), nil
 	case execComplete:
 		// This doesn't really make sense for materialized logs. When
 		// querying a live Docker container, we get interleaved log lines;
@@ -665,23 +667,7 @@ func (e *dockerExec) Shell(ctx context.Context) (io.ReadWriteCloser, error) {
 	}
 	switch state {
 	case execRunning:
-		c := types.ExecConfig{
-			Cmd:          []string{"/bin/bash"},
-			AttachStdin:  true,
-			AttachStdout: true,
-			AttachStderr: true,
-			Tty:          true,
-			DetachKeys:   "ctrl-p,ctrl-q",
-		}
-		response, err := e.client.ContainerExecCreate(ctx, e.containerName(), c)
-		if err != nil {
-			return nil, err
-		}
-		conn, err := e.client.ContainerExecAttach(ctx, response.ID, types.ExecConfig{})
-		if err != nil {
-			return nil, err
-		}
-		return conn.Conn, nil
+		return e.runtime.Shell(ctx, e.containerName())
 	default:
 		return nil, errors.New("cannot shell into a non-running exec")
 	}
@@ -709,22 +695,11 @@ func (e *dockerExec) Inspect(ctx context.Context) (reflow.ExecInspect, error) {
 		inspect.State = "created"
 		inspect.Status = "the exec container was created"
 	case execRunning:
-		top, err := e.client.ContainerTop(ctx, e.containerName(), []string{"auwx"})
+		commands, err := e.runtime.Top(ctx, e.containerName())
 		if err != nil {
 			e.Log.Errorf("top %s: %v", e.containerName(), err)
 		} else {
-			var i int
-			for ; i < len(top.Titles); i++ {
-				if top.Titles[i] == "COMMAND" {
-					break
-				}
-			}
-			if i != len(top.Titles) {
-				inspect.Commands = make([]string, len(top.Processes))
-				for j, proc := range top.Processes {
-					inspect.Commands[j] = proc[i]
-				}
-			}
+			inspect.Commands = commands
 		}
 		inspect.State = "running"
 		inspect.Status = "the exec container is running"
@@ -764,7 +739,7 @@ func (e *dockerExec) Promote(ctx context.Context) error {
 
 // Kill kills the exec's container and removes it entirely.
 func (e *dockerExec) Kill(ctx context.Context) error {
-	e.client.ContainerKill(ctx, e.containerName(), "KILL")
+	e.runtime.Kill(ctx, e.containerName())
 	if err := e.Wait(ctx); err != nil {
 		return err
 	}
@@ -856,6 +831,22 @@ func newAllCloser(r io.Reader, closers ...io.Closer) io.ReadCloser {
 	return &allCloser{r, closers}
 }
 
+// cancelCloser is an io.Closer that cancels a context.
+type cancelCloser context.CancelFunc
+
+func (c cancelCloser) Close() error {
+	c()
+	return nil
+}
+
+// writerOrNil returns f as an io.Writer, or nil if f is nil.
+func writerOrNil(f *os.File) io.Writer {
+	if f == nil {
+		return nil
+	}
+	return f
+}
+
 func (c *allCloser) Close() error {
 	var err error
 	for _, c := range c.closers {
@@ -866,21 +857,6 @@ func (c *allCloser) Close() error {
 	return err
 }
 
-// Kind returns the kind of a docker error.
-func kind(err error) errors.Kind {
-	switch {
-	case docker.IsErrNotFound(err):
-		return errors.NotExist
-	case docker.IsErrUnauthorized(err):
-		return errors.NotAllowed
-	default:
-		// Liberally pick unavailable as the default error, so that lower
-		// layers can retry errors that may be fruitfully retried.
-		// This is always safe to do, but may cause extra work.
-		return errors.Unavailable
-	}
-}
-
 // isOOMSystem checks to see if the docker exec was killed by the
 // OOM Killer.
 func (e *dockerExec) isOOMSystem() bool {
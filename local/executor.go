@@ -17,8 +17,6 @@ import (
 	"time"
 
 	"docker.io/go-docker"
-	"docker.io/go-docker/api/types"
-	"docker.io/go-docker/api/types/container"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/grailbio/base/digest"
 	"github.com/grailbio/base/traverse"
@@ -29,6 +27,8 @@ import (
 	"github.com/grailbio/reflow/internal/walker"
 	"github.com/grailbio/reflow/log"
 	"github.com/grailbio/reflow/repository/filerepo"
+	"github.com/grailbio/reflow/secrets"
+	"github.com/grailbio/reflow/trace"
 	"golang.org/x/sync/errgroup"
 )
 
@@ -70,8 +70,12 @@ type Executor struct {
 	// Dir is the root directory of this executor. All of its state is contained
 	// within it.
 	Dir string
-	// Client is the Docker client used by this executor.
+	// Client is the Docker client used by this executor. It is used
+	// only if Runtime is nil.
 	Client *docker.Client
+	// Runtime is the container runtime used to run execs. If nil,
+	// a Docker runtime using Client is used.
+	Runtime ContainerRuntime
 	// Authenticator is used to pull images that are stored on Amazon's ECR
 	// service.
 	Authenticator ecrauth.Interface
@@ -81,6 +85,9 @@ type Executor struct {
 	// AWSCreds is an AWS credentials provider, used for S3 operations
 	// and "$aws" passthroughs.
 	AWSCreds *credentials.Credentials
+	// Secrets resolves the secrets requested by execs. If nil, execs
+	// that request secrets fail.
+	Secrets secrets.Secrets
 	// Log is this executor's logger where operational status is printed.
 	Log *log.Logger
 
@@ -158,6 +165,9 @@ func (e *Executor) Start() error {
 	e.execs = map[digest.Digest]exec{}
 	e.refCounts = make(map[digest.Digest]refCount)
 	e.ctx, e.cancel = context.WithCancel(context.Background())
+	if e.Runtime == nil {
+		e.Runtime = &DockerRuntime{Client: e.Client}
+	}
 	// Monitor /dev/kmsg for OOMs.
 	e.oomTracker = newOOMTracker()
 	go e.oomTracker.Monitor(e.ctx, e.Log)
@@ -234,10 +244,10 @@ func (e *Executor) Start() error {
 }
 
 // ensureImage returns nil when the image is known to be present
-// at the local Docker client.
+// at the executor's container runtime.
 // TODO(marius): image pulling may be(?) better off as part of the executor interface
 func (e *Executor) ensureImage(ctx context.Context, ref string) error {
-	return ensureImage(ctx, e.Client, e.Authenticator, ref)
+	return e.Runtime.EnsureImage(ctx, e.Authenticator, ref)
 }
 
 // execPath constructs a path for the exec with the given id.
@@ -320,7 +330,13 @@ func (e *Executor) Put(ctx context.Context, id digest.Digest, cfg reflow.ExecCon
 	}
 	e.execs[id] = exec
 	e.mu.Unlock()
-	go exec.Go(e.ctx)
+	// The exec outlives the call to Put, but its span is a child of
+	// the caller's.
+	go func() {
+		ctx, done := trace.Start(trace.CopyTraceContext(ctx, e.ctx), trace.Exec, id, cfg.Ident)
+		defer done()
+		exec.Go(ctx)
+	}()
 	return exec, exec.WaitUntil(execInit)
 }
 
@@ -534,7 +550,11 @@ func (e *Executor) Execs(ctx context.Context) ([]reflow.Exec, error) {
 
 func (e *Executor) promote(ctx context.Context, res reflow.Fileset, repo *filerepo.Repository) error {
 	e.refCount(res)
-	return e.FileRepository.Vacuum(ctx, repo)
+	if err := e.FileRepository.Vacuum(ctx, repo); err != nil {
+		return err
+	}
+	e.Log.Debugf("repository %s: %s", e.FileRepository.Root, e.FileRepository.Stats())
+	return nil
 }
 
 // Kill disposes of the executors and all of its execs. It also sets
@@ -554,27 +574,16 @@ func (e *Executor) Kill(ctx context.Context) error {
 		x.Wait(ctx)
 	}
 	// Now try to collect any vestigial containers.
-	cs, err := e.Client.ContainerList(ctx, types.ContainerListOptions{All: true})
+	names, err := e.Runtime.List(ctx, "reflow-"+e.ID)
 	if err != nil {
 		return errors.E("kill", e.ID, err)
 	}
-	for _, c := range cs {
-		if len(c.Names) != 1 {
-			continue
-		}
-		if !strings.HasPrefix(c.Names[0], "/reflow-"+e.ID) {
+	for _, name := range names {
+		e.Runtime.Kill(ctx, name)
+		if _, err := e.Runtime.Wait(ctx, name); errors.Is(errors.NotExist, err) {
 			continue
 		}
-		e.Client.ContainerKill(ctx, c.ID, "KILL")
-		respc, errc := e.Client.ContainerWait(ctx, c.ID, container.WaitConditionNotRunning)
-		select {
-		case err := <-errc:
-			if docker.IsErrNotFound(err) {
-				continue
-			}
-		case <-respc:
-		}
-		e.Client.ContainerRemove(ctx, c.ID, types.ContainerRemoveOptions{Force: true})
+		e.Runtime.Remove(ctx, name)
 	}
 	// Finally remove collect the repository.
 	// TODO: this could instead be handed off to a repository in the pool
@@ -594,7 +603,7 @@ func (e *Executor) rewriteConfig(cfg *reflow.ExecConfig) error {
 		return err
 	}
 	switch u.Scheme {
-	case "localfile":
+	case "localfile", "file":
 		return nil
 	case "s3", "s3f":
 		if !e.ExternalS3 {
@@ -27,6 +27,7 @@ import (
 	"github.com/grailbio/reflow/internal/fs"
 	"github.com/grailbio/reflow/log"
 	"github.com/grailbio/reflow/pool"
+	"github.com/grailbio/reflow/secrets"
 )
 
 const (
@@ -65,8 +66,12 @@ type Pool struct {
 	// permit running the pool manager inside of a Docker container.
 	Prefix string
 	// Client is the Docker client. We assume that the Docker daemon
-	// runs on the same host from which the pool is managed.
+	// runs on the same host from which the pool is managed. It is used
+	// only if Runtime is nil.
 	Client *docker.Client
+	// Runtime is the container runtime used by the pool's allocs.
+	// If nil, a Docker runtime using Client is used.
+	Runtime ContainerRuntime
 	// Authenticator is used to authenticate ECR image pulls.
 	Authenticator interface {
 		Authenticates(ctx context.Context, image string) (bool, error)
@@ -78,6 +83,8 @@ type Pool struct {
 	// AWSCreds is a credentials provider used to mint AWS credentials.
 	// They are used to access AWS services.
 	AWSCreds *credentials.Credentials
+	// Secrets resolves the secrets requested by execs.
+	Secrets secrets.Secrets
 	// Blob is the blob store implementation used to fetch data from interns.
 	Blob blob.Mux
 	// Log
@@ -89,6 +96,10 @@ type Pool struct {
 	allocs    map[string]*alloc // the set of active allocs
 	resources reflow.Resources  // the total amount of available resources
 	stopped   bool
+	// drainc is closed when the pool starts draining; deadline is the
+	// time at which the draining pool is expected to terminate.
+	drainc   chan struct{}
+	deadline time.Time
 }
 
 // saveState saves the current state of the pool to Prefix/Dir/state.json.
@@ -117,13 +128,16 @@ func (p *Pool) saveState() error {
 func (p *Pool) Start() error {
 	ctx := context.Background()
 
-	info, err := p.Client.Info(ctx)
+	if p.Runtime == nil {
+		p.Runtime = &DockerRuntime{Client: p.Client}
+	}
+	resources, err := p.Runtime.Resources(ctx)
 	if err != nil {
 		return err
 	}
 	p.resources = reflow.Resources{
-		"mem": math.Floor(float64(info.MemTotal) * 0.95),
-		"cpu": float64(info.NCPU),
+		"mem": math.Floor(resources["mem"] * 0.95),
+		"cpu": resources["cpu"],
 	}
 	features, err := cpuFeatures()
 	if err != nil {
@@ -227,6 +241,10 @@ func (p *Pool) new(ctx context.Context, meta pool.AllocMeta) (pool.Alloc, error)
 		p.mu.Unlock()
 		return nil, errors.Errorf("alloc %v: shutting down", meta)
 	}
+	if p.drainingLocked() {
+		p.mu.Unlock()
+		return nil, errors.E("alloc", fmt.Sprint(meta), errors.Unavailable, errors.New("pool is draining"))
+	}
 	var (
 		used    reflow.Resources
 		expired []*alloc
@@ -353,7 +371,7 @@ func (p *Pool) Offer(ctx context.Context, id string) (pool.Offer, error) {
 func (p *Pool) Offers(ctx context.Context) ([]pool.Offer, error) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
-	if p.stopped {
+	if p.stopped || p.drainingLocked() {
 		return nil, nil
 	}
 	var reserved reflow.Resources
@@ -412,6 +430,51 @@ func (p *Pool) StopIfIdleFor(d time.Duration) bool {
 	return true
 }
 
+// Drain puts the pool in draining mode: it makes no more offers, and
+// callers of Terminating are notified that the pool is expected to
+// terminate at the provided deadline. Existing allocs are unaffected.
+func (p *Pool) Drain(deadline time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.drainingLocked() {
+		return
+	}
+	p.deadline = deadline
+	close(p.drainChanLocked())
+}
+
+// Terminating implements pool.Terminator. It returns once the pool is
+// draining.
+func (p *Pool) Terminating(ctx context.Context) (time.Time, error) {
+	p.mu.Lock()
+	drainc := p.drainChanLocked()
+	p.mu.Unlock()
+	select {
+	case <-drainc:
+	case <-ctx.Done():
+		return time.Time{}, ctx.Err()
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.deadline, nil
+}
+
+func (p *Pool) drainChanLocked() chan struct{} {
+	if p.drainc == nil {
+		p.drainc = make(chan struct{})
+	}
+	return p.drainc
+}
+
+func (p *Pool) drainingLocked() bool {
+	select {
+	case <-p.drainChanLocked():
+		return true
+	default:
+		return false
+	}
+}
+
 // Alloc implements a local alloc. It embeds a local executor which
 // does the heavy-lifting, while the alloc code deals with lifecycle
 // and resource concerns.
@@ -435,11 +498,13 @@ func (p *Pool) newAlloc(id string, keepalive time.Duration) *alloc {
 	e := &Executor{
 		ID:            id,
 		Client:        p.Client,
+		Runtime:       p.Runtime,
 		Dir:           filepath.Join(p.Dir, allocsPath, id),
 		Prefix:        p.Prefix,
 		Authenticator: p.Authenticator,
 		AWSImage:      p.AWSImage,
 		AWSCreds:      p.AWSCreds,
+		Secrets:       p.Secrets,
 		Blob:          p.Blob,
 		Log:           p.Log.Tee(nil, id+": "),
 		HardMemLimit:  p.HardMemLimit,
@@ -570,6 +635,9 @@ func (a *alloc) Inspect(ctx context.Context) (pool.AllocInspect, error) {
 		LastKeepalive: a.lastKeepalive,
 	}
 	a.mu.Unlock()
+	if a.FileRepository != nil {
+		i.RepositoryStats = pool.RepositoryStats(a.FileRepository.Stats())
+	}
 	return i, nil
 }
 
@@ -0,0 +1,444 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package local
+
+import (
+	"context"
+	"flag"
+	"io"
+	"os"
+	osexec "os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"docker.io/go-docker/api/types"
+	"docker.io/go-docker/api/types/container"
+	"github.com/grailbio/infra"
+	"github.com/grailbio/reflow"
+	"github.com/grailbio/reflow/errors"
+	"github.com/grailbio/reflow/internal/ecrauth"
+)
+
+func init() {
+	infra.Register("process", new(ProcessRuntime))
+}
+
+// ProcessRuntime is a ContainerRuntime which runs commands directly
+// as child processes of the executor, without container images.
+// Since binds are not mounted, commands refer to host paths.
+//
+// On Linux, processes may be sandboxed in their own user, mount, PID,
+// IPC and UTS namespaces, optionally chrooted, and limited by a
+// (version 2) cgroup. Elsewhere, processes run unconfined.
+//
+// Processes do not outlive the runtime: containers are lost when the
+// executor restarts.
+type ProcessRuntime struct {
+	// Dir is the directory in which process logs are stored.
+	Dir string `yaml:"dir,omitempty"`
+	// Sandbox runs processes in their own namespaces.
+	Sandbox bool `yaml:"sandbox,omitempty"`
+	// Root, if set, is the directory into which processes are
+	// chrooted. The executor's directories must be visible at the same
+	// paths under Root.
+	Root string `yaml:"root,omitempty"`
+	// Cgroup, if set, is the cgroup (v2) directory under which
+	// processes' cgroups are created. Memory limits and resource
+	// usage statistics require a cgroup.
+	Cgroup string `yaml:"cgroup,omitempty"`
+
+	mu    sync.Mutex
+	procs map[string]*process
+}
+
+// process is a container managed by a ProcessRuntime.
+type process struct {
+	name    string
+	spec    ContainerSpec
+	dir     string
+	cgroup  string
+	created time.Time
+	cmd     *osexec.Cmd
+	// done is closed when the process has exited.
+	done chan struct{}
+
+	mu    sync.Mutex
+	state types.ContainerState
+}
+
+// Help implements infra.Provider.
+func (*ProcessRuntime) Help() string {
+	return "run execs as (optionally sandboxed) processes, without container images"
+}
+
+// Flags implements infra.Provider.
+func (r *ProcessRuntime) Flags(flags *flag.FlagSet) {
+	flags.StringVar(&r.Dir, "dir", filepath.Join(os.TempDir(), "reflow-process"), "directory for process logs")
+	flags.BoolVar(&r.Sandbox, "sandbox", false, "run processes in their own namespaces (Linux only)")
+	flags.StringVar(&r.Root, "root", "", "directory into which processes are chrooted (Linux only)")
+	flags.StringVar(&r.Cgroup, "cgroup", "", "cgroup v2 directory under which process cgroups are created (Linux only)")
+}
+
+// Init implements infra.Provider.
+func (r *ProcessRuntime) Init() error {
+	if r.Dir == "" {
+		r.Dir = filepath.Join(os.TempDir(), "reflow-process")
+	}
+	return os.MkdirAll(r.Dir, 0777)
+}
+
+func (r *ProcessRuntime) lookup(op, name string) (*process, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	p := r.procs[name]
+	if p == nil {
+		return nil, errors.E(op, name, errors.NotExist, errors.New("no such process"))
+	}
+	return p, nil
+}
+
+// Resources implements ContainerRuntime.
+func (r *ProcessRuntime) Resources(ctx context.Context) (reflow.Resources, error) {
+	mem, err := memTotal()
+	if err != nil {
+		return nil, errors.E("process.Resources", err)
+	}
+	return reflow.Resources{"mem": float64(mem), "cpu": float64(runtime.NumCPU())}, nil
+}
+
+// EnsureImage implements ContainerRuntime. Images are ignored by the
+// process runtime.
+func (r *ProcessRuntime) EnsureImage(ctx context.Context, auth ecrauth.Interface, ref string) error {
+	return nil
+}
+
+// BindMounts implements ContainerRuntime.
+func (r *ProcessRuntime) BindMounts() bool { return false }
+
+// Create implements ContainerRuntime.
+func (r *ProcessRuntime) Create(ctx context.Context, name string, spec ContainerSpec) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.procs == nil {
+		r.procs = make(map[string]*process)
+	}
+	if r.procs[name] != nil {
+		return errors.E("process.Create", name, errors.Invalid, errors.New("process already exists"))
+	}
+	if len(spec.Cmd) == 0 {
+		return errors.E("process.Create", name, errors.Invalid, errors.New("empty command"))
+	}
+	dir := filepath.Join(r.Dir, name)
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return errors.E("process.Create", name, err)
+	}
+	r.procs[name] = &process{
+		name:    name,
+		spec:    spec,
+		dir:     dir,
+		created: time.Now(),
+		done:    make(chan struct{}),
+		state:   types.ContainerState{Status: "created"},
+	}
+	return nil
+}
+
+// Start implements ContainerRuntime.
+func (r *ProcessRuntime) Start(ctx context.Context, name string) error {
+	p, err := r.lookup("process.Start", name)
+	if err != nil {
+		return err
+	}
+	stdout, err := os.Create(filepath.Join(p.dir, "stdout"))
+	if err != nil {
+		return errors.E("process.Start", name, err)
+	}
+	stderr, err := os.Create(filepath.Join(p.dir, "stderr"))
+	if err != nil {
+		stdout.Close()
+		return errors.E("process.Start", name, err)
+	}
+	cmd := osexec.Command(p.spec.Cmd[0], p.spec.Cmd[1:]...)
+	// Commands run without an image, so they inherit the host's PATH
+	// unless the spec provides one.
+	cmd.Env = append([]string{"PATH=" + os.Getenv("PATH")}, p.spec.Env...)
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+	if r.Cgroup != "" {
+		p.cgroup = filepath.Join(r.Cgroup, name)
+		if err := setupCgroup(p.cgroup, p.spec.Memory); err != nil {
+			stdout.Close()
+			stderr.Close()
+			return errors.E("process.Start", name, err)
+		}
+	}
+	cmd.SysProcAttr = r.sysProcAttr()
+	if r.Root != "" {
+		cmd.Dir = "/"
+	}
+	if p.cgroup != "" {
+		err = startInCgroup(cmd, p.cgroup)
+	} else {
+		err = cmd.Start()
+	}
+	if err != nil {
+		stdout.Close()
+		stderr.Close()
+		if p.cgroup != "" {
+			removeCgroup(p.cgroup)
+		}
+		return errors.E("process.Start", name, err)
+	}
+	p.mu.Lock()
+	p.cmd = cmd
+	p.state.Status = "running"
+	p.state.Running = true
+	p.state.Pid = cmd.Process.Pid
+	p.state.StartedAt = time.Now().UTC().Format(time.RFC3339Nano)
+	p.mu.Unlock()
+	go func() {
+		err := cmd.Wait()
+		stdout.Close()
+		stderr.Close()
+		p.mu.Lock()
+		p.state.Status = "exited"
+		p.state.Running = false
+		p.state.FinishedAt = time.Now().UTC().Format(time.RFC3339Nano)
+		p.state.ExitCode = cmd.ProcessState.ExitCode()
+		if err != nil && p.state.ExitCode == 0 {
+			p.state.ExitCode = -1
+			p.state.Error = err.Error()
+		}
+		if p.cgroup != "" {
+			p.state.OOMKilled = cgroupOOMKilled(p.cgroup)
+			removeCgroup(p.cgroup)
+		}
+		p.mu.Unlock()
+		close(p.done)
+	}()
+	return nil
+}
+
+// Wait implements ContainerRuntime.
+func (r *ProcessRuntime) Wait(ctx context.Context, name string) (int64, error) {
+	p, err := r.lookup("process.Wait", name)
+	if err != nil {
+		return 0, err
+	}
+	select {
+	case <-p.done:
+	case <-ctx.Done():
+		return 0, errors.E("process.Wait", name, ctx.Err())
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return int64(p.state.ExitCode), nil
+}
+
+// Inspect implements ContainerRuntime.
+func (r *ProcessRuntime) Inspect(ctx context.Context, name string) (types.ContainerJSON, error) {
+	p, err := r.lookup("process.Inspect", name)
+	if err != nil {
+		return types.ContainerJSON{}, err
+	}
+	p.mu.Lock()
+	state := p.state
+	p.mu.Unlock()
+	return types.ContainerJSON{
+		ContainerJSONBase: &types.ContainerJSONBase{
+			ID:      name,
+			Name:    "/" + name,
+			Created: p.created.UTC().Format(time.RFC3339Nano),
+			Path:    p.spec.Cmd[0],
+			Args:    p.spec.Cmd[1:],
+			State:   &state,
+			Image:   p.spec.Image,
+		},
+		Config: &container.Config{
+			Image:      p.spec.Image,
+			Entrypoint: p.spec.Cmd,
+			Env:        p.spec.Env,
+			Labels:     p.spec.Labels,
+		},
+	}, nil
+}
+
+// Logs implements ContainerRuntime.
+func (r *ProcessRuntime) Logs(ctx context.Context, name string, stdout, stderr io.Writer, follow bool) error {
+	p, err := r.lookup("process.Logs", name)
+	if err != nil {
+		return err
+	}
+	var (
+		wg   sync.WaitGroup
+		errs = make([]error, 2)
+	)
+	for i, w := range []io.Writer{stdout, stderr} {
+		if w == nil {
+			continue
+		}
+		file := filepath.Join(p.dir, []string{"stdout", "stderr"}[i])
+		wg.Add(1)
+		go func(i int, w io.Writer) {
+			defer wg.Done()
+			errs[i] = tail(ctx, w, file, p.done, follow)
+		}(i, w)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return errors.E("process.Logs", name, err)
+		}
+	}
+	return nil
+}
+
+// tail copies the contents of the file at path to w. If follow is
+// true, tail continues to copy until done is closed or the context
+// is done.
+func tail(ctx context.Context, w io.Writer, path string, done <-chan struct{}, follow bool) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	for {
+		if _, err := io.Copy(w, f); err != nil {
+			return err
+		}
+		if !follow {
+			return nil
+		}
+		select {
+		case <-done:
+			// Copy anything written since the last read.
+			_, err := io.Copy(w, f)
+			return err
+		case <-ctx.Done():
+			return nil
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// Kill implements ContainerRuntime.
+func (r *ProcessRuntime) Kill(ctx context.Context, name string) error {
+	p, err := r.lookup("process.Kill", name)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	cmd := p.cmd
+	p.mu.Unlock()
+	if cmd == nil {
+		return errors.E("process.Kill", name, errors.Invalid, errors.New("process not started"))
+	}
+	select {
+	case <-p.done:
+		return nil
+	default:
+	}
+	if err := killProcess(cmd.Process); err != nil {
+		return errors.E("process.Kill", name, err)
+	}
+	return nil
+}
+
+// Remove implements ContainerRuntime.
+func (r *ProcessRuntime) Remove(ctx context.Context, name string) error {
+	p, err := r.lookup("process.Remove", name)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	cmd := p.cmd
+	p.mu.Unlock()
+	if cmd != nil {
+		select {
+		case <-p.done:
+		default:
+			killProcess(cmd.Process)
+			<-p.done
+		}
+	}
+	r.mu.Lock()
+	delete(r.procs, name)
+	r.mu.Unlock()
+	return os.RemoveAll(p.dir)
+}
+
+// List implements ContainerRuntime.
+func (r *ProcessRuntime) List(ctx context.Context, prefix string) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var names []string
+	for name := range r.procs {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Shell implements ContainerRuntime. Shells are not supported by the
+// process runtime.
+func (r *ProcessRuntime) Shell(ctx context.Context, name string) (io.ReadWriteCloser, error) {
+	return nil, errors.E("process.Shell", name, errors.NotSupported)
+}
+
+// Top implements ContainerRuntime. Only the process's main command is
+// reported.
+func (r *ProcessRuntime) Top(ctx context.Context, name string) ([]string, error) {
+	p, err := r.lookup("process.Top", name)
+	if err != nil {
+		return nil, err
+	}
+	return []string{strings.Join(p.spec.Cmd, " ")}, nil
+}
+
+// Stats implements ContainerRuntime. Statistics are sampled from the
+// process's cgroup; they are not available without one.
+func (r *ProcessRuntime) Stats(ctx context.Context, name string, observe func(reflow.Gauges)) error {
+	p, err := r.lookup("process.Stats", name)
+	if err != nil {
+		return err
+	}
+	if p.cgroup == "" {
+		return errors.E("process.Stats", name, errors.NotSupported, errors.New("no cgroup"))
+	}
+	var (
+		ticker   = time.NewTicker(time.Second)
+		lastCPU  time.Duration
+		lastTime time.Time
+	)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-p.done:
+			return nil
+		case <-ctx.Done():
+			return nil
+		}
+		mem, cpu, err := cgroupStats(p.cgroup)
+		if err != nil {
+			// The cgroup may have been removed as the process exited.
+			continue
+		}
+		now := time.Now()
+		gauges := reflow.Gauges{"mem": float64(mem)}
+		if !lastTime.IsZero() {
+			gauges["cpu"] = float64(cpu-lastCPU) / float64(now.Sub(lastTime))
+		}
+		lastCPU, lastTime = cpu, now
+		observe(gauges)
+	}
+}
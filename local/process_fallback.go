@@ -0,0 +1,46 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+// +build !linux
+
+package local
+
+import (
+	"os"
+	osexec "os/exec"
+	"syscall"
+	"time"
+
+	"github.com/grailbio/reflow/errors"
+)
+
+func (r *ProcessRuntime) sysProcAttr() *syscall.SysProcAttr {
+	return nil
+}
+
+func killProcess(p *os.Process) error {
+	return p.Kill()
+}
+
+func memTotal() (int64, error) {
+	return 0, errors.E("memtotal", errors.NotSupported)
+}
+
+func setupCgroup(dir string, memory int64) error {
+	return errors.E("cgroup", errors.NotSupported)
+}
+
+func startInCgroup(cmd *osexec.Cmd, dir string) error {
+	return errors.E("cgroup", errors.NotSupported)
+}
+
+func cgroupOOMKilled(dir string) bool {
+	return false
+}
+
+func cgroupStats(dir string) (mem int64, cpu time.Duration, err error) {
+	return 0, 0, errors.E("cgroup", errors.NotSupported)
+}
+
+func removeCgroup(dir string) {}
@@ -0,0 +1,246 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+// +build linux
+
+package local
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	osexec "os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/grailbio/reflow/errors"
+)
+
+// cgroupShim is the name (argv[0]) with which the running binary is
+// re-executed in order to start a process in a cgroup; see
+// startInCgroup.
+const cgroupShim = "reflow-cgroup-exec"
+
+func init() {
+	if len(os.Args) > 0 && os.Args[0] == cgroupShim {
+		runCgroupShim(os.Args[1:])
+	}
+}
+
+// sysProcAttr returns the process attributes used to sandbox
+// processes started by the runtime. Processes are placed in their own
+// process group, so that they may be killed together, and are killed
+// if the executor dies.
+func (r *ProcessRuntime) sysProcAttr() *syscall.SysProcAttr {
+	attr := &syscall.SysProcAttr{
+		Setpgid:   true,
+		Pdeathsig: syscall.SIGKILL,
+		Chroot:    r.Root,
+	}
+	if r.Sandbox {
+		attr.Cloneflags = syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS |
+			syscall.CLONE_NEWPID | syscall.CLONE_NEWIPC | syscall.CLONE_NEWUTS
+		// Map the executor's user to the same user in the sandbox, so
+		// that files created by the process are owned by the executor.
+		attr.UidMappings = []syscall.SysProcIDMap{{ContainerID: os.Getuid(), HostID: os.Getuid(), Size: 1}}
+		attr.GidMappings = []syscall.SysProcIDMap{{ContainerID: os.Getgid(), HostID: os.Getgid(), Size: 1}}
+	}
+	return attr
+}
+
+// killProcess kills the process p and its process group.
+func killProcess(p *os.Process) error {
+	if err := syscall.Kill(-p.Pid, syscall.SIGKILL); err != nil && err != syscall.ESRCH {
+		return p.Kill()
+	}
+	return nil
+}
+
+// memTotal returns the total system memory, in bytes.
+func memTotal() (int64, error) {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	scan := bufio.NewScanner(f)
+	for scan.Scan() {
+		fields := strings.Fields(scan.Text())
+		if len(fields) < 2 || fields[0] != "MemTotal:" {
+			continue
+		}
+		kb, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		return kb << 10, nil
+	}
+	if err := scan.Err(); err != nil {
+		return 0, err
+	}
+	return 0, errors.New("MemTotal not found in /proc/meminfo")
+}
+
+// setupCgroup creates the cgroup at dir and limits its memory (if
+// nonzero).
+func setupCgroup(dir string, memory int64) error {
+	if err := os.Mkdir(dir, 0755); err != nil && !os.IsExist(err) {
+		return err
+	}
+	if memory > 0 {
+		if err := writeCgroup(dir, "memory.max", strconv.FormatInt(memory, 10)); err != nil {
+			removeCgroup(dir)
+			return err
+		}
+		// As with Docker, memory limits are hard: the process may not swap.
+		// Not all kernels support swap accounting, so this is best effort.
+		writeCgroup(dir, "memory.swap.max", "0")
+	}
+	return nil
+}
+
+// startInCgroup starts cmd in the cgroup at dir, so that neither the
+// command nor its children ever run outside of it. The running binary
+// is started in place of the command, as a shim (see runCgroupShim)
+// that waits until its pid has been written to the cgroup before it
+// chroots (if the command's process attributes ask for it) and execs
+// the command.
+func startInCgroup(cmd *osexec.Cmd, dir string) error {
+	if len(cmd.ExtraFiles) > 0 {
+		return errors.New("commands with extra files cannot be started in a cgroup")
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	var root string
+	if cmd.SysProcAttr != nil {
+		root, cmd.SysProcAttr.Chroot = cmd.SysProcAttr.Chroot, ""
+	}
+	cmd.Args = append([]string{cgroupShim, root, cmd.Path}, cmd.Args...)
+	cmd.Path = exe
+	cmd.ExtraFiles = []*os.File{r}
+	err = cmd.Start()
+	r.Close()
+	if err != nil {
+		w.Close()
+		return err
+	}
+	if err := writeCgroup(dir, "cgroup.procs", strconv.Itoa(cmd.Process.Pid)); err != nil {
+		// Closing the pipe without writing to it makes the shim exit.
+		w.Close()
+		cmd.Wait()
+		return err
+	}
+	_, err = w.Write([]byte{0})
+	w.Close()
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}
+	return err
+}
+
+// runCgroupShim implements the shim started by startInCgroup. Its
+// arguments are the root to chroot to (if nonempty), the path of the
+// command, and the command's arguments. The shim waits for a byte on
+// file descriptor 3 before it execs the command; it exits if the
+// descriptor is closed first.
+func runCgroupShim(args []string) {
+	if len(args) < 3 {
+		fmt.Fprintln(os.Stderr, "reflow: invalid cgroup shim arguments")
+		os.Exit(127)
+	}
+	start := os.NewFile(3, "start")
+	var b [1]byte
+	if n, _ := start.Read(b[:]); n != 1 {
+		os.Exit(127)
+	}
+	start.Close()
+	root, path, argv := args[0], args[1], args[2:]
+	if root != "" {
+		if err := syscall.Chroot(root); err != nil {
+			fmt.Fprintf(os.Stderr, "reflow: chroot %s: %v\n", root, err)
+			os.Exit(127)
+		}
+		if err := syscall.Chdir("/"); err != nil {
+			fmt.Fprintf(os.Stderr, "reflow: chdir /: %v\n", err)
+			os.Exit(127)
+		}
+	}
+	err := syscall.Exec(path, argv, os.Environ())
+	fmt.Fprintf(os.Stderr, "reflow: exec %s: %v\n", path, err)
+	os.Exit(127)
+}
+
+func writeCgroup(dir, file, value string) error {
+	return ioutil.WriteFile(filepath.Join(dir, file), []byte(value), 0644)
+}
+
+// readCgroupKeys reads a flat keyed cgroup file, such as memory.events.
+func readCgroupKeys(dir, file string) (map[string]int64, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, file))
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[string]int64)
+	for _, line := range bytes.Split(b, []byte("\n")) {
+		fields := strings.Fields(string(line))
+		if len(fields) != 2 {
+			continue
+		}
+		if v, err := strconv.ParseInt(fields[1], 10, 64); err == nil {
+			m[fields[0]] = v
+		}
+	}
+	return m, nil
+}
+
+// cgroupOOMKilled tells whether any process in the cgroup at dir was
+// killed by the OOM killer.
+func cgroupOOMKilled(dir string) bool {
+	events, err := readCgroupKeys(dir, "memory.events")
+	return err == nil && events["oom_kill"] > 0
+}
+
+// cgroupStats returns the memory usage (excluding the page cache) and
+// the total CPU time of the cgroup at dir.
+func cgroupStats(dir string) (mem int64, cpu time.Duration, err error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, "memory.current"))
+	if err != nil {
+		return 0, 0, err
+	}
+	mem, err = strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("memory.current: %v", err)
+	}
+	if stat, err := readCgroupKeys(dir, "memory.stat"); err == nil {
+		mem -= stat["file"]
+	}
+	stat, err := readCgroupKeys(dir, "cpu.stat")
+	if err != nil {
+		return 0, 0, err
+	}
+	return mem, time.Duration(stat["usage_usec"]) * time.Microsecond, nil
+}
+
+// removeCgroup removes the (empty) cgroup at dir.
+func removeCgroup(dir string) {
+	// The kernel may take a moment to release the cgroup's last process.
+	for i := 0; i < 10; i++ {
+		if err := os.Remove(dir); err == nil || os.IsNotExist(err) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
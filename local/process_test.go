@@ -0,0 +1,324 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package local
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grailbio/reflow"
+	"github.com/grailbio/reflow/errors"
+	"github.com/grailbio/testutil"
+)
+
+func newTestProcessRuntime(t *testing.T) (*ProcessRuntime, func()) {
+	t.Helper()
+	dir, cleanup := testutil.TempDir(t, "", "processruntime")
+	r := &ProcessRuntime{Dir: dir}
+	if err := r.Init(); err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	return r, cleanup
+}
+
+func TestProcessRuntime(t *testing.T) {
+	r, cleanup := newTestProcessRuntime(t)
+	defer cleanup()
+	ctx := context.Background()
+	spec := ContainerSpec{
+		Cmd: []string{"/bin/bash", "-c", "echo out; echo err >&2; exit 3"},
+	}
+	if _, err := r.Inspect(ctx, "reflow-test-1"); !errors.Is(errors.NotExist, err) {
+		t.Fatalf("expected NotExist, got %v", err)
+	}
+	if err := r.Create(ctx, "reflow-test-1", spec); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Create(ctx, "reflow-test-1", spec); err == nil {
+		t.Fatal("expected error")
+	}
+	if err := r.Create(ctx, "other", spec); err != nil {
+		t.Fatal(err)
+	}
+	names, err := r.List(ctx, "reflow-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := names, []string{"reflow-test-1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if err := r.Start(ctx, "reflow-test-1"); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	code, err := r.Wait(ctx, "reflow-test-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := code, int64(3); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	info, err := r.Inspect(ctx, "reflow-test-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.State.Running || info.State.ExitCode != 3 || info.State.OOMKilled {
+		t.Errorf("unexpected state %+v", info.State)
+	}
+	var stdout, stderr bytes.Buffer
+	if err := r.Logs(ctx, "reflow-test-1", &stdout, &stderr, false); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := stdout.String(), "out\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got, want := stderr.String(), "err\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if err := r.Remove(ctx, "reflow-test-1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Wait(ctx, "reflow-test-1"); !errors.Is(errors.NotExist, err) {
+		t.Fatalf("expected NotExist, got %v", err)
+	}
+}
+
+func TestProcessRuntimeKill(t *testing.T) {
+	r, cleanup := newTestProcessRuntime(t)
+	defer cleanup()
+	ctx := context.Background()
+	if err := r.Create(ctx, "sleep", ContainerSpec{Cmd: []string{"/bin/sleep", "100"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Start(ctx, "sleep"); err != nil {
+		t.Fatal(err)
+	}
+	info, err := r.Inspect(ctx, "sleep")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.State.Running || info.State.Pid == 0 {
+		t.Errorf("unexpected state %+v", info.State)
+	}
+	if err := r.Kill(ctx, "sleep"); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	if code, err := r.Wait(ctx, "sleep"); err != nil {
+		t.Fatal(err)
+	} else if code == 0 {
+		t.Error("expected nonzero exit code")
+	}
+}
+
+func TestProcessRuntimeCgroup(t *testing.T) {
+	var root string
+	for _, dir := range []string{"/sys/fs/cgroup/unified", "/sys/fs/cgroup"} {
+		if _, err := os.Stat(filepath.Join(dir, "cgroup.procs")); err == nil {
+			root = dir
+			break
+		}
+	}
+	if root == "" {
+		t.Skip("cgroup v2 not mounted")
+	}
+	cgroup, err := ioutil.TempDir(root, "reflowtest")
+	if err != nil {
+		t.Skipf("cgroup v2 not writable: %v", err)
+	}
+	defer os.Remove(cgroup)
+	r, cleanup := newTestProcessRuntime(t)
+	defer cleanup()
+	r.Cgroup = cgroup
+	ctx := context.Background()
+	// The process (and its children) should run in its cgroup from
+	// the start.
+	spec := ContainerSpec{Cmd: []string{"/bin/bash", "-c", "cat /proc/self/cgroup"}}
+	if err := r.Create(ctx, "cgroup", spec); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Start(ctx, "cgroup"); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	if code, err := r.Wait(ctx, "cgroup"); err != nil {
+		t.Fatal(err)
+	} else if code != 0 {
+		t.Fatalf("got exit code %d", code)
+	}
+	var stdout, stderr bytes.Buffer
+	if err := r.Logs(ctx, "cgroup", &stdout, &stderr, false); err != nil {
+		t.Fatal(err)
+	}
+	want := "0::" + strings.TrimPrefix(filepath.Join(cgroup, "cgroup"), root) + "\n"
+	if got := stdout.String(); !strings.Contains(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestProcessExec(t *testing.T) {
+	r, cleanup := newTestProcessRuntime(t)
+	defer cleanup()
+	dir, cleanupDir := testutil.TempDir(t, "", "processexec")
+	defer cleanupDir()
+	x := &Executor{Runtime: r, Dir: dir}
+	x.SetResources(reflow.Resources{"mem": 1 << 30, "cpu": 2, "disk": 1e10})
+	if err := x.Start(); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	id := reflow.Digester.FromString("process exec")
+	exec, err := x.Put(ctx, id, reflow.ExecConfig{
+		Type: "exec",
+		Cmd:  "echo foobar > $tmp/x; cat $tmp/x > $out",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	if err := exec.Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+	res, err := exec.Result(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := reflow.Result{Fileset: reflow.Fileset{
+		Map: map[string]reflow.File{".": {ID: reflow.Digester.FromString("foobar\n"), Size: 7}},
+	}}
+	if !reflect.DeepEqual(res, want) {
+		t.Fatalf("got %v, want %v", res, want)
+	}
+}
+
+type testSecrets map[string]string
+
+func (s testSecrets) Secret(ctx context.Context, name string) (string, error) {
+	v, ok := s[name]
+	if !ok {
+		return "", errors.E("secret", name, errors.NotExist)
+	}
+	return v, nil
+}
+
+func TestProcessExecEnv(t *testing.T) {
+	r, cleanup := newTestProcessRuntime(t)
+	defer cleanup()
+	dir, cleanupDir := testutil.TempDir(t, "", "processexec")
+	defer cleanupDir()
+	x := &Executor{Runtime: r, Dir: dir, Secrets: testSecrets{"DB_PASS": "hunter2"}}
+	x.SetResources(reflow.Resources{"mem": 1 << 30, "cpu": 2, "disk": 1e10})
+	if err := x.Start(); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	id := reflow.Digester.FromString("process exec env")
+	exec, err := x.Put(ctx, id, reflow.ExecConfig{
+		Type:    "exec",
+		Cmd:     "echo $GREETING $DB_PASS > $out",
+		Env:     map[string]string{"GREETING": "hello"},
+		Secrets: []string{"DB_PASS"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := exec.Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+	res, err := exec.Result(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Err != nil {
+		t.Fatal(res.Err)
+	}
+	if got, want := res.Fileset.Map["."].ID, reflow.Digester.FromString("hello hunter2\n"); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	inspect, err := exec.Inspect(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var env []string
+	if inspect.Docker.Config != nil {
+		env = inspect.Docker.Config.Env
+	}
+	var greeting bool
+	for _, kv := range env {
+		if strings.Contains(kv, "hunter2") {
+			t.Errorf("secret value exposed in inspect: %s", kv)
+		}
+		greeting = greeting || kv == "GREETING=hello"
+	}
+	if !greeting {
+		t.Errorf("GREETING missing from inspect environment %v", env)
+	}
+
+	// Execs that request secrets that do not exist fail.
+	exec, err = x.Put(ctx, reflow.Digester.FromString("missing secret"), reflow.ExecConfig{
+		Type:    "exec",
+		Cmd:     "echo $MISSING > $out",
+		Secrets: []string{"MISSING"},
+	})
+	if err == nil {
+		err = exec.Wait(ctx)
+	}
+	if err == nil || !errors.Is(errors.NotExist, err) {
+		t.Errorf("expected NotExist error, got %v", err)
+	}
+}
+
+func TestProcessExecTimeout(t *testing.T) {
+	r, cleanup := newTestProcessRuntime(t)
+	defer cleanup()
+	dir, cleanupDir := testutil.TempDir(t, "", "processexec")
+	defer cleanupDir()
+	x := &Executor{Runtime: r, Dir: dir}
+	x.SetResources(reflow.Resources{"mem": 1 << 30, "cpu": 2, "disk": 1e10})
+	if err := x.Start(); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	id := reflow.Digester.FromString("process exec timeout")
+	exec, err := x.Put(ctx, id, reflow.ExecConfig{
+		Type:    "exec",
+		Cmd:     "sleep 60; echo done > $out",
+		Timeout: 100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := exec.Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+	res, err := exec.Result(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Err == nil || !errors.Is(errors.ExecTimeout, res.Err) {
+		t.Errorf("expected exec timeout error, got %v", res.Err)
+	}
+	inspect, err := exec.Inspect(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inspect.ExecError == nil || !errors.Is(errors.ExecTimeout, inspect.ExecError) {
+		t.Errorf("expected exec timeout error in inspect, got %v", inspect.ExecError)
+	}
+}
@@ -0,0 +1,427 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package local
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"docker.io/go-docker"
+	"docker.io/go-docker/api/types"
+	"docker.io/go-docker/api/types/container"
+	"docker.io/go-docker/api/types/network"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/grailbio/infra"
+	"github.com/grailbio/reflow"
+	"github.com/grailbio/reflow/errors"
+	"github.com/grailbio/reflow/internal/ecrauth"
+)
+
+func init() {
+	infra.Register("dockerruntime", new(DockerRuntime))
+	infra.Register("podman", new(PodmanRuntime))
+}
+
+// ContainerRuntime is the interface through which the executor
+// manages the containers that run its execs. Containers are
+// identified by name. Container state is reported in the form of
+// Docker's inspect output, which is stored in exec manifests.
+//
+// Errors returned by a ContainerRuntime should be classified: in
+// particular, operations on containers that do not exist should
+// return errors of kind errors.NotExist.
+type ContainerRuntime interface {
+	// Resources returns the total memory ("mem", in bytes) and CPUs
+	// ("cpu") available to containers.
+	Resources(ctx context.Context) (reflow.Resources, error)
+	// EnsureImage makes sure that the image ref is available to the
+	// runtime, pulling it if necessary.
+	EnsureImage(ctx context.Context, auth ecrauth.Interface, ref string) error
+	// BindMounts tells whether the runtime mounts ContainerSpec.Binds
+	// into the container at their container paths. If it does not,
+	// commands must refer to host paths directly.
+	BindMounts() bool
+
+	// Create creates, but does not start, a container.
+	Create(ctx context.Context, name string, spec ContainerSpec) error
+	// Start starts a created container.
+	Start(ctx context.Context, name string) error
+	// Wait waits for the container to stop and returns its exit code.
+	Wait(ctx context.Context, name string) (int64, error)
+	// Inspect returns the current state of the container.
+	Inspect(ctx context.Context, name string) (types.ContainerJSON, error)
+	// Logs writes the container's standard output and error to the
+	// provided writers, either of which may be nil. If follow is true,
+	// Logs continues to write logs until the container stops or the
+	// context is done.
+	Logs(ctx context.Context, name string, stdout, stderr io.Writer, follow bool) error
+	// Kill kills a running container.
+	Kill(ctx context.Context, name string) error
+	// Remove removes a container.
+	Remove(ctx context.Context, name string) error
+	// List returns the names of all containers with the provided prefix.
+	List(ctx context.Context, prefix string) ([]string, error)
+
+	// Shell starts an interactive shell inside a running container.
+	Shell(ctx context.Context, name string) (io.ReadWriteCloser, error)
+	// Top returns the commands of the processes running in the container.
+	Top(ctx context.Context, name string) ([]string, error)
+	// Stats samples the container's resource usage until the
+	// container stops or the context is done. Each sample is reported
+	// to observe as a set of gauges: "cpu" (load, in CPUs) and "mem"
+	// (bytes), either of which may be missing.
+	Stats(ctx context.Context, name string, observe func(reflow.Gauges)) error
+}
+
+// Bind binds a host directory into a container.
+type Bind struct {
+	// HostPath is the directory on the host.
+	HostPath string
+	// Path is the path at which the directory is mounted in the container.
+	Path string
+}
+
+// ContainerSpec describes a container to be created by a ContainerRuntime.
+type ContainerSpec struct {
+	// Image is the container image.
+	Image string
+	// Cmd is the command run in the container.
+	Cmd []string
+	// Env is the container's environment, in the form "key=value".
+	Env []string
+	// Binds are the host directories bound into the container.
+	Binds []Bind
+	// Labels are attached to the container.
+	Labels map[string]string
+	// Memory is the container's hard memory limit in bytes. Memory is
+	// not limited if it is zero.
+	Memory int64
+}
+
+// DockerRuntime is a ContainerRuntime which manages containers through
+// the Docker API. DockerRuntime is also an infra provider for the
+// runtime.
+type DockerRuntime struct {
+	// Client is the Docker client. It is initialized from Host if nil.
+	Client *docker.Client `yaml:"-"`
+	// Host is the address of the Docker daemon. If empty, $DOCKER_HOST
+	// is used, or else the daemon's default socket.
+	Host string `yaml:"host,omitempty"`
+	// Rootless indicates that the daemon runs containers without root
+	// privileges, as rootless Podman does. Containers then run as the
+	// daemon's user, and their OOM scores are not adjusted.
+	Rootless bool `yaml:"rootless,omitempty"`
+}
+
+// Help implements infra.Provider.
+func (*DockerRuntime) Help() string {
+	return "run execs in containers managed by the Docker daemon"
+}
+
+// Flags implements infra.Provider.
+func (r *DockerRuntime) Flags(flags *flag.FlagSet) {
+	flags.StringVar(&r.Host, "host", "", "address of the Docker daemon (default $DOCKER_HOST or unix:///var/run/docker.sock)")
+}
+
+// Init implements infra.Provider.
+func (r *DockerRuntime) Init() error {
+	if r.Client != nil {
+		return nil
+	}
+	addr := os.ExpandEnv(r.Host)
+	if addr == "" {
+		addr = os.Getenv("DOCKER_HOST")
+	}
+	if addr == "" {
+		addr = "unix:///var/run/docker.sock"
+	}
+	var err error
+	r.Client, err = docker.NewClient(
+		addr, "1.22", /*client.DefaultVersion*/
+		nil, map[string]string{"user-agent": "reflow"})
+	return err
+}
+
+// Resources implements ContainerRuntime.
+func (r *DockerRuntime) Resources(ctx context.Context) (reflow.Resources, error) {
+	info, err := r.Client.Info(ctx)
+	if err != nil {
+		return nil, errors.E("docker.Info", kind(err), err)
+	}
+	return reflow.Resources{
+		"mem": float64(info.MemTotal),
+		"cpu": float64(info.NCPU),
+	}, nil
+}
+
+// EnsureImage implements ContainerRuntime.
+func (r *DockerRuntime) EnsureImage(ctx context.Context, auth ecrauth.Interface, ref string) error {
+	return ensureImage(ctx, r.Client, auth, ref)
+}
+
+// BindMounts implements ContainerRuntime.
+func (r *DockerRuntime) BindMounts() bool { return true }
+
+// Create implements ContainerRuntime. Containers use the host's
+// network.
+func (r *DockerRuntime) Create(ctx context.Context, name string, spec ContainerSpec) error {
+	hostConfig := &container.HostConfig{
+		NetworkMode: container.NetworkMode("host"),
+	}
+	for _, b := range spec.Binds {
+		hostConfig.Binds = append(hostConfig.Binds, b.HostPath+":"+b.Path)
+	}
+	config := &container.Config{
+		Image:      spec.Image,
+		Entrypoint: spec.Cmd,
+		Cmd:        []string{},
+		Env:        spec.Env,
+		Labels:     spec.Labels,
+	}
+	if !r.Rootless {
+		config.User = dockerUser
+		// Try to ensure that jobs we control get killed before the reflowlet,
+		// so that we don't lose adjacent tasks unnecessarily and so that
+		// errors are more sensible to the user.
+		hostConfig.OomScoreAdj = 1000
+	}
+	// If the container memory limit (the cgroup limit) is exceeded
+	// before the OOM Killer kills the process, the following message
+	// is recorded in /dev/kmsg:
+	// Memory cgroup out of memory: Kill process <pid>
+	// If MemorySwap is not set to be equal Memory, the container will be
+	// able to swap up to twice the amount of memory set in the memory limit.
+	// In order to ensure that Memory is set to a hard limit, MemorySwap is also
+	// set equal to memory.
+	if spec.Memory > 0 {
+		hostConfig.Resources.Memory = spec.Memory
+		hostConfig.Resources.MemorySwap = spec.Memory
+	}
+	networkingConfig := &network.NetworkingConfig{}
+	if _, err := r.Client.ContainerCreate(ctx, config, hostConfig, networkingConfig, name); err != nil {
+		return errors.E(
+			"ContainerCreate",
+			kind(err),
+			name,
+			fmt.Sprint(config), fmt.Sprint(hostConfig), fmt.Sprint(networkingConfig),
+			err,
+		)
+	}
+	return nil
+}
+
+// Start implements ContainerRuntime.
+func (r *DockerRuntime) Start(ctx context.Context, name string) error {
+	if err := r.Client.ContainerStart(ctx, name, types.ContainerStartOptions{}); err != nil {
+		return errors.E("ContainerStart", name, kind(err), err)
+	}
+	return nil
+}
+
+// Wait implements ContainerRuntime.
+func (r *DockerRuntime) Wait(ctx context.Context, name string) (int64, error) {
+	// The documentation for ContainerWait seems to imply that both channels will
+	// be sent. In practice it's one or the other, and it's also not buffered. Cool API.
+	respc, errc := r.Client.ContainerWait(ctx, name, container.WaitConditionNotRunning)
+	select {
+	case err := <-errc:
+		return 0, errors.E("ContainerWait", name, kind(err), err)
+	case resp := <-respc:
+		return resp.StatusCode, nil
+	}
+}
+
+// Inspect implements ContainerRuntime.
+func (r *DockerRuntime) Inspect(ctx context.Context, name string) (types.ContainerJSON, error) {
+	info, err := r.Client.ContainerInspect(ctx, name)
+	if err != nil {
+		return info, errors.E("ContainerInspect", name, kind(err), err)
+	}
+	return info, nil
+}
+
+// Logs implements ContainerRuntime.
+func (r *DockerRuntime) Logs(ctx context.Context, name string, stdout, stderr io.Writer, follow bool) error {
+	opts := types.ContainerLogsOptions{ShowStdout: stdout != nil, ShowStderr: stderr != nil, Follow: follow}
+	rc, err := r.Client.ContainerLogs(ctx, name, opts)
+	if err != nil {
+		return errors.E("ContainerLogs", name, fmt.Sprint(opts), kind(err), err)
+	}
+	defer rc.Close()
+	if stdout == nil {
+		stdout = ioutil.Discard
+	}
+	if stderr == nil {
+		stderr = ioutil.Discard
+	}
+	_, err = stdcopy.StdCopy(stdout, stderr, rc)
+	return err
+}
+
+// Kill implements ContainerRuntime.
+func (r *DockerRuntime) Kill(ctx context.Context, name string) error {
+	if err := r.Client.ContainerKill(ctx, name, "KILL"); err != nil {
+		return errors.E("ContainerKill", name, kind(err), err)
+	}
+	return nil
+}
+
+// Remove implements ContainerRuntime.
+func (r *DockerRuntime) Remove(ctx context.Context, name string) error {
+	if err := r.Client.ContainerRemove(ctx, name, types.ContainerRemoveOptions{Force: true}); err != nil {
+		return errors.E("ContainerRemove", name, kind(err), err)
+	}
+	return nil
+}
+
+// List implements ContainerRuntime.
+func (r *DockerRuntime) List(ctx context.Context, prefix string) ([]string, error) {
+	cs, err := r.Client.ContainerList(ctx, types.ContainerListOptions{All: true})
+	if err != nil {
+		return nil, errors.E("ContainerList", kind(err), err)
+	}
+	var names []string
+	for _, c := range cs {
+		if len(c.Names) != 1 {
+			continue
+		}
+		// Docker prefixes container names with a slash.
+		name := strings.TrimPrefix(c.Names[0], "/")
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// Shell implements ContainerRuntime.
+func (r *DockerRuntime) Shell(ctx context.Context, name string) (io.ReadWriteCloser, error) {
+	c := types.ExecConfig{
+		Cmd:          []string{"/bin/bash"},
+		AttachStdin:  true,
+		AttachStdout: true,
+		AttachStderr: true,
+		Tty:          true,
+		DetachKeys:   "ctrl-p,ctrl-q",
+	}
+	response, err := r.Client.ContainerExecCreate(ctx, name, c)
+	if err != nil {
+		return nil, errors.E("ContainerExecCreate", name, kind(err), err)
+	}
+	conn, err := r.Client.ContainerExecAttach(ctx, response.ID, types.ExecConfig{})
+	if err != nil {
+		return nil, errors.E("ContainerExecAttach", name, kind(err), err)
+	}
+	return conn.Conn, nil
+}
+
+// Top implements ContainerRuntime.
+func (r *DockerRuntime) Top(ctx context.Context, name string) ([]string, error) {
+	top, err := r.Client.ContainerTop(ctx, name, []string{"auwx"})
+	if err != nil {
+		return nil, errors.E("ContainerTop", name, kind(err), err)
+	}
+	var i int
+	for ; i < len(top.Titles); i++ {
+		if top.Titles[i] == "COMMAND" {
+			break
+		}
+	}
+	if i == len(top.Titles) {
+		return nil, nil
+	}
+	commands := make([]string, len(top.Processes))
+	for j, proc := range top.Processes {
+		commands[j] = proc[i]
+	}
+	return commands, nil
+}
+
+// Stats implements ContainerRuntime.
+func (r *DockerRuntime) Stats(ctx context.Context, name string, observe func(reflow.Gauges)) error {
+	resp, err := r.Client.ContainerStats(ctx, name, true /*stream*/)
+	if err != nil {
+		return errors.E("ContainerStats", name, kind(err), err)
+	}
+	defer resp.Body.Close()
+	dec := json.NewDecoder(resp.Body)
+	for {
+		// CPU and memory stats are obtained from the go-docker API. This means that CPU/memory profiling
+		// is entirely dependent on receiving a valid docker stats JSON. If no valid JSON is received before
+		// ctx is canceled, no profiling data for CPU or memory will be reported.
+		var v types.StatsJSON
+		if err := dec.Decode(&v); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			dec = json.NewDecoder(io.MultiReader(dec.Buffered(), resp.Body))
+			select {
+			case <-time.After(100 * time.Millisecond):
+				continue
+			case <-ctx.Done():
+				return nil
+			}
+		}
+		var (
+			deltaCPU = float64(v.CPUStats.CPUUsage.TotalUsage - v.PreCPUStats.CPUUsage.TotalUsage)
+			deltaSys = float64(v.CPUStats.SystemUsage - v.PreCPUStats.SystemUsage)
+			ncpu     = float64(v.CPUStats.OnlineCPUs)
+			gauges   = make(reflow.Gauges)
+		)
+		if deltaSys > 0 {
+			// We compute the CPU time here by looking at the proportion of
+			// this container's CPU time to total system time. This is normalized
+			// and so needs to be multiplied by the number of CPUs to get a
+			// portable load number.
+			gauges["cpu"] = ncpu * deltaCPU / deltaSys
+		}
+		// We exclude page cache memory since this is not counted towards
+		// your limits.
+		gauges["mem"] = float64(v.MemoryStats.Usage - v.MemoryStats.Stats["cache"])
+		observe(gauges)
+	}
+}
+
+var dockerUser = fmt.Sprintf("%d:%d", os.Getuid(), os.Getgid())
+
+// Kind returns the kind of a docker error.
+func kind(err error) errors.Kind {
+	switch {
+	case docker.IsErrNotFound(err):
+		return errors.NotExist
+	case docker.IsErrUnauthorized(err):
+		return errors.NotAllowed
+	default:
+		// Liberally pick unavailable as the default error, so that lower
+		// layers can retry errors that may be fruitfully retried.
+		// This is always safe to do, but may cause extra work.
+		return errors.Unavailable
+	}
+}
+
+// PodmanRuntime is a ContainerRuntime which manages containers through
+// Podman's Docker-compatible API service (see podman-system-service(1)).
+// By default, it connects to the rootless service of the current user.
+type PodmanRuntime struct {
+	DockerRuntime `yaml:",inline"`
+}
+
+// Help implements infra.Provider.
+func (*PodmanRuntime) Help() string {
+	return "run execs in containers managed by Podman"
+}
+
+// Flags implements infra.Provider.
+func (r *PodmanRuntime) Flags(flags *flag.FlagSet) {
+	flags.StringVar(&r.Host, "host", "unix://$XDG_RUNTIME_DIR/podman/podman.sock", "address of the Podman API service")
+	flags.BoolVar(&r.Rootless, "rootless", true, "whether Podman runs rootless")
+}
@@ -0,0 +1,421 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package lsp
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/grailbio/reflow/internal/scanner"
+	"github.com/grailbio/reflow/syntax"
+	"github.com/grailbio/reflow/types"
+)
+
+// A binding is an identifier bound in an analyzed module.
+type binding struct {
+	name string
+	// keyword is the keyword used to declare the binding:
+	// "val", "param", "type", or "func" (for function arguments).
+	keyword string
+	// Start and end are the byte offsets of the identifier in the
+	// module's source.
+	start, end int
+	// Pos is the position of the binding, as recorded by the parser.
+	pos scanner.Position
+	typ *types.T
+	doc string
+	// module is the module bound to the identifier, if it is
+	// bound directly by a make expression; path is the path
+	// of the module.
+	module syntax.Module
+	path   string
+	// Toplevel tells whether the binding is declared at the
+	// toplevel of the module (as a parameter or declaration).
+	toplevel bool
+}
+
+// A definition is the location of an identifier's binding.
+type definition struct {
+	// Pos is the position of the binding, as recorded by the parser.
+	pos scanner.Position
+	// System is the name of the system module that defines the
+	// identifier, if any. System modules have no source.
+	system string
+	name   string
+}
+
+// A reference is an occurrence of an identifier in an analyzed module.
+type reference struct {
+	start, end int
+	name       string
+	keyword    string
+	typ        *types.T
+	doc        string
+	def        *definition
+}
+
+// An analysis is the result of parsing and type checking a module.
+type analysis struct {
+	path string
+	text string
+	// Module is the module's syntax tree; it is nil if the module
+	// does not parse.
+	module *syntax.ModuleImpl
+	errs   []syntax.SourceError
+	// Bindings and refs are sorted by their offsets.
+	bindings []*binding
+	refs     []*reference
+}
+
+// analyze parses and type checks the module at path, reading sources
+// from src, and then indexes the resulting syntax tree.
+func analyze(path string, src syntax.Sourcer) *analysis {
+	a := &analysis{path: path}
+	if b, err := src.Source(path); err == nil {
+		a.text = string(b)
+	}
+	sess := syntax.NewSession(src)
+	sess.Uses = make(map[*syntax.Expr]*types.Symbol)
+	var err error
+	a.module, err = sess.Check(path)
+	a.errs = syntax.SourceErrors(err)
+	if a.module == nil {
+		return a
+	}
+	x := &indexer{
+		analysis: a,
+		uses:     sess.Uses,
+		byPos:    make(map[scanner.Position]*binding),
+		argOf:    make(map[*syntax.Expr]*binding),
+	}
+	for _, d := range a.module.ParamDecls {
+		x.decl(d, "param")
+	}
+	for _, d := range a.module.Decls {
+		x.decl(d, "val")
+	}
+	x.resolve()
+	sort.SliceStable(a.bindings, func(i, j int) bool { return a.bindings[i].start < a.bindings[j].start })
+	sort.SliceStable(a.refs, func(i, j int) bool { return a.refs[i].start < a.refs[j].start })
+	return a
+}
+
+// Ref returns the reference at the byte offset off, if any.
+func (a *analysis) ref(off int) *reference {
+	for _, r := range a.refs {
+		if r.start <= off && off <= r.end {
+			return r
+		}
+	}
+	return nil
+}
+
+// Lookup returns the binding of the identifier name that is nearest
+// to, and precedes, the byte offset off. If there is no such binding,
+// the first binding of name is returned.
+func (a *analysis) lookup(name string, off int) *binding {
+	var b *binding
+	for _, c := range a.bindings {
+		if c.name != name {
+			continue
+		}
+		if b == nil || c.start <= off {
+			b = c
+		}
+	}
+	return b
+}
+
+// An indexer walks a type checked syntax tree to compute the
+// bindings and references of an analysis.
+type indexer struct {
+	*analysis
+	uses  map[*syntax.Expr]*types.Symbol
+	byPos map[scanner.Position]*binding
+	// Idents and derefs are the identifier and field expressions
+	// encountered in the walk; they are resolved once all bindings
+	// are known.
+	idents, derefs []*syntax.Expr
+	// Depth is the expression depth of the walk.
+	depth int
+	// Args is the stack of function argument scopes in the walk;
+	// argOf stores the argument binding of identifier expressions
+	// that refer to function arguments.
+	args  []map[string]*binding
+	argOf map[*syntax.Expr]*binding
+	// DeclPos is the position of the pattern of the declaration
+	// being walked.
+	declPos scanner.Position
+}
+
+func (x *indexer) bind(pos scanner.Position, name, keyword string, typ *types.T, doc string) *binding {
+	if pos.Filename != x.path || !pos.IsValid() {
+		return nil
+	}
+	start, end, ok := locate(x.text, pos.Offset, name)
+	if !ok {
+		return nil
+	}
+	b := &binding{name: name, keyword: keyword, start: start, end: end, pos: pos, typ: typ, doc: doc, toplevel: x.depth == 0}
+	x.bindings = append(x.bindings, b)
+	x.byPos[pos] = b
+	x.refs = append(x.refs, &reference{
+		start: start, end: end, name: name, keyword: keyword, typ: typ, doc: doc,
+		def: &definition{pos: pos, name: name},
+	})
+	return b
+}
+
+func (x *indexer) decl(d *syntax.Decl, keyword string) {
+	if d.Pat != nil {
+		x.declPos = d.Pat.Position
+	}
+	switch d.Kind {
+	case syntax.DeclType:
+		x.bind(d.Position, d.Ident, "type", d.Type, d.Comment)
+	case syntax.DeclDeclare:
+		x.bind(d.Position, d.Ident, keyword, d.Type, d.Comment)
+	case syntax.DeclAssign:
+		if d.Pat != nil && d.Type != nil {
+			env := types.NewEnv()
+			// Errors are reported by the type checker; bind what we can.
+			_ = d.Pat.BindTypes(env, d.Type, types.Never)
+			for id, sym := range env.Values {
+				b := x.bind(sym.Position, id, keyword, sym.Value, d.Comment)
+				if b != nil && d.Pat.Kind == syntax.PatIdent && d.Expr.Kind == syntax.ExprMake {
+					b.module = d.Expr.Module
+					b.path, _ = d.Expr.Left.Val.(string)
+				}
+			}
+		}
+	}
+	x.expr(d.Expr)
+}
+
+func (x *indexer) expr(e *syntax.Expr) {
+	if e == nil {
+		return
+	}
+	x.depth++
+	defer func() { x.depth-- }()
+	switch e.Kind {
+	case syntax.ExprIdent:
+		x.idents = append(x.idents, e)
+		for i := len(x.args) - 1; i >= 0; i-- {
+			if b := x.args[i][e.Ident]; b != nil {
+				x.argOf[e] = b
+				break
+			}
+		}
+	case syntax.ExprDeref:
+		x.derefs = append(x.derefs, e)
+	case syntax.ExprFunc:
+		// Functions declared with the "func" keyword are not
+		// positioned; their arguments follow the declaration's
+		// identifier.
+		pos := e.Position
+		if !pos.IsValid() {
+			pos = x.declPos
+		}
+		scope := make(map[string]*binding)
+		for _, arg := range e.Args {
+			scope[arg.Name] = x.bind(pos, arg.Name, "func", arg.T, "")
+		}
+		x.args = append(x.args, scope)
+		defer func() { x.args = x.args[:len(x.args)-1] }()
+	}
+	for _, d := range e.Decls {
+		x.decl(d, "val")
+	}
+	for _, sub := range e.Subexpr() {
+		x.expr(sub)
+	}
+	x.expr(e.ComprExpr)
+	for _, c := range e.ComprClauses {
+		x.expr(c.Expr)
+	}
+	for _, c := range e.CaseClauses {
+		x.expr(c.Expr)
+	}
+	if e.Template != nil {
+		for _, arg := range e.Template.Args {
+			x.expr(arg)
+		}
+	}
+}
+
+// resolve computes references for the identifier and field
+// expressions encountered in the walk.
+func (x *indexer) resolve() {
+	for _, e := range x.idents {
+		if e.Filename != x.path || !e.Position.IsValid() {
+			continue
+		}
+		start, end, ok := locate(x.text, e.Offset, e.Ident)
+		if !ok {
+			continue
+		}
+		r := &reference{start: start, end: end, name: e.Ident, keyword: "val", typ: e.Type}
+		sym := x.uses[e]
+		switch b := x.argOf[e]; {
+		case b != nil && (sym == nil || !sym.Position.IsValid() || sym.Position == b.pos):
+			r.def = &definition{pos: b.pos, name: e.Ident}
+			r.keyword = b.keyword
+		case sym != nil && sym.Position.IsValid():
+			r.def = &definition{pos: sym.Position, name: e.Ident}
+			if b := x.byPos[sym.Position]; b != nil {
+				r.keyword, r.doc = b.keyword, b.doc
+			}
+		}
+		x.refs = append(x.refs, r)
+	}
+	for _, e := range x.derefs {
+		if e.Left.Type == nil {
+			continue
+		}
+		off := maxOffset(e.Left, x.path)
+		if off < 0 {
+			continue
+		}
+		start, end, ok := locateField(x.text, off, e.Ident)
+		if !ok {
+			continue
+		}
+		r := &reference{start: start, end: end, name: e.Ident, keyword: "val", typ: e.Type}
+		if m, path := x.moduleOf(e.Left); m != nil {
+			r.doc = m.Doc(e.Ident)
+			r.def = moduleDef(m, path, e.Ident)
+		}
+		x.refs = append(x.refs, r)
+	}
+}
+
+// ModuleOf returns the module (and its path) to which the expression
+// e evaluates, if it is known.
+func (x *indexer) moduleOf(e *syntax.Expr) (syntax.Module, string) {
+	switch e.Kind {
+	case syntax.ExprMake:
+		path, _ := e.Left.Val.(string)
+		return e.Module, path
+	case syntax.ExprIdent:
+		if sym := x.uses[e]; sym != nil {
+			if b := x.byPos[sym.Position]; b != nil {
+				return b.module, b.path
+			}
+		}
+	}
+	return nil, ""
+}
+
+// ModuleDef returns the definition of the identifier name in the
+// module m, opened from the provided path.
+func moduleDef(m syntax.Module, path, name string) *definition {
+	if strings.HasPrefix(path, "$/") {
+		return &definition{system: path[2:], name: name}
+	}
+	impl, ok := m.(*syntax.ModuleImpl)
+	if !ok {
+		return nil
+	}
+	for _, d := range impl.Decls {
+		switch d.Kind {
+		case syntax.DeclType:
+			// Session.Open qualifies declaration identifiers with
+			// the module's name.
+			if d.Ident == name || strings.HasSuffix(d.Ident, "."+name) {
+				return &definition{pos: d.Position, name: name}
+			}
+		case syntax.DeclAssign, syntax.DeclDeclare:
+			if d.Pat == nil {
+				continue
+			}
+			env := types.NewEnv()
+			_ = d.Pat.BindTypes(env, d.Type, types.Never)
+			if sym := env.Values[name]; sym != nil {
+				return &definition{pos: sym.Position, name: name}
+			}
+		}
+	}
+	return nil
+}
+
+// maxOffset returns the largest offset of the positions recorded in
+// the expression tree e in the provided file, or -1 if there are none.
+func maxOffset(e *syntax.Expr, file string) int {
+	max := -1
+	if e.Filename == file && e.Position.IsValid() {
+		max = e.Offset
+	}
+	for _, sub := range e.Subexpr() {
+		if off := maxOffset(sub, file); off > max {
+			max = off
+		}
+	}
+	return max
+}
+
+// Locate returns the byte range of the identifier name at the offset
+// off in text. The parser records positions at the end of tokens; for
+// some bindings (e.g., function declarations and arguments), it records
+// the end of a preceding token on the same line. Thus the identifier
+// either ends at off or follows it on the same line.
+func locate(text string, off int, name string) (start, end int, ok bool) {
+	if name == "" || off < 0 || off > len(text) {
+		return 0, 0, false
+	}
+	if start = off - len(name); start >= 0 && text[start:off] == name && isWord(text, start, off) {
+		return start, off, true
+	}
+	line := text[off:]
+	if i := strings.IndexByte(line, '\n'); i >= 0 {
+		line = line[:i]
+	}
+	for i := 0; ; {
+		j := strings.Index(line[i:], name)
+		if j < 0 {
+			return 0, 0, false
+		}
+		start = off + i + j
+		if end = start + len(name); isWord(text, start, end) {
+			return start, end, true
+		}
+		i += j + 1
+	}
+}
+
+// LocateField returns the byte range of the field name in a field
+// selection (".name") following the offset off in text.
+func locateField(text string, off int, name string) (start, end int, ok bool) {
+	if off < 0 || off > len(text) {
+		return 0, 0, false
+	}
+	i := strings.IndexByte(text[off:], '.')
+	if i < 0 {
+		return 0, 0, false
+	}
+	start = off + i + 1
+	for start < len(text) && isSpace(text[start]) {
+		start++
+	}
+	end = start + len(name)
+	if end > len(text) || text[start:end] != name || !isWord(text, start, end) {
+		return 0, 0, false
+	}
+	return start, end, true
+}
+
+// isWord tells whether text[start:end] is delimited by non-identifier
+// characters.
+func isWord(text string, start, end int) bool {
+	return (start == 0 || !isIdentByte(text[start-1])) && (end == len(text) || !isIdentByte(text[end]))
+}
+
+func isIdentByte(c byte) bool {
+	return c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9'
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
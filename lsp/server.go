@@ -0,0 +1,660 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+// Package lsp implements a language server for Reflow modules. The
+// server speaks the language server protocol, providing editors with
+// diagnostics, hover information, definitions, completions, and
+// document symbols.
+//
+// The server does not implement its own parser: modules are parsed
+// and type checked by package syntax, and the server indexes the
+// resulting (typed) syntax trees.
+package lsp
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/grailbio/reflow/log"
+	"github.com/grailbio/reflow/syntax"
+	"github.com/grailbio/reflow/types"
+)
+
+// A document is a module opened by the client.
+type document struct {
+	uri, path, text string
+	// Analysis is the most recent analysis of the document; good
+	// is the most recent analysis of the document that parsed.
+	// Good is used to complete expressions while they are being
+	// edited (and thus may not parse).
+	analysis, good *analysis
+}
+
+// Server is a language server for Reflow modules. It communicates
+// with its client over a pair of streams, and reads module sources
+// from the client's open documents, or else from the local
+// filesystem.
+type Server struct {
+	// Log, if not nil, is used to log protocol errors.
+	Log *log.Logger
+
+	in       *bufio.Reader
+	out      io.Writer
+	docs     map[string]*document
+	stubDir  string
+	stubs    map[string]*stub
+	shutdown bool
+}
+
+// NewServer returns a new server that reads requests from r and
+// writes responses to w.
+func NewServer(r io.Reader, w io.Writer) *Server {
+	return &Server{
+		in:    bufio.NewReader(r),
+		out:   w,
+		docs:  make(map[string]*document),
+		stubs: make(map[string]*stub),
+	}
+}
+
+// Source implements syntax.Sourcer, returning the text of open
+// documents in place of their saved contents.
+func (s *Server) Source(path string) ([]byte, error) {
+	if doc := s.docs[path]; doc != nil {
+		return []byte(doc.text), nil
+	}
+	if stub := s.stubAt(path); stub != nil {
+		return []byte(stub.text), nil
+	}
+	return ioutil.ReadFile(path)
+}
+
+// Serve serves requests until the client exits or the input stream
+// is closed.
+func (s *Server) Serve() error {
+	for {
+		msg, err := readMessage(s.in)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			if rerr, ok := err.(*rpcError); ok {
+				if err := writeMessage(s.out, &message{Error: rerr}); err != nil {
+					return err
+				}
+				continue
+			}
+			return err
+		}
+		if msg.Method == "exit" {
+			return nil
+		}
+		result, err := s.handle(msg)
+		if msg.ID == nil {
+			if err != nil {
+				s.logf("%s: %v", msg.Method, err)
+			}
+			continue
+		}
+		resp := &message{ID: msg.ID}
+		if err != nil {
+			rerr, ok := err.(*rpcError)
+			if !ok {
+				rerr = &rpcError{codeInternalError, err.Error()}
+			}
+			resp.Error = rerr
+		} else {
+			b, err := json.Marshal(result)
+			if err != nil {
+				return err
+			}
+			raw := json.RawMessage(b)
+			resp.Result = &raw
+		}
+		if err := writeMessage(s.out, resp); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *Server) handle(msg *message) (interface{}, error) {
+	if s.shutdown && msg.Method != "exit" {
+		return nil, &rpcError{codeInvalidRequest, "server is shut down"}
+	}
+	switch msg.Method {
+	case "initialize":
+		return map[string]interface{}{
+			"capabilities": map[string]interface{}{
+				"textDocumentSync": map[string]interface{}{
+					"openClose": true,
+					// Full document synchronization.
+					"change": 1,
+				},
+				"hoverProvider":      true,
+				"definitionProvider": true,
+				"completionProvider": map[string]interface{}{
+					"triggerCharacters": []string{"."},
+				},
+				"documentSymbolProvider": true,
+			},
+			"serverInfo": map[string]string{"name": "reflow"},
+		}, nil
+	case "initialized", "$/cancelRequest", "$/setTrace", "textDocument/didSave":
+		return nil, nil
+	case "shutdown":
+		s.shutdown = true
+		return nil, nil
+	case "textDocument/didOpen":
+		var params didOpenParams
+		if err := unmarshal(msg.Params, &params); err != nil {
+			return nil, err
+		}
+		path, err := uriPath(params.TextDocument.URI)
+		if err != nil {
+			return nil, err
+		}
+		s.docs[path] = &document{uri: params.TextDocument.URI, path: path, text: params.TextDocument.Text}
+		return nil, s.update()
+	case "textDocument/didChange":
+		var params didChangeParams
+		if err := unmarshal(msg.Params, &params); err != nil {
+			return nil, err
+		}
+		doc, err := s.doc(params.TextDocument.URI)
+		if err != nil {
+			return nil, err
+		}
+		if n := len(params.ContentChanges); n > 0 {
+			doc.text = params.ContentChanges[n-1].Text
+		}
+		return nil, s.update()
+	case "textDocument/didClose":
+		var params didCloseParams
+		if err := unmarshal(msg.Params, &params); err != nil {
+			return nil, err
+		}
+		doc, err := s.doc(params.TextDocument.URI)
+		if err != nil {
+			return nil, err
+		}
+		delete(s.docs, doc.path)
+		if err := s.publish(doc.uri, nil); err != nil {
+			return nil, err
+		}
+		return nil, s.update()
+	case "textDocument/hover":
+		var params positionParams
+		if err := unmarshal(msg.Params, &params); err != nil {
+			return nil, err
+		}
+		return s.hover(params)
+	case "textDocument/definition":
+		var params positionParams
+		if err := unmarshal(msg.Params, &params); err != nil {
+			return nil, err
+		}
+		return s.definition(params)
+	case "textDocument/completion":
+		var params positionParams
+		if err := unmarshal(msg.Params, &params); err != nil {
+			return nil, err
+		}
+		return s.completion(params)
+	case "textDocument/documentSymbol":
+		var params documentSymbolParams
+		if err := unmarshal(msg.Params, &params); err != nil {
+			return nil, err
+		}
+		return s.symbols(params)
+	default:
+		return nil, &rpcError{codeMethodNotFound, fmt.Sprintf("method %s not supported", msg.Method)}
+	}
+}
+
+// Update analyzes all open documents and publishes their diagnostics.
+// All documents are reanalyzed since they may depend on each other
+// (through make expressions).
+func (s *Server) update() error {
+	paths := make([]string, 0, len(s.docs))
+	for path := range s.docs {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		doc := s.docs[path]
+		if s.stubAt(path) != nil {
+			// Stubs are for reference only; they are not modules.
+			continue
+		}
+		doc.analysis = analyze(path, s)
+		if doc.analysis.module != nil {
+			doc.good = doc.analysis
+		}
+		if err := s.publish(doc.uri, s.diagnostics(doc)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Server) diagnostics(doc *document) []Diagnostic {
+	diags := []Diagnostic{}
+	for _, err := range doc.analysis.errs {
+		var rng Range
+		if err.Filename == doc.path {
+			start, end := err.Offset, err.Offset
+			// Errors are positioned at the end of the offending token.
+			for start > 0 && start <= len(doc.text) && isIdentByte(doc.text[start-1]) {
+				start--
+			}
+			if start == end && start > 0 {
+				start--
+			}
+			rng = Range{positionOf(doc.text, start), positionOf(doc.text, end)}
+		}
+		msg := err.Message
+		if err.Filename != doc.path && err.Position.IsValid() {
+			msg = err.Position.String() + ": " + msg
+		}
+		diags = append(diags, Diagnostic{Range: rng, Severity: severityError, Source: "reflow", Message: msg})
+	}
+	return diags
+}
+
+func (s *Server) publish(uri string, diags []Diagnostic) error {
+	if diags == nil {
+		diags = []Diagnostic{}
+	}
+	params, err := json.Marshal(publishDiagnosticsParams{URI: uri, Diagnostics: diags})
+	if err != nil {
+		return err
+	}
+	return writeMessage(s.out, &message{Method: "textDocument/publishDiagnostics", Params: params})
+}
+
+func (s *Server) hover(params positionParams) (*Hover, error) {
+	doc, err := s.doc(params.TextDocument.URI)
+	if err != nil {
+		return nil, err
+	}
+	if doc.analysis == nil {
+		return nil, nil
+	}
+	r := doc.analysis.ref(offsetOf(doc.text, params.Position))
+	if r == nil || r.typ == nil {
+		return nil, nil
+	}
+	var b strings.Builder
+	b.WriteString("```reflow\n")
+	keyword := r.keyword
+	if keyword == "func" {
+		// Function arguments are values.
+		keyword = "val"
+	}
+	fmt.Fprintf(&b, "%s %s %s\n```", keyword, r.name, typeString(r.typ))
+	if r.doc != "" {
+		b.WriteString("\n\n")
+		b.WriteString(strings.TrimSpace(r.doc))
+	}
+	rng := Range{positionOf(doc.text, r.start), positionOf(doc.text, r.end)}
+	return &Hover{Contents: markupContent{"markdown", b.String()}, Range: &rng}, nil
+}
+
+func (s *Server) definition(params positionParams) ([]Location, error) {
+	doc, err := s.doc(params.TextDocument.URI)
+	if err != nil {
+		return nil, err
+	}
+	locs := []Location{}
+	if doc.analysis == nil {
+		return locs, nil
+	}
+	r := doc.analysis.ref(offsetOf(doc.text, params.Position))
+	if r == nil || r.def == nil {
+		return locs, nil
+	}
+	if loc, ok := s.locate(r.def); ok {
+		locs = append(locs, loc)
+	}
+	return locs, nil
+}
+
+// Locate returns the location of definition def.
+func (s *Server) locate(def *definition) (Location, bool) {
+	if def.system != "" {
+		stub, err := s.stub(def.system)
+		if err != nil {
+			s.logf("system module %s: %v", def.system, err)
+			return Location{}, false
+		}
+		off, ok := stub.offsets[def.name]
+		if !ok {
+			return Location{}, false
+		}
+		rng := Range{positionOf(stub.text, off), positionOf(stub.text, off+len(def.name))}
+		return Location{pathURI(stub.path), rng}, true
+	}
+	b, err := s.Source(def.pos.Filename)
+	if err != nil {
+		return Location{}, false
+	}
+	text := string(b)
+	start, end, ok := locate(text, def.pos.Offset, def.name)
+	if !ok {
+		return Location{}, false
+	}
+	return Location{pathURI(def.pos.Filename), Range{positionOf(text, start), positionOf(text, end)}}, true
+}
+
+// execParams are the parameters accepted by exec expressions.
+var execParams = []struct{ name, detail string }{
+	{"image", "string"},
+	{"cpu", "int or float"},
+	{"mem", "int"},
+	{"disk", "int"},
+	{"cpufeatures", "[string]"},
+	{"nondeterministic", "bool"},
+	{"retries", "int"},
+	{"maxmem", "int"},
+	{"memfactor", "int or float"},
+	{"retrytimeouts", "bool"},
+	{"env", "[string:string]"},
+	{"secrets", "[string]"},
+	{"timeout", "int or string"},
+	{"shellquote", "bool"},
+}
+
+func (s *Server) completion(params positionParams) ([]CompletionItem, error) {
+	doc, err := s.doc(params.TextDocument.URI)
+	if err != nil {
+		return nil, err
+	}
+	items := []CompletionItem{}
+	off := offsetOf(doc.text, params.Position)
+	// Find the identifier being completed, and the selector
+	// expression (if any) that precedes it.
+	start := off
+	for start > 0 && isIdentByte(doc.text[start-1]) {
+		start--
+	}
+	if chain := selector(doc.text, start); chain != nil {
+		if doc.good == nil {
+			return items, nil
+		}
+		b := doc.good.lookup(chain[0], off)
+		if b == nil {
+			return items, nil
+		}
+		t, module := b.typ, b.module
+		for _, field := range chain[1:] {
+			if t == nil || (t.Kind != types.StructKind && t.Kind != types.ModuleKind) {
+				return items, nil
+			}
+			t, module = t.Field(field), nil
+		}
+		if t == nil {
+			return items, nil
+		}
+		switch t.Kind {
+		case types.ModuleKind:
+			for _, f := range t.Aliases {
+				items = append(items, CompletionItem{Label: f.Name, Kind: completionClass, Detail: "type " + typeString(f.T), Documentation: documentation(module, f.Name)})
+			}
+			for _, f := range t.Fields {
+				kind := completionField
+				if f.T.Kind == types.FuncKind {
+					kind = completionFunction
+				}
+				items = append(items, CompletionItem{Label: f.Name, Kind: kind, Detail: typeString(f.T), Documentation: documentation(module, f.Name)})
+			}
+		case types.StructKind:
+			for _, f := range t.Fields {
+				items = append(items, CompletionItem{Label: f.Name, Kind: completionField, Detail: typeString(f.T)})
+			}
+		}
+		return items, nil
+	}
+	if inExec(doc.text, start) {
+		for _, p := range execParams {
+			items = append(items, CompletionItem{Label: p.name, Kind: completionProperty, Detail: p.detail})
+		}
+	}
+	return items, nil
+}
+
+func documentation(m syntax.Module, ident string) *markupContent {
+	if m == nil {
+		return nil
+	}
+	doc := strings.TrimSpace(m.Doc(ident))
+	if doc == "" {
+		return nil
+	}
+	return &markupContent{"markdown", doc}
+}
+
+// Selector returns the chain of identifiers in the selector
+// expression (e.g., "a.b.") that ends at the byte offset off in text.
+// Selector returns nil if there is no such expression.
+func selector(text string, off int) []string {
+	var chain []string
+	for {
+		i := off
+		for i > 0 && isSpace(text[i-1]) {
+			i--
+		}
+		if i == 0 || text[i-1] != '.' {
+			break
+		}
+		i--
+		for i > 0 && isSpace(text[i-1]) {
+			i--
+		}
+		j := i
+		for i > 0 && isIdentByte(text[i-1]) {
+			i--
+		}
+		if i == j {
+			return nil
+		}
+		chain = append([]string{text[i:j]}, chain...)
+		off = i
+	}
+	return chain
+}
+
+// InExec tells whether the byte offset off in text is within the
+// parameter list of an exec expression.
+func inExec(text string, off int) bool {
+	depth := 0
+	for i := off - 1; i >= 0; i-- {
+		switch text[i] {
+		case ')', ']', '}':
+			depth++
+		case '[', '{':
+			if depth == 0 {
+				return false
+			}
+			depth--
+		case '(':
+			if depth > 0 {
+				depth--
+				continue
+			}
+			j := i
+			for j > 0 && isSpace(text[j-1]) {
+				j--
+			}
+			return strings.HasSuffix(text[:j], "exec") && (j == 4 || !isIdentByte(text[j-5]))
+		}
+	}
+	return false
+}
+
+func (s *Server) symbols(params documentSymbolParams) ([]DocumentSymbol, error) {
+	doc, err := s.doc(params.TextDocument.URI)
+	if err != nil {
+		return nil, err
+	}
+	syms := []DocumentSymbol{}
+	if doc.analysis == nil || doc.analysis.module == nil {
+		return syms, nil
+	}
+	for _, b := range doc.analysis.bindings {
+		if !b.toplevel {
+			continue
+		}
+		kind := symbolVariable
+		switch {
+		case b.keyword == "type":
+			kind = symbolClass
+		case b.keyword == "param":
+			kind = symbolProperty
+		case b.module != nil:
+			kind = symbolModule
+		case b.typ != nil && b.typ.Kind == types.FuncKind:
+			kind = symbolFunction
+		}
+		rng := Range{positionOf(doc.text, b.start), positionOf(doc.text, b.end)}
+		sym := DocumentSymbol{Name: b.name, Kind: kind, Range: rng, SelectionRange: rng}
+		if b.typ != nil {
+			sym.Detail = typeString(b.typ)
+		}
+		syms = append(syms, sym)
+	}
+	return syms, nil
+}
+
+func (s *Server) doc(uri string) (*document, error) {
+	path, err := uriPath(uri)
+	if err != nil {
+		return nil, err
+	}
+	doc := s.docs[path]
+	if doc == nil {
+		return nil, &rpcError{codeInvalidParams, fmt.Sprintf("document %s is not open", uri)}
+	}
+	return doc, nil
+}
+
+func (s *Server) logf(format string, v ...interface{}) {
+	if s.Log != nil {
+		s.Log.Errorf(format, v...)
+	}
+}
+
+// A stub is a generated document describing a system module. System
+// modules are implemented in Go, and thus have no source; stubs are
+// the targets of definitions of their identifiers.
+type stub struct {
+	path, text string
+	// Offsets stores the byte offset of each of the module's
+	// identifiers in the stub text.
+	offsets map[string]int
+}
+
+// Stub returns the stub for the system module with the provided name,
+// writing it to the server's stub directory if needed.
+func (s *Server) stub(name string) (*stub, error) {
+	if st := s.stubs[name]; st != nil {
+		return st, nil
+	}
+	m, err := syntax.NewSession(nil).Open("$/" + name)
+	if err != nil {
+		return nil, err
+	}
+	if s.stubDir == "" {
+		s.stubDir, err = ioutil.TempDir("", "reflowlsp")
+		if err != nil {
+			return nil, err
+		}
+	}
+	st := &stub{path: filepath.Join(s.stubDir, name+".rf"), offsets: make(map[string]int)}
+	var b strings.Builder
+	fmt.Fprintf(&b, "// $/%s is a Reflow system module. This file documents its\n", name)
+	b.WriteString("// declarations; it is generated and is not Reflow source.\n")
+	typ := m.Type(nil)
+	for _, f := range typ.Aliases {
+		b.WriteString("\n")
+		writeComment(&b, m.Doc(f.Name))
+		b.WriteString("type ")
+		st.offsets[f.Name] = b.Len()
+		fmt.Fprintf(&b, "%s %s\n", f.Name, typeString(f.T))
+	}
+	for _, f := range typ.Fields {
+		b.WriteString("\n")
+		writeComment(&b, m.Doc(f.Name))
+		b.WriteString("val ")
+		st.offsets[f.Name] = b.Len()
+		fmt.Fprintf(&b, "%s %s\n", f.Name, typeString(f.T))
+	}
+	st.text = b.String()
+	if err := ioutil.WriteFile(st.path, []byte(st.text), 0444); err != nil && !os.IsExist(err) {
+		return nil, err
+	}
+	s.stubs[name] = st
+	return st, nil
+}
+
+// StubAt returns the stub with the provided path, if any.
+func (s *Server) stubAt(path string) *stub {
+	for _, st := range s.stubs {
+		if st.path == path {
+			return st
+		}
+	}
+	return nil
+}
+
+func writeComment(b *strings.Builder, doc string) {
+	doc = strings.TrimSpace(doc)
+	if doc == "" {
+		return
+	}
+	for _, line := range strings.Split(doc, "\n") {
+		b.WriteString(strings.TrimRight("// "+line, " "))
+		b.WriteString("\n")
+	}
+}
+
+// typeString returns a string representation of t suitable for
+// display; type errors are rendered as such.
+func typeString(t *types.T) string {
+	if t.Kind == types.ErrorKind {
+		return "(type error)"
+	}
+	return t.String()
+}
+
+func unmarshal(params json.RawMessage, v interface{}) error {
+	if err := json.Unmarshal(params, v); err != nil {
+		return &rpcError{codeInvalidParams, err.Error()}
+	}
+	return nil
+}
+
+// UriPath returns the local file path of the file URI uri.
+func uriPath(uri string) (string, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", &rpcError{codeInvalidParams, err.Error()}
+	}
+	if u.Scheme != "file" {
+		return "", &rpcError{codeInvalidParams, fmt.Sprintf("unsupported URI %s", uri)}
+	}
+	return filepath.FromSlash(u.Path), nil
+}
+
+// PathURI returns the file URI of the local file path.
+func pathURI(path string) string {
+	return (&url.URL{Scheme: "file", Path: filepath.ToSlash(path)}).String()
+}
@@ -0,0 +1,293 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package lsp
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+const (
+	libSource = `// Greeting is the greeting.
+val Greeting = "hello"
+
+type Pair {a, b int}
+`
+	mainSource = `val lib = make("./lib.rf")
+val strings = make("$/strings")
+
+// Message is the message.
+val Message = lib.Greeting + "!"
+
+val Parts = strings.Split(Message, " ")
+
+func f(x int) int = x + 1
+
+val Main = {
+	p := {a: 1, b: 2}
+	exec(image := "ubuntu", mem := f(p.a)) (out file) {"
+		echo {{Message}} > {{out}}
+	"}
+}
+`
+)
+
+// A client drives a server over a pair of pipes.
+type client struct {
+	t           *testing.T
+	w           io.Writer
+	msgs        chan *message
+	id          int
+	diagnostics map[string][]Diagnostic
+}
+
+func newClient(t *testing.T) (*client, func()) {
+	t.Helper()
+	cr, sw := io.Pipe()
+	sr, cw := io.Pipe()
+	server := NewServer(sr, sw)
+	errc := make(chan error)
+	go func() {
+		errc <- server.Serve()
+		sw.Close()
+	}()
+	c := &client{t: t, w: cw, msgs: make(chan *message, 100), diagnostics: make(map[string][]Diagnostic)}
+	// Messages are read concurrently, since the server may write
+	// notifications while the client writes requests.
+	go func() {
+		r := bufio.NewReader(cr)
+		for {
+			msg, err := readMessage(r)
+			if err != nil {
+				close(c.msgs)
+				return
+			}
+			c.msgs <- msg
+		}
+	}()
+	return c, func() {
+		c.call("shutdown", nil, nil)
+		c.notify("exit", nil)
+		if err := <-errc; err != nil {
+			t.Error(err)
+		}
+		if server.stubDir != "" {
+			os.RemoveAll(server.stubDir)
+		}
+	}
+}
+
+func (c *client) send(msg *message, params interface{}) {
+	c.t.Helper()
+	if params != nil {
+		b, err := json.Marshal(params)
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		msg.Params = b
+	}
+	if err := writeMessage(c.w, msg); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func (c *client) notify(method string, params interface{}) {
+	c.t.Helper()
+	c.send(&message{Method: method}, params)
+}
+
+// Call calls the provided method and decodes its result into result.
+// Notifications received while waiting for the result are recorded.
+func (c *client) call(method string, params, result interface{}) {
+	c.t.Helper()
+	c.id++
+	id := json.RawMessage(strings.TrimSpace(string(mustMarshal(c.t, c.id))))
+	c.send(&message{ID: &id, Method: method}, params)
+	for {
+		msg, ok := <-c.msgs
+		if !ok {
+			c.t.Fatal("server closed connection")
+		}
+		if msg.ID == nil {
+			if msg.Method == "textDocument/publishDiagnostics" {
+				var params publishDiagnosticsParams
+				if err := json.Unmarshal(msg.Params, &params); err != nil {
+					c.t.Fatal(err)
+				}
+				c.diagnostics[params.URI] = params.Diagnostics
+			}
+			continue
+		}
+		if msg.Error != nil {
+			c.t.Fatalf("%s: %v", method, msg.Error)
+		}
+		if result != nil {
+			if err := json.Unmarshal(*msg.Result, result); err != nil {
+				c.t.Fatal(err)
+			}
+		}
+		return
+	}
+}
+
+func mustMarshal(t *testing.T, v interface{}) []byte {
+	t.Helper()
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// at returns the position of the nth (zero-based) occurrence of
+// substr in text, offset by delta bytes.
+func at(text, substr string, n, delta int) Position {
+	off := -1
+	for i := 0; i <= n; i++ {
+		j := strings.Index(text[off+1:], substr)
+		if j < 0 {
+			panic(substr)
+		}
+		off += j + 1
+	}
+	return positionOf(text, off+delta)
+}
+
+func TestServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lsp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	libPath, mainPath := filepath.Join(dir, "lib.rf"), filepath.Join(dir, "main.rf")
+	if err := ioutil.WriteFile(libPath, []byte(libSource), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mainURI := pathURI(mainPath)
+	doc := textDocumentIdentifier{URI: mainURI}
+
+	c, done := newClient(t)
+	defer done()
+	var init struct {
+		Capabilities struct {
+			HoverProvider bool `json:"hoverProvider"`
+		} `json:"capabilities"`
+	}
+	c.call("initialize", map[string]interface{}{}, &init)
+	if !init.Capabilities.HoverProvider {
+		t.Error("expected hover capability")
+	}
+	c.notify("initialized", map[string]interface{}{})
+	c.notify("textDocument/didOpen", didOpenParams{textDocumentItem{URI: mainURI, LanguageID: "reflow", Text: mainSource}})
+
+	var hover Hover
+	c.call("textDocument/hover", positionParams{doc, at(mainSource, "Greeting", 0, 2)}, &hover)
+	if got, want := hover.Contents.Value, "```reflow\nval Greeting string\n```\n\nGreeting is the greeting."; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if diags, ok := c.diagnostics[mainURI]; !ok || len(diags) != 0 {
+		t.Errorf("unexpected diagnostics %v", diags)
+	}
+	c.call("textDocument/hover", positionParams{doc, at(mainSource, "Message", 2, 1)}, &hover)
+	if got, want := hover.Contents.Value, "```reflow\nval Message string\n```\n\nMessage is the message."; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	var locs []Location
+	for _, tc := range []struct {
+		pos  Position
+		path string
+		line int
+	}{
+		{at(mainSource, "Greeting", 0, 0), libPath, 1},
+		{at(mainSource, "x + 1", 0, 0), mainPath, 8},
+		{at(mainSource, "f(p.a)", 0, 0), mainPath, 8},
+		{at(mainSource, "p.a", 0, 0), mainPath, 11},
+		{at(mainSource, "Message, ", 0, 0), mainPath, 4},
+	} {
+		c.call("textDocument/definition", positionParams{doc, tc.pos}, &locs)
+		if len(locs) != 1 {
+			t.Errorf("%v: got %v, want 1 location", tc.pos, locs)
+			continue
+		}
+		if got, want := locs[0].URI, pathURI(tc.path); got != want {
+			t.Errorf("%v: got %v, want %v", tc.pos, got, want)
+		}
+		if got, want := locs[0].Range.Start.Line, tc.line; got != want {
+			t.Errorf("%v: got line %v, want %v", tc.pos, got, want)
+		}
+	}
+
+	c.call("textDocument/definition", positionParams{doc, at(mainSource, "Split", 0, 0)}, &locs)
+	if len(locs) != 1 {
+		t.Fatalf("got %v, want 1 location", locs)
+	}
+	path, err := uriPath(locs[0].URI)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stub, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := at(string(stub), "val Split", 0, 4), locs[0].Range.Start; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	var symbols []DocumentSymbol
+	c.call("textDocument/documentSymbol", documentSymbolParams{doc}, &symbols)
+	var names []string
+	for _, sym := range symbols {
+		names = append(names, sym.Name)
+	}
+	if got, want := strings.Join(names, " "), "lib strings Message Parts f Main"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// Completions are computed while editing, when the module may
+	// not parse.
+	edited := strings.Replace(mainSource, "val Parts", "val Q = lib.\nval R = exec(\nval Parts", 1)
+	c.notify("textDocument/didChange", didChangeParams{
+		TextDocument: struct {
+			URI     string `json:"uri"`
+			Version int    `json:"version"`
+		}{mainURI, 2},
+		ContentChanges: []struct {
+			Text string `json:"text"`
+		}{{edited}},
+	})
+	var items []CompletionItem
+	c.call("textDocument/completion", positionParams{doc, at(edited, "lib.\n", 0, 4)}, &items)
+	if got, want := labels(items), "Greeting Pair"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if diags := c.diagnostics[mainURI]; len(diags) == 0 {
+		t.Error("expected diagnostics")
+	}
+	c.call("textDocument/completion", positionParams{doc, at(edited, "exec(\n", 0, 5)}, &items)
+	if got := labels(items); !strings.Contains(got, "image") || !strings.Contains(got, "mem") {
+		t.Errorf("missing exec parameters in %v", got)
+	}
+	c.call("textDocument/completion", positionParams{doc, at(edited, "p.a", 0, 2)}, &items)
+	if got, want := labels(items), "a b"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func labels(items []CompletionItem) string {
+	var labels []string
+	for _, item := range items {
+		labels = append(labels, item.Label)
+	}
+	sort.Strings(labels)
+	return strings.Join(labels, " ")
+}
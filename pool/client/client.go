@@ -159,6 +159,52 @@ func (c *Client) InstallImage(ctx context.Context, d digest.Digest) error {
 	return nil
 }
 
+// terminatingRetryInterval is the amount of time to wait before
+// retrying a failed termination status request.
+const terminatingRetryInterval = 10 * time.Second
+
+// Terminating implements pool.Terminator. It polls the remote pool's
+// termination status until the pool is terminating or the context is
+// done. Failed requests are retried, unless the remote pool does not
+// support termination notices.
+func (c *Client) Terminating(ctx context.Context) (time.Time, error) {
+	for {
+		status, err := c.terminating(ctx)
+		switch {
+		case err == nil && status.Terminating:
+			return status.Deadline, nil
+		case err == nil:
+			continue
+		case ctx.Err() != nil:
+			return time.Time{}, ctx.Err()
+		case errors.Is(errors.NotSupported, err) || errors.Is(errors.NotExist, err):
+			return time.Time{}, err
+		}
+		select {
+		case <-time.After(terminatingRetryInterval):
+		case <-ctx.Done():
+			return time.Time{}, ctx.Err()
+		}
+	}
+}
+
+func (c *Client) terminating(ctx context.Context) (pool.TerminatingJSON, error) {
+	var status pool.TerminatingJSON
+	call := c.Call("GET", "terminating")
+	defer call.Close()
+	code, err := call.Do(ctx, nil)
+	if err != nil {
+		return status, errors.E("terminating", err)
+	}
+	if code != http.StatusOK {
+		return status, call.Error()
+	}
+	if err := call.Unmarshal(&status); err != nil {
+		return status, errors.E("terminating", err)
+	}
+	return status, nil
+}
+
 type clientAlloc struct {
 	*Client
 	id        string
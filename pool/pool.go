@@ -96,6 +96,23 @@ type AllocInspect struct {
 	Created       time.Time
 	LastKeepalive time.Time
 	Expires       time.Time
+
+	RepositoryStats RepositoryStats
+}
+
+// RepositoryStats describes how files were installed into, and
+// materialized from, an alloc's repository. It mirrors
+// filerepo.Stats.
+type RepositoryStats struct {
+	// Reflinks is the number of files cloned with reflinks.
+	Reflinks int64
+	// Hardlinks is the number of files hardlinked.
+	Hardlinks int64
+	// Copies is the number of files whose contents were copied.
+	Copies int64
+	// BytesSaved is the number of bytes that were not copied because
+	// files were reflinked or hardlinked instead.
+	BytesSaved int64
 }
 
 // keepalive returns the interval to the next keepalive.
@@ -200,6 +217,39 @@ type Pool interface {
 	Offers(ctx context.Context) ([]Offer, error)
 }
 
+// A Terminator is a pool (or an alloc of a pool) that may be
+// terminated while it still has allocs, for example because the
+// instance on which it runs is a spot instance that is interrupted.
+// Terminating pools make no new offers; their users should migrate
+// any outstanding work before the pool terminates.
+type Terminator interface {
+	// Terminating blocks until the pool is terminating, in which case
+	// it returns the time at which the pool is expected to terminate,
+	// or until the provided context is done, in which case the
+	// context's error is returned.
+	Terminating(ctx context.Context) (time.Time, error)
+}
+
+// An Interrupter is a cluster (or pool) whose allocs may be
+// interrupted, for example because they run on spot instances.
+// Users of allocs need only watch for the termination of
+// interruptible allocs (see Terminator).
+type Interrupter interface {
+	// Interruptible tells whether the provided alloc, which must
+	// have been allocated from the Interrupter, may be interrupted.
+	Interruptible(alloc Alloc) bool
+}
+
+// TerminatingJSON is the JSON structure used to describe a pool's
+// termination status.
+type TerminatingJSON struct {
+	// Terminating tells whether the pool is terminating.
+	Terminating bool
+	// Deadline is the time at which the pool is expected to
+	// terminate.
+	Deadline time.Time
+}
+
 var (
 	errUnavailable  = errors.New("no allocs available in pool")
 	errTooManyTries = errors.New("too many tries")
@@ -24,12 +24,47 @@ import (
 // NewNode returns a rest.Node that implements the pool REST API.
 func NewNode(p pool.Pool) rest.Node {
 	v1 := rest.Mux{
-		"allocs": allocsNode{p},
-		"offers": offersNode{p},
+		"allocs":      allocsNode{p},
+		"offers":      offersNode{p},
+		"terminating": terminatingNode{p},
 	}
 	return rest.Mux{"v1": v1}
 }
 
+// terminatingPollTime is the maximum amount of time for which a
+// termination status request is held before it is answered.
+const terminatingPollTime = time.Minute
+
+// terminatingNode serves the pool's termination status. Requests
+// are long-polled: they are answered once the pool is terminating,
+// or after terminatingPollTime, whichever comes first.
+type terminatingNode struct {
+	p pool.Pool
+}
+
+func (n terminatingNode) Walk(ctx context.Context, call *rest.Call, path string) rest.Node {
+	return nil
+}
+
+func (n terminatingNode) Do(ctx context.Context, call *rest.Call) {
+	if !call.Allow("GET") {
+		return
+	}
+	t, ok := n.p.(pool.Terminator)
+	if !ok {
+		call.Error(errors.E("terminating", errors.NotSupported))
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, terminatingPollTime)
+	defer cancel()
+	deadline, err := t.Terminating(ctx)
+	if err != nil && err != ctx.Err() {
+		call.Error(err)
+		return
+	}
+	call.Reply(http.StatusOK, pool.TerminatingJSON{Terminating: err == nil, Deadline: deadline})
+}
+
 type offersNode struct {
 	p pool.Pool
 }
@@ -7,6 +7,7 @@ package reflowlet
 import (
 	"context"
 	"crypto/tls"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io/ioutil"
@@ -17,7 +18,6 @@ import (
 	"syscall"
 	"time"
 
-	"docker.io/go-docker"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/ec2metadata"
@@ -28,6 +28,7 @@ import (
 	infratls "github.com/grailbio/infra/tls"
 	"github.com/grailbio/reflow"
 	"github.com/grailbio/reflow/blob"
+	"github.com/grailbio/reflow/blob/fileblob"
 	"github.com/grailbio/reflow/blob/s3blob"
 	"github.com/grailbio/reflow/ec2authenticator"
 	"github.com/grailbio/reflow/ec2cluster/volume"
@@ -38,6 +39,8 @@ import (
 	"github.com/grailbio/reflow/repository/blobrepo"
 	repositoryhttp "github.com/grailbio/reflow/repository/http"
 	"github.com/grailbio/reflow/rest"
+	"github.com/grailbio/reflow/secrets"
+	"github.com/grailbio/reflow/trace"
 	"golang.org/x/net/http2"
 )
 
@@ -90,12 +93,15 @@ func (s *Server) AddFlags(flags *flag.FlagSet) {
 	flags.BoolVar(&s.HTTPDebug, "httpdebug", false, "turn on HTTP debug logging")
 }
 
-// spotNoticeWatcher watches for a spot termination notice and logs if found.
+// spotNoticeWatcher watches for a spot termination notice. When one is
+// found, the pool is drained so that it makes no new offers, and its
+// users are notified (through the pool's termination status) that
+// the instance is terminating, so that they may migrate their work.
 // See https://docs.aws.amazon.com/AWSEC2/latest/UserGuide/spot-interruptions.html#instance-action-metadata
-// TODO(swami):  When flagged for termination, put server in lameduck mode.
-func (s *Server) spotNoticeWatcher(ctx context.Context) {
+func (s *Server) spotNoticeWatcher(ctx context.Context, p *local.Pool) {
 	logger := log.Std.Prefix("spot notice: ")
-	tick := time.NewTicker(30 * time.Second)
+	tick := time.NewTicker(5 * time.Second)
+	defer tick.Stop()
 	for {
 		select {
 		case <-ctx.Done():
@@ -107,21 +113,44 @@ func (s *Server) spotNoticeWatcher(ctx context.Context) {
 			continue
 		}
 		// The following is done in a func to defer closing the response body.
-		func() {
+		notice, ok := func() (spotNotice, bool) {
 			defer resp.Body.Close()
+			var notice spotNotice
 			if resp.StatusCode != http.StatusOK {
-				return
+				return notice, false
 			}
 			b, err := ioutil.ReadAll(resp.Body)
 			if err != nil {
 				logger.Debugf("read %v", err)
-				return
+				return notice, false
 			}
 			logger.Print(string(b))
+			if err := json.Unmarshal(b, &notice); err != nil {
+				logger.Errorf("unmarshal %s: %v", b, err)
+			}
+			return notice, true
 		}()
+		if !ok {
+			continue
+		}
+		deadline := notice.Time
+		if deadline.IsZero() {
+			// Spot instances are given two minutes' notice.
+			deadline = time.Now().Add(2 * time.Minute)
+		}
+		logger.Printf("instance %s at %s; draining pool", notice.Action, deadline)
+		p.Drain(deadline)
+		return
 	}
 }
 
+// spotNotice is the instance action of an interrupted spot instance,
+// as reported by the instance metadata service.
+type spotNotice struct {
+	Action string    `json:"action"`
+	Time   time.Time `json:"time"`
+}
+
 // setTags sets the reflowlet version tag on the EC2 instance (if running on one).
 func (s *Server) setTags(sess *session.Session) error {
 	if !s.EC2Cluster {
@@ -161,18 +190,20 @@ func (s *Server) setupWatcher(ctx context.Context, sess *session.Session, path s
 
 // ListenAndServe serves the Reflowlet server on the configured address.
 func (s *Server) ListenAndServe() error {
-	addr := os.Getenv("DOCKER_HOST")
-	if addr == "" {
-		addr = "unix:///var/run/docker.sock"
-	}
-	client, err := docker.NewClient(
-		addr, "1.22",
-		nil, map[string]string{"user-agent": "reflow"})
-	if err != nil {
-		return err
+	var runtime local.ContainerRuntime
+	if name, _, _ := s.Config.Keys.String(infra2.Runtime); name != "" {
+		if err := s.Config.Instance(&runtime); err != nil {
+			return fmt.Errorf("container runtime %s: %v", name, err)
+		}
+	} else {
+		dr := new(local.DockerRuntime)
+		if err := dr.Init(); err != nil {
+			return err
+		}
+		runtime = dr
 	}
 	var rc *infra2.ReflowletConfig
-	err = s.Config.Instance(&rc)
+	err := s.Config.Instance(&rc)
 	if err != nil {
 		return err
 	}
@@ -218,19 +249,26 @@ func (s *Server) ListenAndServe() error {
 	// TODO(marius): handle this more elegantly, perhaps by
 	// avoiding global registration altogether.
 	blobrepo.Register("s3", s3blob.New(sess))
+	blobrepo.Register("file", fileblob.New("/"))
 	transport := &http.Transport{TLSClientConfig: clientConfig}
 	http2.ConfigureTransport(transport)
 	repositoryhttp.HTTPClient = &http.Client{Transport: transport}
 
+	var secretStore secrets.Secrets
+	if err := s.Config.Instance(&secretStore); err != nil {
+		log.Debugf("secrets: %v", err)
+	}
 	p := &local.Pool{
-		Client:        client,
+		Runtime:       runtime,
+		Secrets:       secretStore,
 		Dir:           s.Dir,
 		Prefix:        s.Prefix,
 		Authenticator: ec2authenticator.New(sess),
 		AWSImage:      string(*tool),
 		AWSCreds:      creds,
 		Blob: blob.Mux{
-			"s3": s3blob.New(sess),
+			"s3":   s3blob.New(sess),
+			"file": fileblob.New("/"),
 		},
 		Log:          log.Std.Tee(nil, "executor: "),
 		HardMemLimit: hardMemLimit,
@@ -243,7 +281,7 @@ func (s *Server) ListenAndServe() error {
 		if err := s.setupWatcher(ctx, sess, filepath.Join(s.Prefix, s.Dir), rc.VolumeWatcher); err != nil {
 			log.Fatal(err)
 		}
-		go s.spotNoticeWatcher(ctx)
+		go s.spotNoticeWatcher(ctx, p)
 		go func() {
 			const period = time.Minute
 			// Always give the instance an expiry period to receive work,
@@ -269,7 +307,17 @@ func (s *Server) ListenAndServe() error {
 		log.Std.Level = log.DebugLevel
 	}
 
-	http.Handle("/", rest.Handler(server.NewNode(p), httpLog))
+	var handler http.Handler = rest.Handler(server.NewNode(p), httpLog)
+	// If a tracer is configured, serve requests with the caller's
+	// trace context so that spans emitted by this reflowlet nest
+	// under the caller's.
+	var tracer trace.Tracer
+	if err := s.Config.Instance(&tracer); err != nil {
+		log.Debugf("tracer: %v", err)
+	} else {
+		handler = trace.Handler(tracer, handler)
+	}
+	http.Handle("/", handler)
 	// Create a servlet node for this reflowlet's config.
 	cfgNode, err := newConfigNode(s.Config)
 	if err != nil {
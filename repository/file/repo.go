@@ -0,0 +1,71 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+// Package file implements an infra provider for a blob repository
+// stored in a local (or network mounted) directory. Paired with
+// assoc/sqlassoc, it provides a cache that needs no cloud services.
+package file
+
+import (
+	"context"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/grailbio/infra"
+	"github.com/grailbio/reflow/blob/fileblob"
+	"github.com/grailbio/reflow/log"
+	"github.com/grailbio/reflow/repository/blobrepo"
+)
+
+func init() {
+	infra.Register("file", new(Repository))
+}
+
+// Repository is a filesystem backed blob repository.
+type Repository struct {
+	// Repository is the underlying blob repository implementation.
+	*blobrepo.Repository
+	// Dir is the directory in which objects are stored.
+	Dir string
+}
+
+// Help implements infra.Provider
+func (Repository) Help() string {
+	return "configure a repository using a local directory"
+}
+
+// Flags implements infra.Provider
+func (r *Repository) Flags(flags *flag.FlagSet) {
+	flags.StringVar(&r.Dir, "dir", "$HOME/.reflow/repository", "repository directory")
+}
+
+// Init implements infra.Provider
+func (r *Repository) Init() error {
+	dir, err := filepath.Abs(os.ExpandEnv(r.Dir))
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return err
+	}
+	// Repositories are rooted at the filesystem root so that their
+	// URLs (file:///path/to/dir) may be dialed from anywhere.
+	blob := fileblob.New("/")
+	blobrepo.Register("file", blob)
+	bucket, err := blob.Bucket(context.Background(), "")
+	if err != nil {
+		return err
+	}
+	r.Repository = &blobrepo.Repository{Bucket: bucket, Prefix: strings.TrimPrefix(filepath.ToSlash(dir), "/")}
+	return nil
+}
+
+// Setup implements infra.Provider
+func (r *Repository) Setup(log *log.Logger) error {
+	dir := os.ExpandEnv(r.Dir)
+	log.Printf("creating repository directory %s", dir)
+	return os.MkdirAll(dir, 0777)
+}
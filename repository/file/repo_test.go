@@ -0,0 +1,63 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package file
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/grailbio/infra"
+	"github.com/grailbio/reflow"
+	_ "github.com/grailbio/reflow/infra"
+	"github.com/grailbio/reflow/log"
+	"github.com/grailbio/reflow/repository/blobrepo"
+)
+
+func TestFileRepositoryInfra(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filerepo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dir = filepath.Join(dir, "repo")
+	var schema = infra.Schema{
+		"logger":     new(log.Logger),
+		"repository": new(reflow.Repository),
+	}
+	config, err := schema.Make(infra.Keys{
+		"logger":     "logger",
+		"repository": "file,dir=" + dir,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var repo reflow.Repository
+	config.Must(&repo)
+	// As with other blob repositories, the prefix follows the bucket's
+	// location after a separator.
+	if got, want := repo.URL().String(), "file:///"+dir; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	ctx := context.Background()
+	d, err := repo.Put(ctx, strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.Stat(ctx, d); err != nil {
+		t.Fatal(err)
+	}
+	// The repository should be dialable by its URL.
+	dialed, err := blobrepo.Dial(repo.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dialed.Stat(ctx, d); err != nil {
+		t.Fatal(err)
+	}
+}
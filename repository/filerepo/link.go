@@ -0,0 +1,123 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package filerepo
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+
+	"github.com/grailbio/base/data"
+)
+
+// Stats describes how objects were installed into, and materialized
+// from, a repository.
+type Stats struct {
+	// Reflinks is the number of files cloned with reflinks.
+	Reflinks int64
+	// Hardlinks is the number of files hardlinked.
+	Hardlinks int64
+	// Copies is the number of files whose contents were copied.
+	Copies int64
+	// BytesSaved is the number of bytes that were not copied because
+	// files were reflinked or hardlinked instead.
+	BytesSaved int64
+}
+
+// String returns a human-readable summary of the stats.
+func (s Stats) String() string {
+	return fmt.Sprintf("reflinks:%d hardlinks:%d copies:%d saved:%s",
+		s.Reflinks, s.Hardlinks, s.Copies, data.Size(s.BytesSaved))
+}
+
+// Stats returns the repository's deduplication statistics.
+func (r *Repository) Stats() Stats {
+	return Stats{
+		Reflinks:   atomic.LoadInt64(&r.stats.Reflinks),
+		Hardlinks:  atomic.LoadInt64(&r.stats.Hardlinks),
+		Copies:     atomic.LoadInt64(&r.stats.Copies),
+		BytesSaved: atomic.LoadInt64(&r.stats.BytesSaved),
+	}
+}
+
+// takeStats returns the repository's stats and resets them.
+func (r *Repository) takeStats() Stats {
+	return Stats{
+		Reflinks:   atomic.SwapInt64(&r.stats.Reflinks, 0),
+		Hardlinks:  atomic.SwapInt64(&r.stats.Hardlinks, 0),
+		Copies:     atomic.SwapInt64(&r.stats.Copies, 0),
+		BytesSaved: atomic.SwapInt64(&r.stats.BytesSaved, 0),
+	}
+}
+
+func (r *Repository) addStats(s Stats) {
+	atomic.AddInt64(&r.stats.Reflinks, s.Reflinks)
+	atomic.AddInt64(&r.stats.Hardlinks, s.Hardlinks)
+	atomic.AddInt64(&r.stats.Copies, s.Copies)
+	atomic.AddInt64(&r.stats.BytesSaved, s.BytesSaved)
+}
+
+// hardlink links src to dst.
+func (r *Repository) hardlink(src, dst string, size int64) error {
+	if err := os.Link(src, dst); err != nil {
+		return err
+	}
+	r.addStats(Stats{Hardlinks: 1, BytesSaved: size})
+	return nil
+}
+
+// reflink clones src to dst, which is created or truncated. Once the
+// repository's filesystem is found not to support reflinks, reflink
+// fails immediately.
+func (r *Repository) reflink(src, dst string, size int64) error {
+	if atomic.LoadInt32(&r.noReflink) != 0 {
+		return errReflinkUnsupported
+	}
+	err := reflink(src, dst)
+	if err != nil {
+		if reflinkUnsupported(err) {
+			atomic.StoreInt32(&r.noReflink, 1)
+		}
+		return err
+	}
+	r.addStats(Stats{Reflinks: 1, BytesSaved: size})
+	return nil
+}
+
+// copy copies the contents of src to dst, which is created or truncated.
+func (r *Repository) copy(src, dst string) error {
+	s, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	info, err := s.Stat()
+	if err != nil {
+		return err
+	}
+	d, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(d, s)
+	if cerr := d.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(dst)
+		return err
+	}
+	r.addStats(Stats{Copies: 1})
+	return nil
+}
+
+// cloneOrCopy reflinks src to dst if possible, and otherwise copies it.
+func (r *Repository) cloneOrCopy(src, dst string, size int64) error {
+	if err := r.reflink(src, dst, size); err == nil {
+		return nil
+	}
+	return r.copy(src, dst)
+}
@@ -0,0 +1,19 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+// +build !linux
+
+package filerepo
+
+import "github.com/grailbio/reflow/errors"
+
+var errReflinkUnsupported = errors.E("reflink", errors.NotSupported)
+
+func reflink(src, dst string) error {
+	return errReflinkUnsupported
+}
+
+func reflinkUnsupported(err error) bool {
+	return true
+}
@@ -0,0 +1,59 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+// +build linux
+
+package filerepo
+
+import (
+	"os"
+	"syscall"
+)
+
+// ficlone is the FICLONE ioctl request, as defined in linux/fs.h.
+const ficlone = 0x40049409
+
+var errReflinkUnsupported = &os.SyscallError{Syscall: "ioctl", Err: syscall.EOPNOTSUPP}
+
+// reflink clones the file src to dst using the FICLONE ioctl, which is
+// supported by copy-on-write filesystems such as btrfs and xfs.
+func reflink(src, dst string) error {
+	s, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	info, err := s.Stat()
+	if err != nil {
+		return err
+	}
+	d, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, d.Fd(), ficlone, s.Fd())
+	err = d.Close()
+	if errno != 0 {
+		err = &os.SyscallError{Syscall: "ioctl", Err: errno}
+	}
+	if err != nil {
+		os.Remove(dst)
+	}
+	return err
+}
+
+// reflinkUnsupported tells whether err indicates that the filesystem
+// does not support reflinks at all (as opposed to, e.g., the source
+// and destination residing on different devices).
+func reflinkUnsupported(err error) bool {
+	serr, ok := err.(*os.SyscallError)
+	if !ok {
+		return false
+	}
+	switch serr.Err {
+	case syscall.EOPNOTSUPP, syscall.ENOTTY, syscall.EINVAL, syscall.ENOSYS:
+		return true
+	}
+	return false
+}
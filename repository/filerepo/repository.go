@@ -15,7 +15,6 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
-	"syscall"
 	"time"
 
 	"github.com/grailbio/base/data"
@@ -40,6 +39,12 @@ type Repository struct {
 	RepoURL *url.URL
 
 	read, write singleflight.Group
+
+	// stats is updated atomically.
+	stats Stats
+	// noReflink is set (atomically) once the repository's filesystem
+	// has been found not to support reflinks.
+	noReflink int32
 }
 
 // Path returns the filesystem directory and full path of the object with a given digest.
@@ -65,32 +70,42 @@ func (r *Repository) Install(file string) (reflow.File, error) {
 }
 
 // InstallDigest installs a file at the given digest. The caller guarantees
-// that the file's bytes have the digest d.
+// that the file's bytes have the digest d. The file is hardlinked into
+// the repository if possible; otherwise it is reflinked or, failing
+// that, copied.
 func (r *Repository) InstallDigest(d digest.Digest, file string) error {
 	file, err := filepath.EvalSymlinks(file)
 	if err != nil {
 		return err
 	}
+	info, err := os.Stat(file)
+	if err != nil {
+		return err
+	}
 	dir, path := r.Path(d)
 	if err := os.MkdirAll(dir, 0777); err != nil {
 		return err
 	}
-	err = os.Link(file, path)
-	if os.IsExist(err) {
-		err = nil
+	err = r.hardlink(file, path, info.Size())
+	if err == nil || os.IsExist(err) {
+		return nil
 	}
+	// The file could not be linked, e.g., because it resides on a
+	// different device. Clone or copy it into a temporary file in the
+	// repository, which is then linked into place.
+	temp, err := r.TempFile("install-")
 	if err != nil {
-		// Copy if file was reported to be on a different device.
-		if linkErr, ok := err.(*os.LinkError); ok && linkErr.Err == syscall.EXDEV {
-			f, ferr := os.Open(file)
-			if ferr != nil {
-				return ferr
-			}
-			defer func() { _ = f.Close() }()
-			_, err = r.Put(context.Background(), f)
-		}
+		return err
 	}
-	return err
+	temp.Close()
+	defer os.Remove(temp.Name())
+	if err := r.cloneOrCopy(file, temp.Name(), info.Size()); err != nil {
+		return err
+	}
+	if err := os.Link(temp.Name(), path); err != nil && !os.IsExist(err) {
+		return err
+	}
+	return nil
 }
 
 // Stat retrieves metadata for files stored in the repository.
@@ -272,8 +287,11 @@ func (r *Repository) Put(ctx context.Context, body io.Reader) (digest.Digest, er
 	}
 }
 
-// Materialize takes a mapping of path-to-object, and hardlinks the
+// Materialize takes a mapping of path-to-object, and installs the
 // corresponding objects from the repository into the given root.
+// Objects are reflinked where the filesystem supports it, so that
+// modifications to the materialized files do not affect the
+// repository. Otherwise they are hardlinked or, failing that, copied.
 func (r *Repository) Materialize(root string, binds map[string]digest.Digest) error {
 	dirsMade := map[string]bool{}
 	for path, id := range binds {
@@ -288,7 +306,17 @@ func (r *Repository) Materialize(root string, binds map[string]digest.Digest) er
 		}
 		os.Remove(path) // best effort
 		_, rpath := r.Path(id)
-		if err := os.Link(rpath, path); err != nil {
+		info, err := os.Stat(rpath)
+		if err != nil {
+			return err
+		}
+		if err := r.reflink(rpath, path, info.Size()); err == nil {
+			continue
+		}
+		if err := r.hardlink(rpath, path, info.Size()); err == nil {
+			continue
+		}
+		if err := r.copy(rpath, path); err != nil {
 			return err
 		}
 	}
@@ -296,7 +324,9 @@ func (r *Repository) Materialize(root string, binds map[string]digest.Digest) er
 }
 
 // Vacuum moves all objects from the given repository to this one.
+// The given repository's stats are moved to this one.
 func (r *Repository) Vacuum(ctx context.Context, repo *Repository) error {
+	r.addStats(repo.takeStats())
 	var w walker
 	w.Init(repo)
 	for w.Scan() {
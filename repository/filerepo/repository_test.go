@@ -261,3 +261,71 @@ func TestScan(t *testing.T) {
 		}
 	}
 }
+
+func TestStats(t *testing.T) {
+	r, cleanup := newTestRepository(t)
+	defer cleanup()
+	staging, stagingCleanup := newTestRepository(t)
+	defer stagingCleanup()
+	id := mustInstall(t, staging, "contents")
+	if got, want := staging.Stats().Hardlinks, int64(1); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if err := r.Vacuum(context.Background(), staging); err != nil {
+		t.Fatal(err)
+	}
+	// Vacuum moves the staging repository's stats.
+	if got, want := staging.Stats(), (Stats{}); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := r.Stats(), (Stats{Hardlinks: 2, BytesSaved: 16}); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	root, cleanupRoot := grailtest.TempDir(t, "", "materialize-")
+	defer cleanupRoot()
+	if err := r.Materialize(root, map[string]digest.Digest{"x": id}); err != nil {
+		t.Fatal(err)
+	}
+	stats := r.Stats()
+	if got, want := stats.Reflinks+stats.Hardlinks+stats.Copies, int64(3); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := stats.BytesSaved, 8*(stats.Reflinks+stats.Hardlinks); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestCloneOrCopy(t *testing.T) {
+	r, cleanup := newTestRepository(t)
+	defer cleanup()
+	id := mustInstall(t, r, "contents")
+	_, src := r.Path(id)
+	dst := filepath.Join(r.Root, "copy")
+	for i := 0; i < 2; i++ { // The second time, the destination exists.
+		if err := r.cloneOrCopy(src, dst, 8); err != nil {
+			t.Fatal(err)
+		}
+		p, err := ioutil.ReadFile(dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := string(p), "contents"; got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	}
+	// Cloned or copied files are independent of the repository's object.
+	if err := ioutil.WriteFile(dst, []byte("modified"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	p, err := ioutil.ReadFile(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(p), "contents"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	stats := r.Stats()
+	if got, want := stats.Reflinks+stats.Copies, int64(2); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
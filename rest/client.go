@@ -17,6 +17,7 @@ import (
 
 	"github.com/grailbio/reflow/errors"
 	"github.com/grailbio/reflow/log"
+	"github.com/grailbio/reflow/trace"
 	"golang.org/x/net/context/ctxhttp"
 )
 
@@ -120,6 +121,7 @@ func (c *ClientCall) Do(ctx context.Context, body io.Reader) (int, error) {
 	}
 	r.URL = c.url.ResolveReference(&url.URL{Path: path, RawQuery: query})
 	r.Header = c.Header
+	trace.WriteHTTPContext(ctx, &r.Header)
 	if c.log.At(log.DebugLevel) {
 		b, err := httputil.DumpRequest(r, true)
 		if err != nil {
@@ -6,6 +6,7 @@ package runner
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"sync"
 	"time"
@@ -65,10 +66,15 @@ type State struct {
 	AllocID string
 	// AllocInspect is the alloc's inspect output.
 	AllocInspect pool.AllocInspect
-	// Value contains the result of the evaluation,
+	// Result contains the result of the evaluation,
 	// rendered as a string.
-	// TODO(marius): serialize the value into JSON.
 	Result string
+	// ResultType is the type of the result of the evaluation.
+	ResultType string `json:",omitempty"`
+	// ResultJSON contains the result of the evaluation, encoded
+	// by values.MarshalJSON. It is empty if the result cannot be
+	// encoded (e.g., because it contains functions).
+	ResultJSON json.RawMessage `json:",omitempty"`
 	// Err contains runtime errors.
 	Err *errors.Error
 	// NumTries is the number of evaluation attempts
@@ -93,6 +99,8 @@ func (s *State) Reset() {
 	s.AllocID = ""
 	s.AllocInspect = pool.AllocInspect{}
 	s.Result = ""
+	s.ResultType = ""
+	s.ResultJSON = nil
 	s.Err = nil
 	s.NumTries = 0
 	s.LastTry = time.Time{}
@@ -118,6 +126,14 @@ func (s State) String() string {
 	panic("unknown state")
 }
 
+// Value decodes the result of the evaluation, which is of type t.
+func (s State) Value(t *types.T) (values.T, error) {
+	if len(s.ResultJSON) == 0 {
+		return nil, errors.New("run has no JSON-encoded result")
+	}
+	return values.UnmarshalJSON(s.ResultJSON, t)
+}
+
 // A Runner is responsible for evaluating a flow.Flow on a cluster.
 // Runners also launch and maintain auxilliary work-stealing allocs,
 // and manages data transfer and failure handling between the primary
@@ -164,6 +180,11 @@ type Runner struct {
 
 	// Cmdline is a debug string with program name, params and args.
 	Cmdline string
+
+	// Graph is the flow graph of the most recent evaluation. It is
+	// set when each evaluation completes, if EvalConfig.RecordGraph
+	// is set.
+	Graph *flow.Graph
 }
 
 // Do steps the runner state machine. Do returns true whenever
@@ -208,9 +229,9 @@ func (r *Runner) Do(ctx context.Context) bool {
 				break
 			}
 		}
-		var err error
-		r.Result, err = r.Eval(ctx)
+		v, err := r.Eval(ctx)
 		if err == nil {
+			r.setResult(v)
 			r.Phase = Done
 			r.Completion = time.Now()
 			break
@@ -266,7 +287,7 @@ func (r *Runner) Allocate(ctx context.Context) error {
 // Eval evaluates the flow, returning the resulting Value. In the
 // case of failure, r.Alloc is kept-alive for an additional r.Retain
 // duration.
-func (r *Runner) Eval(ctx context.Context) (string, error) {
+func (r *Runner) Eval(ctx context.Context) (values.T, error) {
 	ctx, cancel := context.WithCancel(ctx)
 	var wg sync.WaitGroup
 	if r.Alloc != nil {
@@ -314,6 +335,9 @@ func (r *Runner) Eval(ctx context.Context) (string, error) {
 	}
 	cancel()
 	wg.Wait() // TODO(marius): wait for stealers too?
+	if r.RecordGraph {
+		r.Graph = eval.Graph()
+	}
 
 	var retain time.Duration
 	if err != nil || eval.Err() != nil {
@@ -327,15 +351,29 @@ func (r *Runner) Eval(ctx context.Context) (string, error) {
 		cancel()
 	}
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	if err := eval.Err(); err != nil {
-		return "", errors.E(errors.Eval, err)
+		return nil, errors.E(errors.Eval, err)
 	}
-	if r.Type == nil {
-		return eval.Value().(reflow.Fileset).String(), nil
+	return eval.Value(), nil
+}
+
+// setResult records the result v of the run's evaluation in its
+// state, both rendered as a string and encoded as JSON.
+func (r *Runner) setResult(v values.T) {
+	typ := r.Type
+	if typ == nil {
+		r.Result = v.(reflow.Fileset).String()
+		typ = types.Fileset
+	} else {
+		r.Result = values.Sprint(v, typ)
+	}
+	r.ResultType = typ.String()
+	var err error
+	if r.ResultJSON, err = values.MarshalJSON(v, typ); err != nil {
+		r.Log.Errorf("encode result: %v", err)
 	}
-	return values.Sprint(eval.Value(), r.Type), nil
 }
 
 func (r Runner) labels() pool.Labels {
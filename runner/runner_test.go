@@ -17,6 +17,7 @@ import (
 	"github.com/grailbio/reflow/taskdb"
 	op "github.com/grailbio/reflow/test/flow"
 	"github.com/grailbio/reflow/test/testutil"
+	"github.com/grailbio/reflow/types"
 )
 
 type allocateResult struct {
@@ -133,4 +134,11 @@ func TestRunner(t *testing.T) {
 	if got, want := r.Result, (reflow.Result{Fileset: testutil.Files("ok")}); got != want.String() {
 		t.Errorf("got %v, want %v", got, want)
 	}
+	v, err := r.State.Value(types.Fileset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := v.(reflow.Fileset), testutil.Files("ok"); !got.Equal(want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
 }
@@ -202,7 +202,7 @@ func (w *worker) do(ctx context.Context, f *flow.Flow) (err error) {
 			if err == nil {
 				if w.Eval.TaskDB != nil {
 					tctx, cancel = context.WithCancel(ctx)
-					err = w.Eval.TaskDB.CreateTask(tctx, f.TaskID, w.Eval.RunID, f.Digest(), x.URI())
+					err = w.Eval.TaskDB.CreateTask(tctx, f.TaskID, w.Eval.RunID, f.Digest(), 0, x.URI())
 					if err != nil {
 						log.Debugf("taskdb createtask: %v\n", err)
 					} else {
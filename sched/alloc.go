@@ -72,6 +72,8 @@ type alloc struct {
 
 	idleTime time.Time
 	index    int
+	// terminating is closed when the alloc's pool is terminating.
+	terminating chan struct{}
 	// id is the alloc id. It is the same as Alloc.ID(). It is present here
 	// so that we can retrieve the id to update the stats after the alloc dies.
 	id string
@@ -123,6 +125,24 @@ func (a *alloc) IdleFor() time.Duration {
 	return time.Since(a.idleTime)
 }
 
+// Terminate marks the alloc as terminating: its pool is about to
+// terminate, and its tasks should be migrated to other allocs.
+func (a *alloc) Terminate() {
+	if !a.Terminating() {
+		close(a.terminating)
+	}
+}
+
+// Terminating tells whether the alloc is terminating.
+func (a *alloc) Terminating() bool {
+	select {
+	case <-a.terminating:
+		return true
+	default:
+		return false
+	}
+}
+
 func newAlloc() *alloc {
-	return &alloc{index: -1}
+	return &alloc{index: -1, terminating: make(chan struct{})}
 }
@@ -0,0 +1,301 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package sched
+
+import (
+	"container/heap"
+	"flag"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/grailbio/infra"
+	"github.com/grailbio/reflow"
+)
+
+func init() {
+	infra.Register("fairshare", new(FairShare))
+}
+
+// FairShare configures how a scheduler shares its allocs among the
+// runs that submit tasks to it. Tasks are grouped into shares: by
+// default each run (RunID) is its own share; if Label is set, tasks
+// are grouped by the value of that label (for example, per user or
+// per project).
+//
+// The scheduler implements weighted fair sharing: when tasks from
+// multiple shares are waiting, the next task is taken from the share
+// whose weighted dominant share of the scheduler's live resources
+// is smallest. Task priorities take precedence over fairness: a task
+// of higher priority (in any share) is considered before tasks of
+// lower priority.
+//
+// Scheduling is free of preemption: running tasks are never stopped
+// to make room for other shares. Instead, when the next task of a
+// share does not fit in any alloc, smaller tasks from other shares
+// may be backfilled into the available resources.
+//
+// FairShare is also an infra provider (named "fairshare"), so that
+// the policy may be configured, for example:
+//
+//	fairshare: fairshare,label=user,weights=user=alice:2;user=bob:1,maxshare=0.5
+type FairShare struct {
+	// Label is the name of the task label whose value determines a
+	// task's share. If empty, or if a task does not have the label,
+	// the task's share is its run.
+	Label string `yaml:"label,omitempty"`
+	// Weights is the relative weight of each share. Shares not
+	// present in Weights have weight 1.
+	Weights map[string]float64 `yaml:"weights,omitempty"`
+	// MaxShare is the maximum fraction of the scheduler's live
+	// resources (in any resource dimension) which may be used by
+	// a single share while other shares have tasks waiting. MaxShare
+	// is not enforced if it is zero.
+	MaxShare float64 `yaml:"maxshare,omitempty"`
+}
+
+// Help implements infra.Provider.
+func (*FairShare) Help() string {
+	return "configure how the scheduler shares allocs among runs or labeled groups of tasks"
+}
+
+// Flags implements infra.Provider.
+func (f *FairShare) Flags(flags *flag.FlagSet) {
+	flags.StringVar(&f.Label, "label", "", "task label whose value determines a task's share; by default each run is a share")
+	flags.Var((*shareWeights)(&f.Weights), "weights", "semicolon-separated list of share:weight pairs, e.g., user=alice:2;user=bob:1")
+	flags.Float64Var(&f.MaxShare, "maxshare", 0, "maximum fraction of resources used by a single share while others wait; zero means no limit")
+}
+
+// Init implements infra.Provider.
+func (f *FairShare) Init() error {
+	if f.MaxShare < 0 || f.MaxShare > 1 {
+		return fmt.Errorf("fairshare: maxshare %g is not in [0, 1]", f.MaxShare)
+	}
+	for name, w := range f.Weights {
+		if w <= 0 {
+			return fmt.Errorf("fairshare: share %s has nonpositive weight %g", name, w)
+		}
+	}
+	return nil
+}
+
+// shareWeights is a flag.Value for share weights.
+type shareWeights map[string]float64
+
+func (w *shareWeights) String() string {
+	if w == nil {
+		return ""
+	}
+	var pairs []string
+	for name, weight := range *w {
+		pairs = append(pairs, fmt.Sprintf("%s:%g", name, weight))
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ";")
+}
+
+func (w *shareWeights) Set(s string) error {
+	weights := make(map[string]float64)
+	for _, pair := range strings.Split(s, ";") {
+		if pair == "" {
+			continue
+		}
+		i := strings.LastIndex(pair, ":")
+		if i < 0 {
+			return fmt.Errorf("invalid share weight %q: expected share:weight", pair)
+		}
+		weight, err := strconv.ParseFloat(pair[i+1:], 64)
+		if err != nil {
+			return fmt.Errorf("invalid share weight %q: %v", pair, err)
+		}
+		weights[pair[:i]] = weight
+	}
+	*w = weights
+	return nil
+}
+
+// share returns the name of the share of the provided task.
+func (f *FairShare) share(task *Task) string {
+	if f != nil && f.Label != "" {
+		if v, ok := task.Labels[f.Label]; ok {
+			return f.Label + "=" + v
+		}
+	}
+	return task.RunID.ID()
+}
+
+// weight returns the weight of the named share.
+func (f *FairShare) weight(name string) float64 {
+	if f != nil {
+		if w, ok := f.Weights[name]; ok && w > 0 {
+			return w
+		}
+	}
+	return 1
+}
+
+// A share is a group of tasks that are scheduled fairly with respect
+// to other shares.
+type share struct {
+	name   string
+	weight float64
+	// tasks is the share's queue of runnable tasks.
+	tasks taskq
+	// running is the total resources of the share's assigned tasks.
+	running reflow.Resources
+	// n is the number of the share's assigned tasks.
+	n int
+}
+
+// fairq is a queue of tasks that are dequeued in a weighted fair
+// manner among their shares.
+type fairq struct {
+	policy *FairShare
+	shares map[string]*share
+	// total is the total resources from which shares are computed.
+	total reflow.Resources
+}
+
+func newFairq(policy *FairShare) *fairq {
+	return &fairq{policy: policy, shares: make(map[string]*share)}
+}
+
+// Len returns the number of queued tasks.
+func (q *fairq) Len() int {
+	var n int
+	for _, s := range q.shares {
+		n += len(s.tasks)
+	}
+	return n
+}
+
+// Push adds a task to the queue.
+func (q *fairq) Push(task *Task) {
+	heap.Push(&q.get(task).tasks, task)
+}
+
+// Tasks returns the tasks in the queue, in no particular order.
+func (q *fairq) Tasks() []*Task {
+	var tasks []*Task
+	for _, s := range q.shares {
+		tasks = append(tasks, s.tasks...)
+	}
+	return tasks
+}
+
+// Clear removes all tasks from the queue, returning them.
+func (q *fairq) Clear() []*Task {
+	tasks := q.Tasks()
+	for _, s := range q.shares {
+		s.tasks = nil
+	}
+	q.gc()
+	return tasks
+}
+
+// Assign accounts for the assignment of a task, which must have
+// previously been dequeued, to an alloc.
+func (q *fairq) Assign(task *Task) {
+	s := q.get(task)
+	s.running.Add(s.running, task.Config.Resources)
+	s.n++
+}
+
+// Unassign accounts for the completion of a task's assignment.
+func (q *fairq) Unassign(task *Task) {
+	s := q.get(task)
+	s.running.Sub(s.running, task.Config.Resources)
+	s.n--
+	q.gc()
+}
+
+// Next returns the share from which the next task should be taken,
+// ignoring the shares in skip. Next returns nil if no share is
+// eligible.
+func (q *fairq) Next(skip map[*share]bool) *share {
+	var waiting int
+	for _, s := range q.shares {
+		if len(s.tasks) > 0 {
+			waiting++
+		}
+	}
+	var best *share
+	for _, s := range q.shares {
+		if len(s.tasks) == 0 || skip[s] {
+			continue
+		}
+		// Shares are capped only when they are contended.
+		if max := q.maxShare(); max > 0 && waiting > 1 {
+			var next reflow.Resources
+			next.Add(s.running, s.tasks[0].Config.Resources)
+			if dominantShare(next, q.total) > max {
+				continue
+			}
+		}
+		if best == nil || q.before(s, best) {
+			best = s
+		}
+	}
+	return best
+}
+
+// before tells whether the next task of share s should be scheduled
+// before the next task of share t.
+func (q *fairq) before(s, t *share) bool {
+	if sp, tp := s.tasks[0].Priority, t.tasks[0].Priority; sp != tp {
+		return sp < tp
+	}
+	su := dominantShare(s.running, q.total) / s.weight
+	tu := dominantShare(t.running, q.total) / t.weight
+	if su != tu {
+		return su < tu
+	}
+	if s.n != t.n {
+		return s.n < t.n
+	}
+	return s.name < t.name
+}
+
+func (q *fairq) maxShare() float64 {
+	if q.policy == nil {
+		return 0
+	}
+	return q.policy.MaxShare
+}
+
+func (q *fairq) get(task *Task) *share {
+	name := q.policy.share(task)
+	s := q.shares[name]
+	if s == nil {
+		s = &share{name: name, weight: q.policy.weight(name)}
+		q.shares[name] = s
+	}
+	return s
+}
+
+// gc removes empty shares.
+func (q *fairq) gc() {
+	for name, s := range q.shares {
+		if len(s.tasks) == 0 && s.n == 0 {
+			delete(q.shares, name)
+		}
+	}
+}
+
+// dominantShare returns the largest fraction of total used in any
+// of total's (nonzero) resource dimensions.
+func dominantShare(used, total reflow.Resources) float64 {
+	var max float64
+	for k, v := range total {
+		if v <= 0 {
+			continue
+		}
+		if frac := used[k] / v; frac > max {
+			max = frac
+		}
+	}
+	return max
+}
@@ -0,0 +1,222 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package sched
+
+import (
+	"container/heap"
+	"flag"
+	"reflect"
+	"testing"
+
+	"github.com/grailbio/reflow"
+	"github.com/grailbio/reflow/pool"
+	"github.com/grailbio/reflow/taskdb"
+)
+
+func newFairTask(runID taskdb.RunID, cpu float64) *Task {
+	task := NewTask()
+	task.ID = taskdb.NewTaskID()
+	task.RunID = runID
+	task.Config.Resources = reflow.Resources{"cpu": cpu, "mem": 1 << 30}
+	return task
+}
+
+func newFairAllocs(resources ...reflow.Resources) (allocs allocq, total reflow.Resources) {
+	for _, r := range resources {
+		alloc := newAlloc()
+		alloc.Available = r
+		heap.Push(&allocs, alloc)
+		total.Add(total, r)
+	}
+	return
+}
+
+// count returns the number of tasks from each run in tasks.
+func count(tasks []*Task) map[taskdb.RunID]int {
+	n := make(map[taskdb.RunID]int)
+	for _, task := range tasks {
+		n[task.RunID]++
+	}
+	return n
+}
+
+func TestFairShareEqual(t *testing.T) {
+	var (
+		s    Scheduler
+		q    = newFairq(nil)
+		a, b = taskdb.NewRunID(), taskdb.NewRunID()
+	)
+	// Run a submits all of its tasks before run b.
+	for i := 0; i < 10; i++ {
+		q.Push(newFairTask(a, 1))
+	}
+	for i := 0; i < 10; i++ {
+		q.Push(newFairTask(b, 1))
+	}
+	allocs, total := newFairAllocs(reflow.Resources{"cpu": 8, "mem": 64 << 30})
+	q.total = total
+	n := count(s.assign(q, &allocs, nil))
+	if got, want := n[a], 4; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := n[b], 4; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := q.Len(), 12; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestFairShareWeights(t *testing.T) {
+	var (
+		s      Scheduler
+		a, b   = taskdb.NewRunID(), taskdb.NewRunID()
+		policy = &FairShare{
+			Label:   "user",
+			Weights: map[string]float64{"user=alice": 3},
+		}
+		q = newFairq(policy)
+	)
+	for i := 0; i < 10; i++ {
+		task := newFairTask(a, 1)
+		task.Labels = pool.Labels{"user": "alice"}
+		q.Push(task)
+		task = newFairTask(b, 1)
+		task.Labels = pool.Labels{"user": "bob"}
+		q.Push(task)
+	}
+	allocs, total := newFairAllocs(reflow.Resources{"cpu": 8, "mem": 64 << 30})
+	q.total = total
+	n := count(s.assign(q, &allocs, nil))
+	if got, want := n[a], 6; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := n[b], 2; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestFairShareMaxShare(t *testing.T) {
+	var (
+		s    Scheduler
+		a, b = taskdb.NewRunID(), taskdb.NewRunID()
+		q    = newFairq(&FairShare{MaxShare: 0.25})
+	)
+	for i := 0; i < 10; i++ {
+		q.Push(newFairTask(a, 1))
+	}
+	allocs, total := newFairAllocs(reflow.Resources{"cpu": 8, "mem": 64 << 30})
+	q.total = total
+	// Uncontended shares are not capped.
+	n := count(s.assign(q, &allocs, nil))
+	if got, want := n[a], 8; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	q = newFairq(&FairShare{MaxShare: 0.25})
+	for i := 0; i < 10; i++ {
+		q.Push(newFairTask(a, 1))
+		q.Push(newFairTask(b, 1))
+	}
+	allocs, total = newFairAllocs(reflow.Resources{"cpu": 8, "mem": 64 << 30})
+	q.total = total
+	n = count(s.assign(q, &allocs, nil))
+	if got, want := n[a], 2; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := n[b], 2; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestFairShareBackfill(t *testing.T) {
+	var (
+		s    Scheduler
+		a, b = taskdb.NewRunID(), taskdb.NewRunID()
+		q    = newFairq(nil)
+	)
+	big := newFairTask(a, 8)
+	q.Push(big)
+	small := newFairTask(b, 2)
+	q.Push(small)
+	allocs, total := newFairAllocs(
+		reflow.Resources{"cpu": 4, "mem": 64 << 30},
+		reflow.Resources{"cpu": 2, "mem": 64 << 30},
+	)
+	q.total = total
+	// The big task does not fit anywhere; the small task is backfilled
+	// into the smallest alloc that fits it.
+	assigned := s.assign(q, &allocs, nil)
+	if got, want := len(assigned), 1; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if got, want := assigned[0], small; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := small.alloc.Available["cpu"], 0.0; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := q.Tasks(), []*Task{big}; len(got) != 1 || got[0] != want[0] {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestQueueStats(t *testing.T) {
+	var (
+		stats = newStats()
+		runID = taskdb.NewRunID()
+		tasks = []*Task{newFairTask(runID, 1), newFairTask(runID, 1)}
+		alloc = newAlloc()
+	)
+	alloc.id = "alloc"
+	stats.AddTasks(tasks)
+	stats.Allocs[alloc.id] = &AllocStats{TaskIDs: make(map[string]int)}
+	for _, task := range tasks {
+		stats.QueueTask(task)
+	}
+	stats.AssignTask(tasks[0], alloc)
+	q := stats.GetStats().Queues[runID.ID()]
+	if got, want := *q, (QueueStats{Queued: 1, Running: 1}); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	stats.AssignTask(tasks[1], alloc)
+	stats.ReturnTask(tasks[0], alloc)
+	stats.ReturnTask(tasks[1], alloc)
+	if _, ok := stats.GetStats().Queues[runID.ID()]; ok {
+		t.Error("expected queue stats to be removed")
+	}
+}
+
+func TestFairShareFlags(t *testing.T) {
+	var (
+		policy FairShare
+		flags  = flag.NewFlagSet("fairshare", flag.ContinueOnError)
+	)
+	policy.Flags(flags)
+	if err := flags.Parse([]string{"-label", "user", "-weights", "user=alice:2;user=bob:0.5", "-maxshare", "0.5"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := policy.Init(); err != nil {
+		t.Fatal(err)
+	}
+	want := FairShare{
+		Label:    "user",
+		Weights:  map[string]float64{"user=alice": 2, "user=bob": 0.5},
+		MaxShare: 0.5,
+	}
+	if !reflect.DeepEqual(policy, want) {
+		t.Errorf("got %+v, want %+v", policy, want)
+	}
+	if got, want := policy.weight(policy.share(&Task{Labels: pool.Labels{"user": "alice"}})), 2.0; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if err := flags.Set("weights", "user=alice"); err == nil {
+		t.Error("expected error")
+	}
+	policy.MaxShare = 2
+	if err := policy.Init(); err == nil {
+		t.Error("expected error")
+	}
+}
@@ -17,7 +17,16 @@
 // objects cannot be fetched, or if uploading fails.
 //
 // If an alloc's keepalive fails, its running tasks are marked as
-// lost and rescheduled.
+// lost and rescheduled. If the cluster reports that an alloc may be
+// interrupted (see pool.Interrupter), and the alloc's pool then
+// notifies the scheduler that it is terminating (see
+// pool.Terminator), the alloc is no longer assigned tasks; tasks
+// whose execs have completed are allowed to finish (so that their
+// results are promoted), while the others are immediately
+// rescheduled on other allocs.
+//
+// Tasks submitted by different runs are scheduled fairly with
+// respect to each other; see FairShare.
 package sched
 
 import (
@@ -87,6 +96,10 @@ type Scheduler struct {
 	// Labels is the set of labels applied to newly created allocs.
 	Labels pool.Labels
 
+	// FairShare configures how allocs are shared among runs. If nil,
+	// each run has an equal share.
+	FairShare *FairShare
+
 	// Stats is the scheduler stats.
 	Stats *Stats
 
@@ -125,6 +138,9 @@ func (s *Scheduler) ExportStats() {
 func (s *Scheduler) Do(ctx context.Context) error {
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
+	s.Stats.Lock()
+	s.Stats.fairShare = s.FairShare
+	s.Stats.Unlock()
 
 	// We maintain a priority queue of runnable tasks, and priority
 	// queues for live and pending live. The priority queues are
@@ -143,13 +159,14 @@ func (s *Scheduler) Do(ctx context.Context) error {
 	// remaining task list.
 	var (
 		live, pending allocq
-		todo          taskq
+		todo          = newFairq(s.FairShare)
 
 		nrunning int
 
-		notifyc = make(chan *alloc)
-		deadc   = make(chan *alloc)
-		returnc = make(chan *Task)
+		notifyc      = make(chan *alloc)
+		deadc        = make(chan *alloc)
+		terminatingc = make(chan *alloc)
+		returnc      = make(chan *Task)
 
 		tick = time.NewTicker(s.MaxAllocIdleTime / 2)
 	)
@@ -163,7 +180,7 @@ func (s *Scheduler) Do(ctx context.Context) error {
 			// will be canceled by the same context cancellation.)
 			//
 			// We also cancel keepalives
-			for _, task := range todo {
+			for _, task := range todo.Clear() {
 				task.Err = ctx.Err()
 				task.set(TaskDone)
 			}
@@ -198,12 +215,14 @@ func (s *Scheduler) Do(ctx context.Context) error {
 					go s.directTransfer(ctx, task)
 					continue
 				}
-				heap.Push(&todo, task)
+				todo.Push(task)
+				s.Stats.QueueTask(task)
 			}
 		case task := <-returnc:
 			nrunning--
 			alloc := task.alloc
 			alloc.Unassign(task)
+			todo.Unassign(task)
 			if alloc.index != -1 {
 				heap.Fix(&live, alloc.index)
 			}
@@ -212,7 +231,8 @@ func (s *Scheduler) Do(ctx context.Context) error {
 				panic("illegal task state")
 			case TaskLost:
 				task.set(TaskInit)
-				heap.Push(&todo, task)
+				todo.Push(task)
+				s.Stats.QueueTask(task)
 			case TaskDone:
 				// In this case we're done, and we can forget about the task.
 			}
@@ -222,6 +242,10 @@ func (s *Scheduler) Do(ctx context.Context) error {
 				heap.Remove(&live, alloc.index)
 				alloc.index = -1
 			}
+			// Terminating allocs are released once their last task returns.
+			if alloc.Terminating() && alloc.Pending == 0 {
+				alloc.Cancel()
+			}
 		case alloc := <-notifyc:
 			heap.Remove(&pending, alloc.index)
 			if alloc.Alloc != nil {
@@ -229,6 +253,17 @@ func (s *Scheduler) Do(ctx context.Context) error {
 				heap.Push(&live, alloc)
 				s.Stats.AddAlloc(alloc)
 			}
+		case alloc := <-terminatingc:
+			// The alloc's pool is terminating: no more tasks are assigned
+			// to it, and its running tasks are migrated; see run.
+			if alloc.index != -1 {
+				heap.Remove(&live, alloc.index)
+				alloc.index = -1
+			}
+			alloc.Terminate()
+			if alloc.Pending == 0 {
+				alloc.Cancel()
+			}
 		case alloc := <-deadc:
 			// The allocs tasks will be returned with state TaskLost.
 			if alloc.index != -1 {
@@ -237,7 +272,8 @@ func (s *Scheduler) Do(ctx context.Context) error {
 			s.Stats.MarkAllocDead(alloc)
 		}
 
-		assigned := s.assign(&todo, &live, s.Stats)
+		todo.total = liveResources(live)
+		assigned := s.assign(todo, &live, s.Stats)
 		for _, task := range assigned {
 			task.Log.Debugf("scheduler: assigning task %v to alloc %v", task.ID.IDShort(), task.alloc)
 			nrunning++
@@ -247,17 +283,18 @@ func (s *Scheduler) Do(ctx context.Context) error {
 		// At this point, we've scheduled everything we can onto the current
 		// set of allocs. If we have more work, we'll need to try to create more
 		// allocs.
-		if len(todo) == 0 || len(pending) >= s.MaxPendingAllocs {
+		if todo.Len() == 0 || len(pending) >= s.MaxPendingAllocs {
 			continue
 		}
 
 		// We have more to do, and potential to allocate. We mock allocate remaining
 		// tasks to pending allocs, and then allocate any remaining.
-		assigned = s.assign(&todo, &pending, nil)
-		req := requirements(todo)
+		assigned = s.assign(todo, &pending, nil)
+		req := requirements(todo.Tasks())
 		for _, task := range assigned {
 			task.alloc.Unassign(task)
-			heap.Push(&todo, task)
+			todo.Unassign(task)
+			todo.Push(task)
 		}
 		if req.Equal(reflow.Requirements{}) {
 			continue
@@ -268,39 +305,58 @@ func (s *Scheduler) Do(ctx context.Context) error {
 		alloc.Requirements = req
 		alloc.Available = req.Min
 		heap.Push(&pending, alloc)
-		go s.allocate(ctx, alloc, notifyc, deadc)
+		go s.allocate(ctx, alloc, notifyc, deadc, terminatingc)
 	}
 }
 
-func (s *Scheduler) assign(tasks *taskq, allocs *allocq, stats *Stats) (assigned []*Task) {
-	var unassigned []*alloc
-	for len(*tasks) > 0 && len(*allocs) > 0 {
-		var (
-			task  = (*tasks)[0]
-			alloc = (*allocs)[0]
-		)
-		if !alloc.Available.Available(task.Config.Resources) {
-			// We can't fit the smallest task in the smallest alloc.
-			// Remove the alloc from consideration.
-			heap.Pop(allocs)
-			unassigned = append(unassigned, alloc)
+// assign assigns tasks from the queue onto the provided allocs. Tasks
+// are taken from the queue's shares in fair order; each is assigned
+// to the smallest alloc in which it fits. When a share's next task does
+// not fit in any alloc, the share is skipped so that (smaller) tasks
+// from other shares may be backfilled.
+func (s *Scheduler) assign(tasks *fairq, allocs *allocq, stats *Stats) (assigned []*Task) {
+	skip := make(map[*share]bool)
+	for len(*allocs) > 0 {
+		sh := tasks.Next(skip)
+		if sh == nil {
+			break
+		}
+		task := sh.tasks[0]
+		var alloc *alloc
+		for _, a := range *allocs {
+			if !a.Available.Available(task.Config.Resources) {
+				continue
+			}
+			if alloc == nil || a.Available.ScaledDistance(nil) < alloc.Available.ScaledDistance(nil) {
+				alloc = a
+			}
+		}
+		if alloc == nil {
+			skip[sh] = true
 			continue
 		}
-		heap.Pop(tasks)
+		heap.Pop(&sh.tasks)
 		alloc.Assign(task)
+		tasks.Assign(task)
 		if stats != nil {
 			stats.AssignTask(task, alloc)
 		}
 		assigned = append(assigned, task)
-		heap.Fix(allocs, 0)
-	}
-	for _, alloc := range unassigned {
-		heap.Push(allocs, alloc)
+		heap.Fix(allocs, alloc.index)
 	}
 	return
 }
 
-func (s *Scheduler) allocate(ctx context.Context, alloc *alloc, notify, dead chan<- *alloc) {
+// liveResources returns the total resources of the provided allocs.
+func liveResources(allocs allocq) reflow.Resources {
+	var total reflow.Resources
+	for _, alloc := range allocs {
+		total.Add(total, alloc.Resources())
+	}
+	return total
+}
+
+func (s *Scheduler) allocate(ctx context.Context, alloc *alloc, notify, dead, terminating chan<- *alloc) {
 	var err error
 	alloc.Alloc, err = s.Cluster.Allocate(ctx, alloc.Requirements, s.Labels)
 	if err != nil {
@@ -311,20 +367,46 @@ func (s *Scheduler) allocate(ctx context.Context, alloc *alloc, notify, dead cha
 	}
 	alloc.Context, alloc.Cancel = context.WithCancel(ctx)
 	notify <- alloc
+	if i, ok := s.Cluster.(pool.Interrupter); ok && i.Interruptible(alloc.Alloc) {
+		if t, ok := alloc.Alloc.(pool.Terminator); ok {
+			go s.watchTerminating(alloc, t, terminating)
+		}
+	}
 	err = pool.Keepalive(alloc.Context, s.Log, alloc.Alloc)
-	alloc.Cancel()
-	if err != nil && err == ctx.Err() {
+	// The alloc's context is canceled when the scheduler is done with
+	// the alloc: either the scheduler itself is done, or the alloc was
+	// terminating and has no more tasks. In both cases, the alloc is
+	// released by letting its keepalive expire.
+	if err != nil && err == alloc.Context.Err() {
 		var cancel func()
 		ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
 		_, err = alloc.Keepalive(ctx, 0)
 		cancel()
 	}
+	alloc.Cancel()
 	if err != nil {
 		s.Log.Errorf("alloc keepalive failed: %v", err)
 	}
 	dead <- alloc
 }
 
+// watchTerminating notifies the scheduler, through the terminating
+// channel, when the alloc's pool is terminating.
+func (s *Scheduler) watchTerminating(alloc *alloc, t pool.Terminator, terminating chan<- *alloc) {
+	deadline, err := t.Terminating(alloc.Context)
+	if err != nil {
+		if alloc.Context.Err() == nil {
+			s.Log.Debugf("alloc %s: termination notices unavailable: %v", alloc.Alloc.ID(), err)
+		}
+		return
+	}
+	s.Log.Printf("alloc %s: terminating at %s; migrating its tasks", alloc.Alloc.ID(), deadline.Format(time.RFC3339))
+	select {
+	case terminating <- alloc:
+	case <-alloc.Context.Done():
+	}
+}
+
 type execState int
 
 const (
@@ -376,7 +458,21 @@ func (s *Scheduler) run(task *Task, returnc chan<- *Task) {
 		tctx           context.Context
 		loadedData     sync.Map
 		resultUnloaded bool
+		migrated       bool
 	)
+	// ectx is used until the task's exec has completed. It is canceled
+	// when the alloc is terminating so that the task can be migrated;
+	// tasks whose execs have completed are instead allowed to finish,
+	// so that their results are promoted and transferred.
+	ectx, ecancel := context.WithCancel(ctx)
+	defer ecancel()
+	go func() {
+		select {
+		case <-alloc.terminating:
+			ecancel()
+		case <-ectx.Done():
+		}
+	}()
 	// TODO(marius): we should distinguish between fatal and nonfatal errors.
 	// The fatal ones are useless to retry.
 	for n < numExecTries && state < stateDone {
@@ -390,7 +486,7 @@ func (s *Scheduler) run(task *Task, returnc chan<- *Task) {
 				}
 				loadedData.Store(i, false)
 			}
-			g, gctx := errgroup.WithContext(ctx)
+			g, gctx := errgroup.WithContext(ectx)
 			loadedData.Range(func(key, value interface{}) bool {
 				if value.(bool) {
 					return true
@@ -412,11 +508,11 @@ func (s *Scheduler) run(task *Task, returnc chan<- *Task) {
 			})
 			err = g.Wait()
 		case statePut:
-			x, err = alloc.Put(ctx, digest.Digest(task.ID), task.Config)
+			x, err = alloc.Put(ectx, digest.Digest(task.ID), task.Config)
 		case stateWait:
 			if s.TaskDB != nil {
 				tctx, tcancel = context.WithCancel(ctx)
-				if taskdbErr := s.TaskDB.CreateTask(tctx, task.ID, task.RunID, task.FlowID, x.URI()); taskdbErr != nil {
+				if taskdbErr := s.TaskDB.CreateTask(tctx, task.ID, task.RunID, task.FlowID, task.Attempt, x.URI()); taskdbErr != nil {
 					s.Log.Errorf("taskdb createtask: %v", taskdbErr)
 				} else {
 					go func() { _ = taskdb.KeepTaskAlive(tctx, s.TaskDB, task.ID) }()
@@ -424,7 +520,7 @@ func (s *Scheduler) run(task *Task, returnc chan<- *Task) {
 			}
 			task.Exec = x
 			task.set(TaskRunning)
-			err = x.Wait(ctx)
+			err = x.Wait(ectx)
 			if s.TaskDB != nil {
 				if taskdbErr := s.TaskDB.SetTaskResult(tctx, task.ID, x.ID()); taskdbErr != nil {
 					s.Log.Errorf("taskdb settaskresult: %v", taskdbErr)
@@ -481,6 +577,10 @@ func (s *Scheduler) run(task *Task, returnc chan<- *Task) {
 			state++
 		} else if err == ctx.Err() {
 			break
+		} else if state <= stateWait && alloc.Terminating() {
+			task.Log.Debugf("scheduler: %s %s: alloc terminating; migrating task", task.ID.IDShort(), state)
+			migrated = true
+			break
 		} else {
 			// TODO(marius): terminate early on NotSupported, Invalid
 			task.Log.Debugf("scheduler: %s %s: %s; try %d", task.ID.IDShort(), state, err, n+1)
@@ -488,7 +588,7 @@ func (s *Scheduler) run(task *Task, returnc chan<- *Task) {
 		}
 	}
 	task.Err = err
-	if err != nil && (err == ctx.Err() || errors.Restartable(err)) {
+	if err != nil && (migrated || err == ctx.Err() || errors.Restartable(err)) {
 		task.set(TaskLost)
 	} else {
 		task.set(TaskDone)
@@ -498,7 +598,7 @@ func (s *Scheduler) run(task *Task, returnc chan<- *Task) {
 
 func (s *Scheduler) directTransfer(ctx context.Context, task *Task) {
 	if s.TaskDB != nil {
-		if err := s.TaskDB.CreateTask(ctx, task.ID, task.RunID, task.FlowID, "local"); err != nil {
+		if err := s.TaskDB.CreateTask(ctx, task.ID, task.RunID, task.FlowID, task.Attempt, "local"); err != nil {
 			s.Log.Errorf("taskdb createtask: %v", err)
 		} else {
 			tctx, tcancel := context.WithCancel(ctx)
@@ -5,16 +5,23 @@
 package sched_test
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	golog "log"
+	"reflect"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/grailbio/base/digest"
 	"github.com/grailbio/reflow"
 	"github.com/grailbio/reflow/blob"
 	"github.com/grailbio/reflow/blob/testblob"
 	"github.com/grailbio/reflow/errors"
+	"github.com/grailbio/reflow/log"
+	"github.com/grailbio/reflow/pool"
 	"github.com/grailbio/reflow/repository"
 	"github.com/grailbio/reflow/sched"
 	"github.com/grailbio/reflow/test/testutil"
@@ -328,6 +335,177 @@ func TestTaskNetError(t *testing.T) {
 	allocs[0].exec(digest.Digest(tasks[1].ID))
 }
 
+func TestTaskMigrate(t *testing.T) {
+	cluster := newTestCluster()
+	scheduler := sched.New()
+	scheduler.Transferer = testutil.Transferer
+	scheduler.Repository = testutil.NewInmemoryRepository()
+	scheduler.Cluster = cluster
+	scheduler.MinAlloc = reflow.Resources{}
+	var logs bytes.Buffer
+	scheduler.Log = log.New(golog.New(&logs, "", 0), log.InfoLevel)
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		scheduler.Do(ctx)
+		wg.Done()
+	}()
+
+	tasks := []*sched.Task{
+		newTask(1, 1, 0),
+		newTask(1, 1, 0),
+	}
+	scheduler.Submit(tasks...)
+	terminating := newTerminatingTestAlloc(reflow.Resources{"cpu": 2, "mem": 2}, true)
+	req := <-cluster.Req()
+	req.Reply <- testClusterAllocReply{Alloc: terminating}
+	for _, task := range tasks {
+		if err := task.Wait(ctx, sched.TaskRunning); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Complete the first task; it should not be affected by termination.
+	terminating.exec(digest.Digest(tasks[0].ID)).complete(reflow.Result{}, nil)
+	if err := tasks[0].Wait(ctx, sched.TaskDone); err != nil {
+		t.Fatal(err)
+	}
+
+	// Once the alloc is terminating, the running task is migrated
+	// to a new alloc.
+	terminating.terminate(time.Now().Add(2 * time.Minute))
+	req = <-cluster.Req()
+	if got, want := tasks[1].State(), sched.TaskInit; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	alloc := newTestAlloc(reflow.Resources{"cpu": 2, "mem": 2})
+	req.Reply <- testClusterAllocReply{Alloc: alloc}
+	if err := tasks[1].Wait(ctx, sched.TaskRunning); err != nil {
+		t.Fatal(err)
+	}
+	alloc.exec(digest.Digest(tasks[1].ID)).complete(reflow.Result{}, nil)
+	if err := tasks[1].Wait(ctx, sched.TaskDone); err != nil {
+		t.Fatal(err)
+	}
+	for _, task := range tasks {
+		if task.Err != nil {
+			t.Errorf("task %s: %v", task.ID.IDShort(), task.Err)
+		}
+	}
+	cancel()
+	wg.Wait()
+	// Releasing the terminating alloc, and the others at shutdown, is
+	// not an error.
+	if strings.Contains(logs.String(), "keepalive failed") {
+		t.Errorf("unexpected keepalive failure:\n%s", logs.String())
+	}
+}
+
+func TestTaskNoMigrate(t *testing.T) {
+	scheduler, cluster, _, shutdown := newTestScheduler(t)
+	defer shutdown()
+	ctx := context.Background()
+
+	// Termination notices of allocs that the cluster does not report
+	// as interruptible are not watched.
+	task := newTask(1, 1, 0)
+	scheduler.Submit(task)
+	alloc := newTerminatingTestAlloc(reflow.Resources{"cpu": 2, "mem": 2}, false)
+	alloc.terminate(time.Now())
+	req := <-cluster.Req()
+	req.Reply <- testClusterAllocReply{Alloc: alloc}
+	if err := task.Wait(ctx, sched.TaskRunning); err != nil {
+		t.Fatal(err)
+	}
+	alloc.exec(digest.Digest(task.ID)).complete(reflow.Result{}, nil)
+	if err := task.Wait(ctx, sched.TaskDone); err != nil {
+		t.Fatal(err)
+	}
+	if task.Err != nil {
+		t.Errorf("task %s: %v", task.ID.IDShort(), task.Err)
+	}
+}
+
+func TestSchedulerFairShare(t *testing.T) {
+	cluster := newTestCluster()
+	scheduler := sched.New()
+	scheduler.Transferer = testutil.Transferer
+	scheduler.Repository = testutil.NewInmemoryRepository()
+	scheduler.Cluster = cluster
+	scheduler.MinAlloc = reflow.Resources{}
+	scheduler.FairShare = &sched.FairShare{
+		Label:   "user",
+		Weights: map[string]float64{"user=a": 3},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		scheduler.Do(ctx)
+		wg.Done()
+	}()
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+
+	// Users a and b submit tasks as part of the same run; they are
+	// shared by label, with a weighted 3:1 against b.
+	var tasks []*sched.Task
+	for _, user := range []string{"a", "b"} {
+		for i := 0; i < 8; i++ {
+			task := newTask(1, 1, 0)
+			task.Labels = pool.Labels{"user": user}
+			tasks = append(tasks, task)
+		}
+	}
+	scheduler.Submit(tasks...)
+	req := <-cluster.Req()
+	req.Reply <- testClusterAllocReply{Alloc: newTestAlloc(reflow.Resources{"cpu": 4, "mem": 4})}
+
+	statusCtx, statusCancel := context.WithCancel(context.Background())
+	var running, done sync.WaitGroup
+	running.Add(4)
+	done.Add(len(tasks))
+	for _, task := range tasks {
+		go func(task *sched.Task) {
+			if task.Wait(statusCtx, sched.TaskRunning) == nil {
+				running.Done()
+			}
+			done.Done()
+		}(task)
+	}
+	running.Wait()
+	statusCancel()
+	done.Wait()
+
+	n := make(map[string]int)
+	for _, task := range tasks {
+		if task.State() == sched.TaskRunning {
+			n[task.Labels["user"]]++
+		}
+	}
+	if got, want := n, map[string]int{"a": 3, "b": 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	// Queue stats are kept per share.
+	stats := scheduler.Stats.GetStats()
+	for share, want := range map[string]sched.QueueStats{
+		"user=a": {Queued: 5, Running: 3},
+		"user=b": {Queued: 7, Running: 1},
+	} {
+		q := stats.Queues[share]
+		if q == nil {
+			t.Errorf("missing queue stats for %s", share)
+			continue
+		}
+		if got := *q; got != want {
+			t.Errorf("%s: got %+v, want %+v", share, got, want)
+		}
+	}
+}
+
 func TestSchedulerFracCPU(t *testing.T) {
 	scheduler, cluster, _, shutdown := newTestScheduler(t)
 	ctx := context.Background()
@@ -66,6 +66,15 @@ func (a *AllocStats) Copy() AllocStats {
 	return copy
 }
 
+// QueueStats is the per run queue stats.
+type QueueStats struct {
+	// Queued is the number of the run's tasks waiting to be assigned
+	// to an alloc.
+	Queued int64
+	// Running is the number of the run's tasks assigned to allocs.
+	Running int64
+}
+
 // TaskStatFields is the set of the task stats.
 type TaskStatsFields struct {
 	// Ident is the exec identifier of this task.
@@ -110,6 +119,7 @@ func newStats() *Stats {
 	return &Stats{
 		Allocs: make(map[string]*AllocStats),
 		Tasks:  make(map[string]*TaskStats),
+		Queues: make(map[string]*QueueStats),
 	}
 }
 
@@ -123,6 +133,13 @@ type Stats struct {
 	Allocs map[string]*AllocStats
 	// Tasks has all the task state and stats, including completed/error tasks.
 	Tasks map[string]*TaskStats
+	// Queues has the queue stats of each share (keyed by share name;
+	// see FairShare) with queued or running tasks.
+	Queues map[string]*QueueStats
+
+	// fairShare is the scheduler's fair-share policy, which
+	// determines the share of each task.
+	fairShare *FairShare
 }
 
 // Publish publishes the stats as a go expvar.
@@ -141,6 +158,13 @@ func (s *Stats) AddTasks(tasks []*Task) {
 	}
 }
 
+// QueueTask accounts for a task that is queued for assignment.
+func (s *Stats) QueueTask(task *Task) {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+	s.queue(task).Queued++
+}
+
 // ReturnTask removes a task from the stats before returning it.
 func (s *Stats) ReturnTask(task *Task, alloc *alloc) {
 	s.Mutex.Lock()
@@ -149,6 +173,11 @@ func (s *Stats) ReturnTask(task *Task, alloc *alloc) {
 	t.Update(task)
 	a := s.Allocs[alloc.id]
 	a.RemoveTask(task)
+	q := s.queue(task)
+	q.Running--
+	if q.Queued == 0 && q.Running == 0 {
+		delete(s.Queues, s.fairShare.share(task))
+	}
 }
 
 // AssignTask assigns a task to an alloc.
@@ -159,6 +188,21 @@ func (s *Stats) AssignTask(task *Task, alloc *alloc) {
 	t.Update(task)
 	a := s.Allocs[alloc.id]
 	a.AssignTask(task)
+	q := s.queue(task)
+	q.Queued--
+	q.Running++
+}
+
+// queue returns the queue stats for the task's share.
+// It must be called with s.Mutex held.
+func (s *Stats) queue(task *Task) *QueueStats {
+	id := s.fairShare.share(task)
+	q := s.Queues[id]
+	if q == nil {
+		q = new(QueueStats)
+		s.Queues[id] = q
+	}
+	return q
 }
 
 // AddAlloc adds an alloc to the stats.
@@ -191,6 +235,11 @@ func (s *Stats) GetStats() Stats {
 	for k, v := range s.Tasks {
 		copy.Tasks[k] = v
 	}
+	copy.Queues = make(map[string]*QueueStats)
+	for k, v := range s.Queues {
+		q := *v
+		copy.Queues[k] = &q
+	}
 	s.Mutex.Unlock()
 	for k, v := range copy.Allocs {
 		c := v.Copy()
@@ -12,6 +12,7 @@ import (
 	"github.com/grailbio/base/sync/ctxsync"
 	"github.com/grailbio/reflow"
 	"github.com/grailbio/reflow/log"
+	"github.com/grailbio/reflow/pool"
 	"github.com/grailbio/reflow/taskdb"
 )
 
@@ -85,6 +86,12 @@ type Task struct {
 	RunID taskdb.RunID
 	// FlowID is the digest (flow.Digest) of the flow for which this task was created.
 	FlowID digest.Digest
+	// Labels are the labels of the run that created this task. They
+	// may be used to determine the task's fair share (see FairShare).
+	Labels pool.Labels
+	// Attempt is the number of times the flow's exec was previously
+	// attempted. Retries of a flow's exec are submitted as new tasks.
+	Attempt int
 
 	mu   sync.Mutex
 	cond *ctxsync.Cond
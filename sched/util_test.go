@@ -133,6 +133,12 @@ func (c *testCluster) Req() <-chan testClusterAllocReq {
 	return c.reqs
 }
 
+// Interruptible implements pool.Interrupter.
+func (c *testCluster) Interruptible(alloc pool.Alloc) bool {
+	a, ok := alloc.(*terminatingTestAlloc)
+	return ok && a.interruptible
+}
+
 func (c *testCluster) Allocate(ctx context.Context, req reflow.Requirements, labels pool.Labels) (pool.Alloc, error) {
 	replyc := make(chan testClusterAllocReply)
 	select {
@@ -376,3 +382,34 @@ func (a *testAlloc) hang() {
 	defer a.mu.Unlock()
 	a.hung = true
 }
+
+// terminatingTestAlloc is a testAlloc that implements pool.Terminator.
+// The test cluster reports it as interruptible if interruptible is set.
+type terminatingTestAlloc struct {
+	*testAlloc
+	interruptible bool
+	deadline      time.Time
+	termc         chan struct{}
+}
+
+func newTerminatingTestAlloc(resources reflow.Resources, interruptible bool) *terminatingTestAlloc {
+	return &terminatingTestAlloc{
+		testAlloc:     newTestAlloc(resources),
+		interruptible: interruptible,
+		termc:         make(chan struct{}),
+	}
+}
+
+func (a *terminatingTestAlloc) Terminating(ctx context.Context) (time.Time, error) {
+	select {
+	case <-a.termc:
+		return a.deadline, nil
+	case <-ctx.Done():
+		return time.Time{}, ctx.Err()
+	}
+}
+
+func (a *terminatingTestAlloc) terminate(deadline time.Time) {
+	a.deadline = deadline
+	close(a.termc)
+}
@@ -0,0 +1,151 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+// Package secrets defines the interface through which executors
+// resolve the secrets requested by execs, together with simple
+// file-based secret providers.
+//
+// Secrets are named by the environment variable through which they
+// are exposed to an exec's command. They are resolved by the executor
+// when the exec is started; their values are never part of an exec's
+// digest, nor of its inspect output.
+package secrets
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/grailbio/infra"
+	"github.com/grailbio/reflow/errors"
+)
+
+func init() {
+	infra.Register("envfile", new(EnvFile))
+	infra.Register("localvault", new(LocalVault))
+}
+
+// Secrets is a store of named secrets.
+type Secrets interface {
+	// Secret returns the value of the named secret. Secret returns
+	// an error of kind errors.NotExist if the secret does not exist.
+	Secret(ctx context.Context, name string) (string, error)
+}
+
+var validName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// ValidName tells whether name is a valid secret (and environment
+// variable) name.
+func ValidName(name string) bool {
+	return validName.MatchString(name)
+}
+
+// EnvFile is a Secrets provider that reads secrets from a file of
+// environment variable definitions, one "NAME=value" per line.
+// Blank lines and lines beginning with "#" are ignored; values may
+// be quoted. The file is read each time a secret is requested, so
+// that secrets may be rotated without restarting the executor.
+type EnvFile struct {
+	// Path is the path of the env file.
+	Path string
+}
+
+// Help implements infra.Provider.
+func (*EnvFile) Help() string {
+	return "read secrets from a file of NAME=value lines"
+}
+
+// Flags implements infra.Provider.
+func (e *EnvFile) Flags(flags *flag.FlagSet) {
+	flags.StringVar(&e.Path, "path", "", "path of the env file")
+}
+
+// Init implements infra.Provider.
+func (e *EnvFile) Init() error {
+	if e.Path == "" {
+		return errors.E("envfile", errors.Invalid, errors.New("no path provided"))
+	}
+	return nil
+}
+
+// Secret implements Secrets.
+func (e *EnvFile) Secret(ctx context.Context, name string) (string, error) {
+	f, err := os.Open(e.Path)
+	if err != nil {
+		return "", errors.E("envfile", e.Path, err)
+	}
+	defer f.Close()
+	scan := bufio.NewScanner(f)
+	for scan.Scan() {
+		line := strings.TrimSpace(scan.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		i := strings.Index(line, "=")
+		if i < 0 || strings.TrimSpace(line[:i]) != name {
+			continue
+		}
+		value := strings.TrimSpace(line[i+1:])
+		if len(value) > 1 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			if value[0] == '"' {
+				if unq, err := strconv.Unquote(value); err == nil {
+					return unq, nil
+				}
+			}
+			value = value[1 : len(value)-1]
+		}
+		return value, nil
+	}
+	if err := scan.Err(); err != nil {
+		return "", errors.E("envfile", e.Path, err)
+	}
+	return "", errors.E("envfile", e.Path, name, errors.NotExist)
+}
+
+// LocalVault is a Secrets provider that stands in for a secrets
+// vault: each secret is stored in its own file, named by the secret,
+// in a directory, as is the convention for secrets mounted into
+// containers. Trailing newlines are removed from secret values.
+type LocalVault struct {
+	// Dir is the directory that contains the secrets.
+	Dir string
+}
+
+// Help implements infra.Provider.
+func (*LocalVault) Help() string {
+	return "read secrets from a directory that contains one file per secret"
+}
+
+// Flags implements infra.Provider.
+func (v *LocalVault) Flags(flags *flag.FlagSet) {
+	flags.StringVar(&v.Dir, "dir", "", "directory that contains secret files")
+}
+
+// Init implements infra.Provider.
+func (v *LocalVault) Init() error {
+	if v.Dir == "" {
+		return errors.E("localvault", errors.Invalid, errors.New("no directory provided"))
+	}
+	return nil
+}
+
+// Secret implements Secrets.
+func (v *LocalVault) Secret(ctx context.Context, name string) (string, error) {
+	if !ValidName(name) {
+		return "", errors.E("localvault", name, errors.Invalid, errors.New("invalid secret name"))
+	}
+	path := filepath.Join(v.Dir, name)
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", errors.E("localvault", path, err)
+	}
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
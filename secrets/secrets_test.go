@@ -0,0 +1,78 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package secrets
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/grailbio/reflow/errors"
+)
+
+func TestEnvFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "envfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "secrets.env")
+	const contents = `# database credentials
+DB_USER=reflow
+export DB_PASS="p@ss\tword"
+
+TOKEN='abc=def'
+`
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	e := &EnvFile{Path: path}
+	ctx := context.Background()
+	for name, want := range map[string]string{
+		"DB_USER": "reflow",
+		"DB_PASS": "p@ss\tword",
+		"TOKEN":   "abc=def",
+	} {
+		got, err := e.Secret(ctx, name)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("%s: got %q, want %q", name, got, want)
+		}
+	}
+	if _, err := e.Secret(ctx, "MISSING"); !errors.Is(errors.NotExist, err) {
+		t.Errorf("expected NotExist, got %v", err)
+	}
+}
+
+func TestLocalVault(t *testing.T) {
+	dir, err := ioutil.TempDir("", "localvault")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "DB_PASS"), []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	v := &LocalVault{Dir: dir}
+	ctx := context.Background()
+	got, err := v.Secret(ctx, "DB_PASS")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "secret"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if _, err := v.Secret(ctx, "MISSING"); !errors.Is(errors.NotExist, err) {
+		t.Errorf("expected NotExist, got %v", err)
+	}
+	if _, err := v.Secret(ctx, "../DB_PASS"); !errors.Is(errors.Invalid, err) {
+		t.Errorf("expected Invalid, got %v", err)
+	}
+}
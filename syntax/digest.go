@@ -156,6 +156,9 @@ func (e *Expr) digest(w io.Writer, env *values.Env) {
 				writeN(w, i)
 				continue
 			}
+			if e.Template.IsQuoted(i) {
+				io.WriteString(w, "q")
+			}
 			ae.digest(w, env)
 		}
 	case ExprCond:
@@ -198,6 +201,9 @@ func (e *Expr) digest(w io.Writer, env *values.Env) {
 		// TODO(marius): Module path (e.Left) should probably be normalized somehow.
 		// TODO(marius): sort declarations
 		e.Left.digest(w, env)
+		if !e.ModuleDigest.IsZero() {
+			digest.WriteDigest(w, e.ModuleDigest)
+		}
 		for _, d := range e.Decls {
 			for _, id := range d.Pat.Idents(nil) {
 				io.WriteString(w, id)
@@ -29,6 +29,27 @@ func TestDigestExec(t *testing.T) {
 	}
 }
 
+func TestDigestExecEnv(t *testing.T) {
+	digest := func(decls string) string {
+		v, _, _, err := eval(`exec(image := "ubuntu"` + decls + `) (out file) {" echo $A > {{out}} "}`)
+		if err != nil {
+			t.Fatalf("%s: %v", decls, err)
+		}
+		return v.(*flow.Flow).Digest().String()
+	}
+	base := digest("")
+	if got := digest(`, secrets := ["A"]`); got != base {
+		t.Errorf("secrets changed digest: got %v, want %v", got, base)
+	}
+	env := digest(`, env := ["A": "1"]`)
+	if env == base {
+		t.Error("env did not change digest")
+	}
+	if got := digest(`, env := ["A": "2"]`); got == env {
+		t.Error("env value did not change digest")
+	}
+}
+
 func TestDigestDelay(t *testing.T) {
 	for _, expr := range []string{
 		`{x := 1; delay(x)}`,
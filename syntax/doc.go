@@ -54,6 +54,28 @@ expressions, d1, d2, .. are declarations; t1, t2, .. are types):
 	                                   // deparsed as id := id.
 	                                   // takes an optional declaration nondeterministic bool, which tags
 	                                   // this exec as being non-deterministic.
+	                                   // takes optional declarations retries int, memfactor float, and
+	                                   // maxmem int, which define how many times the exec is retried after
+	                                   // transient errors or running out of memory, and by how much (up to
+	                                   // maxmem) its memory is increased after running out of memory.
+	                                   // retries, memfactor, maxmem, and retrytimeouts apply only when
+	                                   // execs are run by the scheduler; not in local mode (reflow run
+	                                   // -local) or with work stealing (-sched=false or -alloc).
+	                                   // takes optional declarations env [string:string], which defines
+	                                   // environment variables for the exec's command and is part of its
+	                                   // digest, and secrets [string], which names secrets that are
+	                                   // resolved by the executor and defined in the exec's environment,
+	                                   // but are not part of its digest.
+	                                   // takes an optional declaration timeout, an integer number of
+	                                   // seconds or a duration string such as "2h30m", after which the
+	                                   // exec is killed and fails. Execs that time out are retried only
+	                                   // if the optional declaration retrytimeouts bool is true.
+	                                   // takes an optional declaration shellquote bool, which renders
+	                                   // all interpolated strings shell-quoted. Individual interpolations
+	                                   // of strings and lists of strings are quoted by the modifier q, as
+	                                   // in {{q(e1)}}. Lists of strings are interpolated as a sequence of
+	                                   // quoted words; files, dirs, and lists of these are interpolated as
+	                                   // (unquoted) paths.
 	e1 <op> e2                         // a binary op (||, &&, <, >, <=, >=, !=, ==, +, /, %, &, <<, >>)
 	<op> e1                            // unary expression (!)
 	if e1 { d1; d2; ..; e2 }
@@ -68,6 +90,9 @@ expressions, d1, d2, .. are declarations; t1, t2, .. are types):
 	list(e1)                           // convert e1 to a list
 	make(strlit, d1, ..., dn)          // builtin make primitive. identifiers are valid declarations in
 	                                   // this context; they are deparsed as id := id.
+	                                   // strlit may name a remote module: a module in a git
+	                                   // repository (git+url//path@ref) or a blob store (a URL);
+	                                   // remote modules are pinned by reflow.lock.
 	panic(e1)                          // terminate the program with error e1
 	[e1 | c1, c2,..., cn]              // list comprehension: evaluate e1 in the environment provided by
 	                                   // the given clauses (see below)
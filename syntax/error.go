@@ -74,3 +74,36 @@ func (e errlist) Make() error {
 	}
 	return nil
 }
+
+// A SourceError is a parse or type error together with the source
+// position at which it occurred.
+type SourceError struct {
+	scanner.Position
+	Message string
+}
+
+// SourceErrors returns the individual errors contained in err, as
+// returned by Parser.Parse, Session.Open, and Session.Check. Errors
+// that do not carry position information are returned with a zero
+// Position.
+func SourceErrors(err error) []SourceError {
+	switch err := err.(type) {
+	case nil:
+		return nil
+	case posError:
+		// Errors may be nested; the innermost position is the most precise.
+		switch err.err.(type) {
+		case posError, posErrors:
+			return SourceErrors(err.err)
+		}
+		return []SourceError{{err.Position, err.err.Error()}}
+	case posErrors:
+		var errs []SourceError
+		for _, e := range err {
+			errs = append(errs, SourceErrors(e)...)
+		}
+		return errs
+	default:
+		return []SourceError{{Message: err.Error()}}
+	}
+}
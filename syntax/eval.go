@@ -12,13 +12,16 @@ import (
 	"net/url"
 	"os"
 	"runtime/debug"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/grailbio/base/digest"
 	"github.com/grailbio/base/log"
 	"github.com/grailbio/reflow"
 	"github.com/grailbio/reflow/errors"
 	"github.com/grailbio/reflow/flow"
+	"github.com/grailbio/reflow/secrets"
 	"github.com/grailbio/reflow/types"
 	"github.com/grailbio/reflow/values"
 )
@@ -33,7 +36,10 @@ var (
 	errParam               = errors.New("flag parameters may not depend on other flag parameters")
 )
 
-// Eval evaluates the expression e and returns its value (or error).
+// Eval evaluates the type checked expression e in the value
+// environment env and returns its value (or error). Flows produced
+// by the evaluation are labeled with ident.
+//
 // Evaluation is lazy with respect to *flow.Flow, and thus values
 // may be delayed. Delayed values are returned as *flow.Flow
 // values. Note that this relationship holds recursively: a composite
@@ -68,6 +74,11 @@ var (
 // 3. Tools can explore partially evaluated values; e.g., a map
 //    need only its keys evaluated (maps are always strict in their
 //    keys) and thus we perform the minimal amount of computation.
+func (e *Expr) Eval(sess *Session, env *values.Env, ident string) (values.T, error) {
+	return e.eval(sess, env, ident)
+}
+
+// eval implements Eval.
 func (e *Expr) eval(sess *Session, env *values.Env, ident string) (val values.T, err error) {
 	defer func() {
 		if f, ok := val.(*flow.Flow); ok {
@@ -221,6 +232,16 @@ func (e *Expr) eval(sess *Session, env *values.Env, ident string) (val values.T,
 	case ExprApply:
 		return e.k(sess, env, ident, func(vs []values.T) (values.T, error) {
 			fn := vs[0].(values.Func)
+			if sf, ok := fn.(SystemFunc); ok && sf.Type.HasVars() {
+				typs := make([]*types.T, len(e.Fields))
+				for i := range e.Fields {
+					typs[i] = e.Fields[i].Type
+				}
+				var err error
+				if fn, err = sf.Instantiate(typs...); err != nil {
+					return nil, errors.E(e.Position.String(), ident, err)
+				}
+			}
 			fields := make([]values.T, len(e.Fields))
 			for i := range e.Fields {
 				var err error
@@ -372,7 +393,20 @@ func (e *Expr) eval(sess *Session, env *values.Env, ident string) (val values.T,
 			for i := len(e.Decls); i < len(vs); i++ {
 				args[argIndex[i]] = vs[i]
 			}
-			return e.exec(sess, env, ident, args, makeResources(penv))
+			execEnv, secrets, err := makeEnv(penv)
+			if err != nil {
+				return nil, errors.E(fmt.Sprintf("%s:", e.Position), err)
+			}
+			timeout, err := makeTimeout(penv)
+			if err != nil {
+				return nil, errors.E(fmt.Sprintf("%s:", e.Position), err)
+			}
+			retry, err := makeRetryPolicy(penv)
+			if err != nil {
+				return nil, errors.E(fmt.Sprintf("%s:", e.Position), err)
+			}
+			shellquote, _ := penv.Value("shellquote").(bool)
+			return e.exec(sess, env, ident, args, makeResources(penv), retry, execEnv, secrets, timeout, shellquote)
 		}, tvals...)
 	case ExprCond:
 		return e.k(sess, env, ident, func(vs []values.T) (values.T, error) {
@@ -709,8 +743,9 @@ func (e *Expr) eval(sess *Session, env *values.Env, ident string) (val values.T,
 }
 
 // Exec returns a Flow value for an exec expression. The resolved
-// image and resources are passed by the caller.
-func (e *Expr) exec(sess *Session, env *values.Env, ident string, args map[int]values.T, resources reflow.Resources) (values.T, error) {
+// image and resources are passed by the caller. If shellquote is
+// true, all interpolated strings are rendered shell-quoted.
+func (e *Expr) exec(sess *Session, env *values.Env, ident string, args map[int]values.T, resources reflow.Resources, retry *flow.RetryPolicy, execEnv map[string]string, secrets []string, timeout time.Duration, shellquote bool) (values.T, error) {
 	// Execs are special. The interpolation environment also has the
 	// output ids.
 	narg := len(e.Template.Args)
@@ -777,18 +812,40 @@ func (e *Expr) exec(sess *Session, env *values.Env, ident string, args map[int]v
 			}
 		} else {
 			// Immediate argument: we render it and inline it. The typechecker guarantees
-			// that only files, dirs, strings, and ints are allowed here.
+			// that only files, dirs, strings, ints, and lists of files, dirs,
+			// or strings are allowed here.
 			v := varg[i]
-			switch e.Template.Args[i].Type.Kind {
-			case types.StringKind:
-				b.WriteString(strings.Replace(v.(string), "%", "%%", -1))
-			case types.IntKind:
+			switch t := e.Template.Args[i].Type; {
+			case t.Kind == types.StringKind:
+				s := v.(string)
+				switch {
+				case shellquote || e.Template.IsQuoted(i):
+					s = shellQuote(s)
+				case sess.StrictTemplates && t.Level < types.Const:
+					what := "expression"
+					if ae.Kind == ExprIdent {
+						what = ae.Ident
+					}
+					return nil, errors.E(fmt.Sprintf("%s:", e.Position),
+						errors.Errorf("unquoted interpolation of non-constant string %s; use q(...) or shellquote := true", what))
+				}
+				b.WriteString(strings.Replace(s, "%", "%%", -1))
+			case t.Kind == types.ListKind && t.Elem.Kind == types.StringKind:
+				// Lists of strings are always expanded into an array of
+				// quoted arguments.
+				list := v.(values.List)
+				words := make([]string, len(list))
+				for j := range list {
+					words[j] = shellQuote(list[j].(string))
+				}
+				b.WriteString(strings.Replace(strings.Join(words, " "), "%", "%%", -1))
+			case t.Kind == types.IntKind:
 				vint := v.(*big.Int)
 				b.WriteString(vint.String())
-			case types.FloatKind:
+			case t.Kind == types.FloatKind:
 				vfloat := v.(*big.Float)
 				b.WriteString(vfloat.String())
-			case types.FileKind, types.DirKind, types.ListKind:
+			case t.Kind == types.FileKind, t.Kind == types.DirKind, t.Kind == types.ListKind:
 				// Files and directories must be wrapped back into flows since
 				// this is the only way they can be inlined by reflow's executor
 				// (since it controls paths). Also, input arguments must be
@@ -841,6 +898,10 @@ func (e *Expr) exec(sess *Session, env *values.Env, ident string, args map[int]v
 			Argstrs:          argstrs,
 			OutputIsDir:      dirs,
 			NonDeterministic: e.NonDeterministic,
+			Retry:            retry,
+			Env:              execEnv,
+			Secrets:          secrets,
+			Timeout:          timeout,
 		}},
 
 		Op:         flow.Coerce,
@@ -1443,6 +1504,18 @@ func quotequote(s string) string {
 	return strings.Replace(s, "%", "%%", -1)
 }
 
+// shellQuote quotes s so that it is interpreted as a single word
+// by the shell. Strings consisting only of characters that are
+// never special to the shell are returned unmodified.
+func shellQuote(s string) string {
+	if s != "" && strings.Trim(s, shellSafe) == "" {
+		return s
+	}
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+const shellSafe = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_-+=.,:/@%"
+
 // evalK is the type of evaluation continuation. It is abstracted
 // over the function that computes the digest of the delayed
 // computation. This allows us to reuse this code when the expression
@@ -1612,3 +1685,121 @@ func makeResources(env *values.Env) reflow.Resources {
 	}
 	return resources
 }
+
+// makeRetryPolicy constructs an exec's retry policy from a value
+// environment, where "retries" and "maxmem" are integers,
+// "memfactor" is an integer or a float, and "retrytimeouts" is a
+// bool. Retries may not be negative, maxmem must be positive, and
+// memfactor must be greater than 1. Missing values are taken from
+// flow.DefaultRetryPolicy. If none are present, makeRetryPolicy
+// returns nil.
+func makeRetryPolicy(env *values.Env) (*flow.RetryPolicy, error) {
+	var (
+		policy = flow.DefaultRetryPolicy
+		ok     bool
+	)
+	if v := env.Value("retries"); v != nil {
+		n := v.(*big.Int)
+		if n.Sign() < 0 || !n.IsInt64() {
+			return nil, errors.Errorf("retries must be a non-negative integer, got %s", n)
+		}
+		policy.Retries = int(n.Int64())
+		ok = true
+	}
+	if v := env.Value("maxmem"); v != nil {
+		n := v.(*big.Int)
+		if n.Sign() <= 0 || !n.IsUint64() {
+			return nil, errors.Errorf("maxmem must be positive, got %s", n)
+		}
+		policy.MaxMem = float64(n.Uint64())
+		ok = true
+	}
+	if v := env.Value("retrytimeouts"); v != nil {
+		policy.Timeouts = v.(bool)
+		ok = true
+	}
+	switch v := env.Value("memfactor").(type) {
+	case *big.Int:
+		policy.MemFactor, _ = new(big.Float).SetInt(v).Float64()
+		ok = true
+	case *big.Float:
+		policy.MemFactor, _ = v.Float64()
+		ok = true
+	}
+	if policy.MemFactor <= 1 {
+		return nil, errors.Errorf("memfactor must be greater than 1, got %v", policy.MemFactor)
+	}
+	if !ok {
+		return nil, nil
+	}
+	return &policy, nil
+}
+
+// makeEnv constructs an exec's environment and the names of its
+// secrets from a value environment, where "env" is a map of strings
+// to strings and "secrets" is a list of strings. Variable names must
+// be valid environment variable names, and may not be defined both
+// as plain variables and as secrets.
+func makeEnv(env *values.Env) (map[string]string, []string, error) {
+	var (
+		execEnv map[string]string
+		names   []string
+		err     error
+	)
+	if v := env.Value("env"); v != nil {
+		execEnv = make(map[string]string)
+		v.(*values.Map).Each(func(k, v values.T) {
+			key := k.(string)
+			if err == nil && !secrets.ValidName(key) {
+				err = errors.Errorf("invalid environment variable name %q", key)
+			}
+			execEnv[key] = v.(string)
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	if v := env.Value("secrets"); v != nil {
+		seen := make(map[string]bool)
+		for _, name := range v.(values.List) {
+			name := name.(string)
+			_, ok := execEnv[name]
+			switch {
+			case !secrets.ValidName(name):
+				return nil, nil, errors.Errorf("invalid secret name %q", name)
+			case ok:
+				return nil, nil, errors.Errorf("%s is defined both in env and secrets", name)
+			case seen[name]:
+				continue
+			}
+			seen[name] = true
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+	return execEnv, names, nil
+}
+
+// makeTimeout returns the exec timeout defined in a value
+// environment. Timeouts are given either as an integer number of
+// seconds or as a duration string, such as "1h30m". A zero duration
+// is returned if no timeout is defined.
+func makeTimeout(env *values.Env) (time.Duration, error) {
+	var timeout time.Duration
+	switch v := env.Value("timeout").(type) {
+	case nil:
+		return 0, nil
+	case *big.Int:
+		timeout = time.Duration(v.Int64()) * time.Second
+	case string:
+		var err error
+		timeout, err = time.ParseDuration(v)
+		if err != nil {
+			return 0, errors.Errorf("invalid timeout %q: %v", v, err)
+		}
+	}
+	if timeout <= 0 {
+		return 0, errors.Errorf("timeout must be positive, got %s", timeout)
+	}
+	return timeout, nil
+}
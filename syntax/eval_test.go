@@ -7,10 +7,13 @@ package syntax
 import (
 	"bytes"
 	"errors"
+	"fmt"
 	"math/big"
 	"reflect"
 	"regexp"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/grailbio/reflow"
 	"github.com/grailbio/reflow/flow"
@@ -226,6 +229,169 @@ func TestExec(t *testing.T) {
 	}
 }
 
+func TestExecRetryPolicy(t *testing.T) {
+	for _, c := range []struct {
+		decls string
+		want  *flow.RetryPolicy
+	}{
+		{"", nil},
+		{"retries := 5", &flow.RetryPolicy{Retries: 5, MemFactor: flow.DefaultRetryPolicy.MemFactor}},
+		{"memfactor := 2", &flow.RetryPolicy{Retries: flow.DefaultRetryPolicy.Retries, MemFactor: 2}},
+		{"retries := 1, memfactor := 1.25, maxmem := 64*GiB", &flow.RetryPolicy{Retries: 1, MemFactor: 1.25, MaxMem: 64 << 30}},
+		{"retrytimeouts := true", &flow.RetryPolicy{Retries: flow.DefaultRetryPolicy.Retries, MemFactor: flow.DefaultRetryPolicy.MemFactor, Timeouts: true}},
+	} {
+		decls := `image := "ubuntu"`
+		if c.decls != "" {
+			decls += ", " + c.decls
+		}
+		v, _, _, err := eval(`exec(` + decls + `) (out file) {"echo > {{out}}"}`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f := v.(*flow.Flow).Deps[0]
+		if got, want := f.Retry, c.want; !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %v, want %v", c.decls, got, want)
+		}
+	}
+	for _, c := range []struct {
+		decls, errpat string
+	}{
+		{"retries := -1", `retries must be a non-negative integer, got -1`},
+		{"maxmem := -1", `maxmem must be positive, got -1`},
+		{"maxmem := 0", `maxmem must be positive, got 0`},
+		{"memfactor := 1", `memfactor must be greater than 1, got 1`},
+		{"memfactor := 0.5", `memfactor must be greater than 1, got 0.5`},
+	} {
+		_, _, _, err := eval(`exec(image := "ubuntu", ` + c.decls + `) (out file) {"echo > {{out}}"}`)
+		if err == nil {
+			t.Errorf("%s: expected error", c.decls)
+			continue
+		}
+		if !regexp.MustCompile(c.errpat).MatchString(err.Error()) {
+			t.Errorf("%s: error %v does not match %s", c.decls, err, c.errpat)
+		}
+	}
+}
+
+func TestExecEnv(t *testing.T) {
+	v, _, _, err := eval(`exec(image := "ubuntu", env := ["B": "2", "A": "1"], secrets := ["TOKEN", "KEY", "TOKEN"]) (out file) {"echo $A > {{out}}"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := v.(*flow.Flow).Deps[0]
+	if got, want := f.Env, map[string]string{"A": "1", "B": "2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := f.Secrets, []string{"KEY", "TOKEN"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	for _, c := range []struct {
+		decls, errpat string
+	}{
+		{`env := ["A-B": "x"]`, `invalid environment variable name "A-B"`},
+		{`secrets := ["1A"]`, `invalid secret name "1A"`},
+		{`env := ["A": ""], secrets := ["A"]`, `A is defined both in env and secrets`},
+	} {
+		_, _, _, err := eval(`exec(image := "ubuntu", ` + c.decls + `) (out file) {"echo > {{out}}"}`)
+		if err == nil {
+			t.Errorf("%s: expected error", c.decls)
+			continue
+		}
+		if !regexp.MustCompile(c.errpat).MatchString(err.Error()) {
+			t.Errorf("%s: error %v does not match %s", c.decls, err, c.errpat)
+		}
+	}
+}
+
+func TestExecTimeout(t *testing.T) {
+	for _, c := range []struct {
+		decls string
+		want  time.Duration
+	}{
+		{"", 0},
+		{"timeout := 90", 90 * time.Second},
+		{`timeout := "2h30m"`, 150 * time.Minute},
+	} {
+		decls := `image := "ubuntu"`
+		if c.decls != "" {
+			decls += ", " + c.decls
+		}
+		v, _, _, err := eval(`exec(` + decls + `) (out file) {"echo > {{out}}"}`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := v.(*flow.Flow).Deps[0].Timeout, c.want; got != want {
+			t.Errorf("%s: got %v, want %v", c.decls, got, want)
+		}
+	}
+	for _, decls := range []string{`timeout := "forever"`, `timeout := 0`} {
+		if _, _, _, err := eval(`exec(image := "ubuntu", ` + decls + `) (out file) {"echo > {{out}}"}`); err == nil {
+			t.Errorf("%s: expected error", decls)
+		}
+	}
+}
+
+func TestExecQuote(t *testing.T) {
+	const fn = `(func(s string) => exec(image := "ubuntu"%s) (out file) {"%s > {{out}}"})("it's a b%%c")`
+	for _, c := range []struct {
+		decls, tmpl, want string
+		strict            bool
+	}{
+		{"", "echo {{s}}", "echo it's a b%%c > %s", false},
+		{"", "echo {{q(s)}} {{q(\"x\")}}", `echo 'it'\''s a b%%c' x > %s`, true},
+		{", shellquote := true", "echo {{s}} {{1}}", `echo 'it'\''s a b%%c' 1 > %s`, true},
+		{"", `echo {{[s, "x", ""]}}`, `echo 'it'\''s a b%%c' x '' > %s`, true},
+		{"", `echo {{"a b" }}`, "echo a b > %s", true},
+		{"", `echo {{q([s, "x"])}}`, `echo 'it'\''s a b%%c' x > %s`, true},
+	} {
+		p := Parser{Body: bytes.NewReader([]byte(fmt.Sprintf(fn, c.decls, c.tmpl))), Mode: ParseExpr}
+		if err := p.Parse(); err != nil {
+			t.Fatalf("%s: %v", c.tmpl, err)
+		}
+		tenv, venv := Stdlib()
+		sess := NewSession(nil)
+		sess.StrictTemplates = c.strict
+		if err := p.Expr.Init(sess, tenv); err != nil {
+			t.Fatal(err)
+		}
+		v, err := p.Expr.eval(sess, venv, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := v.(*flow.Flow).Deps[0].Cmd, c.want; got != want {
+			t.Errorf("%s: got %q, want %q", c.tmpl, got, want)
+		}
+	}
+
+	p := Parser{Body: bytes.NewReader([]byte(fmt.Sprintf(fn, "", "echo {{s}}"))), Mode: ParseExpr}
+	if err := p.Parse(); err != nil {
+		t.Fatal(err)
+	}
+	tenv, venv := Stdlib()
+	sess := NewSession(nil)
+	sess.StrictTemplates = true
+	if err := p.Expr.Init(sess, tenv); err != nil {
+		t.Fatal(err)
+	}
+	_, err := p.Expr.eval(sess, venv, "")
+	if err == nil || !strings.Contains(err.Error(), "unquoted interpolation of non-constant string s") {
+		t.Errorf("expected unquoted interpolation error, got %v", err)
+	}
+
+	// The q modifier applies only to strings and lists of strings.
+	for _, tmpl := range []string{"echo {{q(1)}}", "echo {{q(file(s))}}", "echo {{q([file(s)])}}", "echo {{q(out)}}"} {
+		p := Parser{Body: bytes.NewReader([]byte(fmt.Sprintf(fn, "", tmpl))), Mode: ParseExpr}
+		if err := p.Parse(); err != nil {
+			t.Fatalf("%s: %v", tmpl, err)
+		}
+		tenv, _ := Stdlib()
+		err := p.Expr.Init(NewSession(nil), tenv)
+		if err == nil || !strings.Contains(err.Error(), "q(...) applies only to strings and lists of strings") {
+			t.Errorf("%s: expected q type error, got %v", tmpl, err)
+		}
+	}
+}
+
 // We have to test this manually because the eval tests aren't run with
 // an executor.
 //
@@ -292,6 +458,10 @@ func TestEval(t *testing.T) {
 		"testdata/reduce.rf",
 		"testdata/fold.rf",
 		"testdata/test_flag_dependence.rf",
+		"testdata/json.rf",
+		"testdata/csv.rf",
+		"testdata/lists.rf",
+		"testdata/maps.rf",
 	}
 	RunReflowTests(t, tests)
 }
@@ -353,6 +523,10 @@ func TestTypeErr(t *testing.T) {
 		{"testdata/typerr17.rf", `testdata/typerr17.rf:2:14: fold expects a list as its second argument, got {a int}`},
 		{"testdata/typerr18.rf", `testdata/typerr18.rf:2:14: fold expects first argument of type func\({a int}, {a int}\) {a int}, got func\(i, j {a, b int}\) {a, b int}`},
 		{"testdata/typerr19.rf", `testdata/typerr19.rf:2:7: nondeterministic must be a bool`},
+		{"testdata/typerr20.rf", `testdata/typerr20.rf:2:7: retries must be an integer`},
+		{"testdata/typerr21.rf", `testdata/typerr21.rf:2:7: env must be a map of strings to strings`},
+		{"testdata/typerr22.rf", `testdata/typerr22.rf:2:7: timeout must be an integer \(seconds\) or a duration string`},
+		{"testdata/typerr23.rf", `testdata/typerr23.rf:3:16: cannot use type int as type string in argument to function \(type func\(s, prefix string\) bool\)$`},
 	} {
 		_, terr := sess.Open(c.file)
 		if terr == nil {
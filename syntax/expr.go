@@ -137,6 +137,34 @@ type Template struct {
 	Text  string
 	Frags []string
 	Args  []*Expr
+
+	// Quoted records which arguments were wrapped in the q
+	// interpolation modifier, and are thus rendered shell-quoted.
+	// It is populated by the type checker, which also replaces the
+	// argument by the modifier's operand.
+	Quoted []bool
+}
+
+// IsQuoted tells whether the ith argument of the template is
+// rendered shell-quoted.
+func (t *Template) IsQuoted(i int) bool {
+	return i < len(t.Quoted) && t.Quoted[i]
+}
+
+// unquote rewrites the ith argument of the template if it is an
+// application of the q interpolation modifier, recording that the
+// argument is to be quoted. The modifier is recognized only if q
+// is not otherwise bound in env.
+func (t *Template) unquote(i int, env *types.Env) {
+	e := t.Args[i]
+	if e.Kind != ExprApply || e.Left.Kind != ExprIdent || e.Left.Ident != "q" || len(e.Fields) != 1 || env.Type("q") != nil {
+		return
+	}
+	if t.Quoted == nil {
+		t.Quoted = make([]bool, len(t.Args))
+	}
+	t.Quoted[i] = true
+	t.Args[i] = e.Fields[0].Expr
 }
 
 // String returns t.Text.
@@ -232,6 +260,12 @@ type Expr struct {
 
 	// Module stores the module as opened during type checking.
 	Module Module
+
+	// ModuleDigest stores the content digest of the module in
+	// ExprMake if it is remote. It is folded into the expression's
+	// digest so that changes to remote modules (e.g., version
+	// upgrades) produce new digests.
+	ModuleDigest digest.Digest
 }
 
 // Subexpr returns a slice of this expression's dependencies.
@@ -400,6 +434,11 @@ func (e *Expr) init(sess *Session, env *types.Env) {
 			e.Type = types.Errorf("identifier %q not defined", e.Ident)
 		}
 		env.Use(e.Ident)
+		if sess != nil && sess.Uses != nil {
+			if sym := env.Symbol(e.Ident); sym != nil {
+				sess.Uses[e] = sym
+			}
+		}
 	case ExprBinop:
 		if e.Op == "~>" {
 			e.Type = types.Swizzle(e.Right.Type, types.NotConst, e.Left.Type)
@@ -503,18 +542,30 @@ func (e *Expr) init(sess *Session, env *types.Env) {
 				e.Left.identOr("function"), types.FieldsString(have), types.FieldsString(e.Left.Type.Fields))
 			return
 		}
+		fn := e.Left.Type
+		if fn.HasVars() {
+			typs := make([]*types.T, len(e.Fields))
+			for i, f := range e.Fields {
+				typs[i] = f.Type
+			}
+			fn = types.Instantiate(fn, typs...)
+			if fn.Kind == types.ErrorKind {
+				e.Type = types.Errorf("in call to %s: %v", e.Left.identOr("function"), fn.Error)
+				return
+			}
+		}
 		typs := make([]*types.T, 1+len(e.Fields))
 		typs[0] = e.Left.Type
 		for i, f := range e.Fields {
-			if !f.Type.Sub(e.Left.Type.Fields[i].T) {
+			if !f.Type.Sub(fn.Fields[i].T) {
 				e.Type = types.Errorf(
 					"cannot use type %v as type %v in argument to %s (type %s)",
-					f.Type, e.Left.Type.Fields[i].T, e.Left.identOr("function"), e.Left.Type)
+					f.Type, fn.Fields[i].T, e.Left.identOr("function"), fn)
 				return
 			}
 			typs[i+1] = f.Type
 		}
-		e.Type = types.Swizzle(e.Left.Type.Elem, types.NotConst, typs...)
+		e.Type = types.Swizzle(fn.Elem, types.NotConst, typs...)
 		return
 	case ExprLit:
 		e.Type = e.Type.Const()
@@ -613,11 +664,40 @@ func (e *Expr) init(sess *Session, env *types.Env) {
 					e.Type = types.Errorf("%s must be a list of strings", ident)
 					return
 				}
-			case "nondeterministic":
+			case "nondeterministic", "shellquote", "retrytimeouts":
 				if d.Type.Kind != types.BoolKind {
 					e.Type = types.Errorf("%s must be a bool", ident)
 					return
 				}
+			case "retries", "maxmem":
+				if d.Type.Kind != types.IntKind {
+					e.Type = types.Errorf("%s must be an integer", ident)
+					return
+				}
+			case "env":
+				if d.Type.Kind != types.MapKind || d.Type.Index.Kind != types.StringKind || d.Type.Elem.Kind != types.StringKind {
+					e.Type = types.Errorf("%s must be a map of strings to strings", ident)
+					return
+				}
+			case "secrets":
+				if d.Type.Kind != types.ListKind || d.Type.Elem.Kind != types.StringKind {
+					e.Type = types.Errorf("%s must be a list of strings", ident)
+					return
+				}
+			case "timeout":
+				switch d.Type.Kind {
+				case types.IntKind, types.StringKind:
+				default:
+					e.Type = types.Errorf("%s must be an integer (seconds) or a duration string", ident)
+					return
+				}
+			case "memfactor":
+				switch d.Type.Kind {
+				case types.IntKind, types.FloatKind:
+				default:
+					e.Type = types.Errorf("%s must be integer or floating point", ident)
+					return
+				}
 			default:
 				e.Type = types.Errorf("unrecognized exec parameter %s", ident)
 				return
@@ -641,9 +721,15 @@ func (e *Expr) init(sess *Session, env *types.Env) {
 			}
 			fields[f.Name] = f.T
 		}
-		for _, ae := range e.Template.Args {
+		for i := range e.Template.Args {
+			e.Template.unquote(i, env)
+			ae := e.Template.Args[i]
 			if t, ok := fields[ae.Ident]; ok && ae.Kind == ExprIdent {
 				ae.Type = t
+				if e.Template.IsQuoted(i) {
+					e.Type = types.Errorf("q(...) applies only to strings and lists of strings, not %s", t)
+					return
+				}
 				continue
 			}
 			ae.init(sess, env)
@@ -657,7 +743,7 @@ func (e *Expr) init(sess *Session, env *types.Env) {
 			case types.FileKind, types.DirKind, types.StringKind, types.IntKind, types.FloatKind:
 			case types.ListKind:
 				switch ae.Type.Elem.Kind {
-				case types.FileKind, types.DirKind:
+				case types.FileKind, types.DirKind, types.StringKind:
 				default:
 					e.Type = types.Errorf("values of type %s cannot be interpolated", ae.Type)
 					return
@@ -666,6 +752,11 @@ func (e *Expr) init(sess *Session, env *types.Env) {
 				e.Type = types.Errorf("values of type %s cannot be interpolated", ae.Type)
 				return
 			}
+			if e.Template.IsQuoted(i) && ae.Type.Kind != types.StringKind &&
+				(ae.Type.Kind != types.ListKind || ae.Type.Elem.Kind != types.StringKind) {
+				e.Type = types.Errorf("q(...) applies only to strings and lists of strings, not %s", ae.Type)
+				return
+			}
 		}
 		e.Type = e.Type.Copy()
 		e.Type.Flow = true
@@ -789,6 +880,7 @@ func (e *Expr) init(sess *Session, env *types.Env) {
 			e.Type = types.Errorf("failed to open module %s: %v", name, err)
 			return
 		}
+		e.ModuleDigest = sess.remoteDigest(name)
 		penv := types.NewEnv()
 		for _, d := range e.Decls {
 			d.Init(sess, env)
@@ -1335,6 +1427,7 @@ func (e *Expr) String() string {
 // as specified in the grammar. These are used to render
 // expressions with proper parenthesization.
 var binopPrec = map[string]int{
+	"~>": 1,
 	"||": 2,
 	"&&": 3,
 	"<":  5, ">": 5, "<=": 5, ">=": 5, "!=": 5, "==": 5,
@@ -0,0 +1,1157 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package syntax
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/grailbio/reflow/internal/scanner"
+	"github.com/grailbio/reflow/types"
+)
+
+// Format parses the Reflow module in src and returns it in canonical
+// form. Format preserves comments, single blank lines between
+// declarations, and the line breaks between the elements of lists,
+// argument lists, and similar constructs. Literals and exec templates
+// are reproduced byte-for-byte. The file name is used in error
+// messages only.
+//
+// Format checks that the formatted module parses to the same syntax
+// tree as the original; it returns an error if it does not.
+func Format(file string, src []byte) ([]byte, error) {
+	orig := Parser{File: file, Body: bytes.NewReader(src), Mode: ParseModule}
+	if err := orig.Parse(); err != nil {
+		return nil, err
+	}
+	p := newPrinter(file, src)
+	p.module(orig.Module)
+	if p.err != nil {
+		return nil, p.err
+	}
+	out := p.buf.Bytes()
+	formatted := Parser{File: file, Body: bytes.NewReader(out), Mode: ParseModule}
+	if err := formatted.Parse(); err != nil {
+		return nil, fmt.Errorf("%s: formatted module does not parse: %v", file, err)
+	}
+	if moduleTree(orig.Module) != moduleTree(formatted.Module) {
+		return nil, fmt.Errorf("%s: formatted module differs from the original", file)
+	}
+	return out, nil
+}
+
+// moduleTree renders the syntax tree of module m, sans positions
+// and comments, so that modules may be compared.
+func moduleTree(m *ModuleImpl) string {
+	var b bytes.Buffer
+	if m.Keyspace != nil {
+		b.WriteString(m.Keyspace.String())
+	}
+	for _, decls := range [][]*Decl{m.ParamDecls, m.Decls} {
+		for _, d := range decls {
+			b.WriteString("\n")
+			b.WriteString(d.String())
+		}
+	}
+	return b.String()
+}
+
+// A fmtToken is a token in a module's source, as used by the printer.
+type fmtToken struct {
+	tok rune
+	// Text is the token's text.
+	text string
+	// Off and end are the byte offsets of the token's start and end.
+	off, end int
+	// Line and endLine are the lines on which the token starts and ends.
+	line, endLine int
+}
+
+// A printer renders a module's syntax tree. It consults the module's
+// source for the things that are not retained by the tree: comments,
+// blank lines, line breaks, and the literal text of constants.
+//
+// Positions in the syntax tree record the ends of the tokens that
+// begin each node; the printer finds the corresponding source tokens
+// through their end offsets.
+type printer struct {
+	src      []byte
+	lines    [][]byte
+	toks     []fmtToken
+	byEnd    map[int]int
+	comments []fmtToken
+	ncomment int
+
+	buf    bytes.Buffer
+	indent int
+	// Extra is the additional indentation of continuation lines that
+	// are forced by line comments.
+	extra int
+	// LineStart tells whether nothing has been written to the current
+	// output line.
+	lineStart bool
+	// MustBreak tells whether the next write must begin a new line
+	// (because a line comment was just written).
+	mustBreak bool
+	// LastLine is the source line of the most recently printed token.
+	lastLine int
+
+	err error
+}
+
+func newPrinter(file string, src []byte) *printer {
+	p := &printer{
+		src:       src,
+		lines:     bytes.Split(src, []byte("\n")),
+		byEnd:     make(map[int]int),
+		lineStart: true,
+	}
+	var s scanner.Scanner
+	s.Init(bytes.NewReader(src))
+	s.Filename = file
+	// The source has already been parsed successfully.
+	s.Error = func(*scanner.Scanner, string) {}
+	s.Mode = scanner.ScanIdents | scanner.ScanFloats | scanner.ScanChars |
+		scanner.ScanStrings | scanner.ScanRawStrings | scanner.ScanComments
+	s.IsIdentRune = isIdentRune
+	for {
+		tok := s.Scan()
+		if tok == scanner.EOF {
+			break
+		}
+		end := s.Pos()
+		t := fmtToken{
+			tok:     tok,
+			text:    s.TokenText(),
+			off:     s.Position.Offset,
+			end:     end.Offset,
+			line:    s.Position.Line,
+			endLine: end.Line,
+		}
+		if tok == scanner.Comment {
+			p.comments = append(p.comments, t)
+			continue
+		}
+		p.byEnd[t.end] = len(p.toks)
+		p.toks = append(p.toks, t)
+	}
+	return p
+}
+
+// Tok returns the index of the token that ends at the provided
+// offset, or -1 if there is no such token.
+func (p *printer) tok(offset int) int {
+	if offset < 0 {
+		return -1
+	}
+	if i, ok := p.byEnd[offset]; ok {
+		return i
+	}
+	i := sort.Search(len(p.toks), func(i int) bool { return p.toks[i].end >= offset })
+	if i == len(p.toks) {
+		return -1
+	}
+	return i
+}
+
+// Text returns the text of token i, or "" if i is not a valid token.
+func (p *printer) text(i int) string {
+	if i < 0 || i >= len(p.toks) {
+		return ""
+	}
+	return p.toks[i].text
+}
+
+// Closing returns the index of the token that closes the bracket
+// opened by token i, or -1.
+func (p *printer) closing(i int) int {
+	if i < 0 {
+		return -1
+	}
+	var depth int
+	for ; i < len(p.toks); i++ {
+		switch p.toks[i].tok {
+		case '(', '[', '{':
+			depth++
+		case ')', ']', '}':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// Brk tells whether there is a line break in the source
+// before token i.
+func (p *printer) brk(i int) bool {
+	return i > 0 && i < len(p.toks) && p.toks[i].line > p.toks[i-1].endLine
+}
+
+func (p *printer) blankLine(line int) bool {
+	return line >= 1 && line <= len(p.lines) && len(bytes.TrimSpace(p.lines[line-1])) == 0
+}
+
+// Write writes s to the output, indenting it if it begins a line.
+func (p *printer) write(s string) {
+	if p.mustBreak {
+		p.mustBreak = false
+		p.buf.WriteByte('\n')
+		p.lineStart = true
+		p.extra = 1
+	}
+	if p.lineStart {
+		for i := 0; i < p.indent+p.extra; i++ {
+			p.buf.WriteByte('\t')
+		}
+		p.lineStart = false
+	}
+	p.buf.WriteString(s)
+}
+
+// Space writes a space, unless the printer is at the beginning of a line.
+func (p *printer) space() {
+	if !p.lineStart && !p.mustBreak {
+		p.buf.WriteByte(' ')
+	}
+}
+
+// Linebreak begins a new output line for an item that begins on the
+// provided source line. A blank line is retained if the item is
+// preceded by one in the source.
+func (p *printer) linebreak(line int) {
+	p.mustBreak = false
+	p.extra = 0
+	if !p.lineStart {
+		p.buf.WriteByte('\n')
+		p.lineStart = true
+	}
+	if !p.blankLine(line - 1) {
+		return
+	}
+	b := p.buf.Bytes()
+	if bytes.HasSuffix(b, []byte("\n\n")) {
+		return
+	}
+	b = bytes.TrimRight(b, " \t\n")
+	if len(b) == 0 || strings.IndexByte("{([", b[len(b)-1]) >= 0 {
+		return
+	}
+	p.buf.WriteByte('\n')
+}
+
+// Flush writes the comments that begin before the provided offset.
+// Comments that follow a token on the same source line are written
+// after it; others are written on their own lines.
+func (p *printer) flush(offset int) {
+	for p.ncomment < len(p.comments) && p.comments[p.ncomment].off < offset {
+		c := p.comments[p.ncomment]
+		p.ncomment++
+		if c.line == p.lastLine && !p.lineStart {
+			p.buf.WriteByte(' ')
+			p.buf.WriteString(c.text)
+		} else {
+			p.linebreak(c.line)
+			p.write(c.text)
+		}
+		p.lastLine = c.endLine
+		if strings.HasPrefix(c.text, "//") || c.line != c.endLine {
+			p.mustBreak = true
+		}
+	}
+}
+
+// At flushes the comments that precede token i and records
+// its position.
+func (p *printer) at(i int) {
+	if i < 0 {
+		return
+	}
+	p.flush(p.toks[i].off)
+	p.lastLine = p.toks[i].line
+}
+
+// Item begins a new line for an item (such as a declaration)
+// that begins at token i.
+func (p *printer) item(i int) {
+	if i < 0 {
+		p.linebreak(0)
+		return
+	}
+	p.flush(p.toks[i].off)
+	p.linebreak(p.toks[i].line)
+	p.lastLine = p.toks[i].line
+}
+
+// Cont prints a continuation that begins at token i: on a new,
+// indented line if it does so in the source, otherwise after a space.
+func (p *printer) cont(i int, print func()) {
+	// Parenthesized expressions begin at their (first) opening paren.
+	for p.text(i-1) == "(" {
+		i--
+	}
+	if !p.brk(i) {
+		p.space()
+		print()
+		return
+	}
+	p.flush(p.toks[i].off)
+	p.indent++
+	p.linebreak(p.toks[i].line)
+	print()
+	p.indent--
+}
+
+// A fmtElem is an element of a delimited list.
+type fmtElem struct {
+	// Tok is the index of the element's first token, or -1.
+	tok int
+	// Comma tells whether the element is preceded by a comma.
+	comma bool
+	print func()
+}
+
+// Delimited prints a list of elements between the opener and closer,
+// which are (if known) the tokens open and open's closing token. Line
+// breaks between elements are retained; if the closer is on its own
+// line, it is preceded by a trailing comma.
+func (p *printer) delimited(open int, opener, closer string, elems []fmtElem) {
+	close := p.closing(open)
+	var broken bool
+	for _, e := range elems {
+		broken = broken || p.brk(e.tok)
+	}
+	broken = broken || p.brk(close)
+	p.at(open)
+	p.write(opener)
+	if broken {
+		p.indent++
+	}
+	for i, e := range elems {
+		if e.comma {
+			p.write(",")
+		}
+		if e.tok >= 0 {
+			p.flush(p.toks[e.tok].off)
+		}
+		if p.brk(e.tok) {
+			p.linebreak(p.toks[e.tok].line)
+		} else if i > 0 {
+			p.space()
+		}
+		e.print()
+	}
+	if close >= 0 {
+		if p.brk(close) {
+			if len(elems) > 0 {
+				p.write(",")
+			}
+			p.flush(p.toks[close].off)
+			p.indent--
+			p.linebreak(p.toks[close].line)
+		} else {
+			p.flush(p.toks[close].off)
+			if broken {
+				p.indent--
+			}
+		}
+		p.at(close)
+	} else if broken {
+		p.indent--
+	}
+	p.write(closer)
+}
+
+// Module prints module m.
+func (p *printer) module(m *ModuleImpl) {
+	if m.Keyspace != nil {
+		p.item(p.exprTok(m.Keyspace) - 1)
+		p.write("keyspace ")
+		p.expr(m.Keyspace)
+	}
+	p.params(m.ParamDecls)
+	for _, d := range m.Decls {
+		p.stmt(d)
+	}
+	p.flush(len(p.src) + 1)
+	if !p.lineStart {
+		p.buf.WriteByte('\n')
+	}
+}
+
+// Params prints the parameter declarations, retaining their grouping
+// into param blocks.
+func (p *printer) params(decls []*Decl) {
+	for i := 0; i < len(decls); {
+		d := decls[i]
+		first := p.tok(d.Position.Offset)
+		if d.Position.Line == 0 || p.text(first-1) != "(" || p.text(first-2) != "param" {
+			n := p.paramGroup(decls[i:])
+			p.item(first - 1)
+			p.write("param ")
+			p.param(decls[i : i+n])
+			i += n
+			continue
+		}
+		open := first - 1
+		close := p.closing(open)
+		if close < 0 {
+			close = len(p.toks)
+		}
+		p.item(open - 1)
+		p.write("param (")
+		p.indent++
+		for i < len(decls) && p.tok(decls[i].Position.Offset) < close {
+			n := p.paramGroup(decls[i:])
+			p.item(p.tok(decls[i].Position.Offset))
+			p.param(decls[i : i+n])
+			i += n
+		}
+		if close < len(p.toks) {
+			p.flush(p.toks[close].off)
+			p.at(close)
+		}
+		p.indent--
+		p.linebreak(0)
+		p.write(")")
+	}
+}
+
+// ParamGroup returns the number of declarations at the beginning of
+// decls that are declared together, as in "x, y string".
+func (p *printer) paramGroup(decls []*Decl) int {
+	n := 1
+	for n < len(decls) && decls[n].Kind == DeclDeclare &&
+		decls[n].Position.Line > 0 && decls[n].Position == decls[0].Position {
+		n++
+	}
+	return n
+}
+
+// Param prints a parameter declaration. Multiple declarations
+// declare a group of parameters of the same type.
+func (p *printer) param(decls []*Decl) {
+	d := decls[0]
+	switch d.Kind {
+	case DeclDeclare:
+		names := make([]string, len(decls))
+		for i := range decls {
+			names[i] = decls[i].Ident
+		}
+		p.write(strings.Join(names, ", ") + " " + typeString(d.Type))
+	case DeclAssign:
+		p.write(d.Pat.Ident)
+		e := d.Expr
+		if e.Kind == ExprAscribe && e.Position.Line > 0 && e.Position == d.Position {
+			p.write(" " + typeString(e.Type))
+			e = e.Left
+		}
+		p.write(" =")
+		p.rhs(e)
+	default:
+		p.err = fmt.Errorf("%s: invalid parameter declaration", d.Position)
+	}
+}
+
+// Stmt prints declaration d on its own line.
+func (p *printer) stmt(d *Decl) {
+	p.item(p.declTok(d))
+	p.decl(d)
+}
+
+// Decl prints declaration d.
+func (p *printer) decl(d *Decl) {
+	switch d.Kind {
+	case DeclType:
+		p.write("type " + d.Ident + " " + typeString(d.Type))
+	case DeclAssign:
+		p.assign(d, d.Expr)
+	default:
+		p.err = fmt.Errorf("%s: invalid declaration", d.Position)
+	}
+}
+
+// Assign prints the assignment declaration d with expression e.
+func (p *printer) assign(d *Decl, e *Expr) {
+	switch {
+	case e.Kind == ExprRequires:
+		at := p.requiresTok(d)
+		p.at(at)
+		p.write("@requires")
+		p.delimited(at+2, "(", ")", p.commadefs(e.Decls, false))
+		// Print the underlying declaration on the next line.
+		p.linebreak(0)
+		p.assign(d, e.Left)
+	case e.Kind == ExprFunc && e.Position.Line == 0:
+		p.write("func " + d.Pat.Ident + "(" + fieldsString(e.Args) + ") =")
+		p.rhs(e.Left)
+	case e.Kind == ExprAscribe && e.Left.Kind == ExprFunc && e.Left.Position.Line == 0:
+		p.write("func " + d.Pat.Ident + "(" + fieldsString(e.Left.Args) + ") " + typeString(e.Type.Elem) + " =")
+		p.rhs(e.Left.Left)
+	case p.isShortAssign(d):
+		p.write(d.Pat.Ident + " :=")
+		p.rhs(e)
+	default:
+		p.write("val ")
+		p.pat(d.Pat)
+		if e.Kind == ExprAscribe && e.Position.Line > 0 && e.Position == e.Left.Position {
+			p.write(" " + typeString(e.Type))
+			e = e.Left
+		}
+		p.write(" =")
+		p.rhs(e)
+	}
+}
+
+// IsShortAssign tells whether d is a declaration of the form "x := e".
+func (p *printer) isShortAssign(d *Decl) bool {
+	if d.Pat == nil || d.Pat.Kind != PatIdent || d.Pat.Position.Line == 0 {
+		return false
+	}
+	i := p.tok(d.Pat.Position.Offset)
+	return i >= 0 && i+1 < len(p.toks) && p.toks[i+1].tok == scanner.Assign
+}
+
+// Rhs prints the right-hand side of a declaration.
+func (p *printer) rhs(e *Expr) {
+	p.cont(p.exprTok(e), func() { p.expr(e) })
+}
+
+// Commadefs returns the elements for a list of comma-separated
+// declarations, as in exec and make arguments. The first
+// element is preceded by a comma if comma is true.
+func (p *printer) commadefs(decls []*Decl, comma bool) []fmtElem {
+	elems := make([]fmtElem, len(decls))
+	for i := range decls {
+		d := decls[i]
+		elems[i] = fmtElem{
+			tok:   p.declTok(d),
+			comma: i > 0 || comma,
+			print: func() {
+				if d.Kind == DeclAssign && d.Pat.Kind == PatIdent &&
+					d.Expr.Kind == ExprIdent && d.Expr.Ident == d.Pat.Ident && d.Expr.Position.Line == 0 {
+					p.at(p.declTok(d))
+					p.write(d.Pat.Ident)
+					return
+				}
+				p.decl(d)
+			},
+		}
+	}
+	return elems
+}
+
+// Expr prints expression e.
+func (p *printer) expr(e *Expr) {
+	p.at(p.exprTok(e))
+	switch e.Kind {
+	default:
+		p.err = fmt.Errorf("%s: cannot format expression %s", e.Position, e)
+	case ExprIdent:
+		p.write(e.Ident)
+	case ExprLit:
+		p.lit(e)
+	case ExprBinop:
+		switch {
+		case p.isListAppend(e):
+			p.listAppend(e)
+		case p.isMapAppend(e):
+			p.mapAppend(e)
+		default:
+			prec := binopPrec[e.Op]
+			p.operand(e.Left, func(l *Expr) bool { return l.Kind == ExprBinop && l.prec() < prec })
+			p.write(" " + e.Op)
+			p.cont(p.exprTok(e.Right), func() {
+				p.operand(e.Right, func(r *Expr) bool { return r.Kind == ExprBinop && r.prec() <= prec })
+			})
+		}
+	case ExprUnop:
+		p.write(e.Op)
+		p.operand(e.Left, func(l *Expr) bool { return l.Kind == ExprBinop || l.Kind == ExprUnop && l.Op == e.Op })
+	case ExprApply:
+		p.operand(e.Left, nil)
+		elems := make([]fmtElem, len(e.Fields))
+		for i := range e.Fields {
+			f := e.Fields[i]
+			elems[i] = fmtElem{tok: p.exprTok(f.Expr), comma: i > 0, print: func() { p.expr(f.Expr) }}
+		}
+		open := -1
+		if len(elems) > 0 && p.text(elems[0].tok-1) == "(" {
+			open = elems[0].tok - 1
+		}
+		p.delimited(open, "(", ")", elems)
+	case ExprBuiltin:
+		p.write(e.Op + "(")
+		for i, f := range e.Fields {
+			if i > 0 {
+				p.write(", ")
+			}
+			p.expr(f.Expr)
+		}
+		p.write(")")
+	case ExprIndex:
+		p.operand(e.Left, nil)
+		p.write("[")
+		p.expr(e.Right)
+		p.write("]")
+	case ExprDeref:
+		p.operand(e.Left, nil)
+		p.write("." + e.Ident)
+	case ExprTuple:
+		elems := make([]fmtElem, len(e.Fields))
+		for i := range e.Fields {
+			f := e.Fields[i]
+			elems[i] = fmtElem{tok: p.exprTok(f.Expr), comma: i > 0, print: func() { p.expr(f.Expr) }}
+		}
+		p.delimited(p.exprTok(e), "(", ")", elems)
+	case ExprStruct:
+		elems := make([]fmtElem, len(e.Fields))
+		for i := range e.Fields {
+			f := e.Fields[i]
+			tok := p.exprTok(f.Expr)
+			explicit := p.text(tok-1) == ":" && p.text(tok-2) == f.Name
+			if explicit {
+				tok -= 2
+			}
+			elems[i] = fmtElem{tok: tok, comma: i > 0, print: func() {
+				if !explicit && f.Expr.Kind == ExprIdent && f.Expr.Ident == f.Name {
+					p.expr(f.Expr)
+					return
+				}
+				p.write(f.Name + ": ")
+				p.expr(f.Expr)
+			}}
+		}
+		p.delimited(p.exprTok(e), "{", "}", elems)
+	case ExprList:
+		p.delimited(p.exprTok(e), "[", "]", p.listElems(e.List))
+	case ExprMap:
+		if len(e.Map) == 0 {
+			p.write("[:]")
+			break
+		}
+		p.delimited(p.exprTok(e), "[", "]", p.mapElems(e))
+	case ExprCompr:
+		p.write("[")
+		p.expr(e.ComprExpr)
+		p.write(" | ")
+		for i, c := range e.ComprClauses {
+			if i > 0 {
+				p.write(", ")
+			}
+			switch c.Kind {
+			case ComprEnum:
+				p.pat(c.Pat)
+				p.write(" <- ")
+				p.expr(c.Expr)
+			case ComprFilter:
+				p.write("if ")
+				p.expr(c.Expr)
+			}
+		}
+		p.write("]")
+	case ExprVariant:
+		p.write("#" + e.Ident)
+		if e.Left != nil {
+			p.write("(")
+			p.expr(e.Left)
+			p.write(")")
+		}
+	case ExprBlock:
+		p.block(e)
+	case ExprCond:
+		p.write("if ")
+		p.expr(e.Cond)
+		p.write(" ")
+		p.block(e.Left)
+		p.write(" else ")
+		if e.Right.Kind == ExprCond {
+			p.expr(e.Right)
+		} else {
+			p.block(e.Right.Left)
+		}
+	case ExprSwitch:
+		p.switchExpr(e)
+	case ExprFunc:
+		p.write("func(" + fieldsString(e.Args) + ") =>")
+		p.rhs(e.Left)
+	case ExprAscribe:
+		if e.Left.Kind != ExprFunc {
+			p.expr(e.Left)
+			break
+		}
+		p.write("func(" + fieldsString(e.Left.Args) + ") " + typeString(e.Type) + " =>")
+		p.rhs(e.Left.Left)
+	case ExprExec:
+		open := p.exprTok(e) + 1
+		p.delimited(open, "exec(", ")", p.commadefs(e.Decls, false))
+		p.write(" " + typeString(e.Type) + " ")
+		tmpl := p.closing(open)
+		for tmpl >= 0 && tmpl < len(p.toks) && p.toks[tmpl].tok != scanner.Template {
+			tmpl++
+		}
+		if tmpl < len(p.toks) {
+			p.at(tmpl)
+		}
+		p.write(`{"` + e.Template.Text + `"}`)
+		if tmpl >= 0 && tmpl < len(p.toks) {
+			p.lastLine = p.toks[tmpl].endLine
+		}
+	case ExprMake:
+		elems := []fmtElem{{tok: p.exprTok(e.Left), print: func() { p.expr(e.Left) }}}
+		elems = append(elems, p.commadefs(e.Decls, true)...)
+		p.delimited(p.exprTok(e)+1, "make(", ")", elems)
+	case ExprRequires:
+		p.expr(e.Left)
+	}
+}
+
+// Operand prints e as the operand of a unary, binary, or postfix
+// operator, parenthesizing it if parens(e) is true, or if e is
+// not otherwise delimited.
+func (p *printer) operand(e *Expr, parens func(*Expr) bool) {
+	var paren bool
+	switch e.Kind {
+	case ExprCond, ExprSwitch, ExprFunc, ExprAscribe:
+		paren = true
+	case ExprBinop:
+		paren = !p.isListAppend(e) && !p.isMapAppend(e) && (parens == nil || parens(e))
+	case ExprUnop:
+		paren = parens == nil || parens(e)
+	}
+	if paren {
+		p.write("(")
+	}
+	p.expr(e)
+	if paren {
+		p.write(")")
+	}
+}
+
+// Lit prints the literal e as it appears in the source.
+func (p *printer) lit(e *Expr) {
+	if i := p.tok(e.Position.Offset); i >= 0 && e.Position.Line > 0 {
+		switch t := p.toks[i]; t.tok {
+		case scanner.Int, scanner.Float, scanner.String, scanner.RawString:
+			p.write(t.text)
+			p.lastLine = t.endLine
+			return
+		}
+	}
+	switch v := e.Val.(type) {
+	case bool:
+		p.write(fmt.Sprint(v))
+	case string:
+		p.write(fmt.Sprintf("%q", v))
+	default:
+		p.write(fmt.Sprint(v))
+	}
+}
+
+// ListElems returns the elements for a list literal.
+func (p *printer) listElems(list []*Expr) []fmtElem {
+	elems := make([]fmtElem, len(list))
+	for i := range list {
+		e := list[i]
+		elems[i] = fmtElem{tok: p.exprTok(e), comma: i > 0, print: func() { p.expr(e) }}
+	}
+	return elems
+}
+
+// MapElems returns the elements for a map literal, in source order.
+func (p *printer) mapElems(e *Expr) []fmtElem {
+	keys := make([]*Expr, 0, len(e.Map))
+	for k := range e.Map {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return p.exprPos(keys[i]) < p.exprPos(keys[j]) })
+	elems := make([]fmtElem, len(keys))
+	for i := range keys {
+		k := keys[i]
+		elems[i] = fmtElem{tok: p.exprTok(k), comma: i > 0, print: func() {
+			p.expr(k)
+			p.write(": ")
+			p.expr(e.Map[k])
+		}}
+	}
+	return elems
+}
+
+// IsListAppend tells whether binary expression e was desugared by
+// the parser from a list literal with appended lists, as in [x, ...y].
+func (p *printer) isListAppend(e *Expr) bool {
+	if e.Kind != ExprBinop || e.Op != "+" || e.Position.Line == 0 {
+		return false
+	}
+	if e.Left.Kind != ExprList && !p.isListAppend(e.Left) {
+		return false
+	}
+	return e.Position == e.Left.Position && p.ellipsis(e.Right)
+}
+
+// IsMapAppend tells whether binary expression e was desugared by
+// the parser from a map literal with appended maps, as in [k: v, ...m].
+func (p *printer) isMapAppend(e *Expr) bool {
+	if e.Kind != ExprBinop || e.Op != "+" || e.Position.Line == 0 {
+		return false
+	}
+	if e.Right.Kind != ExprMap && !p.isMapAppend(e.Right) {
+		return false
+	}
+	return e.Position == e.Right.Position && p.ellipsis(e.Left)
+}
+
+// Ellipsis tells whether expression e is preceded by an ellipsis.
+func (p *printer) ellipsis(e *Expr) bool {
+	i := p.exprTok(e)
+	return i > 0 && p.toks[i-1].tok == scanner.Ellipsis
+}
+
+func (p *printer) listAppend(e *Expr) {
+	var appends []*Expr
+	for ; p.isListAppend(e); e = e.Left {
+		appends = append([]*Expr{e.Right}, appends...)
+	}
+	elems := p.listElems(e.List)
+	p.delimited(p.exprTok(e), "[", "]", append(elems, p.appendElems(appends, len(elems) > 0)...))
+}
+
+func (p *printer) mapAppend(e *Expr) {
+	var appends []*Expr
+	for ; p.isMapAppend(e); e = e.Right {
+		appends = append([]*Expr{e.Left}, appends...)
+	}
+	elems := p.mapElems(e)
+	p.delimited(p.exprTok(e), "[", "]", append(elems, p.appendElems(appends, len(elems) > 0)...))
+}
+
+// AppendElems returns the elements for the appended lists or maps
+// in a list or map literal. Appended elements are not separated by
+// commas.
+func (p *printer) appendElems(appends []*Expr, comma bool) []fmtElem {
+	elems := make([]fmtElem, len(appends))
+	for i := range appends {
+		e := appends[i]
+		elems[i] = fmtElem{tok: p.exprTok(e) - 1, comma: i == 0 && comma, print: func() {
+			p.write("...")
+			p.expr(e)
+		}}
+	}
+	return elems
+}
+
+// Block prints block expression e. Blocks without declarations are
+// kept on a single line if they are so in the source.
+func (p *printer) block(e *Expr) {
+	open := p.exprTok(e)
+	if e.Position.Line == 0 || p.text(open) != "{" {
+		open = -1
+	}
+	close := p.closing(open)
+	if len(e.Decls) == 0 && close >= 0 && !p.brk(p.exprTok(e.Left)) && !p.brk(close) {
+		p.write("{ ")
+		p.expr(e.Left)
+		p.flush(p.toks[close].off)
+		p.at(close)
+		p.write(" }")
+		return
+	}
+	p.write("{")
+	p.indent++
+	p.body(e)
+	if close >= 0 {
+		p.flush(p.toks[close].off)
+	}
+	p.indent--
+	p.linebreak(0)
+	p.at(close)
+	p.write("}")
+}
+
+// Body prints the declarations and the expression of block e,
+// each on its own line.
+func (p *printer) body(e *Expr) {
+	for _, d := range e.Decls {
+		p.stmt(d)
+	}
+	p.item(p.exprTok(e.Left))
+	p.expr(e.Left)
+}
+
+func (p *printer) switchExpr(e *Expr) {
+	p.write("switch ")
+	p.expr(e.Left)
+	p.write(" {")
+	open := -1
+	if len(e.CaseClauses) > 0 {
+		if i := p.tok(e.CaseClauses[0].Position.Offset); p.text(i-1) == "{" {
+			open = i - 1
+		}
+	}
+	p.indent++
+	for _, c := range e.CaseClauses {
+		p.item(p.tok(c.Position.Offset))
+		p.write("case ")
+		p.pat(c.Pat)
+		p.write(":")
+		if c.Expr.Kind == ExprBlock && c.Expr.Position.Line == 0 {
+			p.indent++
+			p.body(c.Expr)
+			p.indent--
+			continue
+		}
+		p.rhs(c.Expr)
+	}
+	close := p.closing(open)
+	if close >= 0 {
+		p.flush(p.toks[close].off)
+	}
+	p.indent--
+	p.linebreak(0)
+	p.at(close)
+	p.write("}")
+}
+
+// Pat prints pattern q.
+func (p *printer) pat(q *Pat) {
+	switch q.Kind {
+	default:
+		p.err = fmt.Errorf("%s: cannot format pattern", q.Position)
+	case PatIdent:
+		p.write(q.Ident)
+	case PatIgnore:
+		p.write("_")
+	case PatTuple:
+		p.write("(")
+		p.pats(q.List)
+		p.write(")")
+	case PatList:
+		p.write("[")
+		p.pats(q.List)
+		if q.Tail != nil {
+			p.write(", ...")
+			// A bare ellipsis is parsed as an ignore pattern positioned
+			// at the ellipsis itself.
+			if i := p.tok(q.Tail.Position.Offset); q.Tail.Kind != PatIgnore || i < 0 || p.toks[i].tok != scanner.Ellipsis {
+				p.pat(q.Tail)
+			}
+		}
+		p.write("]")
+	case PatStruct:
+		p.write("{")
+		for i, f := range q.Fields {
+			if i > 0 {
+				p.write(", ")
+			}
+			if f.Pat.Kind == PatIdent && f.Pat.Ident == f.Name && f.Pat.Position.Line == 0 {
+				p.write(f.Name)
+				continue
+			}
+			p.write(f.Name + ": ")
+			p.pat(f.Pat)
+		}
+		p.write("}")
+	case PatVariant:
+		p.write("#" + q.Tag)
+		if q.Elem != nil {
+			p.write("(")
+			p.pat(q.Elem)
+			p.write(")")
+		}
+	}
+}
+
+func (p *printer) pats(list []*Pat) {
+	for i, q := range list {
+		if i > 0 {
+			p.write(", ")
+		}
+		p.pat(q)
+	}
+}
+
+// ExprTok returns the index of the first token of expression e,
+// or -1 if it cannot be determined.
+func (p *printer) exprTok(e *Expr) int {
+	i := p.tok(p.exprPos(e))
+	if e.Kind == ExprBuiltin && i >= 2 && p.text(i-2) == e.Op {
+		// Builtins' own positions are not reliable; see exprPos.
+		i -= 2
+	}
+	return i
+}
+
+// DeclTok returns the index of the first token of declaration d,
+// or -1 if it cannot be determined.
+func (p *printer) declTok(d *Decl) int {
+	i := p.tok(p.declPos(d))
+	if i < 0 {
+		return i
+	}
+	if d.Kind == DeclAssign && p.text(i-1) == "val" {
+		i--
+	}
+	if d.Kind == DeclAssign && d.Expr.Kind == ExprRequires {
+		if at := p.requiresTok(d); at >= 0 {
+			i = at
+		}
+	}
+	return i
+}
+
+// RequiresTok returns the index of the "@" token that begins
+// the @requires annotation of declaration d.
+func (p *printer) requiresTok(d *Decl) int {
+	i := p.tok(p.declPos(d))
+	for ; i > 0; i-- {
+		if p.text(i) == "@" && p.text(i+1) == "requires" {
+			return i
+		}
+	}
+	return -1
+}
+
+// ExprPos returns the smallest source position (offset) in
+// expression e, or -1 if e has no positions.
+func (p *printer) exprPos(e *Expr) int {
+	if e == nil {
+		return -1
+	}
+	pos := -1
+	// The positions recorded by the parser for the builtins int and
+	// float are unreliable.
+	if e.Position.Line > 0 && e.Kind != ExprBuiltin {
+		pos = e.Position.Offset
+	}
+	min := func(q int) {
+		if q >= 0 && (pos < 0 || q < pos) {
+			pos = q
+		}
+	}
+	for _, sub := range []*Expr{e.Cond, e.Left, e.Right, e.ComprExpr} {
+		min(p.exprPos(sub))
+	}
+	for _, sub := range e.List {
+		min(p.exprPos(sub))
+	}
+	for k, v := range e.Map {
+		min(p.exprPos(k))
+		min(p.exprPos(v))
+	}
+	for _, f := range e.Fields {
+		min(p.exprPos(f.Expr))
+	}
+	for _, d := range e.Decls {
+		min(p.declPos(d))
+	}
+	for _, c := range e.CaseClauses {
+		if c.Position.Line > 0 {
+			min(c.Position.Offset)
+		}
+		min(patPos(c.Pat))
+		min(p.exprPos(c.Expr))
+	}
+	for _, c := range e.ComprClauses {
+		min(patPos(c.Pat))
+		min(p.exprPos(c.Expr))
+	}
+	return pos
+}
+
+// DeclPos returns the smallest source position (offset) in
+// declaration d, or -1 if d has no positions.
+func (p *printer) declPos(d *Decl) int {
+	pos := -1
+	if d.Position.Line > 0 {
+		pos = d.Position.Offset
+	}
+	for _, q := range []int{patPos(d.Pat), p.exprPos(d.Expr)} {
+		if q >= 0 && (pos < 0 || q < pos) {
+			pos = q
+		}
+	}
+	return pos
+}
+
+func patPos(q *Pat) int {
+	if q == nil {
+		return -1
+	}
+	pos := -1
+	if q.Position.Line > 0 {
+		pos = q.Position.Offset
+	}
+	subs := append([]*Pat{q.Tail, q.Elem}, q.List...)
+	for _, f := range q.Fields {
+		subs = append(subs, f.Pat)
+	}
+	for _, sub := range subs {
+		if q := patPos(sub); q >= 0 && (pos < 0 || q < pos) {
+			pos = q
+		}
+	}
+	return pos
+}
+
+// TypeString renders type t in Reflow's concrete syntax.
+func typeString(t *types.T) string {
+	var s string
+	switch t.Kind {
+	default:
+		u := *t
+		u.Label = ""
+		s = u.String()
+	case types.UnitKind:
+		s = "()"
+	case types.RefKind:
+		s = strings.Join(t.Path, ".")
+	case types.ListKind:
+		s = "[" + typeString(t.Elem) + "]"
+	case types.MapKind:
+		s = "[" + typeString(t.Index) + ":" + typeString(t.Elem) + "]"
+	case types.TupleKind:
+		s = "(" + fieldsString(t.Fields) + ")"
+	case types.FuncKind:
+		s = "func(" + fieldsString(t.Fields) + ") " + typeString(t.Elem)
+	case types.StructKind:
+		s = "{" + fieldsString(t.Fields) + "}"
+	case types.ModuleKind:
+		s = "module{" + fieldsString(t.Fields) + "}"
+	case types.SumKind:
+		variants := make([]string, len(t.Variants))
+		for i, v := range t.Variants {
+			variants[i] = "#" + v.Tag
+			if v.Elem != nil {
+				variants[i] += "(" + typeString(v.Elem) + ")"
+			}
+		}
+		s = strings.Join(variants, " | ")
+	}
+	if t.Label != "" {
+		return "(" + t.Label + " " + s + ")"
+	}
+	return s
+}
+
+// FieldsString renders a list of fields; consecutive named
+// fields of the same type are grouped, as in "x, y string".
+func fieldsString(fields []*types.Field) string {
+	args := make([]string, len(fields))
+	for i, f := range fields {
+		typ := typeString(f.T)
+		switch {
+		case f.Name == "":
+			args[i] = typ
+		case i < len(fields)-1 && fields[i+1].Name != "" && typeString(fields[i+1].T) == typ:
+			args[i] = f.Name
+		default:
+			args[i] = f.Name + " " + typ
+		}
+	}
+	return strings.Join(args, ", ")
+}
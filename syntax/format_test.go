@@ -0,0 +1,104 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package syntax
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestFormat(t *testing.T) {
+	for _, c := range []struct {
+		src, want string
+	}{
+		{
+			"val x=1+2*3\nval y = (1+2)*3\n",
+			"val x = 1 + 2 * 3\nval y = (1 + 2) * 3\n",
+		},
+		{
+			"\n\n// Doc for f.\nfunc f(a int,b int) int= a\n\n\n\nval g = func (x int) => f(x) // g\n",
+			"// Doc for f.\nfunc f(a, b int) int = a\n\nval g = func(x int) => f(x) // g\n",
+		},
+		{
+			"param (\n\t\tx,y string\n\tz = 1\n)\nparam w int\n",
+			"param (\n\tx, y string\n\tz = 1\n)\nparam w int\n",
+		},
+		{
+			"val l = [1,\n  2,\n    ...m]\nval n = [\"a\": 1, ...o]\n",
+			"val l = [1,\n\t2,\n\t...m]\nval n = [\"a\": 1, ...o]\n",
+		},
+		{
+			"val Main = {\n  x := {a: 1,b}\n    val {a, b: c} = x\n  if a == c { a } else {\n  c }\n}\n",
+			"val Main = {\n\tx := {a: 1, b}\n\tval {a, b: c} = x\n\tif a == c { a } else {\n\t\tc\n\t}\n}\n",
+		},
+		{
+			"@requires(cpu := 1) val x = exec(image := \"ubuntu\", mem:=GiB) (out file) {\"\n    echo {{x}}   \t// hi\n\"}\n",
+			"@requires(cpu := 1)\nval x = exec(image := \"ubuntu\", mem := GiB) (out file) {\"\n    echo {{x}}   \t// hi\n\"}\n",
+		},
+		{
+			"val s = `raw\n  string`\nval f = 1.50\n",
+			"val s = `raw\n  string`\nval f = 1.50\n",
+		},
+		{
+			"val x = switch y {\ncase #A(z): z\n  case _:\n    0\n}\n",
+			"val x = switch y {\n\tcase #A(z): z\n\tcase _:\n\t\t0\n}\n",
+		},
+	} {
+		got, err := Format("test.rf", []byte(c.src))
+		if err != nil {
+			t.Errorf("%q: %v", c.src, err)
+			continue
+		}
+		if string(got) != c.want {
+			t.Errorf("got:\n%s\nwant:\n%s", got, c.want)
+		}
+	}
+	if _, err := Format("test.rf", []byte("val x = \n")); err == nil {
+		t.Error("expected error")
+	}
+}
+
+// TestFormatTestdata tests that the modules in testdata are formatted
+// idempotently, and that their declarations' comments are preserved.
+func TestFormatTestdata(t *testing.T) {
+	files, err := filepath.Glob("testdata/*.rf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		src, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		orig := Parser{File: file, Body: bytes.NewReader(src), Mode: ParseModule}
+		if orig.Parse() != nil {
+			continue
+		}
+		out, err := Format(file, src)
+		if err != nil {
+			t.Errorf("%s: %v", file, err)
+			continue
+		}
+		again, err := Format(file, out)
+		if err != nil {
+			t.Errorf("%s: %v", file, err)
+			continue
+		}
+		if !bytes.Equal(out, again) {
+			t.Errorf("%s: formatting is not idempotent:\n%s\n\n%s", file, out, again)
+		}
+		formatted := Parser{File: file, Body: bytes.NewReader(out), Mode: ParseModule}
+		if err := formatted.Parse(); err != nil {
+			t.Fatal(err)
+		}
+		for i, d := range orig.Module.Decls {
+			if got, want := formatted.Module.Decls[i].Comment, d.Comment; got != want {
+				t.Errorf("%s: %s: got comment %q, want %q", file, d.Position, got, want)
+			}
+		}
+	}
+}
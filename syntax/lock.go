@@ -0,0 +1,121 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package syntax
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/grailbio/base/digest"
+	"github.com/grailbio/reflow"
+)
+
+// LockFile is the name of the lock file that pins the remote modules
+// imported by the Reflow modules in its directory.
+const LockFile = "reflow.lock"
+
+const lockHeader = "# This file is maintained by reflow. It pins the content digests of remote modules.\n"
+
+// A Lock pins the content digests of remote modules, so that a
+// module path (which includes its version) always names the same
+// source. Locks are stored in lock files, each line of which pins a
+// module path to a digest.
+type Lock struct {
+	mu       sync.Mutex
+	pins     map[string]digest.Digest
+	modified bool
+}
+
+// ReadLock reads the lock stored in the file at the provided path.
+// An empty lock is returned if the file does not exist.
+func ReadLock(path string) (*Lock, error) {
+	lock := &Lock{pins: make(map[string]digest.Digest)}
+	p, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return lock, nil
+	} else if err != nil {
+		return nil, err
+	}
+	scan := bufio.NewScanner(bytes.NewReader(p))
+	for line := 1; scan.Scan(); line++ {
+		text := strings.TrimSpace(scan.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected module path and digest", path, line)
+		}
+		d, err := reflow.Digester.Parse(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		lock.pins[fields[0]] = d
+	}
+	return lock, scan.Err()
+}
+
+// WriteFile writes the lock to the file at the provided path.
+func (l *Lock) WriteFile(path string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	paths := make([]string, 0, len(l.pins))
+	for path := range l.pins {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	var b bytes.Buffer
+	b.WriteString(lockHeader)
+	for _, path := range paths {
+		fmt.Fprintf(&b, "%s %s\n", path, l.pins[path])
+	}
+	if err := ioutil.WriteFile(path, b.Bytes(), 0644); err != nil {
+		return err
+	}
+	l.modified = false
+	return nil
+}
+
+// Modified tells whether pins have been added to the lock since it
+// was read or last written.
+func (l *Lock) Modified() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.modified
+}
+
+// Pin returns the digest pinned for the module path p, if any.
+func (l *Lock) Pin(p string) (digest.Digest, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	d, ok := l.pins[p]
+	return d, ok
+}
+
+// verify checks that the source digest d of module path p matches
+// its pin; modules that are not yet pinned are pinned to d.
+func (l *Lock) verify(p string, d digest.Digest) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.pins == nil {
+		l.pins = make(map[string]digest.Digest)
+	}
+	pin, ok := l.pins[p]
+	if !ok {
+		l.pins[p] = d
+		l.modified = true
+		return nil
+	}
+	if pin != d {
+		return fmt.Errorf("module %s has digest %s, but %s pins it to %s; if the module was intentionally changed, remove it from %s", p, d.Short(), LockFile, pin.Short(), LockFile)
+	}
+	return nil
+}
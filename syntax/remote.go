@@ -0,0 +1,312 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package syntax
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/grailbio/reflow"
+	"github.com/grailbio/reflow/blob"
+)
+
+// Remote modules are modules that are not stored in the local file
+// system. They are named either by git paths of the form
+//
+//	git+url//path@ref
+//
+// for example, git+https://github.com/org/repo//align/bwa.rf@v1.2.0,
+// naming the module at path in the repository at url, as of the
+// tag, branch, or commit ref (HEAD if it is omitted); or by URLs
+// naming objects in a blob store, for example
+// s3://bucket/modules/bwa.rfx. Relative imports ("./x.rf") in remote
+// modules are resolved in the same repository (at the same ref) or
+// blob store prefix.
+
+// IsRemote tells whether the module path names a remote module.
+func IsRemote(p string) bool {
+	return strings.HasPrefix(p, "git+") || strings.Contains(p, "://")
+}
+
+// A gitPath is a parsed git module path.
+type gitPath struct {
+	repo, path, ref string
+}
+
+func parseGitPath(p string) (gitPath, error) {
+	if !strings.HasPrefix(p, "git+") {
+		return gitPath{}, fmt.Errorf("%s is not a git module path", p)
+	}
+	rest := p[len("git+"):]
+	i := strings.Index(rest, "://")
+	if i < 0 {
+		return gitPath{}, fmt.Errorf("git module path %s does not name a repository URL", p)
+	}
+	j := strings.Index(rest[i+3:], "//")
+	if j < 0 {
+		return gitPath{}, fmt.Errorf("git module path %s does not separate the repository from the module path with //", p)
+	}
+	j += i + 3
+	g := gitPath{repo: rest[:j], path: rest[j+2:]}
+	if k := strings.LastIndex(g.path, "@"); k >= 0 {
+		g.path, g.ref = g.path[:k], g.path[k+1:]
+	}
+	return g, nil
+}
+
+func (g gitPath) String() string {
+	s := "git+" + g.repo + "//" + g.path
+	if g.ref != "" {
+		s += "@" + g.ref
+	}
+	return s
+}
+
+// moduleFile returns the file path component of module path p:
+// the module's path within its repository or blob store if it is
+// remote, or p itself otherwise.
+func moduleFile(p string) string {
+	switch {
+	case strings.HasPrefix(p, "git+"):
+		if g, err := parseGitPath(p); err == nil {
+			return g.path
+		}
+	case IsRemote(p):
+		if u, err := url.Parse(p); err == nil {
+			return u.Path
+		}
+	}
+	return p
+}
+
+// moduleDir returns the directory of module path p, against which
+// relative imports are resolved by joinModule.
+func moduleDir(p string) string {
+	switch {
+	case strings.HasPrefix(p, "git+"):
+		if g, err := parseGitPath(p); err == nil {
+			g.path = path.Dir(g.path)
+			return g.String()
+		}
+	case IsRemote(p):
+		if u, err := url.Parse(p); err == nil {
+			u.Path = path.Dir(u.Path)
+			return u.String()
+		}
+	}
+	return filepath.Dir(p)
+}
+
+// joinModule resolves the relative module path rel against the
+// module directory dir, as returned by moduleDir.
+func joinModule(dir, rel string) string {
+	switch {
+	case strings.HasPrefix(dir, "git+"):
+		if g, err := parseGitPath(dir); err == nil {
+			g.path = path.Join(g.path, rel)
+			return g.String()
+		}
+	case IsRemote(dir):
+		if u, err := url.Parse(dir); err == nil {
+			u.Path = path.Join(u.Path, rel)
+			return u.String()
+		}
+	}
+	return filepath.Join(dir, rel)
+}
+
+// Chain returns a Sourcer that reads each path from the first of the
+// provided sourcers that provides it. Sourcers indicate that they do
+// not provide a path by returning an error for which os.IsNotExist
+// is true.
+func Chain(srcs ...Sourcer) Sourcer {
+	return chain(srcs)
+}
+
+type chain []Sourcer
+
+func (c chain) Source(path string) ([]byte, error) {
+	err := error(os.ErrNotExist)
+	for _, src := range c {
+		var p []byte
+		p, err = src.Source(path)
+		if err == nil || !os.IsNotExist(err) {
+			return p, err
+		}
+	}
+	return nil, err
+}
+
+// GitSourcer is a Sourcer for modules stored in git repositories.
+// Repositories are cloned and fetched using the git command. A
+// cached clone is fetched (once per GitSourcer) before it is used to
+// resolve a ref other than a full commit hash. Paths that are not
+// git module paths are not provided by GitSourcer.
+type GitSourcer struct {
+	// Dir is the directory in which repositories are cloned. If it is
+	// empty, the directory reflow/git in the user's cache directory
+	// is used.
+	Dir string
+
+	mu      sync.Mutex
+	fetched map[string]bool
+}
+
+// Source returns the source of the module at the provided git
+// module path.
+func (g *GitSourcer) Source(p string) ([]byte, error) {
+	if !strings.HasPrefix(p, "git+") {
+		return nil, os.ErrNotExist
+	}
+	gp, err := parseGitPath(p)
+	if err != nil {
+		return nil, err
+	}
+	ref := gp.ref
+	if ref == "" {
+		ref = "HEAD"
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	dir, fetched, err := g.clone(gp.repo)
+	if err != nil {
+		return nil, fmt.Errorf("module %s: %v", p, err)
+	}
+	// Branches and tags may have moved since the repository was
+	// cloned; only commit hashes always name the same tree.
+	if !fetched && !isCommitHash(ref) {
+		if err := g.fetch(dir, gp.repo); err != nil {
+			return nil, fmt.Errorf("module %s: %v", p, err)
+		}
+		fetched = true
+	}
+	source, err := git(dir, "cat-file", "blob", ref+":"+gp.path)
+	if err != nil && !fetched {
+		// The repository may have been cloned before the commit existed.
+		if err = g.fetch(dir, gp.repo); err == nil {
+			source, err = git(dir, "cat-file", "blob", ref+":"+gp.path)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("module %s: %v", p, err)
+	}
+	return source, nil
+}
+
+// clone returns the directory of the bare clone of the repository
+// at the provided URL, cloning it if necessary, and whether it is
+// up to date.
+func (g *GitSourcer) clone(repo string) (dir string, fetched bool, err error) {
+	if g.fetched == nil {
+		g.fetched = make(map[string]bool)
+	}
+	root := g.Dir
+	if root == "" {
+		cache, err := os.UserCacheDir()
+		if err != nil {
+			return "", false, err
+		}
+		root = filepath.Join(cache, "reflow", "git")
+	}
+	dir = filepath.Join(root, reflow.Digester.FromString(repo).Hex())
+	if _, err := os.Stat(dir); err == nil {
+		return dir, g.fetched[repo], nil
+	}
+	if err := os.MkdirAll(root, 0777); err != nil {
+		return "", false, err
+	}
+	// Clone into a temporary directory so that concurrent clones
+	// do not observe partial repositories.
+	tmp, err := ioutil.TempDir(root, "clone")
+	if err != nil {
+		return "", false, err
+	}
+	defer os.RemoveAll(tmp)
+	if _, err := git("", "clone", "--quiet", "--bare", "--", repo, tmp); err != nil {
+		return "", false, err
+	}
+	if err := os.Rename(tmp, dir); err != nil {
+		// Another process may have cloned the repository concurrently.
+		if _, serr := os.Stat(dir); serr != nil {
+			return "", false, err
+		}
+	}
+	g.fetched[repo] = true
+	return dir, true, nil
+}
+
+// fetch updates the branches and tags of the bare clone in dir of
+// the repository at the provided URL.
+func (g *GitSourcer) fetch(dir, repo string) error {
+	if _, err := git(dir, "fetch", "--quiet", "--force", "--tags", "origin", "+refs/heads/*:refs/heads/*"); err != nil {
+		return err
+	}
+	g.fetched[repo] = true
+	return nil
+}
+
+// isCommitHash tells whether ref is a full (SHA-1 or SHA-256) commit
+// hash.
+func isCommitHash(ref string) bool {
+	if len(ref) != 40 && len(ref) != 64 {
+		return false
+	}
+	for _, c := range ref {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F') {
+			return false
+		}
+	}
+	return true
+}
+
+// git runs the git command with the provided arguments in the
+// provided git directory, returning its standard output.
+func git(dir string, args ...string) ([]byte, error) {
+	command := "git " + args[0]
+	if dir != "" {
+		args = append([]string{"--git-dir", dir}, args...)
+	}
+	cmd := exec.Command("git", args...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("%s: %s", command, msg)
+		}
+		return nil, fmt.Errorf("%s: %v", command, err)
+	}
+	return stdout.Bytes(), nil
+}
+
+// URLSourcer is a Sourcer for modules stored in blob stores and
+// named by URLs. Paths that are not URLs are not provided by
+// URLSourcer.
+type URLSourcer struct {
+	// Blob is the blob multiplexer from which modules are read.
+	Blob blob.Mux
+}
+
+// Source returns the source of the module named by the provided URL.
+func (u URLSourcer) Source(p string) ([]byte, error) {
+	if strings.HasPrefix(p, "git+") || !strings.Contains(p, "://") {
+		return nil, os.ErrNotExist
+	}
+	rc, _, err := u.Blob.Get(context.Background(), p, "")
+	if err != nil {
+		return nil, fmt.Errorf("module %s: %v", p, err)
+	}
+	defer rc.Close()
+	return ioutil.ReadAll(rc)
+}
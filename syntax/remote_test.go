@@ -0,0 +1,198 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package syntax
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/grailbio/reflow/blob"
+	"github.com/grailbio/reflow/blob/fileblob"
+	"github.com/grailbio/reflow/types"
+	"github.com/grailbio/reflow/values"
+)
+
+func TestModulePaths(t *testing.T) {
+	for _, c := range []struct{ path, file, dir, joined string }{
+		{"x/y.rf", "x/y.rf", "x", "x/z.rf"},
+		{"git+file:///repo//a/b.rf@v1", "a/b.rf", "git+file:///repo//a@v1", "git+file:///repo//a/z.rf@v1"},
+		{"git+ssh://git@host/repo//b.rf", "b.rf", "git+ssh://git@host/repo//.", "git+ssh://git@host/repo//z.rf"},
+		{"s3://bucket/a/b.rfx", "/a/b.rfx", "s3://bucket/a", "s3://bucket/a/z.rf"},
+	} {
+		if got, want := moduleFile(c.path), c.file; got != want {
+			t.Errorf("%s: got %v, want %v", c.path, got, want)
+		}
+		dir := moduleDir(c.path)
+		if got, want := dir, c.dir; got != want {
+			t.Errorf("%s: got %v, want %v", c.path, got, want)
+		}
+		if got, want := joinModule(dir, "./z.rf"), c.joined; got != want {
+			t.Errorf("%s: got %v, want %v", c.path, got, want)
+		}
+	}
+	if _, err := parseGitPath("git+https://host/repo/b.rf"); err == nil {
+		t.Error("expected error")
+	}
+}
+
+// gitRepo creates a git repository in dir with the provided files,
+// committed and tagged with tag.
+func gitRepo(t *testing.T, dir, tag string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, args := range [][]string{
+		{"init", "--quiet"},
+		{"add", "."},
+		{"-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "--quiet", "--allow-empty", "-m", tag},
+		{"tag", "--force", tag},
+	} {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %s: %v: %s", strings.Join(args, " "), err, out)
+		}
+	}
+}
+
+func makeString(t *testing.T, sess *Session, m Module, field string) string {
+	t.Helper()
+	v, err := m.Make(sess, sess.Values.Push())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Force(v.(values.Module)[field], types.String).(string)
+}
+
+func TestRemoteModules(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not available")
+	}
+	dir, err := ioutil.TempDir("", "remote")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	repo, cache, local := filepath.Join(dir, "repo"), filepath.Join(dir, "cache"), filepath.Join(dir, "local")
+	for _, d := range []string{repo, local} {
+		if err := os.Mkdir(d, 0777); err != nil {
+			t.Fatal(err)
+		}
+	}
+	gitRepo(t, repo, "v1", map[string]string{
+		"lib.rf":    `val Greeting = "hello"` + "\n",
+		"remote.rf": `val lib = make("./lib.rf")` + "\n" + `val Message = lib.Greeting + ", remote"` + "\n",
+	})
+	remote := "git+file://" + repo + "//remote.rf@v1"
+	mainPath := filepath.Join(local, "main.rf")
+	main := `val remote = make("` + remote + `")` + "\n" + `val Main = remote.Message` + "\n"
+	if err := ioutil.WriteFile(mainPath, []byte(main), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	sess := NewSession(Chain(&GitSourcer{Dir: cache}, Filesystem))
+	sess.Lock, err = ReadLock(filepath.Join(local, LockFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := sess.Open(mainPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := makeString(t, sess, m, "Main"), "hello, remote"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if !sess.Lock.Modified() {
+		t.Error("expected lock to be modified")
+	}
+	lockPath := filepath.Join(local, LockFile)
+	if err := sess.Lock.WriteFile(lockPath); err != nil {
+		t.Fatal(err)
+	}
+	lock, err := ReadLock(lockPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{remote, "git+file://" + repo + "//lib.rf@v1"} {
+		if _, ok := lock.Pin(path); !ok {
+			t.Errorf("%s is not pinned", path)
+		}
+	}
+	digest := m.(*ModuleImpl).Decls[0].Expr.Digest(nil)
+
+	// Vendored modules are read from the bundle.
+	var b bytes.Buffer
+	if err := sess.Bundle().WriteTo(&b); err != nil {
+		t.Fatal(err)
+	}
+	bsess := NewSession(memorySourcer{"main.rfx": b.Bytes()})
+	bm, err := bsess.Open("main.rfx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := makeString(t, bsess, bm, "Main"), "hello, remote"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// Moving the tag changes the module's contents, which then no
+	// longer match the lock. The cached clone is refreshed since the
+	// tag may have moved.
+	gitRepo(t, repo, "v1", map[string]string{"lib.rf": `val Greeting = "goodbye"` + "\n"})
+	sess = NewSession(Chain(&GitSourcer{Dir: cache}, Filesystem))
+	sess.Lock = lock
+	if _, err := sess.Open(mainPath); err == nil || !strings.Contains(err.Error(), "pins it to") {
+		t.Errorf("expected lock mismatch, got %v", err)
+	}
+
+	// The fetched module's digest is part of the make expression's
+	// digest.
+	gitRepo(t, repo, "v2", nil)
+	main = strings.Replace(main, "@v1", "@v2", 1)
+	if err := ioutil.WriteFile(mainPath, []byte(main), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sess = NewSession(Chain(&GitSourcer{Dir: cache}, Filesystem))
+	m, err = sess.Open(mainPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := makeString(t, sess, m, "Main"), "goodbye, remote"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if m.(*ModuleImpl).Decls[0].Expr.Digest(nil) == digest {
+		t.Error("expected make digest to change with the module's contents")
+	}
+}
+
+func TestURLSourcer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "url")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "lib.rf"), []byte(`val X = "x"`+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	src := Chain(URLSourcer{Blob: blob.Mux{"file": fileblob.New("/")}}, Filesystem)
+	sess := NewSession(src)
+	m, err := sess.Open("file://" + filepath.Join(dir, "lib.rf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := makeString(t, sess, m, "X"), "x"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if _, err := sess.Open(filepath.Join(dir, "missing.rf")); !os.IsNotExist(err) {
+		t.Errorf("expected not exist error, got %v", err)
+	}
+}
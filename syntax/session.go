@@ -36,6 +36,23 @@ type Session struct {
 	Types  *types.Env
 	Values *values.Env
 
+	// Uses, if non-nil, is populated during type checking with the
+	// symbol to which each identifier expression resolves. It is
+	// used by tools that need to map uses of identifiers to their
+	// definitions.
+	Uses map[*Expr]*types.Symbol
+
+	// Lock, if non-nil, pins the content digests of remote modules:
+	// remote modules must match their pins, and modules that are not
+	// yet pinned are added to it.
+	Lock *Lock
+
+	// StrictTemplates causes evaluation to fail when an exec template
+	// interpolates a string whose value is not known statically
+	// without shell-quoting it, either by the q interpolation modifier
+	// or the exec's shellquote parameter.
+	StrictTemplates bool
+
 	src Sourcer
 
 	path    string
@@ -51,6 +68,10 @@ type Session struct {
 	// images is a collection of Docker image names from exec expressions.
 	// It's populated during expression evaluation. Values are all true.
 	images map[string]bool
+
+	// remotes stores the content digests of the remote modules opened
+	// in this session.
+	remotes map[string]digest.Digest
 }
 
 // NewSession creates and initializes a session, reading
@@ -58,7 +79,7 @@ type Session struct {
 //
 // If src is nil, the default Sourcer is selected.
 func NewSession(src Sourcer) *Session {
-	s := &Session{modules: map[string]Module{}, images: map[string]bool{}, src: src}
+	s := &Session{modules: map[string]Module{}, images: map[string]bool{}, remotes: map[string]digest.Digest{}, src: src}
 	if s.src == nil {
 		s.src = Filesystem
 	}
@@ -80,22 +101,20 @@ func (s *Session) Open(path string) (Module, error) {
 	if s == nil {
 		return nil, errors.New("nil session")
 	}
-	if strings.HasPrefix(path, "./") {
-		path = filepath.Join(s.path, path)
-	}
+	path = s.resolve(path)
 	if m, ok := s.modules[path]; ok {
 		return m, nil
 	}
-	source, err := s.src.Source(path)
+	source, err := s.source(path)
 	if err != nil {
 		return nil, err
 	}
 	var (
 		mod              Module
-		modulePath       = filepath.Dir(path)
+		modulePath       = moduleDir(path)
 		assignEntrypoint = s.entrypoint == nil
 	)
-	switch ext := filepath.Ext(path); ext {
+	switch ext := filepath.Ext(moduleFile(path)); ext {
 	default:
 		return nil, fmt.Errorf("unknown module extension %s", ext)
 	case ".rf": // Regular reflow module.
@@ -108,14 +127,14 @@ func (s *Session) Open(path string) (Module, error) {
 			return nil, err
 		}
 		save := s.path
-		s.path = filepath.Dir(path)
+		s.path = modulePath
 		if err := lx.Module.Init(s, s.Types); err != nil {
 			s.path = save
 			return nil, err
 		}
 		s.path = save
 		// Label each toplevel declaration with the module name.
-		base := filepath.Base(path)
+		base := filepath.Base(moduleFile(path))
 		ext := filepath.Ext(base)
 		base = strings.TrimSuffix(base, ext)
 		for _, decl := range lx.Module.Decls {
@@ -201,6 +220,74 @@ func (s *Session) Open(path string) (Module, error) {
 	return mod, nil
 }
 
+// resolve resolves relative module paths against the directory of
+// the module that is being opened.
+func (s *Session) resolve(path string) string {
+	if strings.HasPrefix(path, "./") {
+		return joinModule(s.path, path)
+	}
+	return path
+}
+
+// source returns the source of the module at the provided path.
+// The contents of remote modules are verified against the session's
+// lock, if any, and their digests are recorded.
+func (s *Session) source(path string) ([]byte, error) {
+	source, err := s.src.Source(path)
+	if err != nil || !IsRemote(path) {
+		return source, err
+	}
+	d := reflow.Digester.FromBytes(source)
+	if s.Lock != nil {
+		if err := s.Lock.verify(path, d); err != nil {
+			return nil, err
+		}
+	}
+	s.mu.Lock()
+	s.remotes[path] = d
+	s.mu.Unlock()
+	return source, nil
+}
+
+// remoteDigest returns the content digest of the remote module at
+// the provided (possibly relative) path, or the zero digest if the
+// module is not remote.
+func (s *Session) remoteDigest(path string) digest.Digest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.remotes[s.resolve(path)]
+}
+
+// Check parses and type checks the Reflow module at the given path.
+// Unlike Open, Check returns the module even when it fails to type
+// check (but not when it fails to parse), so that its (partially
+// typed) syntax tree may be inspected; the module is not registered
+// with the session. Check is intended for tools, such as editors,
+// that inspect modules as they are being written.
+func (s *Session) Check(path string) (*ModuleImpl, error) {
+	if filepath.Ext(path) != ".rf" {
+		return nil, fmt.Errorf("cannot check %s: not a Reflow module", path)
+	}
+	source, err := s.src.Source(path)
+	if err != nil {
+		return nil, err
+	}
+	lx := &Parser{
+		File: path,
+		Body: bytes.NewReader(source),
+		Mode: ParseModule,
+	}
+	if err := lx.Parse(); err != nil {
+		return nil, err
+	}
+	lx.Module.source = source
+	save := s.path
+	s.path = filepath.Dir(path)
+	err = lx.Module.Init(s, s.Types)
+	s.path = save
+	return lx.Module, err
+}
+
 // Bundle creates a bundle that represents a self-contained Reflow
 // module. Its entry point is the first module that was opened in the
 // session.
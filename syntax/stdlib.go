@@ -5,7 +5,10 @@
 package syntax
 
 import (
+	"bytes"
+	"encoding/csv"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"math/big"
 	"net/url"
@@ -47,13 +50,21 @@ type SystemFunc struct {
 	Type   *types.T
 	Mode   FuncMode
 	Do     func(loc values.Location, args []values.T) (values.T, error)
+	// DoType is used in place of Do by polymorphic intrinsics, whose
+	// types contain type variables. It is passed the intrinsic's
+	// instantiated function type.
+	DoType func(loc values.Location, t *types.T, args []values.T) (values.T, error)
 }
 
 // Apply applied the intrinsic with the given arguments.
 func (s SystemFunc) Apply(loc values.Location, args []values.T) (values.T, error) {
+	if s.Type.HasVars() {
+		return nil, errors.E(loc.Position, loc.Ident, "$/"+s.Module, s.Id,
+			errors.Errorf("polymorphic function of type %v was not instantiated", s.Type))
+	}
 	args = append([]values.T{}, args...)
 	if s.Mode == ModeDirect {
-		return s.Do(loc, args)
+		return s.do(loc, args)
 	}
 	var (
 		deps  []*flow.Flow
@@ -72,9 +83,14 @@ func (s SystemFunc) Apply(loc values.Location, args []values.T) (values.T, error
 		}
 	}
 	if len(deps) == 0 {
-		return s.Do(loc, args)
+		return s.do(loc, args)
 	}
 	digest.WriteDigest(dw, s.Digest())
+	if s.DoType != nil {
+		// The results of polymorphic intrinsics depend on their
+		// instantiated types.
+		io.WriteString(dw, s.Type.String())
+	}
 	return &flow.Flow{
 		Op:         flow.K,
 		Deps:       deps,
@@ -85,7 +101,7 @@ func (s SystemFunc) Apply(loc values.Location, args []values.T) (values.T, error
 			for i := range vs {
 				args[depsi[i]] = vs[i]
 			}
-			rv, err := s.Do(loc, args)
+			rv, err := s.do(loc, args)
 			if err != nil {
 				return &flow.Flow{Op: flow.Val, Err: errors.Recover(err)}
 			}
@@ -94,6 +110,27 @@ func (s SystemFunc) Apply(loc values.Location, args []values.T) (values.T, error
 	}, nil
 }
 
+func (s SystemFunc) do(loc values.Location, args []values.T) (values.T, error) {
+	if s.DoType != nil {
+		return s.DoType(loc, s.Type, args)
+	}
+	return s.Do(loc, args)
+}
+
+// Instantiate returns the intrinsic instantiated for application
+// to arguments of the provided types. See types.Instantiate.
+func (s SystemFunc) Instantiate(args ...*types.T) (SystemFunc, error) {
+	if !s.Type.HasVars() {
+		return s, nil
+	}
+	t := types.Instantiate(s.Type, args...)
+	if t.Kind == types.ErrorKind {
+		return s, t.Error
+	}
+	s.Type = t
+	return s, nil
+}
+
 // Digest computes the digest of the intrinsic.
 func (s SystemFunc) Digest() digest.Digest {
 	return reflow.Digester.FromString("$/" + s.Module + s.Id)
@@ -811,6 +848,553 @@ var filesetsDecls = []*Decl{
 	}.Decl(),
 }
 
+// contentsFlow returns a flow that parses the contents of the
+// provided file with the function parse, producing a value of type t.
+// The file's contents are read by a flow.Contents node, so that
+// files produced by other flow nodes may be parsed.
+func contentsFlow(loc values.Location, fn string, file reflow.File, t *types.T, parse func(string) (values.T, error)) *flow.Flow {
+	return &flow.Flow{
+		Op: flow.K,
+		Deps: []*flow.Flow{{
+			Op: flow.Contents,
+			Deps: []*flow.Flow{{
+				Op:         flow.Val,
+				Value:      file,
+				FlowDigest: values.Digest(file, types.File),
+			}},
+			Position: loc.Position,
+			Ident:    loc.Ident,
+		}},
+		FlowDigest: reflow.Digester.FromString("$/" + fn + " " + t.String()),
+		Position:   loc.Position,
+		Ident:      loc.Ident,
+		K: func(vs []values.T) *flow.Flow {
+			v, err := parse(vs[0].(string))
+			if err != nil {
+				return &flow.Flow{Op: flow.Val, Err: errors.Recover(errors.E(fn, loc.Position, loc.Ident, err))}
+			}
+			return toFlow(v, t)
+		},
+	}
+}
+
+// dataFile returns a flow that evaluates to a file with the provided
+// contents.
+func dataFile(loc values.Location, b []byte) *flow.Flow {
+	return &flow.Flow{
+		Op: flow.Coerce,
+		Deps: []*flow.Flow{{
+			Op:       flow.Data,
+			Data:     b,
+			Position: loc.Position,
+			Ident:    loc.Ident,
+		}},
+		FlowDigest: coerceFilesetToFileDigest,
+		Coerce:     coerceFilesetToFile,
+	}
+}
+
+var jsonDecls = []*Decl{
+	SystemFunc{
+		Id:     "Parse",
+		Module: "json",
+		Doc: "Parse parses the JSON-encoded contents of a file into a value with the type " +
+			"of the provided prototype value; the prototype is otherwise ignored. For example, " +
+			"json.Parse(f, [{name: \"\", count: 0}]) parses a list of objects, each with a string " +
+			"field \"name\" and an integer field \"count\". Fields of JSON objects that are not " +
+			"part of the prototype's type are ignored; missing fields are an error. Parse supports " +
+			"strings, numbers, bools, lists, tuples, structs, and maps with string keys, as well as " +
+			"the other values encoded by Write.",
+		Type: types.Flow(types.Func(types.Var("T"),
+			&types.Field{Name: "file", T: types.File},
+			&types.Field{Name: "prototype", T: types.Var("T")})),
+		DoType: func(loc values.Location, t *types.T, args []values.T) (values.T, error) {
+			file := args[0].(reflow.File)
+			return contentsFlow(loc, "json.Parse", file, t.Elem, func(s string) (values.T, error) {
+				return values.UnmarshalJSON([]byte(s), t.Elem)
+			}), nil
+		},
+	}.Decl(),
+	SystemFunc{
+		Id:     "Write",
+		Module: "json",
+		Mode:   ModeForced,
+		Doc: "Write encodes a value as JSON and returns a file containing the encoding. " +
+			"Write is the inverse of Parse.",
+		Type: types.Flow(types.Func(types.File,
+			&types.Field{Name: "value", T: types.Var("T")})),
+		DoType: func(loc values.Location, t *types.T, args []values.T) (values.T, error) {
+			b, err := values.MarshalJSON(args[0], t.Fields[0].T)
+			if err != nil {
+				return nil, errors.E("json.Write", loc.Position, loc.Ident, err)
+			}
+			return dataFile(loc, append(b, '\n')), nil
+		},
+	}.Decl(),
+}
+
+var csvRowsType = types.List(types.Map(types.String, types.String))
+
+var csvDecls = []*Decl{
+	SystemFunc{
+		Id:     "Rows",
+		Module: "csv",
+		Doc: "Rows parses a CSV file whose first record is a header. Each subsequent record " +
+			"is returned as a map from column name to value. Rows fails if the records " +
+			"have differing numbers of fields or if column names are repeated.",
+		Type: types.Flow(types.Func(csvRowsType,
+			&types.Field{Name: "file", T: types.File})),
+		Do: func(loc values.Location, args []values.T) (values.T, error) {
+			file := args[0].(reflow.File)
+			return contentsFlow(loc, "csv.Rows", file, csvRowsType, parseCSV), nil
+		},
+	}.Decl(),
+	SystemFunc{
+		Id:     "Write",
+		Module: "csv",
+		Mode:   ModeForced,
+		Doc: "Write encodes a list of rows, each a map from column name to value, as CSV and " +
+			"returns a file containing the encoding. The header comprises the (sorted) union " +
+			"of the rows' column names; missing values are empty. Write is the inverse of Rows.",
+		Type: types.Flow(types.Func(types.File,
+			&types.Field{Name: "rows", T: csvRowsType})),
+		Do: func(loc values.Location, args []values.T) (values.T, error) {
+			b, err := writeCSV(args[0].(values.List))
+			if err != nil {
+				return nil, errors.E("csv.Write", loc.Position, loc.Ident, err)
+			}
+			return dataFile(loc, b), nil
+		},
+	}.Decl(),
+}
+
+// parseCSV parses CSV-encoded rows, keyed by the header in the
+// first record.
+func parseCSV(s string) (values.T, error) {
+	r := csv.NewReader(strings.NewReader(strings.TrimPrefix(s, "\ufeff")))
+	header, err := r.Read()
+	if err == io.EOF {
+		return values.List{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	for _, name := range header {
+		if seen[name] {
+			return nil, errors.Errorf("repeated column name %q", name)
+		}
+		seen[name] = true
+	}
+	rows := values.List{}
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		row := new(values.Map)
+		for i, value := range record {
+			row.Insert(values.Digest(header[i], types.String), header[i], value)
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// writeCSV encodes the provided rows as CSV.
+func writeCSV(rows values.List) ([]byte, error) {
+	seen := make(map[string]bool)
+	var header []string
+	for _, row := range rows {
+		row.(*values.Map).Each(func(k, _ values.T) {
+			if name := k.(string); !seen[name] {
+				seen[name] = true
+				header = append(header, name)
+			}
+		})
+	}
+	sort.Strings(header)
+	var b bytes.Buffer
+	w := csv.NewWriter(&b)
+	if err := w.Write(header); err != nil {
+		return nil, err
+	}
+	record := make([]string, len(header))
+	for _, row := range rows {
+		m := row.(*values.Map)
+		for i, name := range header {
+			record[i] = ""
+			if v := m.Lookup(values.Digest(name, types.String), name); v != nil {
+				record[i] = v.(string)
+			}
+		}
+		if err := w.Write(record); err != nil {
+			return nil, err
+		}
+	}
+	w.Flush()
+	return b.Bytes(), w.Error()
+}
+
+var listsDecls = []*Decl{
+	SystemFunc{
+		Id:     "Sort",
+		Module: "lists",
+		Mode:   ModeForced,
+		Doc: "Sort returns the elements of a list in ascending order. Values are ordered " +
+			"structurally: strings lexicographically, numbers numerically, and compound " +
+			"values (tuples, structs, lists) element by element.",
+		Type: types.Func(types.List(types.Var("T")),
+			&types.Field{Name: "list", T: types.List(types.Var("T"))}),
+		DoType: func(loc values.Location, t *types.T, args []values.T) (values.T, error) {
+			if !comparable(t.Elem.Elem) {
+				return nil, errors.E("lists.Sort", loc.Position, loc.Ident,
+					errors.Errorf("values of type %v cannot be sorted", t.Elem.Elem))
+			}
+			sorted := append(values.List{}, args[0].(values.List)...)
+			sort.SliceStable(sorted, func(i, j int) bool {
+				return values.Less(sorted[i], sorted[j])
+			})
+			return sorted, nil
+		},
+	}.Decl(),
+	SystemFunc{
+		Id:     "SortBy",
+		Module: "lists",
+		Mode:   ModeForced,
+		Doc: "SortBy returns the elements of a list in ascending order of the keys computed " +
+			"by the provided function, as in lists.SortBy(samples, func(s {name string}) => s.name). " +
+			"Keys are ordered as in Sort; elements with equal keys retain their relative order.",
+		Type: types.Func(types.List(types.Var("T")),
+			&types.Field{Name: "list", T: types.List(types.Var("T"))},
+			&types.Field{Name: "key", T: types.Func(types.Var("K"), &types.Field{T: types.Var("T")})}),
+		DoType: func(loc values.Location, t *types.T, args []values.T) (values.T, error) {
+			keyt := t.Fields[1].T.Elem
+			if !comparable(keyt) {
+				return nil, errors.E("lists.SortBy", loc.Position, loc.Ident,
+					errors.Errorf("values of type %v cannot be sorted", keyt))
+			}
+			list := args[0].(values.List)
+			return applyEach(loc, "lists.SortBy", t, args, args[1].(values.Func), list, keyt, func(keys []values.T) (values.T, error) {
+				index := make([]int, len(list))
+				for i := range index {
+					index[i] = i
+				}
+				sort.SliceStable(index, func(i, j int) bool {
+					return values.Less(keys[index[i]], keys[index[j]])
+				})
+				sorted := make(values.List, len(list))
+				for i, j := range index {
+					sorted[i] = list[j]
+				}
+				return sorted, nil
+			})
+		},
+	}.Decl(),
+	SystemFunc{
+		Id:     "Unique",
+		Module: "lists",
+		Mode:   ModeForced,
+		Doc:    "Unique returns the elements of a list with duplicates removed. The first occurrence of each element is retained, in order.",
+		Type: types.Func(types.List(types.Var("T")),
+			&types.Field{Name: "list", T: types.List(types.Var("T"))}),
+		DoType: func(loc values.Location, t *types.T, args []values.T) (values.T, error) {
+			var (
+				elem   = t.Elem.Elem
+				seen   = make(map[digest.Digest]bool)
+				unique = values.List{}
+			)
+			for _, v := range args[0].(values.List) {
+				if d := values.Digest(v, elem); !seen[d] {
+					seen[d] = true
+					unique = append(unique, v)
+				}
+			}
+			return unique, nil
+		},
+	}.Decl(),
+	SystemFunc{
+		Id:     "Slice",
+		Module: "lists",
+		Doc: "Slice returns the elements of a list from index start up to, but not including, " +
+			"index end. Slice fails if the indices are out of range.",
+		Type: types.Func(types.List(types.Var("T")),
+			&types.Field{Name: "list", T: types.List(types.Var("T"))},
+			&types.Field{Name: "start", T: types.Int},
+			&types.Field{Name: "end", T: types.Int}),
+		DoType: func(loc values.Location, t *types.T, args []values.T) (values.T, error) {
+			list := args[0].(values.List)
+			start, end := args[1].(*big.Int), args[2].(*big.Int)
+			if start.Sign() < 0 || start.Cmp(end) > 0 || end.Cmp(big.NewInt(int64(len(list)))) > 0 {
+				return nil, errors.E("lists.Slice", loc.Position, loc.Ident,
+					errors.Errorf("slice bounds [%s:%s] out of range for list of length %d", start, end, len(list)))
+			}
+			return append(values.List{}, list[start.Int64():end.Int64()]...), nil
+		},
+	}.Decl(),
+	SystemFunc{
+		Id:     "Contains",
+		Module: "lists",
+		Mode:   ModeForced,
+		Doc:    "Contains tests whether a list contains the provided value.",
+		Type: types.Func(types.Bool,
+			&types.Field{Name: "list", T: types.List(types.Var("T"))},
+			&types.Field{Name: "value", T: types.Var("T")}),
+		DoType: func(loc values.Location, t *types.T, args []values.T) (values.T, error) {
+			return indexOf(args[0].(values.List), args[1], t.Fields[1].T) >= 0, nil
+		},
+	}.Decl(),
+	SystemFunc{
+		Id:     "Index",
+		Module: "lists",
+		Mode:   ModeForced,
+		Doc:    "Index returns the index of the first occurrence of the provided value in a list, or -1 if the list does not contain the value.",
+		Type: types.Func(types.Int,
+			&types.Field{Name: "list", T: types.List(types.Var("T"))},
+			&types.Field{Name: "value", T: types.Var("T")}),
+		DoType: func(loc values.Location, t *types.T, args []values.T) (values.T, error) {
+			return values.NewInt(int64(indexOf(args[0].(values.List), args[1], t.Fields[1].T))), nil
+		},
+	}.Decl(),
+	SystemFunc{
+		Id:     "Partition",
+		Module: "lists",
+		Mode:   ModeForced,
+		Doc: "Partition splits a list into the elements for which the provided predicate " +
+			"is true and those for which it is false, retaining their order.",
+		Type: types.Func(types.Tuple(
+			&types.Field{T: types.List(types.Var("T"))},
+			&types.Field{T: types.List(types.Var("T"))}),
+			&types.Field{Name: "list", T: types.List(types.Var("T"))},
+			&types.Field{Name: "pred", T: types.Func(types.Bool, &types.Field{T: types.Var("T")})}),
+		DoType: func(loc values.Location, t *types.T, args []values.T) (values.T, error) {
+			list := args[0].(values.List)
+			return applyEach(loc, "lists.Partition", t, args, args[1].(values.Func), list, types.Bool, func(preds []values.T) (values.T, error) {
+				in, out := values.List{}, values.List{}
+				for i, v := range list {
+					if preds[i].(bool) {
+						in = append(in, v)
+					} else {
+						out = append(out, v)
+					}
+				}
+				return values.Tuple{in, out}, nil
+			})
+		},
+	}.Decl(),
+	SystemFunc{
+		Id:     "Chunk",
+		Module: "lists",
+		Doc: "Chunk splits a list into consecutive lists of the provided size; " +
+			"the last list is shorter if the size does not divide the list's length.",
+		Type: types.Func(types.List(types.List(types.Var("T"))),
+			&types.Field{Name: "list", T: types.List(types.Var("T"))},
+			&types.Field{Name: "size", T: types.Int}),
+		DoType: func(loc values.Location, t *types.T, args []values.T) (values.T, error) {
+			list, size := args[0].(values.List), args[1].(*big.Int)
+			if size.Sign() <= 0 {
+				return nil, errors.E("lists.Chunk", loc.Position, loc.Ident,
+					errors.Errorf("chunk size must be positive, got %s", size))
+			}
+			n := len(list)
+			if size.IsInt64() && size.Int64() < int64(n) {
+				n = int(size.Int64())
+			}
+			chunks := values.List{}
+			for len(list) > 0 {
+				if n > len(list) {
+					n = len(list)
+				}
+				chunks = append(chunks, append(values.List{}, list[:n]...))
+				list = list[n:]
+			}
+			return chunks, nil
+		},
+	}.Decl(),
+}
+
+var mapsDecls = []*Decl{
+	SystemFunc{
+		Id:     "Keys",
+		Module: "maps",
+		Mode:   ModeForced,
+		Doc:    "Keys returns the keys of a map in ascending order.",
+		Type: types.Func(types.List(types.Var("K")),
+			&types.Field{Name: "m", T: types.Map(types.Var("K"), types.Var("V"))}),
+		DoType: func(loc values.Location, t *types.T, args []values.T) (values.T, error) {
+			entries := sortedEntries(args[0].(*values.Map))
+			keys := make(values.List, len(entries))
+			for i, e := range entries {
+				keys[i] = e[0]
+			}
+			return keys, nil
+		},
+	}.Decl(),
+	SystemFunc{
+		Id:     "Values",
+		Module: "maps",
+		Mode:   ModeForced,
+		Doc:    "Values returns the values of a map, ordered by their keys as in Keys.",
+		Type: types.Func(types.List(types.Var("V")),
+			&types.Field{Name: "m", T: types.Map(types.Var("K"), types.Var("V"))}),
+		DoType: func(loc values.Location, t *types.T, args []values.T) (values.T, error) {
+			entries := sortedEntries(args[0].(*values.Map))
+			vals := make(values.List, len(entries))
+			for i, e := range entries {
+				vals[i] = e[1]
+			}
+			return vals, nil
+		},
+	}.Decl(),
+	SystemFunc{
+		Id:     "Merge",
+		Module: "maps",
+		Doc:    "Merge returns a map containing the entries of both maps; entries of m2 take precedence over those of m1 with the same key.",
+		Type: types.Func(types.Map(types.Var("K"), types.Var("V")),
+			&types.Field{Name: "m1", T: types.Map(types.Var("K"), types.Var("V"))},
+			&types.Field{Name: "m2", T: types.Map(types.Var("K"), types.Var("V"))}),
+		DoType: func(loc values.Location, t *types.T, args []values.T) (values.T, error) {
+			var (
+				keyt   = t.Elem.Index
+				merged = new(values.Map)
+			)
+			for _, arg := range args {
+				arg.(*values.Map).Each(func(k, v values.T) {
+					merged.Insert(values.Digest(k, keyt), k, v)
+				})
+			}
+			return merged, nil
+		},
+	}.Decl(),
+	SystemFunc{
+		Id:     "Invert",
+		Module: "maps",
+		Mode:   ModeForced,
+		Doc: "Invert returns a map from the values of a map to their keys. " +
+			"Invert fails if the map contains duplicate values.",
+		Type: types.Func(types.Map(types.Var("V"), types.Var("K")),
+			&types.Field{Name: "m", T: types.Map(types.Var("K"), types.Var("V"))}),
+		DoType: func(loc values.Location, t *types.T, args []values.T) (values.T, error) {
+			var (
+				keyt     = t.Elem.Index
+				inverted = new(values.Map)
+			)
+			for _, e := range sortedEntries(args[0].(*values.Map)) {
+				d := values.Digest(e[1], keyt)
+				if inverted.Lookup(d, e[1]) != nil {
+					return nil, errors.E("maps.Invert", loc.Position, loc.Ident,
+						errors.Errorf("duplicate value %s", values.Sprint(e[1], keyt)))
+				}
+				inverted.Insert(d, e[1], e[0])
+			}
+			return inverted, nil
+		},
+	}.Decl(),
+	SystemFunc{
+		Id:     "GroupBy",
+		Module: "maps",
+		Mode:   ModeForced,
+		Doc: "GroupBy groups the elements of a list by the keys computed by the provided " +
+			"function, as in maps.GroupBy(samples, func(s {name, lane string}) => s.name). " +
+			"Each group retains the elements' order in the list.",
+		Type: types.Func(types.Map(types.Var("K"), types.List(types.Var("T"))),
+			&types.Field{Name: "list", T: types.List(types.Var("T"))},
+			&types.Field{Name: "key", T: types.Func(types.Var("K"), &types.Field{T: types.Var("T")})}),
+		DoType: func(loc values.Location, t *types.T, args []values.T) (values.T, error) {
+			var (
+				keyt = t.Elem.Index
+				list = args[0].(values.List)
+			)
+			return applyEach(loc, "maps.GroupBy", t, args, args[1].(values.Func), list, keyt, func(keys []values.T) (values.T, error) {
+				groups := new(values.Map)
+				for i, v := range list {
+					d := values.Digest(keys[i], keyt)
+					group, _ := groups.Lookup(d, keys[i]).(values.List)
+					groups.Insert(d, keys[i], append(group, v))
+				}
+				return groups, nil
+			})
+		},
+	}.Decl(),
+}
+
+// applyEach applies the function fn to each element of list and
+// passes the forced results, of type t, to k, which computes the
+// result of the intrinsic id, whose instantiated type and arguments
+// are given by ftype and args. If any result is delayed, applyEach
+// returns a flow that invokes k once all results are available.
+func applyEach(loc values.Location, id string, ftype *types.T, args []values.T, fn values.Func, list values.List, t *types.T, k func([]values.T) (values.T, error)) (values.T, error) {
+	var (
+		results = make([]values.T, len(list))
+		deps    []*flow.Flow
+		depsi   []int
+	)
+	for i := range list {
+		v, err := fn.Apply(loc, []values.T{list[i]})
+		if err != nil {
+			return nil, err
+		}
+		results[i] = Force(v, t)
+		if f, ok := results[i].(*flow.Flow); ok {
+			deps = append(deps, f)
+			depsi = append(depsi, i)
+		}
+	}
+	if len(deps) == 0 {
+		return k(results)
+	}
+	dw := reflow.Digester.NewWriter()
+	io.WriteString(dw, "$/"+id)
+	io.WriteString(dw, ftype.String())
+	for i := range args {
+		values.WriteDigest(dw, args[i], ftype.Fields[i].T)
+	}
+	return &flow.Flow{
+		Op:         flow.K,
+		Deps:       deps,
+		FlowDigest: dw.Digest(),
+		Position:   loc.Position,
+		Ident:      loc.Ident,
+		K: func(vs []values.T) *flow.Flow {
+			results := append([]values.T{}, results...)
+			for i := range vs {
+				results[depsi[i]] = vs[i]
+			}
+			rv, err := k(results)
+			if err != nil {
+				return &flow.Flow{Op: flow.Val, Err: errors.Recover(err)}
+			}
+			return toFlow(rv, ftype.Elem)
+		},
+	}, nil
+}
+
+// indexOf returns the index of the first element of list that is
+// equal to v, or -1 if there is none.
+func indexOf(list values.List, v values.T, t *types.T) int {
+	d := values.Digest(v, t)
+	for i := range list {
+		if values.Digest(list[i], t) == d {
+			return i
+		}
+	}
+	return -1
+}
+
+// sortedEntries returns the (key, value) entries of map m, ordered
+// by key.
+func sortedEntries(m *values.Map) [][2]values.T {
+	entries := make([][2]values.T, 0, m.Len())
+	m.Each(func(k, v values.T) {
+		entries = append(entries, [2]values.T{k, v})
+	})
+	sort.Slice(entries, func(i, j int) bool {
+		return values.Less(entries[i][0], entries[j][0])
+	})
+	return entries
+}
+
 func init() {
 	for _, mod := range []struct {
 		name  string
@@ -823,6 +1407,10 @@ func init() {
 		{"strings", stringsDecls},
 		{"path", pathDecls},
 		{"filesets", filesetsDecls},
+		{"json", jsonDecls},
+		{"csv", csvDecls},
+		{"lists", listsDecls},
+		{"maps", mapsDecls},
 	} {
 		lib[mod.name] = &ModuleImpl{Decls: mod.decls}
 		lib[mod.name].Init(nil, types.NewEnv())
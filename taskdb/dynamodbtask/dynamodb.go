@@ -12,7 +12,7 @@
 // buckets. Dynamodbtask also uses a bunch of secondary indices to help with run/task querying.
 // Schema:
 // run:  {ID, ID4, Labels, Bundle, Args, Date, Keepalive, StartTime, Type="run", User}
-// task: {ID, ID4, Labels, Date, Keepalive, StartTime, Type="task", FlowID, Inspect, ResultID, RunID, RunID4, Stderr, Stdout, URI}
+// task: {ID, ID4, Labels, Date, Keepalive, StartTime, Type="task", FlowID, Attempt, Inspect, ResultID, RunID, RunID4, Stderr, Stdout, URI}
 // Indexes:
 // 1. Date-Keepalive-index - for queries that are time based.
 // 2. RunID-index - for find all tasks that belongs to a run.
@@ -22,6 +22,7 @@ package dynamodbtask
 import (
 	"context"
 	"fmt"
+	"strconv"
 	"strings"
 	"time"
 
@@ -113,6 +114,7 @@ const (
 	colDate      = "Date"
 	colBundle    = "Bundle"
 	colArgs      = "Args"
+	colAttempt   = "Attempt"
 )
 
 var colmap = map[taskdb.Kind]string{
@@ -229,7 +231,7 @@ func (t *TaskDB) SetRunAttrs(ctx context.Context, id taskdb.RunID, bundle digest
 }
 
 // CreateTask sets a new task in the taskdb with the given taskid, runid and flowid.
-func (t *TaskDB) CreateTask(ctx context.Context, id taskdb.TaskID, runID taskdb.RunID, flowID digest.Digest, uri string) error {
+func (t *TaskDB) CreateTask(ctx context.Context, id taskdb.TaskID, runID taskdb.RunID, flowID digest.Digest, attempt int, uri string) error {
 	now := time.Now().UTC()
 	input := &dynamodb.PutItemInput{
 		TableName: aws.String(t.TableName),
@@ -249,6 +251,9 @@ func (t *TaskDB) CreateTask(ctx context.Context, id taskdb.TaskID, runID taskdb.
 			colFlowID: {
 				S: aws.String(flowID.String()),
 			},
+			colAttempt: {
+				N: aws.String(strconv.Itoa(attempt)),
+			},
 			colType: {
 				S: aws.String(string(task)),
 			},
@@ -617,11 +622,19 @@ func (t *TaskDB) Tasks(ctx context.Context, taskQuery taskdb.TaskQuery) ([]taskd
 				errs = append(errs, fmt.Errorf("parse inspect %v: %v", *it[colInspect].S, err))
 			}
 		}
+		var attempt int
+		if v, ok := it[colAttempt]; ok && v.N != nil {
+			attempt, err = strconv.Atoi(*v.N)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("parse attempt %v: %v", *v.N, err))
+			}
+		}
 		uri := *it[colURI].S
 		tasks = append(tasks, taskdb.Task{
 			ID:        taskdb.TaskID(id),
 			RunID:     taskdb.RunID(runid),
 			FlowID:    fid,
+			Attempt:   attempt,
 			ResultID:  result,
 			URI:       uri,
 			Keepalive: keepalive,
@@ -156,7 +156,7 @@ func TestTaskCreate(t *testing.T) {
 		flowID = reflow.Digester.Rand(nil)
 		uri    = "machineUri"
 	)
-	err := taskb.CreateTask(context.Background(), taskID, runID, flowID, uri)
+	err := taskb.CreateTask(context.Background(), taskID, runID, flowID, 2, uri)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -170,6 +170,7 @@ func TestTaskCreate(t *testing.T) {
 		{*mockdb.pinput.Item[colRunID].S, runID.ID()},
 		{*mockdb.pinput.Item[colRunID4].S, runID.IDShort()},
 		{*mockdb.pinput.Item[colFlowID].S, flowID.String()},
+		{*mockdb.pinput.Item[colAttempt].N, "2"},
 		{*mockdb.pinput.Item[colType].S, "task"},
 		{*mockdb.pinput.Item[colType].S, "task"},
 		{*mockdb.pinput.Item[colURI].S, "machineUri"},
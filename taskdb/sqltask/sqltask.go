@@ -0,0 +1,495 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+// Package sqltask implements the taskdb.TaskDB interface on top of an
+// embedded SQLite database. It is intended for single-host (reflow -local)
+// and on-premises deployments where DynamoDB is not available.
+//
+// Runs and tasks are kept in two tables which mirror the attributes
+// stored by dynamodbtask:
+// runs:  {ID, ID4, Labels, User, Bundle, Args, StartTime, Keepalive}
+// tasks: {ID, ID4, RunID, RunID4, FlowID, Attempt, ResultID, URI, Labels, StartTime, Keepalive, Stdout, Stderr, Inspect}
+// Timestamps are stored as UTC Unix nanoseconds so that keepalive based
+// queries can be answered by an index range scan.
+package sqltask
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/grailbio/base/digest"
+	"github.com/grailbio/infra"
+	"github.com/grailbio/reflow"
+	"github.com/grailbio/reflow/errors"
+	infra2 "github.com/grailbio/reflow/infra"
+	"github.com/grailbio/reflow/log"
+	"github.com/grailbio/reflow/pool"
+	"github.com/grailbio/reflow/taskdb"
+
+	// Register the sqlite3 database/sql driver.
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// The kinds of mappings which may be scanned. They are declared in the
+// same order as in dynamodbtask so that callers may use either
+// implementation interchangeably.
+const (
+	ID4 taskdb.Kind = iota
+	RunID
+	RunID4
+	FlowID
+	ResultID
+	KeepAlive
+	StartTime
+	Stdout
+	Stderr
+	ExecInspect
+	URI
+	Labels
+	User
+	Type
+	Date
+	Bundle
+	Args
+)
+
+func init() {
+	infra.Register("sqltask", new(TaskDB))
+}
+
+type objType string
+
+const (
+	run  objType = "run"
+	task objType = "task"
+)
+
+// defaultSince is the lookback used by queries that do not specify one.
+const defaultSince = 30 * time.Minute
+
+// scanColumns maps the digest-valued kinds to the run and task columns
+// that store them. An empty column name means that the object type
+// does not carry the attribute.
+var scanColumns = map[taskdb.Kind]struct{ run, task string }{
+	RunID:       {"", "RunID"},
+	FlowID:      {"", "FlowID"},
+	ResultID:    {"", "ResultID"},
+	Stdout:      {"", "Stdout"},
+	Stderr:      {"", "Stderr"},
+	ExecInspect: {"", "Inspect"},
+	Bundle:      {"Bundle", ""},
+}
+
+const schema = `
+CREATE TABLE IF NOT EXISTS runs (
+	ID        TEXT PRIMARY KEY,
+	ID4       TEXT NOT NULL,
+	Labels    TEXT,
+	User      TEXT,
+	Bundle    TEXT,
+	Args      TEXT,
+	StartTime INTEGER NOT NULL,
+	Keepalive INTEGER
+);
+CREATE INDEX IF NOT EXISTS runs_ID4 ON runs (ID4);
+CREATE INDEX IF NOT EXISTS runs_Keepalive ON runs (Keepalive);
+CREATE TABLE IF NOT EXISTS tasks (
+	ID        TEXT PRIMARY KEY,
+	ID4       TEXT NOT NULL,
+	RunID     TEXT NOT NULL,
+	RunID4    TEXT NOT NULL,
+	FlowID    TEXT NOT NULL,
+	Attempt   INTEGER,
+	ResultID  TEXT,
+	URI       TEXT,
+	Labels    TEXT,
+	StartTime INTEGER NOT NULL,
+	Keepalive INTEGER,
+	Stdout    TEXT,
+	Stderr    TEXT,
+	Inspect   TEXT
+);
+CREATE INDEX IF NOT EXISTS tasks_ID4 ON tasks (ID4);
+CREATE INDEX IF NOT EXISTS tasks_RunID ON tasks (RunID);
+CREATE INDEX IF NOT EXISTS tasks_Keepalive ON tasks (Keepalive);
+`
+
+// TaskDB implements the SQLite backed taskdb.TaskDB interface to
+// store run/task state and metadata.
+type TaskDB struct {
+	// DB is the underlying database handle.
+	DB *sql.DB
+	// File is the path of the SQLite database file.
+	File string
+	// Labels on the run.
+	Labels []string
+	// User who initiated this run.
+	User string
+}
+
+// Open opens (creating if necessary) the SQLite database at path
+// and returns a TaskDB backed by it. The special path ":memory:"
+// opens a private, in-memory database.
+func Open(path string) (*TaskDB, error) {
+	t := &TaskDB{File: path}
+	if err := t.open(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *TaskDB) open() error {
+	if t.File != ":memory:" {
+		if err := os.MkdirAll(filepath.Dir(t.File), 0777); err != nil {
+			return errors.E("sqltask", "open", t.File, err)
+		}
+	}
+	db, err := sql.Open("sqlite3", t.File+"?_busy_timeout=10000")
+	if err != nil {
+		return errors.E("sqltask", "open", t.File, err)
+	}
+	// SQLite serializes writers anyway; a single connection avoids
+	// spurious "database is locked" errors, and is required for
+	// in-memory databases, which are private to a connection.
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return errors.E("sqltask", "open", t.File, err)
+	}
+	t.DB = db
+	return nil
+}
+
+// Help implements infra.Provider
+func (TaskDB) Help() string {
+	return "configure a local SQLite database to store run/task information"
+}
+
+// Flags implements infra.Provider
+func (t *TaskDB) Flags(flags *flag.FlagSet) {
+	flags.StringVar(&t.File, "file", "$HOME/.reflow/taskdb.sqlite", "path of the SQLite database file")
+}
+
+// Init implements infra.Provider
+func (t *TaskDB) Init(user *infra2.User, labels pool.Labels) error {
+	t.File = os.ExpandEnv(t.File)
+	t.Labels = make([]string, 0, len(labels))
+	for k, v := range labels {
+		t.Labels = append(t.Labels, fmt.Sprintf("%s=%s", k, v))
+	}
+	t.User = string(*user)
+	return t.open()
+}
+
+// Close closes the underlying database.
+func (t *TaskDB) Close() error {
+	return t.DB.Close()
+}
+
+// CreateRun sets a new run in the taskdb with the given id, labels and user.
+func (t *TaskDB) CreateRun(ctx context.Context, id taskdb.RunID, user string) error {
+	labels, err := json.Marshal(t.Labels)
+	if err != nil {
+		return err
+	}
+	_, err = t.DB.ExecContext(ctx,
+		`INSERT OR REPLACE INTO runs (ID, ID4, Labels, User, StartTime) VALUES (?, ?, ?, ?, ?)`,
+		id.ID(), id.IDShort(), string(labels), user, time.Now().UnixNano())
+	return err
+}
+
+// SetRunAttrs sets the reflow bundle and corresponding args for this run.
+func (t *TaskDB) SetRunAttrs(ctx context.Context, id taskdb.RunID, bundle digest.Digest, args []string) error {
+	if len(args) == 0 {
+		return t.update(ctx, "runs", id.ID(), "Bundle = ?", bundle.String())
+	}
+	b, err := json.Marshal(args)
+	if err != nil {
+		return err
+	}
+	return t.update(ctx, "runs", id.ID(), "Bundle = ?, Args = ?", bundle.String(), string(b))
+}
+
+// CreateTask sets a new task in the taskdb with the given taskid, runid and flowid.
+func (t *TaskDB) CreateTask(ctx context.Context, id taskdb.TaskID, runID taskdb.RunID, flowID digest.Digest, attempt int, uri string) error {
+	labels, err := json.Marshal(t.Labels)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UnixNano()
+	_, err = t.DB.ExecContext(ctx,
+		`INSERT OR REPLACE INTO tasks (ID, ID4, RunID, RunID4, FlowID, Attempt, URI, Labels, StartTime, Keepalive) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		id.ID(), id.IDShort(), runID.ID(), runID.IDShort(), flowID.String(), attempt, uri, string(labels), now, now)
+	return err
+}
+
+// SetTaskResult sets the task result id.
+func (t *TaskDB) SetTaskResult(ctx context.Context, id taskdb.TaskID, result digest.Digest) error {
+	return t.update(ctx, "tasks", id.ID(), "ResultID = ?", result.String())
+}
+
+// SetTaskAttrs sets the stdout, stderr and inspect ids for the task.
+func (t *TaskDB) SetTaskAttrs(ctx context.Context, id taskdb.TaskID, stdout, stderr, inspect digest.Digest) error {
+	return t.update(ctx, "tasks", id.ID(), "Stdout = ?, Stderr = ?, Inspect = ?", stdout.String(), stderr.String(), inspect.String())
+}
+
+// KeepRunAlive sets the keepalive for run id to keepalive.
+func (t *TaskDB) KeepRunAlive(ctx context.Context, id taskdb.RunID, keepalive time.Time) error {
+	return t.update(ctx, "runs", id.ID(), "Keepalive = ?", keepalive.UnixNano())
+}
+
+// KeepTaskAlive sets the keepalive for task id to keepalive.
+func (t *TaskDB) KeepTaskAlive(ctx context.Context, id taskdb.TaskID, keepalive time.Time) error {
+	return t.update(ctx, "tasks", id.ID(), "Keepalive = ?", keepalive.UnixNano())
+}
+
+// update applies the SET clause set to the row with the provided id in table.
+// It returns a NotExist error if no such row exists.
+func (t *TaskDB) update(ctx context.Context, table, id, set string, args ...interface{}) error {
+	args = append(args, id)
+	res, err := t.DB.ExecContext(ctx, fmt.Sprintf("UPDATE %s SET %s WHERE ID = ?", table, set), args...)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errors.E(errors.NotExist, "sqltask", table, id)
+	}
+	return nil
+}
+
+// where builds the WHERE clause for a run or task lookup. All queries,
+// with the exception of id queries, are restricted to rows whose
+// keepalive is after q.Since (or the last 30 minutes, if unset).
+// Task queries are restricted by user through their run.
+func where(typ objType, id digest.Digest, since time.Time, user string) (string, []interface{}) {
+	if !id.IsZero() {
+		if id.IsAbbrev() {
+			return "ID4 = ?", []interface{}{id.HexN(4)}
+		}
+		return "ID = ?", []interface{}{id.String()}
+	}
+	if since.IsZero() {
+		since = time.Now().Add(-defaultSince)
+	}
+	var (
+		clauses = []string{"Keepalive > ?"}
+		args    = []interface{}{since.UnixNano()}
+	)
+	if user != "" {
+		switch typ {
+		case run:
+			clauses = append(clauses, "User = ?")
+		case task:
+			clauses = append(clauses, "RunID IN (SELECT ID FROM runs WHERE User = ?)")
+		}
+		args = append(args, user)
+	}
+	return strings.Join(clauses, " AND "), args
+}
+
+// Runs returns runs that matches the query.
+func (t *TaskDB) Runs(ctx context.Context, runQuery taskdb.RunQuery) ([]taskdb.Run, error) {
+	id := digest.Digest(runQuery.ID)
+	clause, args := where(run, id, runQuery.Since, runQuery.User)
+	rows, err := t.DB.QueryContext(ctx, "SELECT ID, Labels, User, StartTime, Keepalive FROM runs WHERE "+clause, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var (
+		runs []taskdb.Run
+		errs []string
+	)
+	for rows.Next() {
+		var (
+			rid, labels, user sql.NullString
+			start, keepalive  sql.NullInt64
+		)
+		if err := rows.Scan(&rid, &labels, &user, &start, &keepalive); err != nil {
+			return nil, err
+		}
+		d, err := reflow.Digester.Parse(rid.String)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("parse id %v: %v", rid.String, err))
+			continue
+		}
+		if !id.IsZero() && id.IsAbbrev() && !d.Expands(id) {
+			continue
+		}
+		r := taskdb.Run{
+			ID:        taskdb.RunID(d),
+			Labels:    make(pool.Labels),
+			User:      user.String,
+			Start:     fromNanos(start),
+			Keepalive: fromNanos(keepalive),
+		}
+		for _, kv := range decodeStrings(labels) {
+			parts := strings.SplitN(kv, "=", 2)
+			if len(parts) != 2 {
+				errs = append(errs, fmt.Sprintf("label not well formed: %v", kv))
+				continue
+			}
+			r.Labels[parts[0]] = parts[1]
+		}
+		runs = append(runs, r)
+	}
+	if err := rows.Err(); err != nil {
+		return runs, err
+	}
+	if len(errs) > 0 {
+		return runs, errors.New(strings.Join(errs, ", "))
+	}
+	return runs, nil
+}
+
+// Tasks returns tasks that matches the query.
+func (t *TaskDB) Tasks(ctx context.Context, taskQuery taskdb.TaskQuery) ([]taskdb.Task, error) {
+	var (
+		id     = digest.Digest(taskQuery.ID)
+		clause string
+		args   []interface{}
+	)
+	if taskQuery.RunID.IsValid() {
+		clause, args = "RunID = ?", []interface{}{taskQuery.RunID.ID()}
+	} else {
+		clause, args = where(task, id, taskQuery.Since, taskQuery.User)
+	}
+	rows, err := t.DB.QueryContext(ctx,
+		"SELECT ID, RunID, FlowID, Attempt, ResultID, URI, StartTime, Keepalive, Stdout, Stderr, Inspect FROM tasks WHERE "+clause, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var (
+		tasks []taskdb.Task
+		errs  []string
+	)
+	// parse parses the optional digest s, recording any errors.
+	parse := func(what string, s sql.NullString) digest.Digest {
+		if !s.Valid {
+			return digest.Digest{}
+		}
+		d, err := reflow.Digester.Parse(s.String)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("parse %s %v: %v", what, s.String, err))
+		}
+		return d
+	}
+	for rows.Next() {
+		var (
+			tid, runID, flowID, resultID, uri sql.NullString
+			stdout, stderr, inspect           sql.NullString
+			start, keepalive, attempt         sql.NullInt64
+		)
+		if err := rows.Scan(&tid, &runID, &flowID, &attempt, &resultID, &uri, &start, &keepalive, &stdout, &stderr, &inspect); err != nil {
+			return nil, err
+		}
+		d := parse("id", tid)
+		if !taskQuery.RunID.IsValid() && !id.IsZero() && id.IsAbbrev() && !d.Expands(id) {
+			continue
+		}
+		tasks = append(tasks, taskdb.Task{
+			ID:        taskdb.TaskID(d),
+			RunID:     taskdb.RunID(parse("runid", runID)),
+			FlowID:    parse("flowid", flowID),
+			Attempt:   int(attempt.Int64),
+			ResultID:  parse("resultid", resultID),
+			URI:       uri.String,
+			Start:     fromNanos(start),
+			Keepalive: fromNanos(keepalive),
+			Stdout:    parse("stdout", stdout),
+			Stderr:    parse("stderr", stderr),
+			Inspect:   parse("inspect", inspect),
+		})
+	}
+	if err := rows.Err(); err != nil {
+		return tasks, err
+	}
+	if len(errs) > 0 {
+		return tasks, errors.New(strings.Join(errs, ", "))
+	}
+	return tasks, nil
+}
+
+// Scan calls the handler function for every association in the mapping.
+// Only digest-valued kinds (RunID, FlowID, ResultID, Stdout, Stderr,
+// ExecInspect and Bundle) may be scanned.
+func (t *TaskDB) Scan(ctx context.Context, kind taskdb.Kind, handler taskdb.MappingHandler) error {
+	cols, ok := scanColumns[kind]
+	if !ok {
+		return errors.E("sqltask", "scan", errors.NotSupported, errors.Errorf("kind %d", kind))
+	}
+	for _, s := range []struct {
+		typ           objType
+		table, column string
+	}{
+		{run, "runs", cols.run},
+		{task, "tasks", cols.task},
+	} {
+		if s.column == "" {
+			continue
+		}
+		if err := t.scan(ctx, kind, s.typ, s.table, s.column, handler); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *TaskDB) scan(ctx context.Context, kind taskdb.Kind, typ objType, table, column string, handler taskdb.MappingHandler) error {
+	rows, err := t.DB.QueryContext(ctx,
+		fmt.Sprintf("SELECT ID, %s, Labels FROM %s WHERE %s IS NOT NULL", column, table, column))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var k, v, labels sql.NullString
+		if err := rows.Scan(&k, &v, &labels); err != nil {
+			return err
+		}
+		kd, err := reflow.Digester.Parse(k.String)
+		if err != nil {
+			log.Errorf("invalid taskdb entry %v", k.String)
+			continue
+		}
+		vd, err := reflow.Digester.Parse(v.String)
+		if err != nil {
+			log.Errorf("invalid taskdb entry %v: %v", k.String, v.String)
+			continue
+		}
+		handler.HandleMapping(kd, vd, kind, string(typ), decodeStrings(labels))
+	}
+	return rows.Err()
+}
+
+func fromNanos(n sql.NullInt64) time.Time {
+	if !n.Valid {
+		return time.Time{}
+	}
+	return time.Unix(0, n.Int64).UTC()
+}
+
+func decodeStrings(s sql.NullString) []string {
+	if !s.Valid || s.String == "" {
+		return nil
+	}
+	var strs []string
+	if err := json.Unmarshal([]byte(s.String), &strs); err != nil {
+		log.Errorf("invalid taskdb string list %q: %v", s.String, err)
+		return nil
+	}
+	return strs
+}
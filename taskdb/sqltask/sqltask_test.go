@@ -0,0 +1,282 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package sqltask
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/grailbio/base/digest"
+	"github.com/grailbio/infra"
+	"github.com/grailbio/reflow"
+	"github.com/grailbio/reflow/errors"
+	infra2 "github.com/grailbio/reflow/infra"
+	"github.com/grailbio/reflow/pool"
+	"github.com/grailbio/reflow/taskdb"
+)
+
+func newTaskDB(t *testing.T) *TaskDB {
+	t.Helper()
+	tdb, err := Open(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tdb.Labels = []string{"test=label"}
+	return tdb
+}
+
+func abbrev(d digest.Digest) digest.Digest {
+	d.Truncate(4)
+	return d
+}
+
+func TestRunCreateQuery(t *testing.T) {
+	var (
+		ctx    = context.Background()
+		tdb    = newTaskDB(t)
+		runID  = taskdb.NewRunID()
+		bundle = reflow.Digester.Rand(nil)
+	)
+	if err := tdb.CreateRun(ctx, runID, "reflow"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tdb.SetRunAttrs(ctx, runID, bundle, []string{"-a=1"}); err != nil {
+		t.Fatal(err)
+	}
+	// Runs are not visible to time based queries until they are kept alive.
+	runs, err := tdb.Runs(ctx, taskdb.RunQuery{Since: time.Now().Add(-time.Minute)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(runs), 0; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	keepalive := time.Now().Add(time.Minute)
+	if err := tdb.KeepRunAlive(ctx, runID, keepalive); err != nil {
+		t.Fatal(err)
+	}
+	for _, q := range []taskdb.RunQuery{
+		{ID: runID},
+		{ID: taskdb.RunID(abbrev(digest.Digest(runID)))},
+		{Since: time.Now().Add(-time.Minute)},
+		{Since: time.Now().Add(-time.Minute), User: "reflow"},
+	} {
+		runs, err := tdb.Runs(ctx, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := len(runs), 1; got != want {
+			t.Fatalf("query %v: got %v, want %v", q, got, want)
+		}
+		r := runs[0]
+		if got, want := r.ID, runID; got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+		if got, want := r.User, "reflow"; got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+		if got, want := r.Labels, (pool.Labels{"test": "label"}); !reflect.DeepEqual(got, want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+		if got, want := r.Keepalive, keepalive; !got.Equal(want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	}
+	for _, q := range []taskdb.RunQuery{
+		{ID: taskdb.NewRunID()},
+		{Since: time.Now().Add(-time.Minute), User: "other"},
+		{Since: time.Now().Add(time.Hour)},
+	} {
+		runs, err := tdb.Runs(ctx, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := len(runs), 0; got != want {
+			t.Errorf("query %v: got %v, want %v", q, got, want)
+		}
+	}
+}
+
+func TestTaskCreateQuery(t *testing.T) {
+	var (
+		ctx    = context.Background()
+		tdb    = newTaskDB(t)
+		runID  = taskdb.NewRunID()
+		taskID = taskdb.NewTaskID()
+		flowID = reflow.Digester.Rand(nil)
+		result = reflow.Digester.Rand(nil)
+		stdout = reflow.Digester.Rand(nil)
+		stderr = reflow.Digester.Rand(nil)
+		insp   = reflow.Digester.Rand(nil)
+	)
+	if err := tdb.CreateRun(ctx, runID, "reflow"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tdb.CreateTask(ctx, taskID, runID, flowID, 1, "machineUri"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tdb.SetTaskResult(ctx, taskID, result); err != nil {
+		t.Fatal(err)
+	}
+	if err := tdb.SetTaskAttrs(ctx, taskID, stdout, stderr, insp); err != nil {
+		t.Fatal(err)
+	}
+	if err := tdb.KeepTaskAlive(ctx, taskID, time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	want := taskdb.Task{
+		ID:       taskID,
+		RunID:    runID,
+		FlowID:   flowID,
+		Attempt:  1,
+		ResultID: result,
+		URI:      "machineUri",
+		Stdout:   stdout,
+		Stderr:   stderr,
+		Inspect:  insp,
+	}
+	for _, q := range []taskdb.TaskQuery{
+		{ID: taskID},
+		{ID: taskdb.TaskID(abbrev(digest.Digest(taskID)))},
+		{RunID: runID},
+		{Since: time.Now().Add(-time.Minute)},
+		{Since: time.Now().Add(-time.Minute), User: "reflow"},
+	} {
+		tasks, err := tdb.Tasks(ctx, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := len(tasks), 1; got != want {
+			t.Fatalf("query %v: got %v, want %v", q, got, want)
+		}
+		got := tasks[0]
+		got.Start, got.Keepalive = time.Time{}, time.Time{}
+		if got != want {
+			t.Errorf("query %v: got %v, want %v", q, got, want)
+		}
+	}
+	tasks, err := tdb.Tasks(ctx, taskdb.TaskQuery{Since: time.Now().Add(-time.Minute), User: "other"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(tasks), 0; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestUpdateMissing(t *testing.T) {
+	var (
+		ctx = context.Background()
+		tdb = newTaskDB(t)
+	)
+	err := tdb.KeepTaskAlive(ctx, taskdb.NewTaskID(), time.Now())
+	if !errors.Is(errors.NotExist, err) {
+		t.Errorf("expected NotExist, got %v", err)
+	}
+}
+
+func TestScan(t *testing.T) {
+	var (
+		ctx    = context.Background()
+		tdb    = newTaskDB(t)
+		runID  = taskdb.NewRunID()
+		bundle = reflow.Digester.Rand(nil)
+		want   = make(map[digest.Digest]digest.Digest)
+	)
+	if err := tdb.CreateRun(ctx, runID, "reflow"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tdb.SetRunAttrs(ctx, runID, bundle, nil); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		id := taskdb.NewTaskID()
+		if err := tdb.CreateTask(ctx, id, runID, reflow.Digester.Rand(nil), 0, "uri"); err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			continue
+		}
+		insp := reflow.Digester.Rand(nil)
+		if err := tdb.SetTaskAttrs(ctx, id, reflow.Digester.Rand(nil), reflow.Digester.Rand(nil), insp); err != nil {
+			t.Fatal(err)
+		}
+		want[digest.Digest(id)] = insp
+	}
+	got := make(map[digest.Digest]digest.Digest)
+	err := tdb.Scan(ctx, ExecInspect, taskdb.MappingHandlerFunc(func(k, v digest.Digest, kind taskdb.Kind, taskType string, labels []string) {
+		if kind != ExecInspect || taskType != "task" {
+			t.Errorf("unexpected mapping %v %v", kind, taskType)
+		}
+		if got, want := labels, []string{"test=label"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+		got[k] = v
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	var bundles []string
+	err = tdb.Scan(ctx, Bundle, taskdb.MappingHandlerFunc(func(k, v digest.Digest, kind taskdb.Kind, taskType string, labels []string) {
+		if taskType != "run" || k != digest.Digest(runID) {
+			t.Errorf("unexpected mapping %v %v", k, taskType)
+		}
+		bundles = append(bundles, v.String())
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(bundles)
+	if got, want := bundles, []string{bundle.String()}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if err := tdb.Scan(ctx, URI, taskdb.MappingHandlerFunc(nil)); !errors.Is(errors.NotSupported, err) {
+		t.Errorf("expected NotSupported, got %v", err)
+	}
+}
+
+func TestSQLTaskdbInfra(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sqltask")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "sub", "taskdb.sqlite")
+	var schema = infra.Schema{
+		"user":   new(infra2.User),
+		"labels": make(pool.Labels),
+		"taskdb": new(taskdb.TaskDB),
+	}
+	config, err := schema.Make(infra.Keys{
+		"user":   "user,user=test",
+		"taskdb": "sqltask,file=" + file,
+		"labels": "kv",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tdb taskdb.TaskDB
+	config.Must(&tdb)
+	var sqltdb *TaskDB
+	config.Must(&sqltdb)
+	if got, want := sqltdb.File, file; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := sqltdb.Labels, []string{"user=test"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if _, err := os.Stat(file); err != nil {
+		t.Error(err)
+	}
+}
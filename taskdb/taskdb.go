@@ -89,8 +89,9 @@ type TaskDB interface {
 	CreateRun(ctx context.Context, id RunID, user string) error
 	// SetRunAttrs sets the reflow bundle and corresponding args for this run.
 	SetRunAttrs(ctx context.Context, id RunID, bundle digest.Digest, args []string) error
-	// CreateTask creates a new task with the provided id, runid, flowid and uri.
-	CreateTask(ctx context.Context, id TaskID, runID RunID, flowID digest.Digest, uri string) error
+	// CreateTask creates a new task with the provided id, runid, flowid, attempt and uri.
+	// Attempt is the number of times the flow's exec was previously attempted in this run.
+	CreateTask(ctx context.Context, id TaskID, runID RunID, flowID digest.Digest, attempt int, uri string) error
 	// SetTaskResult sets the result of the task post completion.
 	SetTaskResult(ctx context.Context, id TaskID, result digest.Digest) error
 	// SetTaskLogs updates the task log ids.
@@ -143,6 +144,9 @@ type Task struct {
 	RunID RunID
 	// FlowID is the flow id of this task.
 	FlowID digest.Digest
+	// Attempt is the attempt number of this task: retries of
+	// a flow's exec are stored as separate tasks, numbered from zero.
+	Attempt int
 	// ResultID is the id of the result, if non zero.
 	ResultID digest.Digest
 	// Keepalive is the keepalive lease on the task.
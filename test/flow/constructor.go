@@ -74,3 +74,8 @@ func Val(v reflow.Fileset) *flow.Flow {
 func Data(b []byte) *flow.Flow {
 	return &flow.Flow{Op: flow.Data, Data: b}
 }
+
+// Contents constructs a new flow.Contents node.
+func Contents(dep *flow.Flow) *flow.Flow {
+	return &flow.Flow{Op: flow.Contents, Deps: []*flow.Flow{dep}}
+}
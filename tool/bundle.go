@@ -5,8 +5,6 @@ import (
 	"flag"
 	"os"
 	"path/filepath"
-
-	"github.com/grailbio/reflow/syntax"
 )
 
 func (c *Cmd) bundle(ctx context.Context, args ...string) {
@@ -20,7 +18,11 @@ suffix ".rfx".
 Reflow bundles are interchangeable with other Reflow modules: they
 may be run with command run or imported by other Reflow modules. Any
 flags provided as arguments provide default values to the module's
-parameters.`
+parameters.
+
+Remote modules (imported from git repositories or blob stores) are
+vendored into the bundle, and are thus neither fetched nor verified
+against the lock file when the bundle is used.`
 	c.Parse(flags, args, help, "bundle [-o output] path [args]")
 	if flags.NArg() == 0 {
 		flags.Usage()
@@ -29,12 +31,13 @@ parameters.`
 	if ext := filepath.Ext(file); ext != ".rf" {
 		c.Fatalf("extension %s not supported for bundling", ext)
 	}
-	sess := syntax.NewSession(nil)
+	sess := c.newSession(file)
 	if !*nowarn {
 		sess.Stdwarn = c.Stderr
 	}
 	m, err := sess.Open(file)
 	c.must(err)
+	c.must(saveLock(sess, file))
 	c.must(m.InjectArgs(sess, args))
 	if *out == "" {
 		*out = filepath.Base(file) + "x" // ".rfx"
@@ -6,8 +6,6 @@ package tool
 import (
 	"context"
 	"flag"
-
-	"github.com/grailbio/reflow/syntax"
 )
 
 func (c *Cmd) check(ctx context.Context, args ...string) {
@@ -20,7 +18,7 @@ exits with code 1.`
 	if flags.NArg() == 0 {
 		flags.Usage()
 	}
-	sess := syntax.NewSession(nil)
+	sess := c.newSession(flags.Arg(0))
 	sess.Stdwarn = c.Stderr
 	ok := true
 	for i := 0; i < flags.NArg(); i++ {
@@ -29,6 +27,9 @@ exits with code 1.`
 			ok = false
 		}
 	}
+	if ok {
+		c.must(saveLock(sess, flags.Arg(0)))
+	}
 	if !ok || *warnErr && sess.NWarn() > 0 {
 		c.Exit(1)
 	}
@@ -8,14 +8,18 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"sync"
 
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/grailbio/base/status"
 	"github.com/grailbio/infra/tls"
 	"github.com/grailbio/reflow"
+	"github.com/grailbio/reflow/blob/fileblob"
 	"github.com/grailbio/reflow/blob/s3blob"
 	"github.com/grailbio/reflow/ec2cluster"
-	"github.com/grailbio/reflow/log"
+	"github.com/grailbio/reflow/hostcluster"
+	"github.com/grailbio/reflow/hpccluster"
+	"github.com/grailbio/reflow/k8scluster"
 	"github.com/grailbio/reflow/repository/blobrepo"
 	repositoryhttp "github.com/grailbio/reflow/repository/http"
 	"github.com/grailbio/reflow/runner"
@@ -26,11 +30,18 @@ type needer interface {
 	Need() reflow.Resources
 }
 
+// registerOnce guards the registration of the cluster's http
+// handlers, since handlers may be registered only once with the
+// default mux.
+var registerOnce sync.Once
+
 // Cluster returns a configured cluster and sets up repository
 // credentials so that remote repositories can be dialed.
 //
-// Cluster also registers an http handler to export the cluster's
-// additional resource needs, if the cluster exports this.
+// The first call to Cluster also registers an http handler to export
+// the cluster's additional resource needs, if the cluster exports
+// this, and, for host clusters, a handler under /hostcluster/ to
+// administer the cluster's hosts.
 //
 // TODO(marius): handle this more elegantly, perhaps by avoiding
 // such global registration altogether. The current way of doing this
@@ -42,12 +53,17 @@ func (c *Cmd) Cluster(status *status.Group) runner.Cluster {
 	if err != nil {
 		c.Fatal(err)
 	}
-	var ec *ec2cluster.Cluster
-	if err := c.Config.Instance(&ec); err == nil {
-		ec.Status = status
-		ec.Configuration = c.Config
-	} else {
-		log.Printf("not a ec2cluster! : %v", err)
+	switch cl := cluster.(type) {
+	case *ec2cluster.Cluster:
+		cl.Status = status
+		cl.Configuration = c.Config
+	case *hostcluster.Cluster:
+		cl.Status = status
+	case *hpccluster.Cluster:
+		cl.Status = status
+	case *k8scluster.Cluster:
+		cl.Status = status
+		cl.Configuration = c.Config
 	}
 	var sess *session.Session
 	err = c.Config.Instance(&sess)
@@ -55,10 +71,21 @@ func (c *Cmd) Cluster(status *status.Group) runner.Cluster {
 		c.Fatal(err)
 	}
 	blobrepo.Register("s3", s3blob.New(sess))
+	blobrepo.Register("file", fileblob.New("/"))
 	repositoryhttp.HTTPClient, err = c.httpClient()
 	if err != nil {
 		c.Fatal(err)
 	}
+	registerOnce.Do(func() { registerClusterHandlers(cluster) })
+	return cluster
+}
+
+// registerClusterHandlers registers the cluster's http handlers with
+// the default mux.
+func registerClusterHandlers(cluster runner.Cluster) {
+	if cl, ok := cluster.(*hostcluster.Cluster); ok {
+		http.Handle("/hostcluster/", cl)
+	}
 	if n, ok := cluster.(needer); ok {
 		http.HandleFunc("/clusterneed", func(w http.ResponseWriter, r *http.Request) {
 			if r.Method != "GET" {
@@ -73,7 +100,6 @@ func (c *Cmd) Cluster(status *status.Group) runner.Cluster {
 			}
 		})
 	}
-	return cluster
 }
 
 func (c *Cmd) httpClient() (*http.Client, error) {
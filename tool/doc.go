@@ -7,6 +7,7 @@ package tool
 import (
 	"context"
 	"flag"
+	"fmt"
 	"io"
 	"sort"
 
@@ -31,46 +32,61 @@ func (c *Cmd) doc(ctx context.Context, args ...string) {
 	if flags.NArg() != 1 {
 		flags.Usage()
 	}
-	sess := syntax.NewSession(nil)
+	sess := c.newSession(flags.Arg(0))
 	m, err := sess.Open(flags.Arg(0))
 	c.must(err)
+	c.must(printModuleDoc(c.Stdout, m))
+}
+
+// printModuleDoc writes the documentation of module m, its
+// parameters and declarations, to w.
+func printModuleDoc(w io.Writer, m syntax.Module) error {
 	if params := m.Params(); len(params) > 0 {
-		c.Println("Parameters")
-		c.Println()
+		fmt.Fprintln(w, "Parameters")
+		fmt.Fprintln(w)
 		for _, p := range params {
 			if p.Required {
-				c.Printf("val %s %s (required)\n", p.Ident, p.Type)
+				fmt.Fprintf(w, "val %s %s (required)\n", p.Ident, p.Type)
 			} else {
-				c.Printf("val %s %s = %s\n", p.Ident, p.Type, p.Expr.Abbrev())
+				fmt.Fprintf(w, "val %s %s = %s\n", p.Ident, p.Type, p.Expr.Abbrev())
+			}
+			if err := printDoc(w, p.Doc, ""); err != nil {
+				return err
 			}
-			c.printdoc(p.Doc, "")
 		}
-		c.Println()
+		fmt.Fprintln(w)
 	}
 
-	c.Println("Declarations")
-	c.Println()
+	fmt.Fprintln(w, "Declarations")
+	fmt.Fprintln(w)
 	for _, f := range m.Type(nil).Aliases {
-		c.Printf("type %s %s\n", f.Name, f.T)
-		c.printdoc(m.Doc(f.Name), "\n")
+		fmt.Fprintf(w, "type %s %s\n", f.Name, f.T)
+		if err := printDoc(w, m.Doc(f.Name), "\n"); err != nil {
+			return err
+		}
 	}
 	for _, f := range m.Type(nil).Fields {
-		c.Printf("val %s %s\n", f.Name, f.T)
-		c.printdoc(m.Doc(f.Name), "\n")
+		fmt.Fprintf(w, "val %s %s\n", f.Name, f.T)
+		if err := printDoc(w, m.Doc(f.Name), "\n"); err != nil {
+			return err
+		}
 	}
+	return nil
 }
 
-func (c *Cmd) printdoc(doc string, nl string) {
+// printDoc writes doc to w, indented and wrapped, followed by nl.
+func printDoc(w io.Writer, doc string, nl string) error {
 	if doc == "" {
-		c.Printf("%s", nl)
-		return
+		_, err := io.WriteString(w, nl)
+		return err
 	}
-	pw := textutil.PrefixLineWriter(c.Stdout, "    ")
+	pw := textutil.PrefixLineWriter(w, "    ")
 	ww := textutil.NewUTF8WrapWriter(pw, 80)
 	if _, err := io.WriteString(ww, doc); err != nil {
-		c.Fatal(err)
+		return err
 	}
 	ww.Flush()
 	pw.Flush()
-	c.Printf("%s", nl)
+	_, err := io.WriteString(w, nl)
+	return err
 }
@@ -14,6 +14,9 @@ import (
 	"strings"
 
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/grailbio/reflow/blob"
+	"github.com/grailbio/reflow/blob/fileblob"
+	"github.com/grailbio/reflow/blob/s3blob"
 	"github.com/grailbio/reflow/ec2authenticator"
 	"github.com/grailbio/reflow/flow"
 	"github.com/grailbio/reflow/lang"
@@ -41,6 +44,9 @@ type Eval struct {
 	// ImageMap stores a mapping between image names and resolved
 	// image names, to be used in evaluation.
 	ImageMap map[string]string
+	// StrictTemplates rejects exec templates that interpolate
+	// non-constant strings without quoting them.
+	StrictTemplates bool
 
 	// Type is the module type of the toplevel module that has been
 	// evaluated.
@@ -118,7 +124,7 @@ func (c *Cmd) Eval(e *Eval) error {
 		e.Type = prog.ModuleType()
 		return nil
 	case ".rf", ".rfx":
-		sess := syntax.NewSession(nil)
+		sess := c.newSession(file)
 		if err := c.evalV1(sess, e); err != nil {
 			return err
 		}
@@ -141,10 +147,14 @@ func (c *Cmd) evalV1(sess *syntax.Session, e *Eval) error {
 		return err
 	}
 	sess.Stderr = c.Stderr
+	sess.StrictTemplates = e.StrictTemplates
 	m, err := sess.Open(file)
 	if err != nil {
 		return err
 	}
+	if err := saveLock(sess, file); err != nil {
+		return err
+	}
 	flags, err := m.Flags(sess, sess.Values)
 	if err != nil {
 		c.Fatal(err)
@@ -183,6 +193,37 @@ func (c *Cmd) evalV1(sess *syntax.Session, e *Eval) error {
 	return err
 }
 
+// newSession returns a session for opening the module at the
+// provided path. Remote modules are read from git repositories and
+// blob stores, and are pinned by the lock file in the directory of
+// the module.
+func (c *Cmd) newSession(path string) *syntax.Session {
+	mux := blob.Mux{"file": fileblob.New("/")}
+	var awsSession *session.Session
+	if err := c.Config.Instance(&awsSession); err == nil {
+		mux["s3"] = s3blob.New(awsSession)
+	} else {
+		c.Log.Debugf("remote modules: s3 unavailable: %v", err)
+	}
+	sess := syntax.NewSession(syntax.Chain(new(syntax.GitSourcer), syntax.URLSourcer{Blob: mux}, syntax.Filesystem))
+	lock, err := syntax.ReadLock(filepath.Join(filepath.Dir(path), syntax.LockFile))
+	if err != nil {
+		c.Fatal(err)
+	}
+	sess.Lock = lock
+	return sess
+}
+
+// saveLock writes the session's lock to the lock file in the
+// directory of the module at the provided path if remote modules
+// were pinned while opening it.
+func saveLock(sess *syntax.Session, path string) error {
+	if sess.Lock == nil || !sess.Lock.Modified() {
+		return nil
+	}
+	return sess.Lock.WriteFile(filepath.Join(filepath.Dir(path), syntax.LockFile))
+}
+
 func sprintval(v values.T, t *types.T) string {
 	if t == nil {
 		return fmt.Sprint(v)
@@ -0,0 +1,129 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package tool
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+
+	"github.com/grailbio/reflow/syntax"
+)
+
+func (c *Cmd) fmtCmd(ctx context.Context, args ...string) {
+	flags := flag.NewFlagSet("fmt", flag.ExitOnError)
+	writeFlag := flags.Bool("w", false, "write the formatted module to its file instead of standard output")
+	diffFlag := flags.Bool("d", false, "print diffs instead of formatted modules")
+	checkFlag := flags.Bool("check", false, "list the modules that are not formatted; exit with code 1 if there are any")
+	help := `Fmt formats Reflow modules canonically. Modules are parsed and
+printed from their syntax trees: comments (including documentation
+comments), blank lines between declarations, and exec templates are
+preserved exactly.
+
+By default, the formatted modules are printed to standard output. With
+-w, they are written back to their files instead; with -d, a diff
+between each module and its formatted version is printed.
+
+With -check, fmt lists the modules whose formatting differs from the
+canonical one, and exits with code 1 if there are any. This is useful
+in pre-commit hooks.
+
+If no files are given, fmt formats standard input.`
+	c.Parse(flags, args, help, "fmt [-w] [-d] [-check] [files...]")
+	if *writeFlag && flags.NArg() == 0 {
+		c.Fatal("cannot use -w with standard input")
+	}
+	var (
+		ok          = true
+		unformatted bool
+	)
+	format := func(name string, src []byte) {
+		out, err := syntax.Format(name, src)
+		if err != nil {
+			c.Errorln(err)
+			ok = false
+			return
+		}
+		changed := !bytes.Equal(src, out)
+		if *checkFlag && changed {
+			unformatted = true
+			c.Println(name)
+		}
+		switch {
+		case *diffFlag:
+			if !changed {
+				break
+			}
+			d, err := diff(name, src, out)
+			if err != nil {
+				c.Errorln(err)
+				ok = false
+				break
+			}
+			c.Stdout.Write(d)
+		case *writeFlag:
+			if !changed {
+				break
+			}
+			info, err := os.Stat(name)
+			if err == nil {
+				err = ioutil.WriteFile(name, out, info.Mode())
+			}
+			if err != nil {
+				c.Errorln(err)
+				ok = false
+			}
+		case !*checkFlag:
+			c.Stdout.Write(out)
+		}
+	}
+	if flags.NArg() == 0 {
+		src, err := ioutil.ReadAll(os.Stdin)
+		c.must(err)
+		format("<stdin>", src)
+	}
+	for _, name := range flags.Args() {
+		src, err := ioutil.ReadFile(name)
+		if err != nil {
+			c.Errorln(err)
+			ok = false
+			continue
+		}
+		format(name, src)
+	}
+	if !ok || unformatted {
+		c.Exit(1)
+	}
+}
+
+// diff returns a unified diff between src and out, as computed
+// by the system's diff command.
+func diff(name string, src, out []byte) ([]byte, error) {
+	dir, err := ioutil.TempDir("", "reflowfmt")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	orig, formatted := dir+"/orig", dir+"/formatted"
+	if err := ioutil.WriteFile(orig, src, 0644); err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(formatted, out, 0644); err != nil {
+		return nil, err
+	}
+	d, err := exec.Command("diff", "-u", "--label", name+".orig", "--label", name, orig, formatted).Output()
+	// Diff exits with code 1 when the files differ.
+	if len(d) > 0 {
+		err = nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("computing diff: %v", err)
+	}
+	return d, nil
+}
@@ -0,0 +1,94 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package tool
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/grailbio/base/digest"
+	"github.com/grailbio/reflow"
+	"github.com/grailbio/reflow/errors"
+	"github.com/grailbio/reflow/flow"
+)
+
+// graphSuffix is the suffix of the file, stored alongside a run's
+// transcript, that contains the run's evaluated flow graph.
+const graphSuffix = ".graph.json"
+
+// saveGraph saves the flow graph g with the transcript of the run
+// with the given base path and, if path is nonempty, also writes it
+// to path. Errors are logged: they do not affect the outcome of the
+// run.
+func (c *Cmd) saveGraph(base, path string, g *flow.Graph) {
+	if err := writeGraphFile(base+graphSuffix, g); err != nil {
+		c.Log.Errorf("save graph: %v", err)
+	}
+	if path == "" {
+		return
+	}
+	if err := writeGraphFile(path, g); err != nil {
+		c.Log.Errorf("write graph: %v", err)
+	}
+}
+
+// writeGraphFile writes the graph g to the file at path. The graph is
+// written in DOT format if the path has the suffix .dot or .gv, and
+// in JSON otherwise.
+func writeGraphFile(path string, g *flow.Graph) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := writeGraph(f, path, g); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func writeGraph(w io.Writer, path string, g *flow.Graph) error {
+	switch filepath.Ext(path) {
+	case ".dot", ".gv":
+		return g.WriteDOT(w)
+	default:
+		return g.WriteJSON(w)
+	}
+}
+
+// readRunGraph reads the saved flow graph of the run with the given,
+// possibly abbreviated, ID.
+func (c *Cmd) readRunGraph(id digest.Digest) (*flow.Graph, error) {
+	dir := c.rundir()
+	if id.IsAbbrev() {
+		paths, err := filepath.Glob(filepath.Join(dir, "*"+graphSuffix))
+		if err != nil {
+			return nil, err
+		}
+		for _, path := range paths {
+			name := filepath.Base(path)
+			full, err := reflow.Digester.Parse(name[:len(name)-len(graphSuffix)])
+			if err != nil {
+				continue
+			}
+			if full.Expands(id) {
+				id = full
+				break
+			}
+		}
+	}
+	f, err := os.Open(filepath.Join(dir, id.Hex()+graphSuffix))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	g := new(flow.Graph)
+	if err := json.NewDecoder(f).Decode(g); err != nil {
+		return nil, errors.E("read graph", id, err)
+	}
+	return g, nil
+}
@@ -0,0 +1,36 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package tool
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/grailbio/reflow/flow"
+)
+
+func TestWriteGraph(t *testing.T) {
+	g := &flow.Graph{Root: 1, Nodes: []flow.GraphNode{
+		{ID: 1, Op: "exec", Ident: "main.x", State: "done", Deps: []int{2}},
+		{ID: 2, Op: "intern", State: "done", Cache: "hit"},
+	}}
+	for _, c := range []struct {
+		path, prefix string
+	}{
+		{"graph.dot", "digraph"},
+		{"graph.gv", "digraph"},
+		{"graph.json", "{"},
+		{"graph", "{"},
+	} {
+		var b bytes.Buffer
+		if err := writeGraph(&b, c.path, g); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(b.String(), c.prefix) {
+			t.Errorf("%s: expected prefix %q, got %q", c.path, c.prefix, b.String())
+		}
+	}
+}
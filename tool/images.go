@@ -11,7 +11,6 @@ import (
 	"os"
 	"sort"
 
-	"github.com/grailbio/reflow/syntax"
 	"github.com/grailbio/reflow/types"
 )
 
@@ -24,7 +23,7 @@ func (c *Cmd) images(ctx context.Context, args ...string) {
 		flags.Usage()
 	}
 	programPath := flags.Arg(0)
-	sess := syntax.NewSession(nil)
+	sess := c.newSession(programPath)
 	m, err := sess.Open(programPath)
 	c.must(err)
 
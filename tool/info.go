@@ -26,6 +26,7 @@ import (
 	"github.com/grailbio/reflow/log"
 	"github.com/grailbio/reflow/pool"
 	"github.com/grailbio/reflow/repository"
+	"github.com/grailbio/reflow/repository/filerepo"
 	"github.com/grailbio/reflow/runner"
 	"github.com/grailbio/reflow/taskdb"
 )
@@ -44,8 +45,20 @@ Info displays information about:
 
 Where an opaque identifier is given (a sha256 checksum), info looks
 it up in all candidate data sources and displays the first match.
-Abbreviated IDs are expanded where possible.`
-	c.Parse(flags, args, help, "info names...")
+Abbreviated IDs are expanded where possible.
+
+With -graph, info instead prints the evaluated flow graph of the
+named runs, as saved by "reflow run -graph": every flow node with its op,
+identifier, source position, digest, state transitions, cache status,
+requested and used resources, and dependencies. The graph is printed
+in JSON or, with -dot, in Graphviz DOT format.
+
+With -result, info instead prints the results of the named runs,
+encoded as JSON (see "reflow run -help").`
+	graphFlag := flags.Bool("graph", false, "print the evaluated flow graph of the named runs")
+	dotFlag := flags.Bool("dot", false, "print flow graphs in Graphviz DOT format instead of JSON")
+	resultFlag := flags.Bool("result", false, "print the JSON-encoded results of the named runs")
+	c.Parse(flags, args, help, "info [-graph [-dot] | -result] names...")
 	if flags.NArg() == 0 {
 		flags.Usage()
 	}
@@ -59,6 +72,35 @@ Abbreviated IDs are expanded where possible.`
 		if err != nil {
 			c.Fatalf("parse name %s: %v", arg, err)
 		}
+		if *graphFlag {
+			if n.Kind != idName {
+				c.Fatalf("%s is not a run ID", arg)
+			}
+			g, err := c.readRunGraph(n.ID)
+			if err != nil {
+				c.Fatalf("graph %s: %v", arg, err)
+			}
+			if *dotFlag {
+				c.must(g.WriteDOT(c.Stdout))
+			} else {
+				c.must(g.WriteJSON(c.Stdout))
+			}
+			continue
+		}
+		if *resultFlag {
+			if n.Kind != idName {
+				c.Fatalf("%s is not a run ID", arg)
+			}
+			state, err := c.readRunState(n.ID)
+			if err != nil {
+				c.Fatalf("result %s: %v", arg, err)
+			}
+			if len(state.ResultJSON) == 0 {
+				c.Fatalf("run %s has no JSON-encoded result", arg)
+			}
+			c.Println(string(state.ResultJSON))
+			continue
+		}
 		ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
 		defer cancel()
 		var tw tabwriter.Writer
@@ -211,12 +253,43 @@ func (c *Cmd) printRunInfo(ctx context.Context, w io.Writer, id digest.Digest) b
 	if state.Result != "" {
 		fmt.Fprintf(w, "\tresult:\t%s\n", state.Result)
 	}
+	if state.ResultType != "" {
+		fmt.Fprintf(w, "\ttype:\t%s\n", state.ResultType)
+	}
 	if _, err := os.Stat(base + ".execlog"); err == nil {
 		fmt.Fprintf(w, "\tlog:\t%s.execlog\n", base)
 	}
 	return true
 }
 
+// readRunState reads the state of the run with the provided
+// (possibly abbreviated) ID, as saved by "reflow run".
+func (c *Cmd) readRunState(id digest.Digest) (runner.State, error) {
+	var st runner.State
+	dir := c.rundir()
+	if id.IsAbbrev() {
+		paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+		if err != nil {
+			return st, err
+		}
+		for _, path := range paths {
+			name := filepath.Base(path)
+			full, err := reflow.Digester.Parse(name[:len(name)-len(".json")])
+			if err != nil {
+				continue
+			}
+			if full.Expands(id) {
+				id = full
+				break
+			}
+		}
+	}
+	if err := state.Unmarshal(filepath.Join(dir, id.Hex()), &st); err != nil {
+		return st, errors.E("read state", id, err)
+	}
+	return st, nil
+}
+
 func (c *Cmd) printTaskDBInfo(ctx context.Context, w io.Writer, id digest.Digest) bool {
 	rq := taskdb.RunQuery{ID: taskdb.RunID(id)}
 	ri, err := c.runInfo(ctx, rq, false /* liveOnly */)
@@ -314,6 +387,9 @@ func (c *Cmd) printAlloc(ctx context.Context, w io.Writer, inspect pool.AllocIns
 			fmt.Fprintf(w, "\t  %s\t%s\n", key, inspect.Meta.Labels[key])
 		}
 	}
+	if stats := filerepo.Stats(inspect.RepositoryStats); stats != (filerepo.Stats{}) {
+		fmt.Fprintf(w, "\trepository:\t%s\n", stats)
+	}
 	if len(execs) > 0 {
 		fmt.Fprintf(w, "\texecs:\n")
 		for _, exec := range execs {
@@ -0,0 +1,34 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package tool
+
+import (
+	"context"
+	"flag"
+	"os"
+
+	"github.com/grailbio/reflow/lsp"
+)
+
+func (c *Cmd) lsp(ctx context.Context, args ...string) {
+	flags := flag.NewFlagSet("lsp", flag.ExitOnError)
+	help := `Lsp runs a language server for Reflow modules. The server speaks
+the language server protocol over standard input and output, and is
+meant to be started by an editor.
+
+The server reports parse and type errors as diagnostics; shows types
+and documentation on hover; finds definitions of identifiers,
+including those declared by modules instantiated by make (system
+modules are described by generated, read-only files); completes
+module exports, record fields, and exec parameters; and lists the
+symbols declared by a module.`
+	c.Parse(flags, args, help, "lsp")
+	if flags.NArg() != 0 {
+		flags.Usage()
+	}
+	server := lsp.NewServer(os.Stdin, c.Stdout)
+	server.Log = c.Log
+	c.must(server.Serve())
+}
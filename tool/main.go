@@ -87,6 +87,10 @@ var commands = map[string]Func{
 	"run":          (*Cmd).run,
 	"bundle":       (*Cmd).bundle,
 	"check":        (*Cmd).check,
+	"fmt":          (*Cmd).fmtCmd,
+	"lsp":          (*Cmd).lsp,
+	"vet":          (*Cmd).vet,
+	"repl":         (*Cmd).repl,
 	"doc":          (*Cmd).doc,
 	"info":         (*Cmd).info,
 	"cat":          (*Cmd).cat,
@@ -110,6 +114,7 @@ var commands = map[string]Func{
 	"http":         (*Cmd).http,
 	"upgrade":      (*Cmd).upgrade,
 	"ec2verify":    (*Cmd).ec2verify,
+	"plan":         (*Cmd).plan,
 }
 
 var intro = `The reflow command helps users run Reflow programs, ExecInspect their
@@ -0,0 +1,215 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package tool
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math"
+	"text/tabwriter"
+
+	"github.com/grailbio/base/data"
+	"github.com/grailbio/base/digest"
+	"github.com/grailbio/reflow"
+	"github.com/grailbio/reflow/assoc"
+	"github.com/grailbio/reflow/ec2cluster/instances"
+	"github.com/grailbio/reflow/flow"
+	"github.com/grailbio/reflow/infra"
+)
+
+// planTotals are the aggregate totals of a plan.
+type planTotals struct {
+	Cache       int              `json:"cache"`
+	Exec        int              `json:"exec"`
+	Invalidated int              `json:"invalidated"`
+	Transfer    int              `json:"transfer"`
+	Bytes       int64            `json:"transferbytes"`
+	Resources   reflow.Resources `json:"resources"`
+	// PeakCost is the estimated hourly cost of running all of the
+	// plan's execs at once. It is an upper bound on the rate at which
+	// the plan incurs costs, not an estimate of the plan's total cost.
+	PeakCost float64 `json:"peakcostperhour"`
+	// Unpriced are the digests of the execs that fit no instance
+	// type in the selected region, and are not included in PeakCost.
+	Unpriced []digest.Digest `json:"unpriced,omitempty"`
+}
+
+func (c *Cmd) plan(ctx context.Context, args ...string) {
+	flags := flag.NewFlagSet("plan", flag.ExitOnError)
+	help := `Plan type checks a Reflow program and then performs a dry run of
+its evaluation: cache lookups and assertion checks are performed as
+they would be by "reflow run", but nothing is executed, transferred,
+or written to the cache.
+
+Plan reports, for each node that would be considered by the
+evaluator, whether it would be retrieved from cache (cache), executed
+(exec), executed because its cached result was invalidated by its
+assertions (invalidated), or whether it would transfer data
+(transfer), together with the aggregate resources and the peak
+hourly rate of the execs that would run: the hourly cost incurred if
+all of them ran at once. The rate of each exec is estimated as its
+share of the cheapest EC2 instance type that fits it in the selected
+region; execs that fit no instance type are reported separately. The
+peak rate is not an estimate of the total cost of the run, which
+depends on how long each exec runs.
+
+Parts of a program whose structure depends on the results of execs
+cannot be planned ahead of time; plan indicates when this is the
+case.
+
+With -json, the plan is printed as a JSON object for consumption by
+other tools.`
+	var config commonRunConfig
+	config.Flags(flags)
+	jsonFlag := flags.Bool("json", false, "print the plan in JSON")
+	regionFlag := flags.String("region", "us-west-2", "region used to estimate costs")
+	c.Parse(flags, args, help, "plan [flags] path [args]")
+	if err := config.Err(); err != nil {
+		c.Errorln(err)
+		flags.Usage()
+	}
+	if config.eval != "topdown" {
+		c.Fatal("plan supports only top-down evaluation")
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+	}
+	e := Eval{
+		InputArgs: flags.Args(),
+	}
+	if err := c.Eval(&e); err != nil {
+		c.Fatal(err)
+	}
+	if e.Main() == nil {
+		c.Fatal("module has no Main")
+	}
+
+	var cache *infra.CacheProvider
+	c.must(c.Config.Instance(&cache))
+	var ass assoc.Assoc
+	if err := c.Config.Instance(&ass); err != nil {
+		c.Log.Debugf("assoc: %v", err)
+	}
+	var repo reflow.Repository
+	if err := c.Config.Instance(&repo); err != nil {
+		c.Log.Debugf("repository: %v", err)
+	}
+	evalConfig := flow.EvalConfig{
+		Log:                c.Log,
+		Repository:         repo,
+		Snapshotter:        c.blob(),
+		Assoc:              ass,
+		AssertionGenerator: c.assertionGenerator(),
+		CacheMode:          cache.CacheMode,
+		ImageMap:           e.ImageMap,
+		DryRun:             true,
+	}
+	config.Configure(&evalConfig, c)
+	eval := flow.NewEval(e.Main(), evalConfig)
+	if err := eval.Do(ctx); err != nil {
+		c.Fatal(err)
+	}
+	if err := eval.Err(); err != nil {
+		c.Fatal(err)
+	}
+	plan := eval.Plan()
+	cost, unpriced := planCost(plan, *regionFlag)
+	totals := planTotals{
+		Cache:       plan.Count(flow.PlanCache),
+		Exec:        plan.Count(flow.PlanExec),
+		Invalidated: plan.Count(flow.PlanInvalidated),
+		Transfer:    plan.Count(flow.PlanTransfer),
+		Bytes:       plan.TransferSize(),
+		Resources:   plan.Resources(),
+		PeakCost:    cost,
+	}
+	for _, node := range unpriced {
+		totals.Unpriced = append(totals.Unpriced, node.Digest)
+	}
+
+	if *jsonFlag {
+		b, err := json.MarshalIndent(struct {
+			*flow.Plan
+			Totals planTotals `json:"totals"`
+		}{plan, totals}, "", "  ")
+		c.must(err)
+		c.Stdout.Write(b)
+		fmt.Fprintln(c.Stdout)
+		return
+	}
+	var tw tabwriter.Writer
+	tw.Init(c.Stdout, 4, 4, 1, ' ', 0)
+	defer tw.Flush()
+	fmt.Fprintln(&tw, "state\tident\top\tdigest\tresources/size\tdetail")
+	for _, node := range plan.Nodes {
+		var (
+			detail = node.Cmd
+			amount string
+		)
+		if node.URL != "" {
+			detail = node.URL
+		}
+		switch node.State {
+		case flow.PlanExec, flow.PlanInvalidated:
+			amount = node.Resources.String()
+		default:
+			if node.Size > 0 {
+				amount = data.Size(node.Size).String()
+			}
+		}
+		fmt.Fprintf(&tw, "%s\t%s\t%s\t%s\t%s\t%s\n",
+			node.State, node.Ident, node.Op, node.Digest.Short(), amount, detail)
+	}
+	fmt.Fprintf(&tw, "\ncache: %d exec: %d invalidated: %d transfer: %d (%s)\n",
+		totals.Cache, totals.Exec, totals.Invalidated, totals.Transfer, data.Size(totals.Bytes))
+	fmt.Fprintf(&tw, "resources: %s\n", totals.Resources)
+	fmt.Fprintf(&tw, "peak hourly rate: $%.2f/hour if all execs run at once (%s)\n", totals.PeakCost, *regionFlag)
+	if len(unpriced) > 0 {
+		fmt.Fprintf(&tw, "note: %d execs fit no instance type in %s and are not priced:\n", len(unpriced), *regionFlag)
+		for _, node := range unpriced {
+			fmt.Fprintf(&tw, "\t%s\t%s\t%s\n", node.Ident, node.Digest.Short(), node.Resources)
+		}
+	}
+	if plan.Partial {
+		fmt.Fprintln(&tw, "note: the plan is partial; parts of the program depend on the results of execs")
+	}
+}
+
+// planCost estimates the peak hourly cost of running the execs in
+// the provided plan in the given region, that is, the hourly cost if
+// all of them ran at once. Each exec is charged its share (by CPU or
+// memory, whichever is larger) of the cheapest instance type that fits
+// it. Execs that fit no instance type are returned in unpriced.
+func planCost(plan *flow.Plan, region string) (total float64, unpriced []flow.PlanNode) {
+	for _, node := range plan.Nodes {
+		if node.State != flow.PlanExec && node.State != flow.PlanInvalidated {
+			continue
+		}
+		var (
+			cpu   = node.Resources["cpu"]
+			mem   = node.Resources["mem"] / (1 << 30)
+			best  = math.MaxFloat64
+			found bool
+		)
+		for _, typ := range instances.Types {
+			price, ok := typ.Price[region]
+			if !ok || float64(typ.VCPU) < cpu || typ.Memory < mem {
+				continue
+			}
+			share := math.Max(cpu/float64(typ.VCPU), mem/typ.Memory)
+			if cost := price * share; cost < best {
+				best, found = cost, true
+			}
+		}
+		if found {
+			total += best
+		} else {
+			unpriced = append(unpriced, node)
+		}
+	}
+	return total, unpriced
+}
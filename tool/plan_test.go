@@ -0,0 +1,50 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package tool
+
+import (
+	"testing"
+
+	"github.com/grailbio/reflow"
+	"github.com/grailbio/reflow/flow"
+)
+
+func TestPlanCost(t *testing.T) {
+	small := reflow.Resources{"cpu": 1, "mem": 1 << 30}
+	plan := &flow.Plan{Nodes: []flow.PlanNode{
+		{State: flow.PlanExec, Resources: small},
+	}}
+	one, unpriced := planCost(plan, "us-west-2")
+	if len(unpriced) != 0 {
+		t.Errorf("unexpected unpriced execs %v", unpriced)
+	}
+	if one <= 0 {
+		t.Fatalf("expected positive cost, got %v", one)
+	}
+	plan.Nodes = append(plan.Nodes,
+		flow.PlanNode{State: flow.PlanInvalidated, Resources: small},
+		flow.PlanNode{State: flow.PlanCache, Resources: small},
+		flow.PlanNode{State: flow.PlanTransfer, Size: 1 << 30},
+		// No instance type fits this exec.
+		flow.PlanNode{State: flow.PlanExec, Ident: "huge", Resources: reflow.Resources{"cpu": 1e6}},
+	)
+	cost, unpriced := planCost(plan, "us-west-2")
+	if got, want := cost, 2*one; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := len(unpriced), 1; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if got, want := unpriced[0].Ident, "huge"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	cost, unpriced = planCost(plan, "nonexistent-region")
+	if got, want := cost, 0.0; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := len(unpriced), 3; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
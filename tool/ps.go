@@ -18,6 +18,7 @@ import (
 	"github.com/grailbio/base/data"
 	"github.com/grailbio/base/digest"
 	"github.com/grailbio/reflow"
+	"github.com/grailbio/reflow/errors"
 	"github.com/grailbio/reflow/infra"
 	"github.com/grailbio/reflow/log"
 	"github.com/grailbio/reflow/pool"
@@ -78,7 +79,8 @@ Global flags that work in both query modes:
 Flag -i lists all known execs in any state. Completed execs display profile
 information for memory, cpu, and disk utilization in place of live utilization.
 Flag -l shows the long listing; the live exec URI for a running task and the result id
-for a completed task.
+for a completed task, followed by the exec's timeout ("-" if it has none), which is
+marked "exceeded" if the exec was killed for exceeding it.
 
 Ps must contact each node in the cluster to gather exec data. If a node 
 does not respond within a predefined timeout, it is skipped, and an error is
@@ -202,7 +204,7 @@ printed on the console.`
 				procs,
 			)
 			if *longFlag {
-				fmt.Fprint(&tw, "\t", info.URI)
+				fmt.Fprint(&tw, "\t", info.URI, "\t", execTimeout(info.ExecInspect))
 			}
 			fmt.Fprint(&tw, "\n")
 		}
@@ -441,6 +443,20 @@ func (c *Cmd) writeTask(task taskInfo, w io.Writer, longListing bool) {
 		} else {
 			fmt.Fprint(w, "\t", task.Task.ResultID.String())
 		}
+		fmt.Fprint(w, "\t", execTimeout(info))
 	}
 	fmt.Fprint(w, "\n")
 }
+
+// execTimeout describes the timeout of the exec with the provided
+// inspect for long listings.
+func execTimeout(info reflow.ExecInspect) string {
+	if info.Config.Timeout == 0 {
+		return "-"
+	}
+	s := info.Config.Timeout.String()
+	if info.ExecError != nil && errors.Is(errors.ExecTimeout, info.ExecError) {
+		s += " (exceeded)"
+	}
+	return s
+}
@@ -0,0 +1,651 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package tool
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/grailbio/reflow"
+	"github.com/grailbio/reflow/assoc"
+	"github.com/grailbio/reflow/ec2authenticator"
+	"github.com/grailbio/reflow/flow"
+	"github.com/grailbio/reflow/infra"
+	"github.com/grailbio/reflow/internal/scanner"
+	"github.com/grailbio/reflow/local"
+	"github.com/grailbio/reflow/repository"
+	"github.com/grailbio/reflow/sched"
+	"github.com/grailbio/reflow/secrets"
+	"github.com/grailbio/reflow/syntax"
+	"github.com/grailbio/reflow/taskdb"
+	"github.com/grailbio/reflow/types"
+	"github.com/grailbio/reflow/values"
+)
+
+// maxHistory is the number of inputs retained in the repl history.
+const maxHistory = 1000
+
+const replHelp = `Declarations (val, func, type) are bound in the session; expressions
+are evaluated and printed together with their types. Input continues
+on the next line while brackets or templates are unterminated.
+
+Commands:
+	:type expr               print the type of expr without evaluating it
+	:doc [ident[.field]]     print the documentation of an identifier,
+	                         a module field, or a module path
+	:load path [-param=val]  instantiate the module at path and bind
+	                         its declarations in the session
+	:history                 print the input history
+	!n, !!                   evaluate history entry n, or the last entry
+	:help                    print this message
+	:quit                    end the session`
+
+var errQuit = errors.New("quit")
+
+func (c *Cmd) repl(ctx context.Context, args ...string) {
+	flags := flag.NewFlagSet("repl", flag.ExitOnError)
+	localMode := flags.Bool("local", false, "evaluate execs on the local Docker instance")
+	localDir := flags.String("localdir", defaultFlowDir, "directory where execution state is stored in local mode")
+	historyFile := flags.String("history", "", "file in which the input history is stored (default $HOME/.reflow/repl_history)")
+	help := `Repl starts an interactive Reflow session. The session keeps its
+declarations across inputs, so that expressions may be explored
+without editing and running a module for each change.
+
+` + replHelp + `
+
+Values that require exec, intern, or extern operations are evaluated
+on the cluster specified by the runtime profile, or, with -local,
+on the locally-available Docker daemon. The evaluator is set up when
+it is first needed.
+
+Modules provided as arguments are loaded before the first prompt.`
+	c.Parse(flags, args, help, "repl [-local] [module.rf...]")
+
+	sess := c.newSession(".")
+	sess.Stderr = c.Stderr
+	r := newRepl(sess, c.Stdout)
+	r.eval = c.replEvaluator(sess, *localMode, *localDir)
+	r.prompt = true
+	r.histfile = *historyFile
+	if r.histfile == "" {
+		if home, ok := os.LookupEnv("HOME"); ok {
+			r.histfile = filepath.Join(home, ".reflow", "repl_history")
+		}
+	}
+	if err := r.readHistory(); err != nil {
+		c.Log.Debugf("repl history: %v", err)
+	}
+	for _, path := range flags.Args() {
+		if err := r.load(path, nil); err != nil {
+			c.Errorln(err)
+		}
+	}
+	c.must(r.run(ctx, os.Stdin))
+	c.must(saveLock(sess, "."))
+}
+
+// A repl is an interactive Reflow session. Declarations are type
+// checked and evaluated in environments that persist across inputs.
+type repl struct {
+	sess *syntax.Session
+	tenv *types.Env
+	venv *values.Env
+	out  io.Writer
+
+	// prompt tells whether prompts are written before each input.
+	prompt bool
+	// eval evaluates delayed values; it is nil if the session cannot
+	// evaluate flows.
+	eval func(ctx context.Context, f *flow.Flow) (values.T, error)
+
+	// docs stores the documentation of bound identifiers; modules
+	// stores the modules of identifiers bound to module instances.
+	docs    map[string]string
+	modules map[string]syntax.Module
+
+	histfile string
+	history  []string
+}
+
+func newRepl(sess *syntax.Session, out io.Writer) *repl {
+	return &repl{
+		sess:    sess,
+		tenv:    sess.Types.Push(),
+		venv:    sess.Values.Push(),
+		out:     out,
+		docs:    make(map[string]string),
+		modules: make(map[string]syntax.Module),
+	}
+}
+
+// run reads inputs from in until it is exhausted or the session is
+// ended. Errors are reported in the session's output.
+func (r *repl) run(ctx context.Context, in io.Reader) error {
+	scan := bufio.NewScanner(in)
+	var input strings.Builder
+	r.printPrompt("> ")
+	for scan.Scan() {
+		input.WriteString(scan.Text())
+		input.WriteString("\n")
+		text := strings.TrimSpace(input.String())
+		if !strings.HasPrefix(text, ":") && incomplete(text) {
+			r.printPrompt(". ")
+			continue
+		}
+		input.Reset()
+		switch err := r.input(ctx, text); {
+		case err == errQuit:
+			return nil
+		case err != nil:
+			fmt.Fprintln(r.out, err)
+		}
+		r.printPrompt("> ")
+	}
+	return scan.Err()
+}
+
+func (r *repl) printPrompt(prompt string) {
+	if r.prompt {
+		io.WriteString(r.out, prompt)
+	}
+}
+
+// input evaluates a single (possibly multi-line) input, after
+// expanding history references, and records it in the history.
+func (r *repl) input(ctx context.Context, text string) error {
+	if text == "" {
+		return nil
+	}
+	if strings.HasPrefix(text, "!") {
+		n := len(r.history)
+		if text != "!!" {
+			var err error
+			n, err = strconv.Atoi(text[1:])
+			if err != nil {
+				return fmt.Errorf("invalid history reference %s", text)
+			}
+		}
+		if n < 1 || n > len(r.history) {
+			return fmt.Errorf("no history entry %s", text)
+		}
+		text = r.history[n-1]
+		fmt.Fprintln(r.out, text)
+	}
+	if err := r.addHistory(text); err != nil {
+		fmt.Fprintf(r.out, "history: %v\n", err)
+	}
+	return r.do(ctx, text)
+}
+
+// do evaluates the input text: a command, a set of declarations,
+// or an expression.
+func (r *repl) do(ctx context.Context, text string) error {
+	if strings.HasPrefix(text, ":") {
+		return r.command(ctx, text)
+	}
+	p := syntax.Parser{File: "<repl>", Mode: syntax.ParseDecls, Body: strings.NewReader(text)}
+	err := p.Parse()
+	if err == nil {
+		for _, d := range p.Decls {
+			if err := r.decl(ctx, d); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	switch strings.Fields(text)[0] {
+	case "val", "type", "func":
+		return err
+	}
+	e, err := r.expr(text)
+	if err != nil {
+		return err
+	}
+	v, err := e.Eval(r.sess, r.venv, "repl")
+	if err != nil {
+		return err
+	}
+	if v, err = r.force(ctx, v, e.Type); err != nil {
+		return err
+	}
+	fmt.Fprintf(r.out, "%s : %s\n", values.Sprint(v, e.Type), e.Type)
+	return nil
+}
+
+// expr parses and type checks the expression in text.
+func (r *repl) expr(text string) (*syntax.Expr, error) {
+	p := syntax.Parser{File: "<repl>", Mode: syntax.ParseExpr, Body: strings.NewReader(text)}
+	if err := p.Parse(); err != nil {
+		return nil, err
+	}
+	if err := p.Expr.Init(r.sess, r.tenv); err != nil {
+		return nil, err
+	}
+	return p.Expr, nil
+}
+
+// decl type checks and evaluates the declaration d, binding its
+// identifiers in the session.
+func (r *repl) decl(ctx context.Context, d *syntax.Decl) error {
+	if err := d.Init(r.sess, r.tenv); err != nil {
+		return err
+	}
+	if d.Type.Kind == types.ErrorKind {
+		return fmt.Errorf("%s: %v", d.Position, d.Type.Error)
+	}
+	switch d.Kind {
+	case syntax.DeclType:
+		r.tenv = r.tenv.Push()
+		r.tenv.BindAlias(d.Ident, d.Type)
+		fmt.Fprintf(r.out, "type %s %s\n", d.Ident, d.Type)
+		return nil
+	case syntax.DeclDeclare:
+		return fmt.Errorf("%s: declaration of %s has no value", d.Position, d.Ident)
+	}
+	v, err := d.Eval(r.sess, r.venv, "")
+	if err != nil {
+		return err
+	}
+	if v, err = r.force(ctx, v, d.Type); err != nil {
+		return err
+	}
+	tenv, venv := types.NewEnv(), values.NewEnv()
+	if err := d.Pat.BindTypes(tenv, d.Type, types.Never); err != nil {
+		return fmt.Errorf("%s: %v", d.Position, err)
+	}
+	if !d.Pat.BindValues(venv, v) {
+		return fmt.Errorf("%s: value %s does not match pattern %s", d.Position, values.Sprint(v, d.Type), d.Pat)
+	}
+	// Each declaration is bound in a new frame so that functions
+	// continue to refer to the values that were bound when they were
+	// declared.
+	r.tenv, r.venv = r.tenv.Push(), r.venv.Push()
+	for _, id := range sortedSymbols(tenv) {
+		t := tenv.Type(id)
+		r.tenv.Bind(id, t, d.Position, types.Never)
+		r.venv.Bind(id, venv.Value(id))
+		r.docs[id] = d.Comment
+		delete(r.modules, id)
+		switch t.Kind {
+		case types.FuncKind, types.ModuleKind:
+			fmt.Fprintf(r.out, "val %s %s\n", id, t)
+		default:
+			fmt.Fprintf(r.out, "val %s %s = %s\n", id, t, values.Sprint(venv.Value(id), t))
+		}
+	}
+	if d.Pat.Kind == syntax.PatIdent && d.Expr.Kind == syntax.ExprMake {
+		r.modules[d.Pat.Ident] = d.Expr.Module
+	}
+	return nil
+}
+
+// force fully evaluates the value v of type t, evaluating delayed
+// values with the session's evaluator.
+func (r *repl) force(ctx context.Context, v values.T, t *types.T) (values.T, error) {
+	f, ok := syntax.Force(v, t).(*flow.Flow)
+	if !ok {
+		return v, nil
+	}
+	if r.eval == nil {
+		return nil, errors.New("the value requires flow evaluation, which is not available in this session")
+	}
+	return r.eval(ctx, f)
+}
+
+// command evaluates the session command in text.
+func (r *repl) command(ctx context.Context, text string) error {
+	var name, arg string
+	if i := strings.IndexAny(text, " \t\n"); i < 0 {
+		name = text
+	} else {
+		name, arg = text[:i], strings.TrimSpace(text[i:])
+	}
+	switch name {
+	case ":type", ":t":
+		if arg == "" {
+			return errors.New("usage: :type expr")
+		}
+		e, err := r.expr(arg)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(r.out, e.Type)
+	case ":doc", ":d":
+		return r.doc(arg)
+	case ":load", ":l":
+		args := strings.Fields(arg)
+		if len(args) == 0 {
+			return errors.New("usage: :load path [-param=value...]")
+		}
+		return r.load(args[0], args[1:])
+	case ":history":
+		for i, text := range r.history {
+			fmt.Fprintf(r.out, "%4d  %s\n", i+1, strings.Replace(text, "\n", "\n      ", -1))
+		}
+	case ":help", ":h", ":?":
+		fmt.Fprintln(r.out, replHelp)
+	case ":quit", ":q":
+		return errQuit
+	default:
+		return fmt.Errorf("unknown command %s; try :help", name)
+	}
+	return nil
+}
+
+// doc prints the documentation for arg, which names a module, an
+// identifier bound in the session, or a field of a module instance.
+func (r *repl) doc(arg string) error {
+	switch {
+	case arg == "":
+		fmt.Fprintln(r.out, "Reflow's system modules are:")
+		names := syntax.Modules()
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(r.out, "	$/%s\n", name)
+		}
+		return nil
+	case strings.HasPrefix(arg, "$/"), syntax.IsRemote(arg),
+		strings.HasSuffix(arg, ".rf"), strings.HasSuffix(arg, ".rfx"):
+		m, err := r.sess.Open(arg)
+		if err != nil {
+			return err
+		}
+		return printModuleDoc(r.out, m)
+	}
+	ident, field := arg, ""
+	if i := strings.Index(arg, "."); i >= 0 {
+		ident, field = arg[:i], arg[i+1:]
+	}
+	if m := r.modules[ident]; m != nil {
+		if field == "" {
+			return printModuleDoc(r.out, m)
+		}
+		t := m.Type(nil).Field(field)
+		if t == nil {
+			return fmt.Errorf("module %s has no field %s", ident, field)
+		}
+		fmt.Fprintf(r.out, "val %s %s\n", field, t)
+		return printDoc(r.out, m.Doc(field), "")
+	}
+	t := r.tenv.Type(ident)
+	if t == nil {
+		return fmt.Errorf("identifier %s is not defined", ident)
+	}
+	if field != "" {
+		if t = t.Field(field); t == nil {
+			return fmt.Errorf("%s has no field %s", ident, field)
+		}
+		fmt.Fprintf(r.out, "val %s %s\n", arg, t)
+		return nil
+	}
+	fmt.Fprintf(r.out, "val %s %s\n", ident, t)
+	return printDoc(r.out, r.docs[ident], "")
+}
+
+// load instantiates the module at path with the parameters in args
+// and binds its declarations in the session.
+func (r *repl) load(path string, args []string) error {
+	m, err := r.sess.Open(path)
+	if err != nil {
+		return err
+	}
+	flags, err := m.Flags(r.sess, r.sess.Values)
+	if err != nil {
+		return err
+	}
+	flags.SetOutput(ioutil.Discard)
+	if err := flags.Parse(args); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	if flags.NArg() > 0 {
+		return fmt.Errorf("%s: unrecognized parameters: %s", path, strings.Join(flags.Args(), " "))
+	}
+	env := r.sess.Values.Push()
+	if err := m.FlagEnv(flags, env, types.NewEnv()); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	v, err := m.Make(r.sess, env)
+	if err != nil {
+		return err
+	}
+	typ := m.Type(nil)
+	r.tenv, r.venv = r.tenv.Push(), r.venv.Push()
+	for _, f := range typ.Aliases {
+		r.tenv.BindAlias(f.Name, f.T)
+	}
+	for _, f := range typ.Fields {
+		r.tenv.Bind(f.Name, f.T, scanner.Position{Filename: path}, types.Never)
+		r.venv.Bind(f.Name, v.(values.Module)[f.Name])
+		r.docs[f.Name] = m.Doc(f.Name)
+		delete(r.modules, f.Name)
+	}
+	fmt.Fprintf(r.out, "loaded %s (%d declarations)\n", path, len(typ.Fields)+len(typ.Aliases))
+	return nil
+}
+
+// readHistory reads the history stored in the session's history
+// file, if any.
+func (r *repl) readHistory() error {
+	if r.histfile == "" {
+		return nil
+	}
+	f, err := os.Open(r.histfile)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	scan := bufio.NewScanner(f)
+	for scan.Scan() {
+		text, err := strconv.Unquote(scan.Text())
+		if err != nil {
+			continue
+		}
+		r.history = append(r.history, text)
+	}
+	if len(r.history) > maxHistory {
+		r.history = r.history[len(r.history)-maxHistory:]
+	}
+	return scan.Err()
+}
+
+// addHistory appends text to the history and to the history file.
+// Each entry is stored as a quoted string on its own line.
+func (r *repl) addHistory(text string) error {
+	if n := len(r.history); n > 0 && r.history[n-1] == text {
+		return nil
+	}
+	r.history = append(r.history, text)
+	if r.histfile == "" {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(r.histfile), 0777); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(r.histfile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(f, strconv.Quote(text))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// incomplete tells whether the input text is unterminated: it has
+// unbalanced brackets or an unterminated string or template.
+func incomplete(text string) bool {
+	var depth int
+	for i := 0; i < len(text); i++ {
+		switch text[i] {
+		case '/':
+			if strings.HasPrefix(text[i:], "//") {
+				j := strings.IndexByte(text[i:], '\n')
+				if j < 0 {
+					return depth > 0
+				}
+				i += j
+			}
+		case '"':
+			j := i + 1
+			for ; j < len(text) && text[j] != '"' && text[j] != '\n'; j++ {
+				if text[j] == '\\' {
+					j++
+				}
+			}
+			if j >= len(text) {
+				return true
+			}
+			i = j
+		case '`':
+			j := strings.IndexByte(text[i+1:], '`')
+			if j < 0 {
+				return true
+			}
+			i += j + 1
+		case '{':
+			if strings.HasPrefix(text[i:], `{"`) {
+				j := strings.Index(text[i+2:], `"}`)
+				if j < 0 {
+					return true
+				}
+				i += j + 3
+				continue
+			}
+			depth++
+		case '(', '[':
+			depth++
+		case '}', ')', ']':
+			depth--
+		}
+	}
+	return depth > 0
+}
+
+// sortedSymbols returns the identifiers bound in env, sorted.
+func sortedSymbols(env *types.Env) []string {
+	var ids []string
+	for id := range env.Symbols() {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// replEvaluator returns a function that evaluates flows produced in
+// the session sess, on the cluster or, if localMode is set, on the local
+// Docker daemon, with execution state stored in localDir. The
+// evaluator is configured on first use.
+func (c *Cmd) replEvaluator(sess *syntax.Session, localMode bool, localDir string) func(context.Context, *flow.Flow) (values.T, error) {
+	var config *flow.EvalConfig
+	return func(ctx context.Context, f *flow.Flow) (values.T, error) {
+		if config == nil {
+			config = c.replEvalConfig(ctx, localMode, localDir)
+		}
+		var awsSession *session.Session
+		if err := c.Config.Instance(&awsSession); err != nil {
+			c.Log.Debug(err)
+		}
+		resolver := ImageResolver{Authenticator: ec2authenticator.New(awsSession)}
+		imageMap, err := resolver.ResolveImages(ctx, sess.Images())
+		if err != nil {
+			return nil, err
+		}
+		evalConfig := *config
+		evalConfig.ImageMap = imageMap
+		evalConfig.RunID = taskdb.NewRunID()
+		eval := flow.NewEval(f, evalConfig)
+		if err := eval.Do(ctx); err != nil {
+			return nil, err
+		}
+		if err := eval.Err(); err != nil {
+			return nil, err
+		}
+		return eval.Value(), nil
+	}
+}
+
+// replEvalConfig returns the evaluation configuration for the repl:
+// a local executor if localMode is set, or else a scheduler that
+// allocates from the configured cluster.
+func (c *Cmd) replEvalConfig(ctx context.Context, localMode bool, localDir string) *flow.EvalConfig {
+	var cache *infra.CacheProvider
+	c.must(c.Config.Instance(&cache))
+	var ass assoc.Assoc
+	if err := c.Config.Instance(&ass); err != nil && !localMode {
+		c.Fatal(err)
+	}
+	var repo reflow.Repository
+	if err := c.Config.Instance(&repo); err != nil && !localMode {
+		c.Fatal(err)
+	}
+	transferer := &repository.Manager{
+		Status:           c.Status.Group("transfers"),
+		PendingTransfers: repository.NewLimits(c.TransferLimit()),
+		Stat:             repository.NewLimits(statLimit),
+		Log:              c.Log,
+	}
+	if repo != nil {
+		transferer.PendingTransfers.Set(repo.URL().String(), int(^uint(0)>>1))
+	}
+	config := &flow.EvalConfig{
+		Snapshotter:        c.blob(),
+		Transferer:         transferer,
+		Log:                c.Log,
+		Repository:         repo,
+		Assoc:              ass,
+		AssertionGenerator: c.assertionGenerator(),
+		CacheMode:          cache.CacheMode,
+		Status:             c.Status.Group("repl"),
+	}
+	if !localMode {
+		scheduler := sched.New()
+		scheduler.Transferer = transferer
+		scheduler.Mux = c.blob()
+		scheduler.Repository = repo
+		scheduler.Cluster = c.Cluster(c.Status.Group("ec2cluster"))
+		scheduler.Log = c.Log.Prefix("scheduler: ")
+		scheduler.FairShare = c.fairShare()
+		go func() {
+			if err := scheduler.Do(ctx); err != nil && err != ctx.Err() {
+				c.Log.Printf("scheduler: %v", err)
+			}
+		}()
+		config.Scheduler = scheduler
+		return config
+	}
+	runtime, resources := c.containerRuntime()
+	var sess *session.Session
+	c.must(c.Config.Instance(&sess))
+	var secretStore secrets.Secrets
+	if err := c.Config.Instance(&secretStore); err != nil {
+		c.Log.Debugf("secrets: %v", err)
+	}
+	x := &local.Executor{
+		Runtime:       runtime,
+		Secrets:       secretStore,
+		Dir:           localDir,
+		Authenticator: ec2authenticator.New(sess),
+		Blob:          c.blob(),
+		Log:           c.Log.Tee(nil, "executor: "),
+	}
+	x.SetResources(resources)
+	c.must(x.Start())
+	config.Executor = x
+	return config
+}
@@ -0,0 +1,118 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package tool
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/grailbio/reflow/syntax"
+)
+
+func TestRepl(t *testing.T) {
+	dir, err := ioutil.TempDir("", "repl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	module := filepath.Join(dir, "m.rf")
+	if err := ioutil.WriteFile(module, []byte(`param prefix = "x"
+
+// Name returns a prefixed name.
+func Name(s string) = prefix + s
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	r := newRepl(syntax.NewSession(nil), &out)
+	r.histfile = filepath.Join(dir, "history")
+	input := `val x = 1
+x + 1
+:type [x, 2]
+func double(i int) = i * 2
+double(x)
+val strings = make("$/strings")
+:doc strings.Join
+val (a, b) = (1, "s")
+[
+	double(a),
+	2]
+:load ` + module + ` -prefix=y
+Name(b)
+:doc Name
+!5
+undefined
+val f = exec(image := "ubuntu") (out file) {" echo hi > {{out}} "}
+:quit
+x
+`
+	if err := r.run(context.Background(), strings.NewReader(input)); err != nil {
+		t.Fatal(err)
+	}
+	want := `val x int = 1
+2 : int
+[int]
+val double func(i int) int
+2 : int
+val strings module{Split func(s, sep string) [string], Join func(strs [string], sep string) string, HasPrefix, HasSuffix func(s, suffix string) bool, Sort func(strs [string]) [string], FromInt func(intVal int) string, FromFloat func(floattVal float, precision int) string}
+val Join func(strs [string], sep string) string
+    Join concatenates a list of strings into a single string using the provided
+    separator.
+val a int = 1
+val b string = "s"
+[2, 2] : [int]
+loaded ` + module + ` (1 declarations)
+"ys" : string
+val Name func(s string) string
+    Name returns a prefixed name.
+double(x)
+2 : int
+<repl>:1:10: identifier "undefined" not defined
+the value requires flow evaluation, which is not available in this session
+`
+	if got := out.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+
+	// The history persists across sessions.
+	r = newRepl(syntax.NewSession(nil), &out)
+	r.histfile = filepath.Join(dir, "history")
+	if err := r.readHistory(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(r.history), 16; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if got, want := r.history[8], "[\n\tdouble(a),\n\t2]"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestIncomplete(t *testing.T) {
+	for _, c := range []struct {
+		text       string
+		incomplete bool
+	}{
+		{"val x = 1", false},
+		{"val x = {", true},
+		{"[1, 2,", true},
+		{`f("(")`, false},
+		{`"abc`, true},
+		{"`abc", true},
+		{`exec(image := "x") (out file) {"`, true},
+		{`exec(image := "x") (out file) {" echo {{x}} > {{out}} "}`, false},
+		{"1 // (", false},
+	} {
+		if got, want := incomplete(c.text), c.incomplete; got != want {
+			t.Errorf("%q: got %v, want %v", c.text, got, want)
+		}
+	}
+}
@@ -21,7 +21,6 @@ import (
 	"strings"
 	"time"
 
-	"docker.io/go-docker"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/grailbio/base/digest"
@@ -30,6 +29,7 @@ import (
 	"github.com/grailbio/reflow"
 	"github.com/grailbio/reflow/assoc"
 	"github.com/grailbio/reflow/blob"
+	"github.com/grailbio/reflow/blob/fileblob"
 	"github.com/grailbio/reflow/blob/s3blob"
 	"github.com/grailbio/reflow/ec2authenticator"
 	"github.com/grailbio/reflow/errors"
@@ -41,10 +41,12 @@ import (
 	"github.com/grailbio/reflow/repository"
 	"github.com/grailbio/reflow/runner"
 	"github.com/grailbio/reflow/sched"
+	"github.com/grailbio/reflow/secrets"
 	"github.com/grailbio/reflow/syntax"
 	"github.com/grailbio/reflow/taskdb"
 	"github.com/grailbio/reflow/trace"
 	"github.com/grailbio/reflow/types"
+	"github.com/grailbio/reflow/values"
 	"github.com/grailbio/reflow/wg"
 )
 
@@ -58,6 +60,7 @@ type commonRunConfig struct {
 	eval           string
 	invalidate     string
 	assert         string
+	exectimeout    time.Duration
 }
 
 func (r *commonRunConfig) Flags(flags *flag.FlagSet) {
@@ -67,6 +70,7 @@ func (r *commonRunConfig) Flags(flags *flag.FlagSet) {
 	flags.StringVar(&r.eval, "eval", "topdown", "evaluation strategy")
 	flags.StringVar(&r.invalidate, "invalidate", "", "regular expression for node identifiers that should be invalidated")
 	flags.StringVar(&r.assert, "assert", "never", "policy used to assert cached flow result compatibility (eg: never, exact)")
+	flags.DurationVar(&r.exectimeout, "exectimeout", 0, "default timeout of execs that do not define their own (e.g., 12h); zero means no timeout")
 }
 
 func (r *commonRunConfig) Err() error {
@@ -81,6 +85,9 @@ func (r *commonRunConfig) Err() error {
 			return err
 		}
 	}
+	if r.exectimeout < 0 {
+		return fmt.Errorf("invalid exec timeout %s", r.exectimeout)
+	}
 	return nil
 }
 
@@ -92,6 +99,7 @@ func (r *commonRunConfig) Configure(c *flow.EvalConfig, cmd *Cmd) {
 	c.GC = r.gc
 	c.RecomputeEmpty = r.recomputeempty
 	c.BottomUp = r.eval == "bottomup"
+	c.ExecTimeout = r.exectimeout
 	if r.invalidate != "" {
 		re := regexp.MustCompile(r.invalidate)
 		c.Invalidate = func(f *flow.Flow) bool {
@@ -112,6 +120,9 @@ type runConfig struct {
 	sched         bool
 	needAss       bool
 	needRepo      bool
+	graph         string
+	strict        bool
+	output        string
 
 	common commonRunConfig
 }
@@ -125,9 +136,17 @@ func (r *runConfig) Flags(flags *flag.FlagSet) {
 	flags.BoolVar(&r.trace, "trace", false, "trace flow evaluation")
 	flags.StringVar(&r.resourcesFlag, "resources", "", "override offered resources in local mode (JSON formatted reflow.Resources)")
 	flags.BoolVar(&r.sched, "sched", true, "use scalable scheduler instead of work stealing")
+	flags.StringVar(&r.graph, "graph", "", "write the evaluated flow graph to this file (DOT if its suffix is .dot or .gv, JSON otherwise)")
+	flags.BoolVar(&r.strict, "stricttemplates", false, "reject exec templates that interpolate non-constant strings without quoting them")
+	flags.StringVar(&r.output, "output", "text", "format in which the result is printed (text or json)")
 }
 
 func (r *runConfig) Err() error {
+	switch r.output {
+	case "text", "json":
+	default:
+		return fmt.Errorf("invalid output format %s", r.output)
+	}
 	if r.local {
 		r.sched = false
 		if r.alloc != "" {
@@ -178,6 +197,29 @@ Reflow logs abbreviated task summaries for execs, interns, and
 externs. On error, or if the logging level is set to debug, the full
 task state is printed together with context.
 
+The flag -graph writes the evaluated flow graph, including each
+node's state transitions, cache status, and requested and used
+resources, to the given file, in Graphviz DOT format if the file name
+has the suffix ".dot" or ".gv", and in JSON otherwise. The graph is
+also saved with the run's transcript, and may later be retrieved with
+"reflow info -graph runid".
+
+The result of the evaluation is printed to standard output. With
+-output=json, it is instead encoded as JSON, according to its type:
+ints and floats are JSON numbers (of arbitrary precision); lists and
+tuples are arrays; structs and modules are objects; maps with
+string, int, float, or bool keys are objects, other maps are arrays
+of [key, value] pairs; sum values are objects {"tag": tag, "elem":
+elem}; and files, dirs, and filesets are objects containing their
+digests, sizes, and source URLs. The encoded result is also stored
+in the run's state, and may be retrieved with "reflow info -result
+runid".
+
+Execs may define a timeout (e.g., exec(image := "x", timeout := "2h"));
+execs that exceed their timeout are killed, fail with an "exec timed
+out" error, and are retried according to their retry policy. Flag
+-exectimeout sets the timeout of execs that do not define their own.
+
 Run exits with an error code according to evaluation status. Exit
 code 10 indicates a transient runtime error. Exit codes greater than
 10 indicate errors during program evaluation, which are likely not
@@ -196,7 +238,8 @@ retriable.`
 	}
 	file, args := flags.Arg(0), flags.Args()[1:]
 	e := Eval{
-		InputArgs: flags.Args(),
+		InputArgs:       flags.Args(),
+		StrictTemplates: config.strict,
 	}
 	err := c.Eval(&e)
 	if e.V1 && config.common.gc {
@@ -222,7 +265,7 @@ retriable.`
 func (c *Cmd) runCommon(ctx context.Context, config runConfig, e Eval, file string, args []string) {
 	// In the case where a flow is immediate, we print the result and quit.
 	if e.Main().Op == flow.Val {
-		c.Println(sprintval(e.Main().Value, e.MainType()))
+		c.printResult(config.output, e.Main().Value, e.MainType())
 		c.Exit(0)
 	}
 	// Construct a unique name for this run, used to identify this invocation
@@ -362,6 +405,7 @@ func (c *Cmd) runCommon(ctx context.Context, config runConfig, e Eval, file stri
 		scheduler.Log = c.Log.Prefix("scheduler: ")
 		scheduler.MinAlloc.Max(scheduler.MinAlloc, e.Main().Requirements().Min)
 		scheduler.TaskDB = tdb
+		scheduler.FairShare = c.fairShare()
 		var schedctx context.Context
 		schedctx, donecancel = context.WithCancel(ctx)
 		wg.Add(1)
@@ -389,6 +433,7 @@ func (c *Cmd) runCommon(ctx context.Context, config runConfig, e Eval, file stri
 			ImageMap:           e.ImageMap,
 			TaskDB:             tdb,
 			RunID:              runID,
+			RecordGraph:        config.graph != "",
 		},
 		Type:    e.MainType(),
 		Labels:  make(pool.Labels),
@@ -425,11 +470,21 @@ func (c *Cmd) runCommon(ctx context.Context, config runConfig, e Eval, file stri
 			c.Log.Errorf("failed to marshal state: %v", err)
 		}
 	}
-	if run.Err != nil {
+	switch {
+	case run.Err != nil:
 		c.Errorln(run.Err)
-	} else {
+	case config.output == "json":
+		if len(run.ResultJSON) == 0 {
+			c.Errorln("result of type", run.ResultType, "cannot be encoded as JSON")
+		} else {
+			c.Println(string(run.ResultJSON))
+		}
+	default:
 		c.Println(run.Result)
 	}
+	if run.Graph != nil {
+		c.saveGraph(base, config.graph, run.Graph)
+	}
 	if donecancel != nil {
 		donecancel()
 	}
@@ -450,7 +505,7 @@ func (c *Cmd) runCommon(ctx context.Context, config runConfig, e Eval, file stri
 }
 
 func (c *Cmd) runLocal(ctx context.Context, config runConfig, execLogger *log.Logger, runID taskdb.RunID, f *flow.Flow, typ *types.T, imageMap map[string]string, cmdline string, ass assoc.Assoc, repo reflow.Repository, tdb taskdb.TaskDB, cache *infra.CacheProvider) {
-	client, resources := c.dockerClient()
+	runtime, resources := c.containerRuntime()
 
 	var sess *session.Session
 	c.must(c.Config.Instance(&sess))
@@ -474,8 +529,13 @@ func (c *Cmd) runLocal(ctx context.Context, config runConfig, execLogger *log.Lo
 	if config.dir != "" {
 		dir = config.dir
 	}
+	var secretStore secrets.Secrets
+	if err := c.Config.Instance(&secretStore); err != nil {
+		c.Log.Debugf("secrets: %v", err)
+	}
 	x := &local.Executor{
-		Client:        client,
+		Runtime:       runtime,
+		Secrets:       secretStore,
 		Dir:           dir,
 		Authenticator: ec2authenticator.New(sess),
 		AWSImage:      string(*awstool),
@@ -508,6 +568,7 @@ func (c *Cmd) runLocal(ctx context.Context, config runConfig, execLogger *log.Lo
 		ImageMap:           imageMap,
 		TaskDB:             tdb,
 		RunID:              runID,
+		RecordGraph:        config.graph != "",
 	}
 	config.common.Configure(&evalConfig, c)
 	if config.trace {
@@ -522,7 +583,11 @@ func (c *Cmd) runLocal(ctx context.Context, config runConfig, execLogger *log.Lo
 	if len(traceid) > 0 {
 		c.Log.Printf("Trace ID: %v", traceid)
 	}
-	if err := eval.Do(ctx); err != nil {
+	err := eval.Do(ctx)
+	if config.graph != "" {
+		c.saveGraph(c.Runbase(runID), config.graph, eval.Graph())
+	}
+	if err != nil {
 		c.Errorln(err)
 		if errors.Restartable(err) {
 			c.Exit(10)
@@ -536,10 +601,28 @@ func (c *Cmd) runLocal(ctx context.Context, config runConfig, execLogger *log.Lo
 		c.Exit(11)
 	}
 	eval.LogSummary(c.Log)
-	c.Println(sprintval(eval.Value(), typ))
+	c.printResult(config.output, eval.Value(), typ)
 	c.Exit(0)
 }
 
+// printResult prints the result v of type t in the provided output
+// format. Results of legacy programs, for which t is nil, are
+// filesets.
+func (c *Cmd) printResult(output string, v values.T, t *types.T) {
+	if output != "json" {
+		c.Println(sprintval(v, t))
+		return
+	}
+	if t == nil {
+		t = types.Fileset
+	}
+	b, err := values.MarshalJSON(v, t)
+	if err != nil {
+		c.Fatalf("encode result: %v", err)
+	}
+	c.Println(string(b))
+}
+
 // rundir returns the directory that stores run state, creating it if necessary.
 func (c *Cmd) rundir() string {
 	var rundir string
@@ -642,31 +725,46 @@ func (c Cmd) blob() blob.Mux {
 		c.Fatal(err)
 	}
 	return blob.Mux{
-		"s3": s3blob.New(sess),
+		"s3":   s3blob.New(sess),
+		"file": fileblob.New("/"),
 	}
 }
 
-func (c Cmd) dockerClient() (*docker.Client, reflow.Resources) {
-	addr := os.Getenv("DOCKER_HOST")
-	if addr == "" {
-		addr = "unix:///var/run/docker.sock"
+// fairShare returns the configured fair-share policy of the
+// scheduler, or nil if none is configured.
+func (c Cmd) fairShare() *sched.FairShare {
+	if name, _, _ := c.Config.Keys.String(infra.FairShare); name == "" {
+		return nil
 	}
-	client, err := docker.NewClient(
-		addr, "1.22", /*client.DefaultVersion*/
-		nil, map[string]string{"user-agent": "reflow"})
-	if err != nil {
-		c.Fatal(err)
+	var policy *sched.FairShare
+	c.must(c.Config.Instance(&policy))
+	return policy
+}
+
+// containerRuntime returns the configured container runtime and the
+// resources available to it. If no runtime is configured, the local
+// Docker daemon is used; a misconfigured runtime is fatal.
+func (c Cmd) containerRuntime() (local.ContainerRuntime, reflow.Resources) {
+	var runtime local.ContainerRuntime
+	if name, _, _ := c.Config.Keys.String(infra.Runtime); name != "" {
+		if err := c.Config.Instance(&runtime); err != nil {
+			c.Fatalf("container runtime %s: %v", name, err)
+		}
+	} else {
+		dr := new(local.DockerRuntime)
+		c.must(dr.Init())
+		runtime = dr
 	}
-	info, err := client.Info(context.Background())
+	info, err := runtime.Resources(context.Background())
 	if err != nil {
 		c.Fatal(err)
 	}
 	resources := reflow.Resources{
-		"mem":  math.Floor(float64(info.MemTotal) * 0.95),
-		"cpu":  float64(info.NCPU),
+		"mem":  math.Floor(info["mem"] * 0.95),
+		"cpu":  info["cpu"],
 		"disk": 1e13, // Assume 10TB. TODO(marius): real disk management
 	}
-	return client, resources
+	return runtime, resources
 }
 
 func getBundle(file string) (io.ReadCloser, digest.Digest, error) {
@@ -111,13 +111,13 @@ func (c *Cmd) makeTestExecutor(executor **local.Executor) {
 	if *executor != nil {
 		return
 	}
-	client, resources := c.dockerClient()
+	runtime, resources := c.containerRuntime()
 	var sess *session.Session
 	c.must(c.Config.Instance(&sess))
 	var creds *credentials.Credentials
 	c.must(c.Config.Instance(&creds))
 	*executor = &local.Executor{
-		Client:        client,
+		Runtime:       runtime,
 		Dir:           defaultFlowDir,
 		Authenticator: ec2authenticator.New(sess),
 		AWSCreds:      creds,
@@ -0,0 +1,63 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package tool
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"strings"
+
+	"github.com/grailbio/reflow/syntax"
+	"github.com/grailbio/reflow/vet"
+)
+
+func (c *Cmd) vet(ctx context.Context, args ...string) {
+	flags := flag.NewFlagSet("vet", flag.ExitOnError)
+	jsonFlag := flags.Bool("json", false, "print findings as JSON, one per line")
+	help := `Vet type checks the provided modules and reports suspicious
+constructs that are legal but likely mistakes. The following checks
+are performed:
+
+	` + strings.Join(vet.Checks, "\n\t") + `
+
+Findings may be suppressed by a "// vet:ignore check[, check...]"
+comment on the offending line or on the line preceding it; the
+comment suppresses all findings when no checks are named.
+
+Vet exits with code 1 if any findings are reported, and with code 2
+if a module fails to type check.`
+	c.Parse(flags, args, help, "vet [-json] modules...")
+	if flags.NArg() == 0 {
+		flags.Usage()
+	}
+	var (
+		n      int
+		failed bool
+		enc    = json.NewEncoder(c.Stdout)
+	)
+	for _, path := range flags.Args() {
+		findings, err := vet.Vet(syntax.NewSession(nil), path)
+		if err != nil {
+			c.Errorln(err)
+			failed = true
+			continue
+		}
+		for _, f := range findings {
+			if *jsonFlag {
+				c.must(enc.Encode(f))
+			} else {
+				c.Println(f.String())
+			}
+		}
+		n += len(findings)
+	}
+	switch {
+	case failed:
+		c.Exit(2)
+	case n > 0:
+		c.Exit(1)
+	}
+}
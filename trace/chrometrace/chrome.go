@@ -0,0 +1,276 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+// Package chrometrace implements a Reflow tracer that writes trace
+// events in the Chrome Trace Event Format. The resulting files may be
+// viewed in chrome://tracing or in Perfetto (https://ui.perfetto.dev).
+//
+// Spans are written as complete ("X") events when they end, with the
+// span's notes as event arguments. Concurrent spans are laid out on
+// separate threads (lanes) so that they display as a timeline.
+// Events are streamed to the trace file as they occur, using the JSON
+// Array Format. The array is terminated, and the trace file closed,
+// when the run's span ends (or when the tracer is closed).
+package chrometrace
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/grailbio/infra"
+	"github.com/grailbio/reflow/errors"
+	"github.com/grailbio/reflow/trace"
+)
+
+func init() {
+	infra.Register("chrometrace", new(Tracer))
+}
+
+// Tracer is a trace.Tracer that writes trace events to a file in the
+// Chrome Trace Event Format.
+type Tracer struct {
+	// Path is the path of the trace file.
+	Path string
+
+	mu     sync.Mutex
+	w      io.Writer
+	file   *os.File
+	closed bool
+	n      int
+	pid    int
+	spans  map[[8]byte]*span
+	lanes  []bool
+}
+
+// span is a span that has started but not yet ended.
+type span struct {
+	trace.SpanContext
+	parent trace.SpanContext
+	kind   trace.Kind
+	name   string
+	id     string
+	start  time.Time
+	lane   int
+	args   map[string]interface{}
+}
+
+// event is a Chrome trace event.
+type event struct {
+	Name  string                 `json:"name"`
+	Cat   string                 `json:"cat"`
+	Phase string                 `json:"ph"`
+	Ts    int64                  `json:"ts"`
+	Dur   int64                  `json:"dur"`
+	Pid   int                    `json:"pid"`
+	Tid   int                    `json:"tid"`
+	Args  map[string]interface{} `json:"args,omitempty"`
+}
+
+// New returns a new tracer that writes trace events to w.
+func New(w io.Writer) *Tracer {
+	t := &Tracer{w: w}
+	t.init()
+	return t
+}
+
+// Help implements infra.Provider.
+func (*Tracer) Help() string {
+	return "write trace events in the Chrome Trace Event Format (viewable in Perfetto) to a file"
+}
+
+// Flags implements infra.Provider.
+func (t *Tracer) Flags(flags *flag.FlagSet) {
+	flags.StringVar(&t.Path, "path", "reflow.trace.json", "path of the trace file")
+}
+
+// Init implements infra.Provider.
+func (t *Tracer) Init() error {
+	if t.Path == "" {
+		return errors.E("chrometrace", errors.Invalid, errors.New("no trace file path provided"))
+	}
+	f, err := os.Create(t.Path)
+	if err != nil {
+		return errors.E("chrometrace", t.Path, err)
+	}
+	t.w = f
+	t.file = f
+	t.init()
+	return nil
+}
+
+func (t *Tracer) init() {
+	t.pid = os.Getpid()
+	t.spans = make(map[[8]byte]*span)
+}
+
+// Emit implements trace.Tracer.
+func (t *Tracer) Emit(ctx context.Context, e trace.Event) (context.Context, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return ctx, nil
+	}
+	switch e.Kind {
+	case trace.StartEvent:
+		parent, _ := trace.SpanContextFrom(ctx)
+		s := &span{
+			SpanContext: trace.NewSpanContext(parent),
+			parent:      parent,
+			kind:        e.SpanKind,
+			name:        e.Name,
+			id:          e.Id.String(),
+			start:       e.Time,
+			lane:        t.allocLane(),
+			args:        make(map[string]interface{}),
+		}
+		t.spans[s.SpanID] = s
+		return trace.WithSpanContext(ctx, s.SpanContext), nil
+	case trace.EndEvent:
+		s, err := t.span(ctx)
+		if err != nil {
+			return ctx, err
+		}
+		delete(t.spans, s.SpanID)
+		t.lanes[s.lane] = false
+		s.args["id"] = s.id
+		s.args["trace"] = s.TraceIDString()
+		s.args["span"] = s.SpanIDString()
+		if s.parent.IsValid() {
+			s.args["parent"] = s.parent.SpanIDString()
+		}
+		err = t.write(event{
+			Name:  s.name,
+			Cat:   s.kind.String(),
+			Phase: "X",
+			Ts:    s.start.UnixNano() / 1e3,
+			Dur:   int64(e.Time.Sub(s.start) / time.Microsecond),
+			Pid:   t.pid,
+			Tid:   s.lane,
+			Args:  s.args,
+		})
+		if err == nil && s.kind == trace.Run {
+			// The process commonly exits soon after a run completes;
+			// complete the trace file before returning.
+			err = t.closeLocked()
+		}
+		return ctx, err
+	case trace.NoteEvent:
+		if sc, ok := trace.SpanContextFrom(ctx); ok && t.spans[sc.SpanID] == nil {
+			// The current span is a remote span adopted from an HTTP
+			// request (see trace.Handler); its notes are recorded by
+			// the remote tracer, if at all.
+			return ctx, nil
+		}
+		s, err := t.span(ctx)
+		if err != nil {
+			return ctx, err
+		}
+		s.args[e.Key] = e.Value
+	}
+	return ctx, nil
+}
+
+// Close terminates the trace's JSON array and closes the trace file,
+// if it was opened by the tracer. Events emitted after Close are
+// dropped.
+func (t *Tracer) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.closeLocked()
+}
+
+// closeLocked closes the tracer. It must be called with t.mu held.
+func (t *Tracer) closeLocked() error {
+	if t.closed {
+		return nil
+	}
+	t.closed = true
+	end := "\n]\n"
+	if t.n == 0 {
+		end = "[]\n"
+	}
+	_, err := io.WriteString(t.w, end)
+	if t.file != nil {
+		if cerr := t.file.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// WriteHTTPContext implements trace.Tracer.
+func (t *Tracer) WriteHTTPContext(ctx context.Context, h *http.Header) {
+	trace.WriteSpanContext(ctx, h)
+}
+
+// ReadHTTPContext implements trace.Tracer.
+func (t *Tracer) ReadHTTPContext(ctx context.Context, h http.Header) context.Context {
+	return trace.ReadSpanContext(ctx, h)
+}
+
+// CopyTraceContext implements trace.Tracer.
+func (t *Tracer) CopyTraceContext(src, dst context.Context) context.Context {
+	return trace.CopySpanContext(src, dst)
+}
+
+// URL returns the URL of the trace file.
+func (t *Tracer) URL(ctx context.Context) string {
+	if t.Path == "" {
+		return ""
+	}
+	path, err := filepath.Abs(t.Path)
+	if err != nil {
+		path = t.Path
+	}
+	return "file://" + path
+}
+
+// span returns the current span of ctx. It must be called with t.mu held.
+func (t *Tracer) span(ctx context.Context) (*span, error) {
+	sc, ok := trace.SpanContextFrom(ctx)
+	if !ok {
+		return nil, errors.E("chrometrace", errors.NotExist, errors.New("no current span"))
+	}
+	s := t.spans[sc.SpanID]
+	if s == nil {
+		return nil, errors.E("chrometrace", sc.SpanIDString(), errors.NotExist, errors.New("span not found"))
+	}
+	return s, nil
+}
+
+// allocLane returns the lowest unused lane. It must be called with
+// t.mu held.
+func (t *Tracer) allocLane() int {
+	for i, used := range t.lanes {
+		if !used {
+			t.lanes[i] = true
+			return i
+		}
+	}
+	t.lanes = append(t.lanes, true)
+	return len(t.lanes) - 1
+}
+
+// write writes event e to the trace file. It must be called with t.mu held.
+func (t *Tracer) write(e event) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if t.n == 0 {
+		b = append([]byte("[\n"), b...)
+	} else {
+		b = append([]byte(",\n"), b...)
+	}
+	t.n++
+	_, err = t.w.Write(b)
+	return err
+}
@@ -0,0 +1,131 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package chrometrace
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/grailbio/base/digest"
+	"github.com/grailbio/infra"
+	"github.com/grailbio/reflow"
+	"github.com/grailbio/reflow/trace"
+)
+
+func TestChromeTracer(t *testing.T) {
+	var b bytes.Buffer
+	tracer := New(&b)
+	ctx := trace.WithTracer(context.Background(), tracer)
+	ctx, endRun := trace.Start(ctx, trace.Run, reflow.Digester.FromString("run"), "run")
+
+	// Propagate the run's context over HTTP, as is done for reflowlets.
+	h := make(http.Header)
+	trace.WriteHTTPContext(ctx, &h)
+	remote := trace.ReadHTTPContext(trace.WithTracer(context.Background(), tracer), h)
+	// Notes on a span adopted from another process are ignored.
+	other := New(ioutil.Discard)
+	adopted := trace.ReadHTTPContext(trace.WithTracer(context.Background(), other), h)
+	if _, err := other.Emit(adopted, trace.Event{Kind: trace.NoteEvent, Key: "remote", Value: true}); err != nil {
+		t.Errorf("note on remote span: %v", err)
+	}
+	remote, endExec := trace.Start(remote, trace.Exec, reflow.Digester.FromString("exec"), "exec")
+	trace.Note(remote, "ident", "main.exec")
+	_, endCache := trace.Start(ctx, trace.Cache, digest.Digest{}, "cache")
+	endCache()
+	endExec()
+	endRun()
+
+	var events []event
+	// The trace is complete once the run ends.
+	if err := json.Unmarshal(b.Bytes(), &events); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(events), 3; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	byName := make(map[string]event)
+	for _, e := range events {
+		if e.Phase != "X" {
+			t.Errorf("event %s: got phase %q, want X", e.Name, e.Phase)
+		}
+		byName[e.Name] = e
+	}
+	run, exec, cache := byName["run"], byName["exec"], byName["cache"]
+	if got, want := run.Cat, "Run"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if _, ok := run.Args["parent"]; ok {
+		t.Error("run span has a parent")
+	}
+	for _, e := range []event{exec, cache} {
+		if got, want := e.Args["parent"], run.Args["span"]; got != want {
+			t.Errorf("%s: got parent %v, want %v", e.Name, got, want)
+		}
+		if got, want := e.Args["trace"], run.Args["trace"]; got != want {
+			t.Errorf("%s: got trace %v, want %v", e.Name, got, want)
+		}
+	}
+	if got, want := exec.Args["ident"], "main.exec"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	// The exec and cache spans overlap, and so must be on separate lanes.
+	if exec.Tid == cache.Tid {
+		t.Errorf("overlapping spans share lane %d", exec.Tid)
+	}
+	// Events after the run has ended are dropped.
+	n := b.Len()
+	_, end := trace.Start(ctx, trace.Cache, digest.Digest{}, "late")
+	end()
+	if got, want := b.Len(), n; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestChromeTracerInfra(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chrometrace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var schema = infra.Schema{
+		"tracer": new(trace.Tracer),
+	}
+	config, err := schema.Make(infra.Keys{
+		"tracer": "chrometrace,path=" + filepath.Join(dir, "trace.json"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tracer trace.Tracer
+	config.Must(&tracer)
+	chrome, ok := tracer.(*Tracer)
+	if !ok {
+		t.Fatalf("%v is not a chrometrace", reflect.TypeOf(tracer))
+	}
+	ctx := trace.WithTracer(context.Background(), tracer)
+	_, end := trace.Start(ctx, trace.Exec, reflow.Digester.FromString("exec"), "exec")
+	end()
+	if err := chrome.Close(); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, "trace.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var events []event
+	if err := json.Unmarshal(b, &events); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(events), 1; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
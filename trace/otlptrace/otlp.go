@@ -0,0 +1,371 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+// Package otlptrace implements a Reflow tracer that exports spans to
+// an OpenTelemetry collector using OTLP over HTTP (JSON encoding).
+//
+// Each Reflow span (Run, Exec, Cache, Transfer) is exported as an
+// OTLP span whose attributes are the span's notes. Trace context is
+// propagated across processes with the W3C traceparent header, so
+// that spans emitted by reflowlets nest under the run that invoked
+// them.
+package otlptrace
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/grailbio/infra"
+	"github.com/grailbio/reflow/errors"
+	"github.com/grailbio/reflow/log"
+	"github.com/grailbio/reflow/trace"
+)
+
+func init() {
+	infra.Register("otlp", new(Tracer))
+}
+
+const (
+	// maxBatch is the number of spans after which a batch is exported.
+	maxBatch = 512
+	// maxPending is the maximum number of spans buffered for export;
+	// spans are dropped when it is exceeded.
+	maxPending = 1 << 16
+	// exportInterval is the interval at which spans are exported.
+	exportInterval = 5 * time.Second
+	// flushTimeout is the maximum time spent exporting spans when
+	// a run completes.
+	flushTimeout = 10 * time.Second
+)
+
+// Tracer is a trace.Tracer that exports spans to an OTLP/HTTP
+// endpoint. Spans are exported asynchronously, in batches.
+type Tracer struct {
+	// Endpoint is the URL to which spans are exported, e.g.,
+	// http://localhost:4318/v1/traces.
+	Endpoint string
+	// Service is the service name reported with exported spans.
+	Service string
+	// Client is the HTTP client used to export spans. If nil,
+	// http.DefaultClient is used.
+	Client *http.Client
+
+	mu      sync.Mutex
+	spans   map[[8]byte]*span
+	pending []*span
+	flushc  chan chan struct{}
+	once    sync.Once
+}
+
+// span is a span in progress or awaiting export.
+type span struct {
+	trace.SpanContext
+	parent trace.SpanContext
+	kind   trace.Kind
+	name   string
+	start  time.Time
+	end    time.Time
+	attrs  []attribute
+}
+
+// Help implements infra.Provider.
+func (*Tracer) Help() string {
+	return "export trace spans to an OpenTelemetry collector using OTLP over HTTP"
+}
+
+// Flags implements infra.Provider.
+func (t *Tracer) Flags(flags *flag.FlagSet) {
+	flags.StringVar(&t.Endpoint, "endpoint", "http://localhost:4318/v1/traces", "OTLP/HTTP traces endpoint")
+	flags.StringVar(&t.Service, "service", "reflow", "service name of exported spans")
+}
+
+// Init implements infra.Provider.
+func (t *Tracer) Init() error {
+	if t.Endpoint == "" {
+		return errors.E("otlptrace", errors.Invalid, errors.New("no endpoint provided"))
+	}
+	t.start()
+	return nil
+}
+
+func (t *Tracer) start() {
+	t.once.Do(func() {
+		if t.Service == "" {
+			t.Service = "reflow"
+		}
+		t.spans = make(map[[8]byte]*span)
+		t.flushc = make(chan chan struct{})
+		go t.loop()
+	})
+}
+
+// Emit implements trace.Tracer.
+func (t *Tracer) Emit(ctx context.Context, e trace.Event) (context.Context, error) {
+	t.start()
+	var flush bool
+	t.mu.Lock()
+	switch e.Kind {
+	case trace.StartEvent:
+		parent, _ := trace.SpanContextFrom(ctx)
+		s := &span{
+			SpanContext: trace.NewSpanContext(parent),
+			parent:      parent,
+			kind:        e.SpanKind,
+			name:        e.Name,
+			start:       e.Time,
+			attrs: []attribute{
+				newAttribute("reflow.kind", e.SpanKind.String()),
+				newAttribute("reflow.id", e.Id.String()),
+			},
+		}
+		t.spans[s.SpanID] = s
+		ctx = trace.WithSpanContext(ctx, s.SpanContext)
+	case trace.EndEvent:
+		s, err := t.span(ctx)
+		if err != nil {
+			t.mu.Unlock()
+			return ctx, err
+		}
+		delete(t.spans, s.SpanID)
+		s.end = e.Time
+		if len(t.pending) < maxPending {
+			t.pending = append(t.pending, s)
+		}
+		if len(t.pending) >= maxBatch {
+			go t.Flush(context.Background())
+		}
+		flush = e.SpanKind == trace.Run
+	case trace.NoteEvent:
+		s, err := t.span(ctx)
+		if err != nil {
+			t.mu.Unlock()
+			return ctx, err
+		}
+		s.attrs = append(s.attrs, newAttribute(e.Key, e.Value))
+	}
+	t.mu.Unlock()
+	if flush {
+		// The process commonly exits soon after a run completes;
+		// export its spans before returning.
+		fctx, cancel := context.WithTimeout(context.Background(), flushTimeout)
+		defer cancel()
+		if err := t.Flush(fctx); err != nil {
+			return ctx, err
+		}
+	}
+	return ctx, nil
+}
+
+// Flush exports all completed spans. It returns when the spans have
+// been exported or when the context is done.
+func (t *Tracer) Flush(ctx context.Context) error {
+	t.start()
+	done := make(chan struct{})
+	select {
+	case t.flushc <- done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// WriteHTTPContext implements trace.Tracer.
+func (t *Tracer) WriteHTTPContext(ctx context.Context, h *http.Header) {
+	trace.WriteSpanContext(ctx, h)
+}
+
+// ReadHTTPContext implements trace.Tracer.
+func (t *Tracer) ReadHTTPContext(ctx context.Context, h http.Header) context.Context {
+	return trace.ReadSpanContext(ctx, h)
+}
+
+// CopyTraceContext implements trace.Tracer.
+func (t *Tracer) CopyTraceContext(src, dst context.Context) context.Context {
+	return trace.CopySpanContext(src, dst)
+}
+
+// URL returns the ID of the trace associated with ctx, by which the
+// trace may be found in the tracing backend.
+func (t *Tracer) URL(ctx context.Context) string {
+	s, ok := trace.SpanContextFrom(ctx)
+	if !ok {
+		return ""
+	}
+	return s.TraceIDString()
+}
+
+// span returns the current span of ctx. It must be called with t.mu held.
+func (t *Tracer) span(ctx context.Context) (*span, error) {
+	sc, ok := trace.SpanContextFrom(ctx)
+	if !ok {
+		return nil, errors.E("otlptrace", errors.NotExist, errors.New("no current span"))
+	}
+	s := t.spans[sc.SpanID]
+	if s == nil {
+		return nil, errors.E("otlptrace", sc.SpanIDString(), errors.NotExist, errors.New("span not found"))
+	}
+	return s, nil
+}
+
+func (t *Tracer) loop() {
+	ticker := time.NewTicker(exportInterval)
+	defer ticker.Stop()
+	for {
+		var done chan struct{}
+		select {
+		case <-ticker.C:
+		case done = <-t.flushc:
+		}
+		t.mu.Lock()
+		spans := t.pending
+		t.pending = nil
+		t.mu.Unlock()
+		for len(spans) > 0 {
+			n := len(spans)
+			if n > maxBatch {
+				n = maxBatch
+			}
+			if err := t.export(spans[:n]); err != nil {
+				log.Debugf("otlptrace: export %d spans: %v", n, err)
+			}
+			spans = spans[n:]
+		}
+		if done != nil {
+			close(done)
+		}
+	}
+}
+
+// export exports the provided spans to the tracer's endpoint.
+func (t *Tracer) export(spans []*span) error {
+	req := exportRequest{ResourceSpans: []resourceSpans{{
+		Resource: resource{Attributes: []attribute{newAttribute("service.name", t.Service)}},
+		ScopeSpans: []scopeSpans{{
+			Scope: scope{Name: "github.com/grailbio/reflow/trace"},
+			Spans: make([]otlpSpan, len(spans)),
+		}},
+	}}}
+	for i, s := range spans {
+		o := otlpSpan{
+			TraceID:           s.TraceIDString(),
+			SpanID:            s.SpanIDString(),
+			Name:              s.name,
+			Kind:              spanKindInternal,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+			Attributes:        s.attrs,
+		}
+		if s.parent.IsValid() {
+			o.ParentSpanID = s.parent.SpanIDString()
+		}
+		req.ResourceSpans[0].ScopeSpans[0].Spans[i] = o
+	}
+	b, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	client := t.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Post(t.Endpoint, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return errors.E("otlptrace", t.Endpoint, errors.Net, err)
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return errors.E("otlptrace", t.Endpoint, errors.Errorf("export: %s", resp.Status))
+	}
+	return nil
+}
+
+// The following types implement the JSON encoding of the OTLP
+// ExportTraceServiceRequest message.
+
+const spanKindInternal = 1
+
+type exportRequest struct {
+	ResourceSpans []resourceSpans `json:"resourceSpans"`
+}
+
+type resourceSpans struct {
+	Resource   resource     `json:"resource"`
+	ScopeSpans []scopeSpans `json:"scopeSpans"`
+}
+
+type resource struct {
+	Attributes []attribute `json:"attributes"`
+}
+
+type scopeSpans struct {
+	Scope scope      `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type scope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string      `json:"traceId"`
+	SpanID            string      `json:"spanId"`
+	ParentSpanID      string      `json:"parentSpanId,omitempty"`
+	Name              string      `json:"name"`
+	Kind              int         `json:"kind"`
+	StartTimeUnixNano string      `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string      `json:"endTimeUnixNano"`
+	Attributes        []attribute `json:"attributes,omitempty"`
+}
+
+type attribute struct {
+	Key   string         `json:"key"`
+	Value attributeValue `json:"value"`
+}
+
+type attributeValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+// newAttribute returns an attribute for the provided key and value.
+// Values of types other than strings, booleans, and numbers are
+// formatted as strings.
+func newAttribute(key string, value interface{}) attribute {
+	a := attribute{Key: key}
+	switch v := value.(type) {
+	case string:
+		a.Value.StringValue = &v
+	case bool:
+		a.Value.BoolValue = &v
+	case int:
+		s := strconv.FormatInt(int64(v), 10)
+		a.Value.IntValue = &s
+	case int64:
+		s := strconv.FormatInt(v, 10)
+		a.Value.IntValue = &s
+	case float64:
+		a.Value.DoubleValue = &v
+	default:
+		s := fmt.Sprint(v)
+		a.Value.StringValue = &s
+	}
+	return a
+}
@@ -0,0 +1,112 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package otlptrace
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/grailbio/infra"
+	"github.com/grailbio/reflow"
+	"github.com/grailbio/reflow/trace"
+)
+
+func TestOTLPTracer(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		spans []otlpSpan
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req exportRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if got, want := *req.ResourceSpans[0].Resource.Attributes[0].Value.StringValue, "test"; got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+		mu.Lock()
+		spans = append(spans, req.ResourceSpans[0].ScopeSpans[0].Spans...)
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	tracer := &Tracer{Endpoint: srv.URL, Service: "test"}
+	if err := tracer.Init(); err != nil {
+		t.Fatal(err)
+	}
+	ctx := trace.WithTracer(context.Background(), tracer)
+	ctx, endRun := trace.Start(ctx, trace.Run, reflow.Digester.FromString("run"), "run")
+	h := make(http.Header)
+	trace.WriteHTTPContext(ctx, &h)
+	remote := trace.ReadHTTPContext(trace.WithTracer(context.Background(), tracer), h)
+	remote, endTransfer := trace.Start(remote, trace.Transfer, reflow.Digester.FromString("transfer"), "transfer")
+	trace.Note(remote, "size", float64(1024))
+	trace.Note(remote, "files", "a, b")
+	endTransfer()
+	endRun()
+	if err := tracer.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := trace.URL(ctx), tracer.URL(ctx); got != want || got == "" {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if got, want := len(spans), 2; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	byName := make(map[string]otlpSpan)
+	for _, s := range spans {
+		byName[s.Name] = s
+	}
+	run, transfer := byName["run"], byName["transfer"]
+	if run.ParentSpanID != "" {
+		t.Errorf("run span has parent %s", run.ParentSpanID)
+	}
+	if got, want := transfer.ParentSpanID, run.SpanID; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := transfer.TraceID, run.TraceID; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	attrs := make(map[string]attributeValue)
+	for _, a := range transfer.Attributes {
+		attrs[a.Key] = a.Value
+	}
+	if v := attrs["reflow.kind"].StringValue; v == nil || *v != "Transfer" {
+		t.Errorf("bad reflow.kind attribute %v", attrs["reflow.kind"])
+	}
+	if v := attrs["size"].DoubleValue; v == nil || *v != 1024 {
+		t.Errorf("bad size attribute %v", attrs["size"])
+	}
+	if v := attrs["files"].StringValue; v == nil || *v != "a, b" {
+		t.Errorf("bad files attribute %v", attrs["files"])
+	}
+}
+
+func TestOTLPTracerInfra(t *testing.T) {
+	var schema = infra.Schema{
+		"tracer": new(trace.Tracer),
+	}
+	config, err := schema.Make(infra.Keys{
+		"tracer": "otlp,endpoint=http://localhost:4318/v1/traces",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tracer trace.Tracer
+	config.Must(&tracer)
+	if _, ok := tracer.(*Tracer); !ok {
+		t.Fatalf("%v is not an otlptrace", reflect.TypeOf(tracer))
+	}
+}
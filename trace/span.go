@@ -0,0 +1,142 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package trace
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// TraceparentHeader is the HTTP header used to propagate span
+// contexts, as defined by W3C Trace Context.
+const TraceparentHeader = "traceparent"
+
+// SpanContext identifies a span within a trace. Tracers that
+// propagate W3C Trace Context may use SpanContexts to track spans
+// across processes.
+type SpanContext struct {
+	// TraceID is the ID of the trace to which the span belongs.
+	TraceID [16]byte
+	// SpanID is the ID of the span.
+	SpanID [8]byte
+}
+
+// NewSpanContext returns a new span context for a child of the
+// provided parent span. If the parent is not valid, the returned
+// span begins a new trace.
+func NewSpanContext(parent SpanContext) SpanContext {
+	var s SpanContext
+	if parent.IsValid() {
+		s.TraceID = parent.TraceID
+	} else {
+		mustRead(s.TraceID[:])
+	}
+	mustRead(s.SpanID[:])
+	return s
+}
+
+// IsValid tells whether s identifies a span.
+func (s SpanContext) IsValid() bool {
+	return s.TraceID != [16]byte{} && s.SpanID != [8]byte{}
+}
+
+// TraceIDString returns the hex encoding of the span's trace ID.
+func (s SpanContext) TraceIDString() string {
+	return hex.EncodeToString(s.TraceID[:])
+}
+
+// SpanIDString returns the hex encoding of the span's ID.
+func (s SpanContext) SpanIDString() string {
+	return hex.EncodeToString(s.SpanID[:])
+}
+
+// String returns the span context formatted as a traceparent header
+// value.
+func (s SpanContext) String() string {
+	return fmt.Sprintf("00-%s-%s-01", s.TraceIDString(), s.SpanIDString())
+}
+
+// ParseSpanContext parses a span context from a traceparent header
+// value.
+func ParseSpanContext(v string) (SpanContext, error) {
+	var s SpanContext
+	parts := strings.Split(v, "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return s, fmt.Errorf("invalid traceparent %q", v)
+	}
+	if _, err := hex.Decode(s.TraceID[:], []byte(parts[1])); err != nil || len(parts[1]) != 2*len(s.TraceID) {
+		return s, fmt.Errorf("invalid trace ID in traceparent %q", v)
+	}
+	if _, err := hex.Decode(s.SpanID[:], []byte(parts[2])); err != nil || len(parts[2]) != 2*len(s.SpanID) {
+		return s, fmt.Errorf("invalid span ID in traceparent %q", v)
+	}
+	if !s.IsValid() {
+		return s, fmt.Errorf("invalid traceparent %q", v)
+	}
+	return s, nil
+}
+
+// WithSpanContext returns a context with the provided span context.
+func WithSpanContext(ctx context.Context, s SpanContext) context.Context {
+	return context.WithValue(ctx, spanKey, s)
+}
+
+// SpanContextFrom returns the span context associated with the
+// provided context, if any.
+func SpanContextFrom(ctx context.Context) (SpanContext, bool) {
+	s, ok := ctx.Value(spanKey).(SpanContext)
+	return s, ok
+}
+
+// WriteSpanContext writes the span context associated with ctx, if
+// any, to the traceparent header in h.
+func WriteSpanContext(ctx context.Context, h *http.Header) {
+	if s, ok := SpanContextFrom(ctx); ok {
+		h.Set(TraceparentHeader, s.String())
+	}
+}
+
+// ReadSpanContext returns a context with the span context stored in
+// the traceparent header in h. The returned context's span is the
+// parent of spans started with it. ReadSpanContext returns ctx
+// unchanged if h does not contain a valid span context.
+func ReadSpanContext(ctx context.Context, h http.Header) context.Context {
+	s, err := ParseSpanContext(h.Get(TraceparentHeader))
+	if err != nil {
+		return ctx
+	}
+	return WithSpanContext(ctx, s)
+}
+
+// CopySpanContext copies the span context, if any, from src to dst.
+func CopySpanContext(src, dst context.Context) context.Context {
+	if s, ok := SpanContextFrom(src); ok {
+		return WithSpanContext(dst, s)
+	}
+	return dst
+}
+
+// Handler returns an http.Handler that serves requests with h. The
+// requests' contexts emit trace events to the provided tracer, and
+// carry the trace context (if any) propagated in the request headers,
+// so that spans started while serving the request are children of
+// the caller's span.
+func Handler(tracer Tracer, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := WithTracer(r.Context(), tracer)
+		ctx = ReadHTTPContext(ctx, r.Header)
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func mustRead(b []byte) {
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+}
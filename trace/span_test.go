@@ -0,0 +1,63 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package trace_test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/grailbio/reflow/trace"
+)
+
+func TestSpanContext(t *testing.T) {
+	root := trace.NewSpanContext(trace.SpanContext{})
+	if !root.IsValid() {
+		t.Fatal("root span is not valid")
+	}
+	child := trace.NewSpanContext(root)
+	if got, want := child.TraceID, root.TraceID; got != want {
+		t.Errorf("got %x, want %x", got, want)
+	}
+	if child.SpanID == root.SpanID {
+		t.Error("child has the same span ID as its parent")
+	}
+	parsed, err := trace.ParseSpanContext(child.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := parsed, child; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	for _, v := range []string{
+		"",
+		"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331",
+		"00-0af7651916cd43dd8448eb211c80319c-b7ad6b71692033-01",
+		"ff-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01",
+		"00-00000000000000000000000000000000-b7ad6b7169203331-01",
+		"00-0af7651916cd43dd8448eb211c80319c-zzad6b7169203331-01",
+	} {
+		if _, err := trace.ParseSpanContext(v); err == nil {
+			t.Errorf("expected error parsing %q", v)
+		}
+	}
+}
+
+func TestSpanContextHTTP(t *testing.T) {
+	s := trace.NewSpanContext(trace.SpanContext{})
+	ctx := trace.WithSpanContext(context.Background(), s)
+	h := make(http.Header)
+	trace.WriteSpanContext(ctx, &h)
+	got, ok := trace.SpanContextFrom(trace.ReadSpanContext(context.Background(), h))
+	if !ok {
+		t.Fatal("no span context read")
+	}
+	if got != s {
+		t.Errorf("got %v, want %v", got, s)
+	}
+	if _, ok := trace.SpanContextFrom(trace.ReadSpanContext(context.Background(), make(http.Header))); ok {
+		t.Error("unexpected span context")
+	}
+}
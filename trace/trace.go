@@ -103,14 +103,15 @@ func WriteHTTPContext(ctx context.Context, h *http.Header) {
 	t.WriteHTTPContext(ctx, h)
 }
 
-// CopyTraceContext copies the trace context from src to dst.
+// CopyTraceContext copies the trace context, including its tracer,
+// from src to dst.
 func CopyTraceContext(src, dst context.Context) context.Context {
 	if !On(src) {
 		return dst
 	}
 	t := tracer(src)
 	dst = t.CopyTraceContext(src, dst)
-	return dst
+	return WithTracer(dst, t)
 }
 
 // URL returns the url of the current trace.
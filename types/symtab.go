@@ -81,6 +81,11 @@ func (e *Env) Type(id string) *T {
 	return sym.Value
 }
 
+// Symbol returns the symbol bound to identifier id, if any.
+func (e *Env) Symbol(id string) *Symbol {
+	return e.sym(id)
+}
+
 // Use marks the provided identifier as used.
 func (e *Env) Use(id string) {
 	sym := e.sym(id)
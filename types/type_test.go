@@ -290,6 +290,45 @@ func TestSub(t *testing.T) {
 	}
 }
 
+func TestInstantiate(t *testing.T) {
+	var (
+		a = Var("T")
+		b = Var("U")
+	)
+	for _, c := range []struct {
+		fn   *T
+		args []*T
+		want string
+	}{
+		{Func(a, &Field{Name: "x", T: a}), []*T{Int}, "func(x int) int"},
+		{Func(List(a), &Field{Name: "x", T: List(a)}), []*T{List(ty4)}, "func(x [{a, b string}]) [{a, b string}]"},
+		{
+			Func(Map(a, b), &Field{Name: "m", T: Map(a, b)}, &Field{Name: "f", T: Func(b, &Field{Name: "k", T: a})}),
+			[]*T{Map(String, Bottom), Func(Int, &Field{Name: "k", T: String})},
+			"func(m [string:int], f func(k string) int) [string:int]",
+		},
+		{Func(Tuple(&Field{T: a}, &Field{T: b}), &Field{Name: "x", T: a}, &Field{Name: "y", T: b}), []*T{Bool, File}, "func(x bool, y file) (bool, file)"},
+		{Func(a, &Field{Name: "x", T: Int}), []*T{Int}, "error: cannot infer type of T in func(x int) T"},
+		{Func(a, &Field{Name: "x", T: List(a)}), []*T{Int}, "error: cannot infer type of T in func(x [T]) T"},
+		{Func(Map(a, Int), &Field{Name: "x", T: List(a)}), []*T{List(List(Int))}, "error: [int] is not a valid map key type"},
+	} {
+		if got, want := Instantiate(c.fn, c.args...).String(), c.want; got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	}
+	fn := Func(a, &Field{Name: "x", T: a}, &Field{Name: "y", T: a})
+	if !fn.HasVars() {
+		t.Errorf("%v has type variables", fn)
+	}
+	inst := Instantiate(fn, Int, String)
+	if inst.HasVars() {
+		t.Errorf("%v has no type variables", inst)
+	}
+	if String.Sub(inst.Fields[1].T) {
+		t.Errorf("string is not a subtype of %v", inst.Fields[1].T)
+	}
+}
+
 func TestEnv(t *testing.T) {
 	e := NewEnv()
 	e.Bind("a", Int, scanner.Position{}, Never)
@@ -126,6 +126,12 @@ const (
 	// RefKind is a pseudo-kind to carry type alias references.
 	RefKind
 
+	// VarKind is the kind of type variables. Type variables stand
+	// for any type in the signatures of polymorphic (system)
+	// functions; they are replaced by concrete types when the
+	// function is applied (see Instantiate).
+	VarKind
+
 	typeMax
 )
 
@@ -149,6 +155,7 @@ var kindStrings = [typeMax]string{
 	ModuleKind:  "module",
 	TopKind:     "top",
 	SumKind:     "sum",
+	VarKind:     "var",
 }
 
 func (k Kind) String() string {
@@ -176,6 +183,7 @@ var kindsInOrder = [...]Kind{
 	FilesetKind,
 	TopKind,
 	SumKind,
+	VarKind,
 }
 
 var kindID [typeMax]byte
@@ -448,7 +456,7 @@ func List(elem *T) *T {
 // Map returns a new map type with the given index and element types.
 func Map(index, elem *T) *T {
 	switch index.Kind {
-	case StringKind, IntKind, FloatKind, BoolKind, FileKind, TopKind:
+	case StringKind, IntKind, FloatKind, BoolKind, FileKind, TopKind, VarKind:
 	default:
 		return Errorf("%v is not a valid map key type", index)
 	}
@@ -503,6 +511,11 @@ func Ref(path ...string) *T {
 	return Make(&T{Kind: RefKind, Path: path})
 }
 
+// Var returns a new type variable with the given name.
+func Var(name string) *T {
+	return &T{Kind: VarKind, Path: []string{name}}
+}
+
 // Labeled returns a labeled version of type t.
 func Labeled(label string, t *T) *T {
 	t = t.Copy()
@@ -557,7 +570,7 @@ func (t *T) String() string {
 		s = "dir"
 	case UnitKind:
 		s = "unit"
-	case RefKind:
+	case RefKind, VarKind:
 		s = t.Ident()
 	case ListKind:
 		s = "[" + t.Elem.String() + "]"
@@ -727,7 +740,7 @@ func (t *T) equal(u *T, refok bool) bool {
 				return false
 			}
 		}
-	case RefKind:
+	case RefKind, VarKind:
 		if len(t.Path) != len(u.Path) {
 			return false
 		}
@@ -761,6 +774,8 @@ func (t *T) Sub(u *T) bool {
 		return false
 	case IntKind, FloatKind, StringKind, BoolKind, FileKind, DirKind, BottomKind, FilesetKind:
 		return true
+	case VarKind:
+		return t.Ident() == u.Ident()
 	case ListKind:
 		return t.Elem.Sub(u.Elem)
 	case MapKind:
@@ -996,6 +1011,11 @@ func Unify(maxlevel ConstLevel, ts ...*T) *T {
 			t = Swizzle(t, maxlevel, u)
 		case ErrorKind:
 			return typeError
+		case VarKind:
+			if t.Ident() != u.Ident() {
+				return Errorf("type variables %v and %v are incompatible", t, u)
+			}
+			t = Swizzle(t, maxlevel, u)
 		case ListKind:
 			t = List(Unify(level, t.Elem, u.Elem))
 		case MapKind:
@@ -1141,3 +1161,111 @@ func set(u **T, t *T) *T {
 	}
 	return *u
 }
+
+// HasVars tells whether type t contains type variables.
+func (t *T) HasVars() bool {
+	var ok bool
+	t.Map(func(t *T) *T {
+		ok = ok || t.Kind == VarKind
+		return t
+	})
+	return ok
+}
+
+// Instantiate instantiates the polymorphic function type fn for
+// application to arguments of the provided types: each type variable
+// in fn is bound to the type of the argument in the corresponding
+// position, and the instantiated function type is returned. A type
+// variable that appears in multiple argument positions is bound by
+// its first (non-bottom) occurrence; the instantiated type is
+// subsequently subject to the ordinary argument type checks.
+// Instantiate returns an error type if a type variable cannot be
+// bound.
+func Instantiate(fn *T, args ...*T) *T {
+	if fn.Kind != FuncKind {
+		return Errorf("cannot instantiate non-function type %v", fn)
+	}
+	if len(args) != len(fn.Fields) {
+		return Errorf("wrong number of arguments to %v: %d", fn, len(args))
+	}
+	bindings := make(map[string]*T)
+	for i, f := range fn.Fields {
+		bind(bindings, f.T, args[i])
+	}
+	var unbound *T
+	inst := fn.Map(func(t *T) *T {
+		if t.Kind != VarKind {
+			return t
+		}
+		u := bindings[t.Ident()]
+		if u == nil {
+			unbound = t
+			return t
+		}
+		return u
+	})
+	if unbound != nil {
+		return Errorf("cannot infer type of %v in %v", unbound, fn)
+	}
+	// Type variables may be bound to types that are not valid map keys.
+	var invalid *T
+	inst.Map(func(t *T) *T {
+		if t.Kind == MapKind && t.Index.Kind != BottomKind && invalid == nil {
+			if m := Map(t.Index, t.Elem); m.Kind == ErrorKind {
+				invalid = m
+			}
+		}
+		return t
+	})
+	if invalid != nil {
+		return invalid
+	}
+	return inst
+}
+
+// bind binds the type variables in parameter type p to the
+// corresponding parts of argument type t.
+func bind(bindings map[string]*T, p, t *T) {
+	if p == nil || t == nil {
+		return
+	}
+	if p.Kind == VarKind {
+		if b := bindings[p.Ident()]; b == nil || b.Kind == BottomKind {
+			u := t.Copy()
+			u.Flow = false
+			u.Level = NotConst
+			u.Predicates.Clear()
+			bindings[p.Ident()] = u
+		}
+		return
+	}
+	if p.Kind != t.Kind {
+		return
+	}
+	switch p.Kind {
+	case ListKind:
+		bind(bindings, p.Elem, t.Elem)
+	case MapKind:
+		bind(bindings, p.Index, t.Index)
+		bind(bindings, p.Elem, t.Elem)
+	case TupleKind, FuncKind:
+		if len(p.Fields) == len(t.Fields) {
+			for i := range p.Fields {
+				bind(bindings, p.Fields[i].T, t.Fields[i].T)
+			}
+		}
+		if p.Kind == FuncKind {
+			bind(bindings, p.Elem, t.Elem)
+		}
+	case StructKind, ModuleKind:
+		tfields := t.FieldMap()
+		for _, f := range p.Fields {
+			bind(bindings, f.T, tfields[f.Name])
+		}
+	case SumKind:
+		tvariants := t.VariantMap()
+		for _, v := range p.Variants {
+			bind(bindings, v.Elem, tvariants[v.Tag])
+		}
+	}
+}
@@ -0,0 +1,451 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package values
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"sort"
+	"strconv"
+
+	"github.com/grailbio/base/digest"
+	"github.com/grailbio/reflow"
+	"github.com/grailbio/reflow/types"
+)
+
+// MarshalJSON returns the JSON encoding of value v of type t.
+// Values are encoded according to their type:
+//
+//	- ints and floats are encoded as JSON numbers; ints retain
+//	  their full precision;
+//	- strings and bools are encoded as JSON strings and booleans;
+//	- units are encoded as null;
+//	- lists and tuples are encoded as arrays;
+//	- structs and modules are encoded as objects keyed by field name;
+//	- maps with string, int, float, or bool keys are encoded as
+//	  objects keyed by the (formatted) map keys; other maps are
+//	  encoded as arrays of [key, value] pairs;
+//	- sum values are encoded as objects {"tag": tag, "elem": elem},
+//	  where elem is omitted for variants without elements;
+//	- files and filesets are encoded as their reflow.File and
+//	  reflow.Fileset representations, and dirs are encoded as objects
+//	  that map paths to files.
+//
+// Functions, and values of type top, cannot be encoded. Value v
+// must be fully evaluated.
+func MarshalJSON(v T, t *types.T) ([]byte, error) {
+	j, err := toJSON(v, t)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(j)
+}
+
+// UnmarshalJSON decodes the JSON-encoded data b into a value of type
+// t. The encoding is that of MarshalJSON; additionally, struct
+// fields in b that are not part of t are ignored, so that values
+// may be decoded from JSON documents produced by other programs.
+func UnmarshalJSON(b []byte, t *types.T) (T, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var j interface{}
+	if err := dec.Decode(&j); err != nil {
+		return nil, err
+	}
+	if dec.More() {
+		return nil, fmt.Errorf("unexpected data after top-level value")
+	}
+	return fromJSON(j, t, "$")
+}
+
+func toJSON(v T, t *types.T) (interface{}, error) {
+	switch t.Kind {
+	case types.FileKind, types.FilesetKind, types.FuncKind:
+	default:
+		// Values of other kinds are digesters only if they are delayed.
+		if _, ok := v.(digester); ok {
+			return nil, fmt.Errorf("cannot encode delayed value of type %v", t)
+		}
+	}
+	switch t.Kind {
+	case types.IntKind:
+		return json.Number(v.(*big.Int).String()), nil
+	case types.FloatKind:
+		f := v.(*big.Float)
+		if f.IsInf() {
+			return nil, fmt.Errorf("cannot encode infinite float %v", f)
+		}
+		return json.Number(f.Text('g', -1)), nil
+	case types.StringKind, types.BoolKind:
+		return v, nil
+	case types.UnitKind:
+		return nil, nil
+	case types.FileKind:
+		file, ok := v.(reflow.File)
+		if !ok {
+			return nil, fmt.Errorf("cannot encode delayed value of type %v", t)
+		}
+		return file, nil
+	case types.DirKind:
+		m := make(map[string]reflow.File)
+		for scan := v.(Dir).Scan(); scan.Scan(); {
+			m[scan.Path()] = scan.File()
+		}
+		return m, nil
+	case types.FilesetKind:
+		fs, ok := v.(reflow.Fileset)
+		if !ok {
+			return nil, fmt.Errorf("cannot encode delayed value of type %v", t)
+		}
+		return fs, nil
+	case types.ListKind:
+		list := v.(List)
+		js := make([]interface{}, len(list))
+		for i := range list {
+			var err error
+			if js[i], err = toJSON(list[i], t.Elem); err != nil {
+				return nil, err
+			}
+		}
+		return js, nil
+	case types.TupleKind:
+		tuple := v.(Tuple)
+		js := make([]interface{}, len(t.Fields))
+		for i, f := range t.Fields {
+			var err error
+			if js[i], err = toJSON(tuple[i], f.T); err != nil {
+				return nil, err
+			}
+		}
+		return js, nil
+	case types.StructKind, types.ModuleKind:
+		var fields map[string]T
+		if t.Kind == types.StructKind {
+			fields = v.(Struct)
+		} else {
+			fields = v.(Module)
+		}
+		js := make(map[string]interface{})
+		for _, f := range t.Fields {
+			var err error
+			if js[f.Name], err = toJSON(fields[f.Name], f.T); err != nil {
+				return nil, err
+			}
+		}
+		return js, nil
+	case types.MapKind:
+		m := v.(*Map)
+		if objectKey(t.Index) {
+			js := make(map[string]interface{})
+			var err error
+			m.Each(func(k, v T) {
+				if err != nil {
+					return
+				}
+				var key interface{}
+				if key, err = toJSON(k, t.Index); err != nil {
+					return
+				}
+				js[fmt.Sprint(key)], err = toJSON(v, t.Elem)
+			})
+			return js, err
+		}
+		type entry struct {
+			d  digest.Digest
+			kv [2]interface{}
+		}
+		var (
+			entries []entry
+			err     error
+		)
+		m.Each(func(k, v T) {
+			if err != nil {
+				return
+			}
+			e := entry{d: Digest(k, t.Index)}
+			if e.kv[0], err = toJSON(k, t.Index); err != nil {
+				return
+			}
+			e.kv[1], err = toJSON(v, t.Elem)
+			entries = append(entries, e)
+		})
+		if err != nil {
+			return nil, err
+		}
+		// Map iteration order is not defined; sort the entries (by
+		// key digest) so that the encoding is deterministic.
+		sort.Slice(entries, func(i, j int) bool {
+			return entries[i].d.Less(entries[j].d)
+		})
+		js := make([][2]interface{}, len(entries))
+		for i := range entries {
+			js[i] = entries[i].kv
+		}
+		return js, nil
+	case types.SumKind:
+		variant := v.(*Variant)
+		js := map[string]interface{}{"tag": variant.Tag}
+		if elem := t.VariantMap()[variant.Tag]; elem != nil {
+			var err error
+			if js["elem"], err = toJSON(variant.Elem, elem); err != nil {
+				return nil, err
+			}
+		}
+		return js, nil
+	default:
+		return nil, fmt.Errorf("cannot encode values of type %v", t)
+	}
+}
+
+// objectKey tells whether maps with keys of type t are encoded as
+// JSON objects.
+func objectKey(t *types.T) bool {
+	switch t.Kind {
+	case types.StringKind, types.IntKind, types.FloatKind, types.BoolKind:
+		return true
+	}
+	return false
+}
+
+func fromJSON(j interface{}, t *types.T, path string) (T, error) {
+	typeErr := func() error {
+		return fmt.Errorf("%s: cannot decode %s into value of type %v", path, jsonKind(j), t)
+	}
+	switch t.Kind {
+	case types.IntKind:
+		n, ok := j.(json.Number)
+		if !ok {
+			return nil, typeErr()
+		}
+		i, ok := new(big.Int).SetString(string(n), 10)
+		if !ok {
+			return nil, fmt.Errorf("%s: %s is not an integer", path, n)
+		}
+		return i, nil
+	case types.FloatKind:
+		n, ok := j.(json.Number)
+		if !ok {
+			return nil, typeErr()
+		}
+		f, _, err := new(big.Float).Parse(string(n), 10)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		return f, nil
+	case types.StringKind:
+		s, ok := j.(string)
+		if !ok {
+			return nil, typeErr()
+		}
+		return s, nil
+	case types.BoolKind:
+		b, ok := j.(bool)
+		if !ok {
+			return nil, typeErr()
+		}
+		return b, nil
+	case types.UnitKind:
+		if j != nil {
+			return nil, typeErr()
+		}
+		return Unit, nil
+	case types.FileKind:
+		var file reflow.File
+		if err := remarshal(j, &file); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		return file, nil
+	case types.DirKind:
+		var files map[string]reflow.File
+		if err := remarshal(j, &files); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		var dir Dir
+		for path, file := range files {
+			dir.Set(path, file)
+		}
+		return dir, nil
+	case types.FilesetKind:
+		var fs reflow.Fileset
+		if err := remarshal(j, &fs); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		return fs, nil
+	case types.ListKind:
+		js, ok := j.([]interface{})
+		if !ok {
+			return nil, typeErr()
+		}
+		list := make(List, len(js))
+		for i := range js {
+			var err error
+			if list[i], err = fromJSON(js[i], t.Elem, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return nil, err
+			}
+		}
+		return list, nil
+	case types.TupleKind:
+		js, ok := j.([]interface{})
+		if !ok {
+			return nil, typeErr()
+		}
+		if len(js) != len(t.Fields) {
+			return nil, fmt.Errorf("%s: expected %d tuple elements, got %d", path, len(t.Fields), len(js))
+		}
+		tuple := make(Tuple, len(js))
+		for i, f := range t.Fields {
+			var err error
+			if tuple[i], err = fromJSON(js[i], f.T, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return nil, err
+			}
+		}
+		return tuple, nil
+	case types.StructKind, types.ModuleKind:
+		js, ok := j.(map[string]interface{})
+		if !ok {
+			return nil, typeErr()
+		}
+		fields := make(map[string]T)
+		for _, f := range t.Fields {
+			fj, ok := js[f.Name]
+			if !ok {
+				return nil, fmt.Errorf("%s: missing field %q", path, f.Name)
+			}
+			var err error
+			if fields[f.Name], err = fromJSON(fj, f.T, path+"."+f.Name); err != nil {
+				return nil, err
+			}
+		}
+		if t.Kind == types.StructKind {
+			return Struct(fields), nil
+		}
+		return Module(fields), nil
+	case types.MapKind:
+		m := new(Map)
+		if objectKey(t.Index) {
+			js, ok := j.(map[string]interface{})
+			if !ok {
+				return nil, typeErr()
+			}
+			for k, vj := range js {
+				key, err := parseKey(k, t.Index)
+				if err != nil {
+					return nil, fmt.Errorf("%s: %v", path, err)
+				}
+				v, err := fromJSON(vj, t.Elem, fmt.Sprintf("%s[%q]", path, k))
+				if err != nil {
+					return nil, err
+				}
+				m.Insert(Digest(key, t.Index), key, v)
+			}
+			return m, nil
+		}
+		js, ok := j.([]interface{})
+		if !ok {
+			return nil, typeErr()
+		}
+		for i := range js {
+			entry, ok := js[i].([]interface{})
+			if !ok || len(entry) != 2 {
+				return nil, fmt.Errorf("%s[%d]: expected [key, value] pair", path, i)
+			}
+			epath := fmt.Sprintf("%s[%d]", path, i)
+			key, err := fromJSON(entry[0], t.Index, epath+"[0]")
+			if err != nil {
+				return nil, err
+			}
+			v, err := fromJSON(entry[1], t.Elem, epath+"[1]")
+			if err != nil {
+				return nil, err
+			}
+			m.Insert(Digest(key, t.Index), key, v)
+		}
+		return m, nil
+	case types.SumKind:
+		js, ok := j.(map[string]interface{})
+		if !ok {
+			return nil, typeErr()
+		}
+		tag, ok := js["tag"].(string)
+		if !ok {
+			return nil, fmt.Errorf("%s: missing variant tag", path)
+		}
+		variants := t.VariantMap()
+		elem, ok := variants[tag]
+		if !ok {
+			return nil, fmt.Errorf("%s: tag %q is not a variant of type %v", path, tag, t)
+		}
+		variant := &Variant{Tag: tag}
+		if elem != nil {
+			var err error
+			if variant.Elem, err = fromJSON(js["elem"], elem, path+".elem"); err != nil {
+				return nil, err
+			}
+		}
+		return variant, nil
+	default:
+		return nil, fmt.Errorf("%s: cannot decode values of type %v", path, t)
+	}
+}
+
+// parseKey parses the (object) map key k into a value of type t.
+func parseKey(k string, t *types.T) (T, error) {
+	switch t.Kind {
+	case types.StringKind:
+		return k, nil
+	case types.IntKind:
+		i, ok := new(big.Int).SetString(k, 10)
+		if !ok {
+			return nil, fmt.Errorf("map key %q is not an integer", k)
+		}
+		return i, nil
+	case types.FloatKind:
+		f, _, err := new(big.Float).Parse(k, 10)
+		if err != nil {
+			return nil, fmt.Errorf("map key %q is not a float", k)
+		}
+		return f, nil
+	case types.BoolKind:
+		b, err := strconv.ParseBool(k)
+		if err != nil {
+			return nil, fmt.Errorf("map key %q is not a bool", k)
+		}
+		return b, nil
+	default:
+		panic("invalid key type " + t.String())
+	}
+}
+
+// remarshal decodes the generic JSON value j into v.
+func remarshal(j interface{}, v interface{}) error {
+	b, err := json.Marshal(j)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// jsonKind returns a description of the kind of the
+// generic JSON value j.
+func jsonKind(j interface{}) string {
+	switch j.(type) {
+	case nil:
+		return "null"
+	case json.Number:
+		return "number"
+	case string:
+		return "string"
+	case bool:
+		return "bool"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	default:
+		return fmt.Sprintf("%T", j)
+	}
+}
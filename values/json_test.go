@@ -0,0 +1,120 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package values
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/grailbio/reflow"
+	"github.com/grailbio/reflow/types"
+)
+
+func TestJSONRoundtrip(t *testing.T) {
+	bigint, _ := new(big.Int).SetString("123456789012345678901234567890", 10)
+	file := reflow.File{ID: reflow.Digester.FromString("hello"), Size: 5}
+	var dir Dir
+	dir.Set("a/b", file)
+	fileMap := new(Map)
+	fileMap.Insert(Digest(file, types.File), file, NewInt(1))
+	float, _, _ := new(big.Float).Parse("1.5", 10)
+	tenth, _, _ := new(big.Float).Parse("0.1", 10)
+	huge, _, _ := new(big.Float).Parse("1.234567890123456789e300", 10)
+	sum := types.Sum(&types.Variant{Tag: "A", Elem: types.Int}, &types.Variant{Tag: "B"})
+	for _, c := range []struct {
+		v T
+		t *types.T
+		j string
+	}{
+		{NewInt(-12), types.Int, `-12`},
+		{bigint, types.Int, `123456789012345678901234567890`},
+		{float, types.Float, `1.5`},
+		{tenth, types.Float, `0.1`},
+		{huge, types.Float, `1.234567890123456789e+300`},
+		{"hello", types.String, `"hello"`},
+		{true, types.Bool, `true`},
+		{Unit, types.Unit, `null`},
+		{List{"a", "b"}, types.List(types.String), `["a","b"]`},
+		{
+			Tuple{NewInt(1), "x"},
+			types.Tuple(&types.Field{T: types.Int}, &types.Field{T: types.String}),
+			`[1,"x"]`,
+		},
+		{
+			Struct{"a": NewInt(1), "b": List{true}},
+			types.Struct(&types.Field{Name: "a", T: types.Int}, &types.Field{Name: "b", T: types.List(types.Bool)}),
+			`{"a":1,"b":[true]}`,
+		},
+		{makeMap(map[string]string{"x": "y"}), types.Map(types.String, types.String), `{"x":"y"}`},
+		{MakeMap(types.Int, NewInt(1), "one"), types.Map(types.Int, types.String), `{"1":"one"}`},
+		{&Variant{Tag: "A", Elem: NewInt(3)}, sum, `{"elem":3,"tag":"A"}`},
+		{&Variant{Tag: "B"}, sum, `{"tag":"B"}`},
+		{file, types.File, ""},
+		{dir, types.Dir, ""},
+		{fileMap, types.Map(types.File, types.Int), ""},
+	} {
+		b, err := MarshalJSON(c.v, c.t)
+		if err != nil {
+			t.Errorf("marshal %s: %v", Sprint(c.v, c.t), err)
+			continue
+		}
+		if c.j != "" {
+			if got, want := string(b), c.j; got != want {
+				t.Errorf("got %s, want %s", got, want)
+			}
+		}
+		v, err := UnmarshalJSON(b, c.t)
+		if err != nil {
+			t.Errorf("unmarshal %s: %v", b, err)
+			continue
+		}
+		if !Equal(v, c.v) {
+			t.Errorf("got %s, want %s", Sprint(v, c.t), Sprint(c.v, c.t))
+		}
+	}
+}
+
+func TestJSONUnmarshal(t *testing.T) {
+	typ := types.List(types.Struct(
+		&types.Field{Name: "name", T: types.String},
+		&types.Field{Name: "count", T: types.Int},
+	))
+	v, err := UnmarshalJSON([]byte(`[{"name": "a", "count": 1, "extra": [1, 2]}, {"count": 2, "name": "b"}]`), typ)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := List{
+		Struct{"name": "a", "count": NewInt(1)},
+		Struct{"name": "b", "count": NewInt(2)},
+	}
+	if !Equal(v, want) {
+		t.Errorf("got %s, want %s", Sprint(v, typ), Sprint(want, typ))
+	}
+
+	for _, c := range []struct {
+		j, err string
+	}{
+		{`{"name": "a"}`, `$: cannot decode object into value of type [{name string, count int}]`},
+		{`[{"name": "a"}]`, `$[0]: missing field "count"`},
+		{`[{"name": "a", "count": 1.5}]`, `$[0].count: 1.5 is not an integer`},
+		{`[{"name": 1, "count": 1}]`, `$[0].name: cannot decode number into value of type string`},
+		{`[] []`, `unexpected data after top-level value`},
+	} {
+		_, err := UnmarshalJSON([]byte(c.j), typ)
+		if err == nil {
+			t.Errorf("%s: expected error", c.j)
+			continue
+		}
+		if got, want := err.Error(), c.err; got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	}
+}
+
+func TestJSONMarshalError(t *testing.T) {
+	if _, err := MarshalJSON("x", types.Top); err == nil {
+		t.Error("expected error")
+	}
+}
@@ -0,0 +1,594 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+// Package vet implements a static checker for Reflow modules. Vet
+// examines type checked syntax trees for common mistakes that are
+// not type errors: for example, exec outputs that are never written,
+// unused declarations, and images without tags.
+//
+// Each finding is identified by a stable check ID. Findings may be
+// suppressed by a comment of the form
+//
+//	// vet:ignore check-id[, check-id...]
+//
+// either on the line of the finding, or on its own line immediately
+// preceding it. A suppression comment without check IDs suppresses
+// all findings.
+package vet
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/grailbio/reflow/internal/scanner"
+	"github.com/grailbio/reflow/syntax"
+	"github.com/grailbio/reflow/types"
+	"github.com/grailbio/reflow/values"
+)
+
+// Check IDs.
+const (
+	// UnwrittenOutput flags exec outputs that are never written by
+	// the exec's template.
+	UnwrittenOutput = "unwritten-output"
+	// UnusedParam flags module parameters that are never used.
+	UnusedParam = "unused-param"
+	// UnusedDecl flags declarations that are never used. Exported
+	// toplevel declarations are considered used.
+	UnusedDecl = "unused-decl"
+	// UntaggedImage flags exec images that are untagged, or that
+	// use the "latest" tag.
+	UntaggedImage = "untagged-image"
+	// ExecResources flags execs that do not explicitly reserve
+	// memory or CPU.
+	ExecResources = "exec-resources"
+	// NondeterministicExtern flags externs (e.g., files.Copy) whose
+	// arguments depend on nondeterministic execs.
+	NondeterministicExtern = "nondeterministic-extern"
+	// ShadowedDecl flags block declarations that shadow a declaration
+	// of an enclosing scope that is used after the block: since
+	// declarations only update the binding in their own scope, this
+	// is usually a mistake.
+	ShadowedDecl = "shadowed-decl"
+)
+
+// Checks is the set of check IDs implemented by vet.
+var Checks = []string{
+	UnwrittenOutput,
+	UnusedParam,
+	UnusedDecl,
+	UntaggedImage,
+	ExecResources,
+	NondeterministicExtern,
+	ShadowedDecl,
+}
+
+// A Finding is a mistake found by vet.
+type Finding struct {
+	// Position is the source position of the finding.
+	scanner.Position
+	// Check is the ID of the check that produced the finding.
+	Check string
+	// Message describes the finding.
+	Message string
+}
+
+// String returns a string representation of the finding, suitable
+// for display.
+func (f Finding) String() string {
+	return fmt.Sprintf("%s: %s (%s)", f.Position, f.Message, f.Check)
+}
+
+// MarshalJSON implements json.Marshaler.
+func (f Finding) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Check   string `json:"check"`
+		File    string `json:"file"`
+		Line    int    `json:"line"`
+		Column  int    `json:"column"`
+		Message string `json:"message"`
+	}{f.Check, f.Filename, f.Line, f.Column, f.Message})
+}
+
+// Vet type checks and then vets the Reflow module at path in the
+// provided session. Only the module itself is vetted; modules it
+// instantiates are not. Vet returns an error if the module fails to
+// type check. Findings are returned in source order.
+//
+// Vet instantiates the module, if its parameters permit it, in order
+// to compare the images used by its execs (as recorded in the
+// session) with their declarations.
+func Vet(sess *syntax.Session, path string) ([]Finding, error) {
+	if sess.Uses == nil {
+		sess.Uses = make(map[*syntax.Expr]*types.Symbol)
+	}
+	m, err := sess.Check(path)
+	if err != nil {
+		return nil, err
+	}
+	instantiate(sess, m)
+	v := &vetter{
+		sess:    sess,
+		path:    path,
+		used:    make(map[symbol][]int),
+		decls:   make(map[symbol]*syntax.Decl),
+		modules: make(map[symbol]string),
+		tainted: make(map[symbol]scanner.Position),
+	}
+	for _, sym := range sess.Uses {
+		v.used[symbol{sym.Position, sym.Name}] = nil
+	}
+	for e, sym := range sess.Uses {
+		if e.Filename == path {
+			key := symbol{sym.Position, sym.Name}
+			v.used[key] = append(v.used[key], e.Offset)
+		}
+	}
+	v.module(m)
+	findings := v.findings[:0]
+	ignores := ignored(m.Source(), path)
+	for _, f := range v.findings {
+		if !ignores.ignore(f) {
+			findings = append(findings, f)
+		}
+	}
+	// Images that could not be attributed to an exec of this module
+	// were used by the modules it instantiates.
+	for _, image := range sess.Images() {
+		if v.images[image] {
+			continue
+		}
+		if msg := checkImage(image); msg != "" {
+			pos := scanner.Position{Filename: path, Line: 1, Column: 1}
+			findings = append(findings, Finding{pos, UntaggedImage, msg + " (used by an instantiated module)"})
+		}
+	}
+	sort.SliceStable(findings, func(i, j int) bool {
+		if findings[i].Line != findings[j].Line {
+			return findings[i].Line < findings[j].Line
+		}
+		return findings[i].Column < findings[j].Column
+	})
+	return findings, nil
+}
+
+// Instantiate instantiates the module m with its default parameters,
+// if it has no required parameters, thus populating the images
+// recorded by the session. Errors are ignored: instantiation is
+// opportunistic.
+func instantiate(sess *syntax.Session, m *syntax.ModuleImpl) {
+	flags, err := m.Flags(sess, sess.Values)
+	if err != nil {
+		return
+	}
+	env := sess.Values.Push()
+	if err := m.FlagEnv(flags, env, types.NewEnv()); err != nil {
+		return
+	}
+	_, _ = m.Make(sess, env)
+}
+
+// A symbol identifies a binding by its position and name.
+type symbol struct {
+	pos  scanner.Position
+	name string
+}
+
+type vetter struct {
+	sess     *syntax.Session
+	path     string
+	findings []Finding
+	// Used stores, for each symbol that is used, the offsets of the
+	// uses in the vetted module.
+	used map[symbol][]int
+	// Decls stores the declaration of each symbol.
+	decls map[symbol]*syntax.Decl
+	// Modules stores the paths of the modules bound (by make) to
+	// symbols.
+	modules map[symbol]string
+	// Tainted stores the symbols whose values depend on the output of
+	// a nondeterministic exec, and the position of that exec.
+	tainted map[symbol]scanner.Position
+	// Scopes is the stack of (block) scopes.
+	scopes []map[string]symbol
+	// Images is the set of images attributed to execs.
+	images map[string]bool
+}
+
+func (v *vetter) report(pos scanner.Position, check, format string, args ...interface{}) {
+	v.findings = append(v.findings, Finding{pos, check, fmt.Sprintf(format, args...)})
+}
+
+func (v *vetter) module(m *syntax.ModuleImpl) {
+	v.images = make(map[string]bool)
+	v.scopes = []map[string]symbol{make(map[string]symbol)}
+	for _, d := range m.ParamDecls {
+		for _, sym := range v.bind(d) {
+			if _, ok := v.used[sym]; !ok {
+				v.report(sym.pos, UnusedParam, "parameter %s is never used", sym.name)
+			}
+		}
+		v.expr(d.Expr)
+	}
+	for _, d := range m.Decls {
+		v.decl(d, true)
+	}
+}
+
+// Bind records the bindings of declaration d in the current scope,
+// and returns their symbols.
+func (v *vetter) bind(d *syntax.Decl) []symbol {
+	syms := v.symbols(d)
+	scope := v.scopes[len(v.scopes)-1]
+	for _, sym := range syms {
+		v.decls[sym] = d
+		scope[sym.name] = sym
+		if d.Pat != nil && d.Pat.Kind == syntax.PatIdent && d.Expr.Kind == syntax.ExprMake {
+			v.modules[sym], _ = d.Expr.Left.Val.(string)
+		}
+	}
+	return syms
+}
+
+func (v *vetter) decl(d *syntax.Decl, toplevel bool) {
+	if d.Kind == syntax.DeclType {
+		return
+	}
+	v.expr(d.Expr)
+	var outer []symbol
+	if !toplevel {
+		scope := v.scopes[len(v.scopes)-1]
+		for _, sym := range v.symbols(d) {
+			if _, ok := scope[sym.name]; ok {
+				// Rebinding in the same scope is a strong update.
+				continue
+			}
+			if prev, ok := v.lookup(sym.name, len(v.scopes)-2); ok {
+				outer = append(outer, prev)
+			}
+		}
+	}
+	taint, tainted := v.taint(d.Expr)
+	for _, sym := range v.bind(d) {
+		if tainted {
+			v.tainted[sym] = taint
+		}
+		if _, ok := v.used[sym]; !ok && (!toplevel || !types.IsExported(sym.name)) {
+			v.report(sym.pos, UnusedDecl, "%s is declared but never used", sym.name)
+		}
+	}
+	for _, prev := range outer {
+		for _, off := range v.used[prev] {
+			if off > d.Offset {
+				v.report(d.Position, ShadowedDecl, "declaration of %s shadows the declaration at %s, which is used after this block", prev.name, prev.pos)
+				break
+			}
+		}
+	}
+}
+
+// Symbols returns the symbols bound by declaration d, in source
+// order, without binding them.
+func (v *vetter) symbols(d *syntax.Decl) []symbol {
+	var syms []symbol
+	switch d.Kind {
+	case syntax.DeclDeclare:
+		syms = append(syms, symbol{d.Position, d.Ident})
+	case syntax.DeclAssign:
+		env := types.NewEnv()
+		// Errors are reported by the type checker.
+		_ = d.Pat.BindTypes(env, d.Type, types.Never)
+		for id, sym := range env.Values {
+			syms = append(syms, symbol{sym.Position, id})
+		}
+	}
+	sort.Slice(syms, func(i, j int) bool { return syms[i].pos.Offset < syms[j].pos.Offset })
+	return syms
+}
+
+// Lookup looks up the identifier in the scopes up to (and including)
+// scope index i.
+func (v *vetter) lookup(name string, i int) (symbol, bool) {
+	for ; i >= 0; i-- {
+		if sym, ok := v.scopes[i][name]; ok {
+			return sym, true
+		}
+	}
+	return symbol{}, false
+}
+
+func (v *vetter) expr(e *syntax.Expr) {
+	if e == nil {
+		return
+	}
+	switch e.Kind {
+	case syntax.ExprBlock:
+		v.scopes = append(v.scopes, make(map[string]symbol))
+		for _, d := range e.Decls {
+			v.decl(d, false)
+		}
+		v.expr(e.Left)
+		v.scopes = v.scopes[:len(v.scopes)-1]
+		return
+	case syntax.ExprExec:
+		v.exec(e)
+	case syntax.ExprApply:
+		v.apply(e)
+	}
+	for _, d := range e.Decls {
+		v.expr(d.Expr)
+	}
+	for _, sub := range e.Subexpr() {
+		v.expr(sub)
+	}
+	v.expr(e.ComprExpr)
+	for _, c := range e.ComprClauses {
+		v.expr(c.Expr)
+	}
+	for _, c := range e.CaseClauses {
+		v.expr(c.Expr)
+	}
+}
+
+func (v *vetter) exec(e *syntax.Expr) {
+	params := make(map[string]*syntax.Expr)
+	for _, d := range e.Decls {
+		params[d.Pat.Ident] = d.Expr
+	}
+	var missing []string
+	for _, p := range []string{"mem", "cpu"} {
+		if params[p] == nil {
+			missing = append(missing, p)
+		}
+	}
+	if len(missing) > 0 {
+		v.report(e.Position, ExecResources, "exec does not reserve %s", strings.Join(missing, " or "))
+	}
+
+	image, ok := v.constString(params["image"])
+	if !ok {
+		// The image is computed; it is known only if the exec
+		// has been evaluated.
+		image = e.Image
+	}
+	if image != "" {
+		v.images[image] = true
+		if msg := checkImage(image); msg != "" {
+			v.report(e.Position, UntaggedImage, "%s", msg)
+		}
+	}
+
+	if e.Type == nil || e.Type.Kind == types.ErrorKind || e.Template == nil {
+		return
+	}
+	for _, f := range e.Type.Tupled().Fields {
+		var written, read bool
+		for i, arg := range e.Template.Args {
+			if arg.Kind != syntax.ExprIdent || arg.Ident != f.Name {
+				continue
+			}
+			if before := strings.TrimRight(e.Template.Frags[i], " \t"); strings.HasSuffix(before, "<") && !strings.HasSuffix(before, "<<") {
+				read = true
+			} else {
+				written = true
+			}
+		}
+		switch {
+		case written:
+		case read:
+			v.report(e.Position, UnwrittenOutput, "exec output %s is read but never written", f.Name)
+		default:
+			v.report(e.Position, UnwrittenOutput, "exec output %s is never written", f.Name)
+		}
+	}
+}
+
+// Externs are the system functions that copy values to extern
+// locations, by module path.
+var externs = map[string]map[string]bool{
+	"$/files": {"Copy": true},
+	"$/dirs":  {"Copy": true},
+}
+
+func (v *vetter) apply(e *syntax.Expr) {
+	fn := e.Left
+	if fn.Kind != syntax.ExprDeref || !externs[v.modulePath(fn.Left)][fn.Ident] {
+		return
+	}
+	for _, f := range e.Fields {
+		if pos, ok := v.taint(f.Expr); ok {
+			v.report(e.Position, NondeterministicExtern, "%s copies the output of the nondeterministic exec at %s to an extern location", fn.Ident, pos)
+			return
+		}
+	}
+}
+
+// ModulePath returns the path of the module to which the expression
+// e evaluates, if it is known.
+func (v *vetter) modulePath(e *syntax.Expr) string {
+	switch e.Kind {
+	case syntax.ExprMake:
+		path, _ := e.Left.Val.(string)
+		return path
+	case syntax.ExprIdent:
+		if sym := v.sess.Uses[e]; sym != nil {
+			return v.modules[symbol{sym.Position, sym.Name}]
+		}
+	}
+	return ""
+}
+
+// Taint tells whether the value of expression e depends on the
+// output of a nondeterministic exec, returning the position of that
+// exec.
+func (v *vetter) taint(e *syntax.Expr) (scanner.Position, bool) {
+	if e == nil {
+		return scanner.Position{}, false
+	}
+	switch e.Kind {
+	case syntax.ExprExec:
+		for _, d := range e.Decls {
+			if d.Pat.Ident != "nondeterministic" {
+				continue
+			}
+			if b, ok := v.constBool(d.Expr); (ok && b) || (!ok && e.NonDeterministic) {
+				return e.Position, true
+			}
+		}
+	case syntax.ExprIdent:
+		if sym := v.sess.Uses[e]; sym != nil {
+			pos, ok := v.tainted[symbol{sym.Position, sym.Name}]
+			return pos, ok
+		}
+	}
+	for _, d := range e.Decls {
+		if pos, ok := v.taint(d.Expr); ok {
+			return pos, true
+		}
+	}
+	for _, sub := range append(e.Subexpr(), e.ComprExpr) {
+		if pos, ok := v.taint(sub); ok {
+			return pos, true
+		}
+	}
+	for _, c := range e.ComprClauses {
+		if pos, ok := v.taint(c.Expr); ok {
+			return pos, true
+		}
+	}
+	for _, c := range e.CaseClauses {
+		if pos, ok := v.taint(c.Expr); ok {
+			return pos, true
+		}
+	}
+	if e.Template != nil {
+		for _, arg := range e.Template.Args {
+			if pos, ok := v.taint(arg); ok {
+				return pos, true
+			}
+		}
+	}
+	return scanner.Position{}, false
+}
+
+// Const returns the literal value of expression e, following
+// identifiers to their declarations.
+func (v *vetter) constValue(e *syntax.Expr) values.T {
+	for i := 0; e != nil && i < 100; i++ {
+		switch e.Kind {
+		case syntax.ExprLit:
+			return e.Val
+		case syntax.ExprIdent:
+			sym := v.sess.Uses[e]
+			if sym == nil {
+				return nil
+			}
+			d := v.decls[symbol{sym.Position, sym.Name}]
+			if d == nil || d.Pat == nil || d.Pat.Kind != syntax.PatIdent {
+				return nil
+			}
+			e = d.Expr
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+func (v *vetter) constString(e *syntax.Expr) (string, bool) {
+	s, ok := v.constValue(e).(string)
+	return s, ok
+}
+
+func (v *vetter) constBool(e *syntax.Expr) (bool, bool) {
+	b, ok := v.constValue(e).(bool)
+	return b, ok
+}
+
+// CheckImage checks the provided image name, returning a message
+// describing the problem, or the empty string if the image is
+// properly tagged (or pinned by digest).
+func checkImage(image string) string {
+	if strings.Contains(image, "@") {
+		return ""
+	}
+	name := image
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		name = name[i+1:]
+	}
+	i := strings.LastIndex(name, ":")
+	switch {
+	case i < 0:
+		return fmt.Sprintf("image %s is untagged", image)
+	case name[i+1:] == "latest":
+		return fmt.Sprintf("image %s uses the latest tag", image)
+	}
+	return ""
+}
+
+// Ignores stores the check IDs suppressed on each line; a nil set
+// suppresses all checks.
+type ignores map[int]map[string]bool
+
+// Ignored returns the suppressions in the provided module source.
+func ignored(src []byte, file string) ignores {
+	ign := make(ignores)
+	var s scanner.Scanner
+	s.Init(bytes.NewReader(src))
+	s.Filename = file
+	s.Error = func(*scanner.Scanner, string) {}
+	s.Mode = scanner.ScanIdents | scanner.ScanFloats | scanner.ScanChars |
+		scanner.ScanStrings | scanner.ScanRawStrings | scanner.ScanComments
+	lastLine := 0
+	for tok := s.Scan(); tok != scanner.EOF; tok = s.Scan() {
+		line := s.Position.Line
+		if tok != scanner.Comment {
+			lastLine = s.Pos().Line
+			continue
+		}
+		text := s.TokenText()
+		text = strings.TrimPrefix(text, "//")
+		text = strings.TrimSuffix(strings.TrimPrefix(text, "/*"), "*/")
+		text = strings.TrimSpace(text)
+		if !strings.HasPrefix(text, "vet:ignore") {
+			continue
+		}
+		var checks map[string]bool
+		if ids := strings.FieldsFunc(text[len("vet:ignore"):], func(r rune) bool { return r == ',' || r == ' ' || r == '\t' }); len(ids) > 0 {
+			checks = make(map[string]bool)
+			for _, id := range ids {
+				checks[id] = true
+			}
+		}
+		ign.add(line, checks)
+		if lastLine != line {
+			// The comment is on its own line, and applies also to the
+			// next line.
+			ign.add(s.Pos().Line+1, checks)
+		}
+	}
+	return ign
+}
+
+func (ign ignores) add(line int, checks map[string]bool) {
+	prev, ok := ign[line]
+	switch {
+	case !ok:
+		ign[line] = checks
+	case prev == nil || checks == nil:
+		ign[line] = nil
+	default:
+		for id := range checks {
+			prev[id] = true
+		}
+	}
+}
+
+func (ign ignores) ignore(f Finding) bool {
+	checks, ok := ign[f.Line]
+	return ok && (checks == nil || checks[f.Check])
+}
@@ -0,0 +1,108 @@
+// Copyright 2019 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package vet
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/grailbio/reflow/syntax"
+)
+
+const module = `param (
+	unused string
+	used = "x"
+)
+
+val files = make("$/files")
+
+val image = "ubuntu"
+
+val tagged = "ubuntu:18.04"
+
+val notUsed = 1
+
+func produce(s string) = exec(image := tagged, mem := 1, cpu := 1, nondeterministic := true) (out file) {"
+	echo {{s}} > {{out}}
+"}
+
+val Main = {
+	x := 1
+	y := {
+		x := 2
+		x + 1
+	}
+	unread := exec(image, mem := 1) (out, missing file) {"
+		cat < {{out}}
+	"}
+	ignored := exec(image := "ubuntu:latest", mem := 1) (out file) {" echo > {{out}} "} // vet:ignore exec-resources
+	// vet:ignore
+	val ignoredToo = exec(image, mem := 1) (out file) {" echo > {{out}} "}
+	copied := files.Copy(produce(used), "s3://bucket/key")
+	(x, y, unread, ignored, copied)
+}
+`
+
+func TestVet(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "test.rf")
+	if err := ioutil.WriteFile(path, []byte(module), 0644); err != nil {
+		t.Fatal(err)
+	}
+	findings, err := Vet(syntax.NewSession(nil), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, f := range findings {
+		got = append(got, fmt.Sprintf("%d: %s: %s", f.Line, f.Check, f.Message))
+	}
+	want := []string{
+		"2: unused-param: parameter unused is never used",
+		"12: unused-decl: notUsed is declared but never used",
+		"21: shadowed-decl: declaration of x shadows the declaration at " + path + ":19:3, which is used after this block",
+		"24: exec-resources: exec does not reserve cpu",
+		"24: untagged-image: image ubuntu is untagged",
+		"24: unwritten-output: exec output out is read but never written",
+		"24: unwritten-output: exec output missing is never written",
+		"27: untagged-image: image ubuntu:latest uses the latest tag",
+		"30: nondeterministic-extern: Copy copies the output of the nondeterministic exec at " + path + ":14:30 to an extern location",
+	}
+	if g, w := strings.Join(got, "\n"), strings.Join(want, "\n"); g != w {
+		t.Errorf("got:\n%s\nwant:\n%s", g, w)
+	}
+
+	b, err := json.Marshal(findings[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), `{"check":"unused-param","file":"`+path+`","line":2,"column":8,"message":"parameter unused is never used"}`; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestCheckImage(t *testing.T) {
+	for _, c := range []struct{ image, msg string }{
+		{"ubuntu", "image ubuntu is untagged"},
+		{"ubuntu:latest", "image ubuntu:latest uses the latest tag"},
+		{"ubuntu:18.04", ""},
+		{"localhost:5000/ubuntu", "image localhost:5000/ubuntu is untagged"},
+		{"localhost:5000/ubuntu:18.04", ""},
+		{"ubuntu@sha256:45b23dee08af5e43a7fea6c4cf9c25ccf269ee113168c19722f87876677c5cb2", ""},
+	} {
+		if got, want := checkImage(c.image), c.msg; got != want {
+			t.Errorf("%s: got %q, want %q", c.image, got, want)
+		}
+	}
+}